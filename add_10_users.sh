@@ -5,8 +5,11 @@ echo ""
 
 BASE_URL="http://localhost:3000"
 
+# Requests authenticate with an admin key from: go run . apikey create <name> admin
+[ -z "$LBK_API_KEY" ] && echo "LBK_API_KEY is not set; requests will fail unless the server runs with LBK_AUTH_REQUIRED=false"
+
 echo "User 1: Somchai Jaidee (Gold Member)"
-curl -X POST "$BASE_URL/users" \
+curl -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users" \
   -H "Content-Type: application/json" \
   -d '{
     "member_id": "LBK001234",
@@ -21,7 +24,7 @@ curl -X POST "$BASE_URL/users" \
 echo ""
 
 echo "User 2: Siriporn Thanakit (Platinum Member)"
-curl -X POST "$BASE_URL/users" \
+curl -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users" \
   -H "Content-Type: application/json" \
   -d '{
     "member_id": "LBK001235",
@@ -36,7 +39,7 @@ curl -X POST "$BASE_URL/users" \
 echo ""
 
 echo "User 3: John Smith (Silver Member)"
-curl -X POST "$BASE_URL/users" \
+curl -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users" \
   -H "Content-Type: application/json" \
   -d '{
     "member_id": "LBK001236",
@@ -51,7 +54,7 @@ curl -X POST "$BASE_URL/users" \
 echo ""
 
 echo "User 4: Apinya Wongsuwan (Bronze Member)"
-curl -X POST "$BASE_URL/users" \
+curl -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users" \
   -H "Content-Type: application/json" \
   -d '{
     "member_id": "LBK001237",
@@ -66,7 +69,7 @@ curl -X POST "$BASE_URL/users" \
 echo ""
 
 echo "User 5: Maria Garcia (Gold Member)"
-curl -X POST "$BASE_URL/users" \
+curl -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users" \
   -H "Content-Type: application/json" \
   -d '{
     "member_id": "LBK001238",
@@ -81,7 +84,7 @@ curl -X POST "$BASE_URL/users" \
 echo ""
 
 echo "User 6: Pongsakorn Rattanakit (Silver Member)"
-curl -X POST "$BASE_URL/users" \
+curl -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users" \
   -H "Content-Type: application/json" \
   -d '{
     "member_id": "LBK001239",
@@ -96,7 +99,7 @@ curl -X POST "$BASE_URL/users" \
 echo ""
 
 echo "User 7: Emily Johnson (Platinum Member)"
-curl -X POST "$BASE_URL/users" \
+curl -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users" \
   -H "Content-Type: application/json" \
   -d '{
     "member_id": "LBK001240",
@@ -111,7 +114,7 @@ curl -X POST "$BASE_URL/users" \
 echo ""
 
 echo "User 8: Nattaporn Srisawat (Bronze Member)"
-curl -X POST "$BASE_URL/users" \
+curl -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users" \
   -H "Content-Type: application/json" \
   -d '{
     "member_id": "LBK001241",
@@ -126,7 +129,7 @@ curl -X POST "$BASE_URL/users" \
 echo ""
 
 echo "User 9: David Chen (Gold Member)"
-curl -X POST "$BASE_URL/users" \
+curl -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users" \
   -H "Content-Type: application/json" \
   -d '{
     "member_id": "LBK001242",
@@ -141,7 +144,7 @@ curl -X POST "$BASE_URL/users" \
 echo ""
 
 echo "User 10: Kanlaya Promsuwan (Silver Member)"
-curl -X POST "$BASE_URL/users" \
+curl -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users" \
   -H "Content-Type: application/json" \
   -d '{
     "member_id": "LBK001243",
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Roles a caller can hold. Members act only on their own account; staff
+// operate on any member; admins may also adjust points, delete users and
+// force reversals. Partners only hold API keys, which reach nothing but
+// their own partner's purchase routes.
+const (
+	roleMember  = "member"
+	roleStaff   = "staff"
+	roleAdmin   = "admin"
+	rolePartner = "partner"
+)
+
+// isRole reports whether role can be carried by a bearer token
+func isRole(role string) bool {
+	return role == roleMember || role == roleStaff || role == roleAdmin
+}
+
+// APIKey is a stored credential. Only the SHA-256 hash of the key is kept;
+// the plaintext is shown once, when the key is created.
+type APIKey struct {
+	ID        int     `json:"id"`
+	Name      string  `json:"name"`
+	Prefix    string  `json:"prefix"`
+	KeyHash   string  `json:"-"`
+	Role      string  `json:"role"`
+	UserID    *int    `json:"userId,omitempty"`
+	PartnerID *int    `json:"partnerId,omitempty"`
+	CreatedAt string  `json:"createdAt"`
+	RevokedAt *string `json:"revokedAt,omitempty"`
+}
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Role string
+	// UserID is the member's own user id; zero for staff and admins
+	UserID int
+	// PartnerID is the partner a partner key records purchases for
+	PartnerID int
+	// Subject names the caller in logs: the API key name or the token subject
+	Subject string
+}
+
+// apiKeyPrefix marks keys issued by this server so they are easy to spot in config
+const apiKeyPrefix = "lbk_"
+
+// generateAPIKey returns a new random key and the short prefix stored to identify it
+func generateAPIKey() (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(secret)
+	return key, key[:len(apiKeyPrefix)+8], nil
+}
+
+// hashAPIKey is how keys are stored and looked up
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenClaims are the claims read from a JWT bearer token. For members the
+// subject must be their user id.
+type tokenClaims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// principalFromToken verifies an HS256 token signed with the configured secret
+func principalFromToken(raw string) (Principal, error) {
+	if cfg.JWTSecret == "" {
+		return Principal{}, fmt.Errorf("bearer tokens are not enabled")
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256"}),
+		jwt.WithExpirationRequired(),
+	}
+	if cfg.JWTIssuer != "" {
+		options = append(options, jwt.WithIssuer(cfg.JWTIssuer))
+	}
+
+	var claims tokenClaims
+	_, err := jwt.ParseWithClaims(raw, &claims, func(*jwt.Token) (interface{}, error) {
+		return []byte(cfg.JWTSecret), nil
+	}, options...)
+	if err != nil {
+		return Principal{}, err
+	}
+	if !isRole(claims.Role) {
+		return Principal{}, fmt.Errorf("token has no valid role")
+	}
+
+	principal := Principal{Role: claims.Role, Subject: claims.Subject}
+	if claims.Role == roleMember {
+		userID, err := strconv.Atoi(claims.Subject)
+		if err != nil || userID <= 0 {
+			return Principal{}, fmt.Errorf("member token subject must be a user id")
+		}
+		principal.UserID = userID
+	}
+	return principal, nil
+}
+
+// principalFromAPIKey looks up an API key by its hash
+func (a *API) principalFromAPIKey(key string) (Principal, error) {
+	stored, err := a.store.APIKeys().GetByHash(hashAPIKey(key))
+	if err != nil {
+		return Principal{}, err
+	}
+	if stored.RevokedAt != nil {
+		return Principal{}, errAPIKeyNotFound
+	}
+
+	principal := Principal{Role: stored.Role, Subject: stored.Name}
+	if stored.UserID != nil {
+		principal.UserID = *stored.UserID
+	}
+	if stored.PartnerID != nil {
+		principal.PartnerID = *stored.PartnerID
+	}
+	return principal, nil
+}
+
+func unauthorized(c *fiber.Ctx, message string) error {
+	return c.Status(401).JSON(fiber.Map{
+		"error":   "UNAUTHORIZED",
+		"message": message,
+	})
+}
+
+func forbidden(c *fiber.Ctx, message string) error {
+	return c.Status(403).JSON(fiber.Map{
+		"error":   "FORBIDDEN",
+		"message": message,
+	})
+}
+
+// authenticate identifies the caller from an X-API-Key header or an
+// Authorization: Bearer token. Without credentials the request is rejected,
+// unless auth_required is off, in which case it runs as an anonymous admin.
+func (a *API) authenticate(c *fiber.Ctx) error {
+	var principal Principal
+	var err error
+
+	if key := c.Get("X-API-Key"); key != "" {
+		principal, err = a.principalFromAPIKey(key)
+		if err == errAPIKeyNotFound {
+			return unauthorized(c, "Invalid or revoked API key")
+		} else if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error":   "INTERNAL_ERROR",
+				"message": "Failed to check API key",
+			})
+		}
+	} else if header := c.Get("Authorization"); header != "" {
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			return unauthorized(c, "Authorization header must use the Bearer scheme")
+		}
+		if principal, err = principalFromToken(token); err != nil {
+			return unauthorized(c, "Invalid or expired bearer token")
+		}
+
+		// A member token must name a member who still exists
+		if principal.Role == roleMember {
+			if _, err := a.store.Users().Get(principal.UserID); err == errUserNotFound {
+				return unauthorized(c, "Invalid or expired bearer token")
+			} else if err != nil {
+				return c.Status(500).JSON(fiber.Map{
+					"error":   "INTERNAL_ERROR",
+					"message": "Failed to check bearer token",
+				})
+			}
+		}
+	} else if cfg.AuthRequired {
+		return unauthorized(c, "Provide an X-API-Key header or a Bearer token")
+	} else {
+		principal = Principal{Role: roleAdmin, Subject: "anonymous"}
+	}
+
+	c.Locals("principal", principal)
+	return c.Next()
+}
+
+// principalFrom returns the caller set by authenticate
+func principalFrom(c *fiber.Ctx) Principal {
+	principal, _ := c.Locals("principal").(Principal)
+	return principal
+}
+
+// hasRole reports whether the principal holds one of roles
+func (p Principal) hasRole(roles ...string) bool {
+	for _, role := range roles {
+		if p.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// canSeeTransfer reports whether the principal may read t: members only see
+// transfers they sent or received
+func (p Principal) canSeeTransfer(t Transfer) bool {
+	return p.Role != roleMember || t.FromUserID == p.UserID || t.ToUserID == p.UserID
+}
+
+// allowRoles only lets callers holding one of roles through
+func allowRoles(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !principalFrom(c).hasRole(roles...) {
+			return forbidden(c, "This action requires the "+strings.Join(roles, " or ")+" role")
+		}
+		return c.Next()
+	}
+}
+
+// allowSelfOr lets members through for their own /users/:id routes and
+// callers holding one of roles for any user
+func allowSelfOr(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		principal := principalFrom(c)
+		if principal.hasRole(roles...) {
+			return c.Next()
+		}
+		if principal.Role == roleMember && c.Params("id") == strconv.Itoa(principal.UserID) {
+			return c.Next()
+		}
+		return forbidden(c, "Members can only access their own account")
+	}
+}
+
+// allowPartnerOr lets partner keys through for their own
+// /partners/:partnerId routes and callers holding one of roles for any partner
+func allowPartnerOr(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		principal := principalFrom(c)
+		if principal.hasRole(roles...) {
+			return c.Next()
+		}
+		if principal.Role == rolePartner && c.Params("partnerId") == strconv.Itoa(principal.PartnerID) {
+			return c.Next()
+		}
+		return forbidden(c, "This action requires the partner's own API key")
+	}
+}
+
+// runAPIKeyCommand implements the `apikey create|list|revoke` subcommand,
+// which is how the first admin key is issued
+func runAPIKeyCommand(store Store, args []string) error {
+	usage := fmt.Errorf("usage: apikey create <name> <member|staff|admin|partner> [userId|partnerId] | list | revoke <id>")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "create":
+		if len(args) < 3 {
+			return usage
+		}
+		key := APIKey{Name: args[1], Role: args[2], CreatedAt: timestamp(time.Now())}
+		if !isRole(key.Role) && key.Role != rolePartner {
+			return fmt.Errorf("role must be member, staff, admin or partner")
+		}
+
+		// Member keys act for one user and partner keys for one partner;
+		// staff and admin keys for neither
+		if key.Role == rolePartner {
+			if len(args) < 4 {
+				return fmt.Errorf("partner keys need the partner id")
+			}
+			partnerID, err := strconv.Atoi(args[3])
+			if err != nil {
+				return fmt.Errorf("partnerId must be an integer")
+			}
+			if _, err := store.Partners().Get(partnerID); err != nil {
+				return fmt.Errorf("partner %d: %w", partnerID, err)
+			}
+			key.PartnerID = &partnerID
+		} else if key.Role == roleMember {
+			if len(args) < 4 {
+				return fmt.Errorf("member keys need the member's user id")
+			}
+			userID, err := strconv.Atoi(args[3])
+			if err != nil {
+				return fmt.Errorf("userId must be an integer")
+			}
+			if _, err := store.Users().Get(userID); err != nil {
+				return fmt.Errorf("user %d: %w", userID, err)
+			}
+			key.UserID = &userID
+		} else if len(args) > 3 {
+			return fmt.Errorf("only member and partner keys take an id")
+		}
+
+		plaintext, prefix, err := generateAPIKey()
+		if err != nil {
+			return err
+		}
+		key.Prefix = prefix
+		key.KeyHash = hashAPIKey(plaintext)
+		if err := store.APIKeys().Create(&key); err != nil {
+			return err
+		}
+
+		fmt.Printf("Created %s key %d (%s). Store it now; it cannot be shown again:\n%s\n", key.Role, key.ID, key.Name, plaintext)
+		return nil
+
+	case "list":
+		keys, err := store.APIKeys().List()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			state := "active"
+			if k.RevokedAt != nil {
+				state = "revoked " + *k.RevokedAt
+			}
+			owner := "-"
+			if k.UserID != nil {
+				owner = "user " + strconv.Itoa(*k.UserID)
+			} else if k.PartnerID != nil {
+				owner = "partner " + strconv.Itoa(*k.PartnerID)
+			}
+			fmt.Printf("%4d  %-20s %-12s %-7s %-14s %s\n", k.ID, k.Name, k.Prefix, k.Role, owner, state)
+		}
+		return nil
+
+	case "revoke":
+		if len(args) < 2 {
+			return usage
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("id must be an integer")
+		}
+		if err := store.APIKeys().Revoke(id, timestamp(time.Now())); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked key %d\n", id)
+		return nil
+	}
+
+	return usage
+}
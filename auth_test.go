@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signToken returns a bearer token for role and subject signed with secret
+func signToken(t *testing.T, secret, role, subject string) string {
+	t.Helper()
+	claims := tokenClaims{
+		Role: role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAuthenticateBearerToken(t *testing.T) {
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.JWTSecret = "unit-test-secret-at-least-32-characters"
+
+	s := newMemoryStore()
+	alice, err := conformanceUser(s, "unit", "alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Use(newAPI(s).authenticate)
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendString(principalFrom(c).Role)
+	})
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"member", signToken(t, cfg.JWTSecret, roleMember, strconv.Itoa(alice.ID)), 200},
+		{"staff", signToken(t, cfg.JWTSecret, roleStaff, "ops"), 200},
+		{"unknown member", signToken(t, cfg.JWTSecret, roleMember, strconv.Itoa(alice.ID+1000)), 401},
+		{"wrong secret", signToken(t, "another-secret-at-least-32-characters", roleStaff, "ops"), 401},
+		{"malformed", "not-a-token", 401},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+			continue
+		}
+		if tt.status != 401 {
+			continue
+		}
+
+		// Rejections never echo the token parser's reason
+		var body struct{ Message string }
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Message != "Invalid or expired bearer token" {
+			t.Errorf("%s: message %q", tt.name, body.Message)
+		}
+	}
+}
+
+func TestPartnerKeyScope(t *testing.T) {
+	s := newMemoryStore()
+	now := timestamp(time.Now())
+	keys := map[string]string{}
+	for _, k := range []struct {
+		name, role string
+		partnerID  int
+	}{{"partner 1", rolePartner, 1}, {"partner 2", rolePartner, 2}, {"staff", roleStaff, 0}} {
+		plaintext, prefix, err := generateAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := APIKey{Name: k.name, Prefix: prefix, KeyHash: hashAPIKey(plaintext), Role: k.role, CreatedAt: now}
+		if k.partnerID != 0 {
+			partnerID := k.partnerID
+			key.PartnerID = &partnerID
+		}
+		if err := s.APIKeys().Create(&key); err != nil {
+			t.Fatal(err)
+		}
+		keys[k.name] = plaintext
+	}
+
+	// The same guards main puts on the partner routes
+	ok := func(c *fiber.Ctx) error { return c.SendStatus(200) }
+	app := fiber.New()
+	app.Use(newAPI(s).authenticate)
+	app.Post("/partners/:partnerId/purchases", allowPartnerOr(), ok)
+	app.Get("/partners/:partnerId/purchases", allowPartnerOr(roleStaff, roleAdmin), ok)
+	app.Use(allowRoles(roleMember, roleStaff, roleAdmin))
+	app.Get("/users", ok)
+
+	tests := []struct {
+		key, method, path string
+		status            int
+	}{
+		{"partner 1", "POST", "/partners/1/purchases", 200},
+		{"partner 2", "POST", "/partners/1/purchases", 403},
+		{"staff", "POST", "/partners/1/purchases", 403},
+		{"partner 1", "GET", "/partners/1/purchases", 200},
+		{"partner 2", "GET", "/partners/1/purchases", 403},
+		{"staff", "GET", "/partners/1/purchases", 200},
+		{"partner 1", "GET", "/users", 403},
+		{"staff", "GET", "/users", 200},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("X-API-Key", keys[tt.key])
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s with the %s key: status %d, want %d", tt.method, tt.path, tt.key, resp.StatusCode, tt.status)
+		}
+	}
+}
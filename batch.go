@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// maxBatchTransfers bounds the legs of one batch
+const maxBatchTransfers = 100
+
+// batchLegKeyPrefix starts the idempotency key of every batch leg. Client
+// keys may not use it, so a transfer can never replay a batch leg.
+const batchLegKeyPrefix = "batch:"
+
+// TransferBatchLeg is one recipient of a batch transfer
+type TransferBatchLeg struct {
+	ToUserID int    `json:"toUserId"`
+	Amount   int    `json:"amount"`
+	Note     string `json:"note,omitempty"`
+}
+
+// TransferBatchRequest represents the request body for a batch transfer from
+// one sender to many recipients
+type TransferBatchRequest struct {
+	FromUserID int                `json:"fromUserId"`
+	Transfers  []TransferBatchLeg `json:"transfers"`
+
+	// BestEffort executes each leg on its own, so that one failing leg does
+	// not hold back the rest, instead of all legs or none
+	BestEffort bool `json:"bestEffort,omitempty"`
+}
+
+// TransferBatchResult reports what happened to one leg of a batch
+type TransferBatchResult struct {
+	Index int `json:"index"`
+	// Status is completed or failed
+	Status   string    `json:"status"`
+	Transfer *Transfer `json:"transfer,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// TransferBatchResponse represents the response for a batch transfer
+type TransferBatchResponse struct {
+	BatchID   string                `json:"batchId"`
+	Completed int                   `json:"completed"`
+	Failed    int                   `json:"failed"`
+	Results   []TransferBatchResult `json:"results"`
+}
+
+// batchLegError reports the leg that failed an all-or-nothing batch
+type batchLegError struct {
+	index int
+	err   error
+}
+
+func (e *batchLegError) Error() string {
+	return fmt.Sprintf("transfer %d: %v", e.index, e.err)
+}
+
+func (e *batchLegError) Unwrap() error {
+	return e.err
+}
+
+// batchLegKey is the idempotency key of leg i of a batch
+func batchLegKey(batchID string, i int) string {
+	return fmt.Sprintf("%s%s-%d", batchLegKeyPrefix, batchID, i+1)
+}
+
+// batchLegRequest is the single transfer leg i of req stands for
+func batchLegRequest(req TransferBatchRequest, i int) TransferCreateRequest {
+	leg := req.Transfers[i]
+	return TransferCreateRequest{
+		FromUserID: req.FromUserID,
+		ToUserID:   leg.ToUserID,
+		Amount:     leg.Amount,
+		Note:       leg.Note,
+	}
+}
+
+// executeTransferBatch sends every leg of req in one transaction, after
+// checking the sender can cover them all; a failing leg fails the batch with
+// a *batchLegError. Each leg is an ordinary completed transfer carrying
+// batchID, checked against the sender's transfer limits in turn. Running a
+// recorded batch again returns its transfers with replayed set, or fails
+// with errIdemKeyReused if the legs differ.
+func executeTransferBatch(s Store, req TransferBatchRequest, batchID string) (transfers []Transfer, replayed bool, err error) {
+	transfers = make([]Transfer, len(req.Transfers))
+	err = s.RunInTx(func(tx Store) error {
+		ids := []int{req.FromUserID}
+		total := 0
+		for _, leg := range req.Transfers {
+			ids = append(ids, leg.ToUserID)
+			total += leg.Amount
+		}
+		if err := tx.Users().Lock(ids...); err != nil {
+			return err
+		}
+
+		// A batch is recorded whole or not at all
+		recorded, err := tx.Transfers().Count(TransferFilter{BatchID: batchID})
+		if err != nil {
+			return err
+		}
+		replayed = recorded > 0
+		if replayed && recorded != len(req.Transfers) {
+			return errIdemKeyReused
+		}
+
+		if !replayed {
+			balance, held, err := tx.Users().Balances(req.FromUserID)
+			if err == errUserNotFound {
+				return errFromUserNotFound
+			} else if err != nil {
+				return err
+			}
+			if balance-held < total {
+				return errInsufficientBalance
+			}
+		}
+
+		for i := range req.Transfers {
+			transfer, _, err := executeTransferFrom(tx, batchLegRequest(req, i), batchLegKey(batchID, i), transferOrigin{BatchID: batchID})
+			if err != nil {
+				return &batchLegError{index: i, err: err}
+			}
+			transfers[i] = transfer
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return transfers, replayed, nil
+}
+
+// executeTransferBatchBestEffort sends each leg of req in its own
+// transaction and reports how each one went. Legs already recorded for
+// batchID are replayed, so a retry only sends the legs that failed.
+func executeTransferBatchBestEffort(s Store, req TransferBatchRequest, batchID string) (results []TransferBatchResult, replayed bool) {
+	results = make([]TransferBatchResult, len(req.Transfers))
+	replayed = true
+	for i := range req.Transfers {
+		result := TransferBatchResult{Index: i, Status: "completed"}
+		transfer, legReplayed, err := executeTransferFrom(s, batchLegRequest(req, i), batchLegKey(batchID, i), transferOrigin{BatchID: batchID})
+		if err != nil {
+			_, code, message, ok := describeError(err)
+			if !ok {
+				message = "Failed to create transfer"
+			}
+			result.Status, result.Error, result.Message = "failed", code, message
+		} else {
+			result.Transfer = &transfer
+		}
+		replayed = replayed && legReplayed
+		results[i] = result
+	}
+	return results, replayed
+}
+
+// POST /transfers/batch - Send points from one sender to many recipients,
+// all or nothing unless bestEffort is set. An Idempotency-Key header becomes
+// the batch id and makes the call retry-safe.
+func (a *API) createTransferBatch(c *fiber.Ctx) error {
+	validationError := func(message string) error {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": message,
+		})
+	}
+
+	var req TransferBatchRequest
+	if err := c.BodyParser(&req); err != nil {
+		return validationError("Invalid request body")
+	}
+	if req.FromUserID <= 0 {
+		return validationError("fromUserId must be a positive integer")
+	}
+	if len(req.Transfers) == 0 || len(req.Transfers) > maxBatchTransfers {
+		return validationError(fmt.Sprintf("transfers must hold between 1 and %d legs", maxBatchTransfers))
+	}
+	for i, leg := range req.Transfers {
+		if leg.ToUserID <= 0 || leg.Amount <= 0 {
+			return c.Status(400).JSON(fiber.Map{
+				"error":   "VALIDATION_ERROR",
+				"message": "toUserId and amount must be positive integers",
+				"index":   i,
+			})
+		}
+	}
+
+	// Members can only send their own points
+	if principal := principalFrom(c); principal.Role == roleMember && req.FromUserID != principal.UserID {
+		return forbidden(c, "Members can only transfer from their own account")
+	}
+
+	// Leave room for the prefix and leg number around each leg's key
+	batchID := c.Get("Idempotency-Key")
+	if maxLength := maxIdemKeyLength - len(batchLegKey("", maxBatchTransfers)); len(batchID) > maxLength {
+		return validationError(fmt.Sprintf("Idempotency-Key must be at most %d characters", maxLength))
+	}
+	if batchID == "" {
+		batchID = uuid.New().String()
+	}
+
+	response := TransferBatchResponse{BatchID: batchID}
+	status := 201
+	var replayed bool
+	if req.BestEffort {
+		response.Results, replayed = executeTransferBatchBestEffort(a.store, req, batchID)
+		status = 200
+	} else {
+		var transfers []Transfer
+		var err error
+		transfers, replayed, err = executeTransferBatch(a.store, req, batchID)
+		if err != nil {
+			var legErr *batchLegError
+			if !errors.As(err, &legErr) {
+				return transferErrorResponse(c, err, "create transfers")
+			}
+			status, code, message, ok := describeError(legErr.err)
+			if !ok {
+				message = "Failed to create transfers"
+			}
+			return c.Status(status).JSON(fiber.Map{
+				"error":   code,
+				"message": message,
+				"index":   legErr.index,
+			})
+		}
+		for i := range transfers {
+			response.Results = append(response.Results, TransferBatchResult{Index: i, Status: "completed", Transfer: &transfers[i]})
+		}
+	}
+	for _, result := range response.Results {
+		if result.Status == "completed" {
+			response.Completed++
+		} else {
+			response.Failed++
+		}
+	}
+
+	c.Set("Idempotency-Key", batchID)
+	if replayed {
+		c.Set("Idempotent-Replayed", "true")
+	}
+	return c.Status(status).JSON(response)
+}
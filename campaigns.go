@@ -0,0 +1,485 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Campaign awards bonus points for member activity within a date window.
+// Trigger is the activity it reacts to: "earn" for points earned, or
+// "transfer" for a completed transfer, credited to the sender. RuleType
+// decides the bonus:
+//
+//   - multiplier: Multiplier times the points earned, less the points
+//     themselves (earn only)
+//   - fixed: BonusPoints for every matching activity
+//   - threshold: BonusPoints when the activity's amount is at least Threshold
+//   - first: BonusPoints when the activity is the member's first ever: their
+//     first earn entry, or the first transfer they sent that still stands
+//
+// Bonuses paid for a transfer are taken back when it is reversed.
+// Empty Tiers and register date bounds match every member. A nil Budget or
+// MaxAwardsPerMember is unlimited.
+type Campaign struct {
+	ID                 int      `json:"id"`
+	Name               string   `json:"name"`
+	Description        string   `json:"description,omitempty"`
+	RuleType           string   `json:"ruleType"`
+	Trigger            string   `json:"trigger"`
+	Multiplier         float64  `json:"multiplier,omitempty"`
+	BonusPoints        int      `json:"bonusPoints,omitempty"`
+	Threshold          int      `json:"threshold,omitempty"`
+	StartsAt           string   `json:"startsAt"`
+	EndsAt             string   `json:"endsAt"`
+	Tiers              []string `json:"tiers"`
+	RegisteredFrom     string   `json:"registeredFrom,omitempty"`
+	RegisteredTo       string   `json:"registeredTo,omitempty"`
+	MaxAwardsPerMember *int     `json:"maxAwardsPerMember"`
+	Budget             *int     `json:"budget"`
+	BudgetUsed         int      `json:"budgetUsed"`
+	Active             bool     `json:"active"`
+	CreatedAt          string   `json:"createdAt"`
+	UpdatedAt          string   `json:"updatedAt"`
+}
+
+// CampaignRequest represents the request body for creating or replacing a campaign
+type CampaignRequest struct {
+	Name               string   `json:"name"`
+	Description        string   `json:"description,omitempty"`
+	RuleType           string   `json:"ruleType"`
+	Trigger            string   `json:"trigger"`
+	Multiplier         float64  `json:"multiplier,omitempty"`
+	BonusPoints        int      `json:"bonusPoints,omitempty"`
+	Threshold          int      `json:"threshold,omitempty"`
+	StartsAt           string   `json:"startsAt"`
+	EndsAt             string   `json:"endsAt"`
+	Tiers              []string `json:"tiers,omitempty"`
+	RegisteredFrom     string   `json:"registeredFrom,omitempty"`
+	RegisteredTo       string   `json:"registeredTo,omitempty"`
+	MaxAwardsPerMember *int     `json:"maxAwardsPerMember"`
+	Budget             *int     `json:"budget"`
+	// Active defaults to true when omitted
+	Active *bool `json:"active,omitempty"`
+}
+
+// CampaignAward records a bonus a campaign paid to a member. TransferID is
+// set for bonuses paid for a transfer, and ReversedAt once a reversal of
+// that transfer took the bonus back.
+type CampaignAward struct {
+	ID            int
+	CampaignID    int
+	UserID        int
+	LedgerEntryID int
+	Points        int
+	TransferID    *int
+	CreatedAt     string
+	ReversedAt    *string
+}
+
+var (
+	campaignRuleTypes = []string{"multiplier", "fixed", "threshold", "first"}
+	campaignTriggers  = []string{"earn", "transfer"}
+)
+
+// matches reports whether the campaign targets user
+func (c Campaign) matches(user User) bool {
+	if len(c.Tiers) > 0 && !containsString(c.Tiers, user.MembershipLevel) {
+		return false
+	}
+	return (c.RegisteredFrom == "" || user.RegisterDate >= c.RegisteredFrom) &&
+		(c.RegisteredTo == "" || user.RegisterDate <= c.RegisteredTo)
+}
+
+// bonus returns the points the campaign's rule awards for an activity of amount
+func (c Campaign) bonus(amount int) int {
+	switch c.RuleType {
+	case "multiplier":
+		return int(float64(amount) * (c.Multiplier - 1))
+	case "threshold":
+		if amount < c.Threshold {
+			return 0
+		}
+	}
+	return c.BonusPoints
+}
+
+// isFirstActivity reports whether the activity being rewarded is the
+// user's first of its kind: their only earn entry, or the only transfer
+// they sent that stands completed
+func isFirstActivity(tx Store, userID int, trigger string) (bool, error) {
+	if trigger == "transfer" {
+		sent, err := tx.Transfers().Count(TransferFilter{UserID: userID, Direction: "sent", Statuses: []string{"completed"}})
+		return sent == 1, err
+	}
+	earns, err := tx.Ledger().List(LedgerFilter{UserID: userID, EventType: "earn"}, ListPage{Limit: 2})
+	return len(earns) == 1, err
+}
+
+// applyCampaigns credits the bonuses of every running campaign for trigger
+// that targets the user, each as its own earn ledger entry carrying the
+// campaign id in its metadata. transferID is the transfer a transfer
+// trigger rewards, so a reversal can take its bonuses back. A bonus is cut
+// down to what is left of the campaign's budget. It must run inside the
+// transaction that recorded the activity.
+func applyCampaigns(tx Store, userID int, trigger string, amount int, transferID *int, now string) ([]PointLedgerEntry, error) {
+	campaigns, err := tx.Campaigns().List(CampaignFilter{RunningAt: now, Trigger: trigger})
+	if err != nil || len(campaigns) == 0 {
+		return nil, err
+	}
+	user, err := tx.Users().Get(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decided before any bonus below adds an earn entry of its own
+	first := false
+	for _, campaign := range campaigns {
+		if campaign.RuleType == "first" {
+			if first, err = isFirstActivity(tx, userID, trigger); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	var entries []PointLedgerEntry
+	for _, campaign := range campaigns {
+		if !campaign.matches(user) || (campaign.RuleType == "first" && !first) {
+			continue
+		}
+		points := campaign.bonus(amount)
+		if campaign.Budget != nil {
+			points = min(points, *campaign.Budget-campaign.BudgetUsed)
+		}
+		if points <= 0 {
+			continue
+		}
+		if campaign.MaxAwardsPerMember != nil {
+			awarded, err := tx.Campaigns().CountAwards(campaign.ID, userID)
+			if err != nil {
+				return nil, err
+			}
+			if awarded >= *campaign.MaxAwardsPerMember {
+				continue
+			}
+		}
+
+		// A concurrent award may have spent the budget since it was read
+		if err := tx.Campaigns().AddBudgetUsed(campaign.ID, points); err == errCampaignBudgetExhausted {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		metadata, _ := json.Marshal(map[string]interface{}{
+			"campaignId": campaign.ID,
+			"ruleType":   campaign.RuleType,
+			"trigger":    trigger,
+			"amount":     amount,
+		})
+		entry, err := applyPointChange(tx, pointChange{
+			UserID:    userID,
+			Change:    points,
+			EventType: "earn",
+			Reference: "Campaign bonus: " + campaign.Name,
+			Metadata:  string(metadata),
+		}, now)
+		if err != nil {
+			return nil, err
+		}
+		err = tx.Campaigns().RecordAward(&CampaignAward{
+			CampaignID:    campaign.ID,
+			UserID:        userID,
+			LedgerEntryID: entry.ID,
+			Points:        points,
+			TransferID:    transferID,
+			CreatedAt:     now,
+		})
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// reverseCampaignAwards takes back the bonuses campaigns paid for a transfer
+// that is being reversed, each as a negative earn entry, and returns their
+// points to the campaigns' budgets. The reversed awards no longer count
+// towards MaxAwardsPerMember. The member may be left with a negative
+// balance if they already spent a bonus. It must run inside the reversal's
+// transaction.
+func reverseCampaignAwards(tx Store, t Transfer, now string) ([]PointLedgerEntry, error) {
+	awards, err := tx.Campaigns().ListAwardsByTransfer(t.TransferID)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []PointLedgerEntry
+	for _, award := range awards {
+		campaign, err := tx.Campaigns().Get(award.CampaignID)
+		if err != nil {
+			return nil, err
+		}
+		metadata, _ := json.Marshal(map[string]interface{}{
+			"campaignId": campaign.ID,
+			"reversalOf": t.IdemKey,
+		})
+		entry, err := applyPointChange(tx, pointChange{
+			UserID:        award.UserID,
+			Change:        -award.Points,
+			EventType:     "earn",
+			Reference:     "Reversal of campaign bonus: " + campaign.Name,
+			Metadata:      string(metadata),
+			AllowNegative: true,
+		}, now)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Campaigns().AddBudgetUsed(campaign.ID, -award.Points); err != nil {
+			return nil, err
+		}
+		if err := tx.Campaigns().ReverseAward(award.ID, now); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// creditEarned credits earned points and any campaign and referral bonuses
+// they qualify for in one transaction
+func creditEarned(s Store, pc pointChange) (PointLedgerEntry, []PointLedgerEntry, error) {
+	var entry PointLedgerEntry
+	var bonuses []PointLedgerEntry
+	err := s.RunInTx(func(tx Store) error {
+		now := timestamp(time.Now())
+		var err error
+		if entry, err = applyPointChange(tx, pc, now); err != nil {
+			return err
+		}
+		if bonuses, err = applyCampaigns(tx, pc.UserID, "earn", pc.Change, nil, now); err != nil {
+			return err
+		}
+		referral, err := applyReferral(tx, pc.UserID, pc.Change, now)
+		if referral != nil {
+			bonuses = append(bonuses, *referral)
+		}
+		return err
+	})
+	return entry, bonuses, err
+}
+
+// parseCampaignRequest validates a CampaignRequest body and returns the
+// campaign it describes, or the message explaining why it is invalid
+func parseCampaignRequest(body []byte) (Campaign, string) {
+	var req CampaignRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return Campaign{}, "Invalid request body"
+	}
+
+	campaign := Campaign{
+		Name:               strings.TrimSpace(req.Name),
+		Description:        req.Description,
+		RuleType:           req.RuleType,
+		Trigger:            req.Trigger,
+		Tiers:              []string{},
+		MaxAwardsPerMember: req.MaxAwardsPerMember,
+		Budget:             req.Budget,
+		Active:             req.Active == nil || *req.Active,
+	}
+	if campaign.Name == "" {
+		return Campaign{}, "name is required"
+	}
+	if !containsString(campaignTriggers, req.Trigger) {
+		return Campaign{}, "trigger must be one of: " + strings.Join(campaignTriggers, ", ")
+	}
+
+	switch req.RuleType {
+	case "multiplier":
+		if req.Trigger != "earn" {
+			return Campaign{}, "multiplier campaigns need the earn trigger"
+		}
+		if req.Multiplier <= 1 {
+			return Campaign{}, "multiplier must be greater than 1"
+		}
+		campaign.Multiplier = req.Multiplier
+	case "fixed", "threshold", "first":
+		if req.BonusPoints <= 0 {
+			return Campaign{}, "bonusPoints must be a positive integer"
+		}
+		campaign.BonusPoints = req.BonusPoints
+		if req.RuleType == "threshold" {
+			if req.Threshold <= 0 {
+				return Campaign{}, "threshold must be a positive integer"
+			}
+			campaign.Threshold = req.Threshold
+		}
+	default:
+		return Campaign{}, "ruleType must be one of: " + strings.Join(campaignRuleTypes, ", ")
+	}
+
+	for _, bound := range []struct {
+		param    string
+		value    string
+		endOfDay bool
+		dst      *string
+	}{
+		{"startsAt", req.StartsAt, false, &campaign.StartsAt},
+		{"endsAt", req.EndsAt, true, &campaign.EndsAt},
+	} {
+		parsed, err := parseDateBound(bound.value, bound.endOfDay)
+		if err != nil {
+			return Campaign{}, bound.param + " must be a date (YYYY-MM-DD) or RFC3339 timestamp"
+		}
+		*bound.dst = parsed
+	}
+	if campaign.StartsAt > campaign.EndsAt {
+		return Campaign{}, "startsAt must not be after endsAt"
+	}
+
+	for _, bound := range []struct {
+		param string
+		value string
+		dst   *string
+	}{
+		{"registeredFrom", req.RegisteredFrom, &campaign.RegisteredFrom},
+		{"registeredTo", req.RegisteredTo, &campaign.RegisteredTo},
+	} {
+		if bound.value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", bound.value); err != nil {
+			return Campaign{}, bound.param + " must be a date (YYYY-MM-DD)"
+		}
+		*bound.dst = bound.value
+	}
+
+	for _, tier := range req.Tiers {
+		if !isTier(tier) {
+			return Campaign{}, "tiers must only contain: " + strings.Join(tierNames(), ", ")
+		}
+		campaign.Tiers = append(campaign.Tiers, tier)
+	}
+	if req.MaxAwardsPerMember != nil && *req.MaxAwardsPerMember <= 0 {
+		return Campaign{}, "maxAwardsPerMember must be a positive integer or null"
+	}
+	if req.Budget != nil && *req.Budget <= 0 {
+		return Campaign{}, "budget must be a positive integer or null"
+	}
+	return campaign, ""
+}
+
+// containsString reports whether values holds value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// GET /campaigns - List campaigns; running=true limits the list to those running now
+func (a *API) getCampaigns(c *fiber.Ctx) error {
+	var filter CampaignFilter
+	if c.Query("running") == "true" {
+		filter.RunningAt = timestamp(time.Now())
+	}
+
+	campaigns, err := a.store.Campaigns().List(filter)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "INTERNAL_ERROR",
+			"message": "Failed to fetch campaigns",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": campaigns,
+	})
+}
+
+// GET /campaigns/:id - Get a campaign and how much of its budget is used
+func (a *API) getCampaignByID(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil || id <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "Campaign ID must be a positive integer",
+		})
+	}
+
+	campaign, err := a.store.Campaigns().Get(id)
+	if err != nil {
+		return transferErrorResponse(c, err, "fetch campaign")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": campaign,
+	})
+}
+
+// POST /campaigns - Create a campaign
+func (a *API) createCampaign(c *fiber.Ctx) error {
+	campaign, message := parseCampaignRequest(c.Body())
+	if message != "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": message,
+		})
+	}
+
+	campaign.CreatedAt = timestamp(time.Now())
+	campaign.UpdatedAt = campaign.CreatedAt
+	if err := a.store.Campaigns().Create(&campaign); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "INTERNAL_ERROR",
+			"message": "Failed to create campaign",
+		})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"data": campaign,
+	})
+}
+
+// PUT /campaigns/:id - Replace a campaign's rules. The budget already used
+// is kept; set "active": false to stop a campaign early.
+func (a *API) updateCampaign(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil || id <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "Campaign ID must be a positive integer",
+		})
+	}
+
+	campaign, message := parseCampaignRequest(c.Body())
+	if message != "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": message,
+		})
+	}
+
+	existing, err := a.store.Campaigns().Get(id)
+	if err != nil {
+		return transferErrorResponse(c, err, "fetch campaign")
+	}
+	campaign.ID = id
+	campaign.BudgetUsed = existing.BudgetUsed
+	campaign.CreatedAt = existing.CreatedAt
+	campaign.UpdatedAt = timestamp(time.Now())
+	if err := a.store.Campaigns().Update(campaign); err != nil {
+		return transferErrorResponse(c, err, "update campaign")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": campaign,
+	})
+}
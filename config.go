@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the runtime settings for the server. Values are resolved in
+// order of precedence: built-in defaults, then the optional YAML file named
+// by LBK_CONFIG_FILE, then individual LBK_* environment variables.
+type Config struct {
+	DatabaseDriver     string        `yaml:"database_driver"`
+	DatabaseDSN        string        `yaml:"database_dsn"`
+	AutoMigrate        bool          `yaml:"auto_migrate"`
+	ListenAddr         string        `yaml:"listen_addr"`
+	CORSAllowedOrigins []string      `yaml:"cors_allowed_origins"`
+	DefaultPageSize    int           `yaml:"default_page_size"`
+	MaxPageSize        int           `yaml:"max_page_size"`
+	JSONPretty         bool          `yaml:"json_pretty"`
+	PendingHoldTTL     time.Duration `yaml:"pending_hold_ttl"`
+	HoldExpiryInterval time.Duration `yaml:"hold_expiry_interval"`
+	AuthRequired       bool          `yaml:"auth_required"`
+	JWTSecret          string        `yaml:"jwt_secret"`
+	JWTIssuer          string        `yaml:"jwt_issuer"`
+
+	// Tiers lists the membership tiers from lowest to highest. A member
+	// qualifies for the highest tier whose MinPoints they earned within
+	// TierWindow; tiers are re-evaluated daily at TierEvaluationTime (UTC).
+	Tiers              []TierConfig  `yaml:"tiers"`
+	TierWindow         time.Duration `yaml:"tier_window"`
+	TierEvaluationTime string        `yaml:"tier_evaluation_time"`
+
+	// WebhookURL receives event notifications, signed with WebhookSecret;
+	// undelivered events are retried every WebhookInterval
+	WebhookURL      string        `yaml:"webhook_url"`
+	WebhookSecret   string        `yaml:"webhook_secret"`
+	WebhookInterval time.Duration `yaml:"webhook_interval"`
+
+	// PointExpiryMonths is how long credited points last before they
+	// expire, 0 for never; PointExpiryInterval is how often the expiry job runs
+	PointExpiryMonths   int           `yaml:"point_expiry_months"`
+	PointExpiryInterval time.Duration `yaml:"point_expiry_interval"`
+
+	// A referral is rewarded once the referee earns at least ReferralMinEarn
+	// points in one go: the referrer gets ReferrerPoints and the referee
+	// RefereePoints. ReferralMaxPerReferrer caps the referrals a member can
+	// have pending or rewarded, 0 for no cap.
+	ReferrerPoints         int `yaml:"referral_referrer_points"`
+	RefereePoints          int `yaml:"referral_referee_points"`
+	ReferralMinEarn        int `yaml:"referral_min_earn"`
+	ReferralMaxPerReferrer int `yaml:"referral_max_per_referrer"`
+
+	// ScheduledTransferInterval is how often due scheduled transfers are sent
+	ScheduledTransferInterval time.Duration `yaml:"scheduled_transfer_interval"`
+}
+
+// TierConfig is one membership tier and the points needed to qualify for it
+type TierConfig struct {
+	Name      string `json:"name" yaml:"name"`
+	MinPoints int    `json:"minPoints" yaml:"min_points"`
+}
+
+var cfg = defaultConfig()
+
+// defaultConfig returns the settings the server used before it was configurable
+func defaultConfig() Config {
+	return Config{
+		DatabaseDriver:     "sqlite",
+		DatabaseDSN:        "./users.db",
+		AutoMigrate:        true,
+		ListenAddr:         ":3000",
+		CORSAllowedOrigins: []string{"*"},
+		DefaultPageSize:    20,
+		MaxPageSize:        200,
+		JSONPretty:         true,
+		PendingHoldTTL:     15 * time.Minute,
+		HoldExpiryInterval: time.Minute,
+		AuthRequired:       true,
+		Tiers: []TierConfig{
+			{Name: "Bronze", MinPoints: 0},
+			{Name: "Silver", MinPoints: 5000},
+			{Name: "Gold", MinPoints: 20000},
+			{Name: "Platinum", MinPoints: 50000},
+		},
+		TierWindow:          365 * 24 * time.Hour,
+		TierEvaluationTime:  "02:00",
+		WebhookInterval:     10 * time.Second,
+		PointExpiryMonths:   24,
+		PointExpiryInterval: time.Hour,
+
+		ReferrerPoints:         500,
+		RefereePoints:          250,
+		ReferralMinEarn:        1,
+		ReferralMaxPerReferrer: 20,
+
+		ScheduledTransferInterval: time.Minute,
+	}
+}
+
+// loadConfig builds the Config from defaults, the optional config file and
+// the environment, and validates the result
+func loadConfig() (Config, error) {
+	c := defaultConfig()
+
+	if path := os.Getenv("LBK_CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return c, fmt.Errorf("read config file: %w", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&c); err != nil {
+			return c, fmt.Errorf("parse config file %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(&c); err != nil {
+		return c, err
+	}
+
+	if err := c.validate(); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// applyEnv overrides c with any LBK_* environment variables that are set
+func applyEnv(c *Config) error {
+	if v, ok := os.LookupEnv("LBK_DB_DRIVER"); ok {
+		c.DatabaseDriver = v
+	}
+	if v, ok := os.LookupEnv("LBK_DB_DSN"); ok {
+		c.DatabaseDSN = v
+	}
+	if v, ok := os.LookupEnv("LBK_LISTEN_ADDR"); ok {
+		c.ListenAddr = v
+	}
+	if v, ok := os.LookupEnv("LBK_JWT_SECRET"); ok {
+		c.JWTSecret = v
+	}
+	if v, ok := os.LookupEnv("LBK_JWT_ISSUER"); ok {
+		c.JWTIssuer = v
+	}
+	if v, ok := os.LookupEnv("LBK_TIER_EVALUATION_TIME"); ok {
+		c.TierEvaluationTime = v
+	}
+	if v, ok := os.LookupEnv("LBK_WEBHOOK_URL"); ok {
+		c.WebhookURL = v
+	}
+	if v, ok := os.LookupEnv("LBK_WEBHOOK_SECRET"); ok {
+		c.WebhookSecret = v
+	}
+	if v, ok := os.LookupEnv("LBK_CORS_ALLOWED_ORIGINS"); ok {
+		c.CORSAllowedOrigins = nil
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				c.CORSAllowedOrigins = append(c.CORSAllowedOrigins, origin)
+			}
+		}
+	}
+
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"LBK_DEFAULT_PAGE_SIZE", &c.DefaultPageSize},
+		{"LBK_MAX_PAGE_SIZE", &c.MaxPageSize},
+		{"LBK_POINT_EXPIRY_MONTHS", &c.PointExpiryMonths},
+		{"LBK_REFERRAL_REFERRER_POINTS", &c.ReferrerPoints},
+		{"LBK_REFERRAL_REFEREE_POINTS", &c.RefereePoints},
+		{"LBK_REFERRAL_MIN_EARN", &c.ReferralMinEarn},
+		{"LBK_REFERRAL_MAX_PER_REFERRER", &c.ReferralMaxPerReferrer},
+	}
+	for _, e := range ints {
+		if v, ok := os.LookupEnv(e.name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s must be an integer: %w", e.name, err)
+			}
+			*e.dst = n
+		}
+	}
+
+	durations := []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"LBK_PENDING_HOLD_TTL", &c.PendingHoldTTL},
+		{"LBK_HOLD_EXPIRY_INTERVAL", &c.HoldExpiryInterval},
+		{"LBK_TIER_WINDOW", &c.TierWindow},
+		{"LBK_WEBHOOK_INTERVAL", &c.WebhookInterval},
+		{"LBK_POINT_EXPIRY_INTERVAL", &c.PointExpiryInterval},
+		{"LBK_SCHEDULED_TRANSFER_INTERVAL", &c.ScheduledTransferInterval},
+	}
+	for _, e := range durations {
+		if v, ok := os.LookupEnv(e.name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s must be a duration such as 15m: %w", e.name, err)
+			}
+			*e.dst = d
+		}
+	}
+
+	bools := []struct {
+		name string
+		dst  *bool
+	}{
+		{"LBK_AUTO_MIGRATE", &c.AutoMigrate},
+		{"LBK_JSON_PRETTY", &c.JSONPretty},
+		{"LBK_AUTH_REQUIRED", &c.AuthRequired},
+	}
+	for _, e := range bools {
+		if v, ok := os.LookupEnv(e.name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%s must be true or false: %w", e.name, err)
+			}
+			*e.dst = b
+		}
+	}
+
+	return nil
+}
+
+// validate rejects settings the server cannot start with
+func (c Config) validate() error {
+	var problems []string
+
+	switch c.DatabaseDriver {
+	case "sqlite", "postgres":
+		if c.DatabaseDSN == "" {
+			problems = append(problems, "database_dsn is required")
+		}
+	case "memory":
+	default:
+		problems = append(problems, fmt.Sprintf("database_driver %q must be sqlite, postgres or memory", c.DatabaseDriver))
+	}
+	if c.ListenAddr == "" {
+		problems = append(problems, "listen_addr is required")
+	}
+	if len(c.CORSAllowedOrigins) == 0 {
+		problems = append(problems, "cors_allowed_origins must list at least one origin (use * to allow all)")
+	}
+	for _, origin := range c.CORSAllowedOrigins {
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			problems = append(problems, fmt.Sprintf("cors origin %q must start with http:// or https://", origin))
+		}
+	}
+	if c.MaxPageSize < 1 || c.MaxPageSize > 1000 {
+		problems = append(problems, "max_page_size must be between 1 and 1000")
+	}
+	if c.DefaultPageSize < 1 || c.DefaultPageSize > c.MaxPageSize {
+		problems = append(problems, "default_page_size must be between 1 and max_page_size")
+	}
+	if c.PendingHoldTTL <= 0 {
+		problems = append(problems, "pending_hold_ttl must be positive")
+	}
+	if c.HoldExpiryInterval <= 0 {
+		problems = append(problems, "hold_expiry_interval must be positive")
+	}
+	if c.PointExpiryMonths < 0 {
+		problems = append(problems, "point_expiry_months must be 0 (never expire) or positive")
+	}
+	if c.PointExpiryInterval <= 0 {
+		problems = append(problems, "point_expiry_interval must be positive")
+	}
+	if c.ScheduledTransferInterval <= 0 {
+		problems = append(problems, "scheduled_transfer_interval must be positive")
+	}
+	if c.ReferrerPoints < 0 || c.RefereePoints < 0 {
+		problems = append(problems, "referral_referrer_points and referral_referee_points must not be negative")
+	}
+	if c.ReferralMinEarn < 1 {
+		problems = append(problems, "referral_min_earn must be positive")
+	}
+	if c.ReferralMaxPerReferrer < 0 {
+		problems = append(problems, "referral_max_per_referrer must be 0 (no cap) or positive")
+	}
+	if c.JWTSecret != "" && len(c.JWTSecret) < 32 {
+		problems = append(problems, "jwt_secret must be at least 32 characters")
+	}
+	if len(c.Tiers) == 0 {
+		problems = append(problems, "tiers must list at least one tier")
+	} else if c.Tiers[0].MinPoints != 0 {
+		problems = append(problems, "the first tier must have min_points 0")
+	}
+	for i, tier := range c.Tiers {
+		if tier.Name == "" {
+			problems = append(problems, "every tier needs a name")
+		}
+		if i > 0 && tier.MinPoints <= c.Tiers[i-1].MinPoints {
+			problems = append(problems, fmt.Sprintf("tier %q must need more points than %q", tier.Name, c.Tiers[i-1].Name))
+		}
+		for _, other := range c.Tiers[:i] {
+			if other.Name == tier.Name {
+				problems = append(problems, fmt.Sprintf("tier %q is listed twice", tier.Name))
+			}
+		}
+	}
+	if c.TierWindow <= 0 {
+		problems = append(problems, "tier_window must be positive")
+	}
+	if _, err := time.Parse("15:04", c.TierEvaluationTime); err != nil {
+		problems = append(problems, "tier_evaluation_time must be a time of day such as 02:00")
+	}
+	if c.WebhookURL != "" && !strings.HasPrefix(c.WebhookURL, "http://") && !strings.HasPrefix(c.WebhookURL, "https://") {
+		problems = append(problems, "webhook_url must start with http:// or https://")
+	}
+	if c.WebhookURL != "" && c.WebhookSecret == "" {
+		problems = append(problems, "webhook_secret is required when webhook_url is set")
+	}
+	if c.WebhookInterval <= 0 {
+		problems = append(problems, "webhook_interval must be positive")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
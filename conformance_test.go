@@ -0,0 +1,2040 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// conformanceCheck is one behaviour every Store implementation must share.
+// run receives a suffix unique to this run, so checks can create their own
+// members in a database that already holds data.
+type conformanceCheck struct {
+	name string
+	run  func(s Store, run string) error
+}
+
+// conformanceChecks is the suite TestStoreConformance runs against each
+// backend
+var conformanceChecks = []conformanceCheck{
+	{"users: create, get, update and delete", checkUserLifecycle},
+	{"users: filter, search, sort and keyset pages", checkUserListing},
+	{"transfers: create, lookup, keyset pages and compare-and-set", checkTransferStore},
+	{"transfers: filters and sort by amount", checkTransferFilters},
+	{"ledger: append, filtered listing and keyset pages", checkLedgerStore},
+	{"api keys: create, lookup, revoke and delete with user", checkAPIKeyStore},
+	{"tiers: earned points, evaluation, baselines and history", checkTierEngine},
+	{"webhooks: enqueue, due events and retries", checkWebhookStore},
+	{"transfer limits: per-level caps and sent totals", checkTransferLimitStore},
+	{"point lots: FIFO debits and expiry", checkPointLots},
+	{"point lots: transfers, reversals and refunds keep earned dates", checkTransferredLots},
+	{"rewards: stock, eligibility and order lifecycle", checkRewards},
+	{"campaigns: bonus rules, targeting, budget caps and reversals", checkCampaigns},
+	{"referrals: codes, abuse checks and first-earn bonuses", checkReferrals},
+	{"partner purchases: earn rates, receipts and replays", checkPartnerPurchases},
+	{"user import: dry runs, upserts and per-row failures", checkUserImport},
+	{"transfer batches: all or nothing, replays and best effort", checkTransferBatches},
+	{"scheduled transfers: runs, recorded failures and pause/resume/cancel", checkScheduledTransfers},
+	{"transactions: rollback and nested join", checkTransactions},
+	{"points: transfer, replay, hold and reversal", checkTransferFlow},
+	{"points: concurrent transfers keep balances consistent", checkConcurrentTransfers},
+}
+
+// TestStoreConformance runs every check against the memory store, a scratch
+// SQLite database, and Postgres when LBK_TEST_POSTGRES_DSN is set
+func TestStoreConformance(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		runConformance(t, newMemoryStore())
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		initDatabase("sqlite", filepath.Join(t.TempDir(), "conformance.db"), true)
+		defer db.Close()
+		runConformance(t, newSQLStore(db, dbDialect))
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv("LBK_TEST_POSTGRES_DSN")
+		if dsn == "" {
+			t.Skip("set LBK_TEST_POSTGRES_DSN to run against Postgres")
+		}
+		initDatabase("postgres", dsn, true)
+		defer db.Close()
+		runConformance(t, newSQLStore(db, dbDialect))
+	})
+}
+
+// runConformance runs every check against s as a subtest
+func runConformance(t *testing.T, s Store) {
+	run := fmt.Sprintf("%d", time.Now().UnixNano())
+	for _, check := range conformanceChecks {
+		t.Run(check.name, func(t *testing.T) {
+			if err := check.run(s, run); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// conformanceUser creates a member named after the run with an opening balance
+func conformanceUser(s Store, run, name string, balance int) (User, error) {
+	user := User{
+		MemberID:        "conf-" + run + "-" + name,
+		FirstName:       name,
+		LastName:        "Conformance",
+		Email:           "conf-" + run + "-" + name + "@example.com",
+		RegisterDate:    "2024-01-01",
+		MembershipLevel: lowestTier(),
+		PointBalance:    balance,
+	}
+	if err := createMember(s, &user); err != nil {
+		return User{}, fmt.Errorf("create %s: %w", name, err)
+	}
+	return user, nil
+}
+
+// expectErr checks that err is want
+func expectErr(what string, err, want error) error {
+	if !errors.Is(err, want) {
+		return fmt.Errorf("%s: got error %v, want %v", what, err, want)
+	}
+	return nil
+}
+
+// expectBalance checks a user's balance and held amount
+func expectBalance(s Store, userID, wantBalance, wantHeld int) error {
+	balance, held, err := s.Users().Balances(userID)
+	if err != nil {
+		return err
+	}
+	if balance != wantBalance || held != wantHeld {
+		return fmt.Errorf("user %d: balance %d held %d, want %d held %d", userID, balance, held, wantBalance, wantHeld)
+	}
+	return nil
+}
+
+func checkUserLifecycle(s Store, run string) error {
+	user, err := conformanceUser(s, run, "alice", 50)
+	if err != nil {
+		return err
+	}
+	if user.ID == 0 || user.CreatedAt == "" || user.PointBalance != 50 {
+		return fmt.Errorf("created user not filled in: %+v", user)
+	}
+
+	got, err := s.Users().Get(user.ID)
+	if err != nil {
+		return err
+	}
+	if got != user {
+		return fmt.Errorf("get returned %+v, want %+v", got, user)
+	}
+
+	duplicate := User{MemberID: user.MemberID, FirstName: "Dup", LastName: "Dup", RegisterDate: "2024-01-01", MembershipLevel: "Bronze"}
+	if err := expectErr("duplicate member_id", s.Users().Create(&duplicate), errDuplicateUser); err != nil {
+		return err
+	}
+
+	firstName, email := "Alicia", ""
+	if err := s.Users().Update(user.ID, UserPatch{FirstName: &firstName, Email: &email}); err != nil {
+		return err
+	}
+	got, err = s.Users().Get(user.ID)
+	if err != nil {
+		return err
+	}
+	if got.FirstName != "Alicia" || got.Email != "" || got.LastName != user.LastName {
+		return fmt.Errorf("update not applied as a patch: %+v", got)
+	}
+
+	if err := expectErr("update missing user", s.Users().Update(-1, UserPatch{FirstName: &firstName}), errUserNotFound); err != nil {
+		return err
+	}
+	if _, err := s.Users().Get(-1); err != errUserNotFound {
+		return expectErr("get missing user", err, errUserNotFound)
+	}
+
+	// A member without history can be deleted
+	fresh := User{MemberID: "conf-" + run + "-fresh", FirstName: "Fresh", LastName: "Member", RegisterDate: "2024-01-01", MembershipLevel: "Bronze"}
+	if err := s.Users().Create(&fresh); err != nil {
+		return err
+	}
+	if err := s.Users().Delete(fresh.ID); err != nil {
+		return err
+	}
+	if _, err := s.Users().Get(fresh.ID); err != errUserNotFound {
+		return expectErr("get deleted user", err, errUserNotFound)
+	}
+	return expectErr("delete missing user", s.Users().Delete(fresh.ID), errUserNotFound)
+}
+
+func checkUserListing(s Store, run string) error {
+	var created []User
+	for i, balance := range []int{300, 100, 200} {
+		user, err := conformanceUser(s, run, fmt.Sprintf("list%d", i), balance)
+		if err != nil {
+			return err
+		}
+		created = append(created, user)
+	}
+
+	// Every member of this run has the run in their email
+	query := UserQuery{Search: strings.ToUpper("conf-" + run + "-list"), Sort: "point_balance", Limit: 2}
+	users, total, err := s.Users().List(query)
+	if err != nil {
+		return err
+	}
+	if total != 3 || len(users) != 2 || users[0].ID != created[1].ID || users[1].ID != created[2].ID {
+		return fmt.Errorf("first page: total %d, users %+v", total, users)
+	}
+
+	query.After = &Keyset{Value: userSortValue(users[1], "point_balance"), ID: users[1].ID}
+	users, _, err = s.Users().List(query)
+	if err != nil {
+		return err
+	}
+	if len(users) != 1 || users[0].ID != created[0].ID {
+		return fmt.Errorf("page after cursor: %+v", users)
+	}
+
+	query = UserQuery{Search: "conf-" + run + "-list", Sort: "id", Limit: 10, SkipCount: true}
+	users, total, err = s.Users().List(query)
+	if err != nil {
+		return err
+	}
+	if total != 0 || len(users) != 3 {
+		return fmt.Errorf("skipCount: total %d, users %+v", total, users)
+	}
+
+	minBalance := 150
+	query = UserQuery{Search: "conf-" + run + "-list", MinBalance: &minBalance, Sort: "id", Desc: true, Limit: 10}
+	users, total, err = s.Users().List(query)
+	if err != nil {
+		return err
+	}
+	if total != 2 || len(users) != 2 || users[0].ID != created[2].ID {
+		return fmt.Errorf("minBalance filter: total %d, users %+v", total, users)
+	}
+
+	// LIKE wildcards in the search term match literally
+	_, total, err = s.Users().List(UserQuery{Search: "conf-" + run + "%", Limit: 10})
+	if err != nil {
+		return err
+	}
+	if total != 0 {
+		return fmt.Errorf("search for a literal %% matched %d users", total)
+	}
+	return nil
+}
+
+func checkTransferStore(s Store, run string) error {
+	from, err := conformanceUser(s, run, "ts-from", 0)
+	if err != nil {
+		return err
+	}
+	to, err := conformanceUser(s, run, "ts-to", 0)
+	if err != nil {
+		return err
+	}
+
+	note := "conformance"
+	past := timestamp(time.Now().Add(-time.Hour))
+	older := Transfer{
+		IdemKey: "conf-" + run + "-older", FromUserID: from.ID, ToUserID: to.ID, Amount: 5,
+		Status: "pending", Note: &note, CreatedAt: past, UpdatedAt: past, ExpiresAt: &past,
+	}
+	if err := s.Transfers().Create(&older); err != nil {
+		return err
+	}
+	if older.TransferID == 0 {
+		return fmt.Errorf("create did not set TransferID")
+	}
+
+	again := older
+	if err := expectErr("reused idempotency key", s.Transfers().Create(&again), errIdemKeyConflict); err != nil {
+		return err
+	}
+
+	got, err := s.Transfers().GetByIdemKey(older.IdemKey)
+	if err != nil {
+		return err
+	}
+	if got.TransferID != older.TransferID || got.Note == nil || *got.Note != note ||
+		got.ExpiresAt == nil || *got.ExpiresAt != past || got.CompletedAt != nil {
+		return fmt.Errorf("get returned %+v", got)
+	}
+	if _, err := s.Transfers().GetByIdemKey("conf-" + run + "-missing"); err != errTransferNotFound {
+		return expectErr("get missing transfer", err, errTransferNotFound)
+	}
+
+	now := timestamp(time.Now())
+	newer := Transfer{
+		IdemKey: "conf-" + run + "-newer", FromUserID: to.ID, ToUserID: from.ID, Amount: 7,
+		Status: "completed", CreatedAt: now, UpdatedAt: now, CompletedAt: &now,
+	}
+	if err := s.Transfers().Create(&newer); err != nil {
+		return err
+	}
+
+	filter := TransferFilter{UserID: from.ID}
+	page, err := s.Transfers().List(filter, ListPage{Limit: 1})
+	if err != nil {
+		return err
+	}
+	total, err := s.Transfers().Count(filter)
+	if err != nil {
+		return err
+	}
+	if total != 2 || len(page) != 1 || page[0].IdemKey != newer.IdemKey {
+		return fmt.Errorf("list by user: total %d, page %+v; want newest of 2", total, page)
+	}
+
+	// Keyset pages continue after the newest and lead back before the oldest
+	after := transferKeyset(page[0], "created_at")
+	page, err = s.Transfers().List(filter, ListPage{After: &after, Limit: 10})
+	if err != nil {
+		return err
+	}
+	if len(page) != 1 || page[0].IdemKey != older.IdemKey {
+		return fmt.Errorf("page after newest: %+v", page)
+	}
+	before := transferKeyset(page[0], "created_at")
+	page, err = s.Transfers().List(filter, ListPage{Before: &before, Limit: 10})
+	if err != nil {
+		return err
+	}
+	if len(page) != 1 || page[0].IdemKey != newer.IdemKey {
+		return fmt.Errorf("page before oldest: %+v", page)
+	}
+
+	expired, err := s.Transfers().ListExpiredPending(now)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, t := range expired {
+		found = found || t.IdemKey == older.IdemKey
+	}
+	if !found {
+		return fmt.Errorf("expired pending transfer not listed")
+	}
+
+	reason := "Cancelled by conformance"
+	older.Status = "cancelled"
+	older.UpdatedAt = now
+	older.FailReason = &reason
+	if err := s.Transfers().Update(older, "pending"); err != nil {
+		return err
+	}
+	if err := expectErr("stale update", s.Transfers().Update(older, "pending"), errTransferStatusChanged); err != nil {
+		return err
+	}
+	got, err = s.Transfers().GetByIdemKey(older.IdemKey)
+	if err != nil {
+		return err
+	}
+	if got.Status != "cancelled" || got.FailReason == nil || *got.FailReason != reason {
+		return fmt.Errorf("update not saved: %+v", got)
+	}
+	return nil
+}
+
+func checkTransferFilters(s Store, run string) error {
+	var users []User
+	for _, name := range []string{"tf-a", "tf-b", "tf-c"} {
+		user, err := conformanceUser(s, run, name, 0)
+		if err != nil {
+			return err
+		}
+		users = append(users, user)
+	}
+	a, b, c := users[0].ID, users[1].ID, users[2].ID
+
+	now := timestamp(time.Now())
+	for i, leg := range []struct {
+		from, to, amount int
+		status, note     string
+	}{
+		{a, b, 30, "completed", "Rent share"},
+		{b, a, 10, "failed", ""},
+		{a, c, 20, "completed", "rent DEPOSIT"},
+		{c, a, 50, "pending", "Dinner"},
+	} {
+		t := Transfer{
+			IdemKey: fmt.Sprintf("conf-%s-tf%d", run, i), FromUserID: leg.from, ToUserID: leg.to,
+			Amount: leg.amount, Status: leg.status, CreatedAt: now, UpdatedAt: now,
+		}
+		if leg.note != "" {
+			note := leg.note
+			t.Note = &note
+		}
+		if leg.status == "completed" {
+			t.CompletedAt = &now
+		}
+		if err := s.Transfers().Create(&t); err != nil {
+			return err
+		}
+	}
+
+	amounts := func(filter TransferFilter, page ListPage) ([]int, error) {
+		page.Limit = 10
+		transfers, err := s.Transfers().List(filter, page)
+		if err != nil {
+			return nil, err
+		}
+		count, err := s.Transfers().Count(filter)
+		if err != nil {
+			return nil, err
+		}
+		if page.After == nil && count != len(transfers) {
+			return nil, fmt.Errorf("filter %+v: count %d but listed %d", filter, count, len(transfers))
+		}
+		var result []int
+		for _, t := range transfers {
+			result = append(result, t.Amount)
+		}
+		return result, nil
+	}
+
+	minAmount := 15
+	for _, tc := range []struct {
+		name   string
+		filter TransferFilter
+		page   ListPage
+		want   []int
+	}{
+		{"sent by amount", TransferFilter{UserID: a, Direction: "sent"}, ListPage{Sort: "amount"}, []int{30, 20}},
+		{"received", TransferFilter{UserID: a, Direction: "received"}, ListPage{Sort: "amount", Asc: true}, []int{10, 50}},
+		{"counterparty", TransferFilter{UserID: a, CounterpartyID: b}, ListPage{Sort: "amount"}, []int{30, 10}},
+		{"statuses", TransferFilter{UserID: a, Statuses: []string{"failed", "pending"}}, ListPage{Sort: "amount"}, []int{50, 10}},
+		{"amount range and note", TransferFilter{UserID: a, MinAmount: &minAmount, Note: "rent"}, ListPage{Sort: "amount", Asc: true}, []int{20, 30}},
+		{"completed range", TransferFilter{UserID: a, CompletedFrom: now, CompletedTo: now}, ListPage{Sort: "amount"}, []int{30, 20}},
+		{"created before", TransferFilter{UserID: a, CreatedTo: "2000-01-01T00:00:00Z"}, ListPage{}, nil},
+	} {
+		got, err := amounts(tc.filter, tc.page)
+		if err != nil {
+			return err
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			return fmt.Errorf("%s: got amounts %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// Amount keysets compare as numbers, not text ("50" > "100" as text)
+	after := Keyset{Value: "25", ID: 0}
+	got, err := amounts(TransferFilter{UserID: a}, ListPage{Sort: "amount", Asc: true, After: &after})
+	if err != nil {
+		return err
+	}
+	if fmt.Sprint(got) != fmt.Sprint([]int{30, 50}) {
+		return fmt.Errorf("amounts after 25: got %v", got)
+	}
+	return nil
+}
+
+func checkLedgerStore(s Store, run string) error {
+	user, err := conformanceUser(s, run, "ledger", 100)
+	if err != nil {
+		return err
+	}
+
+	earned, err := changeBalance(s, pointChange{UserID: user.ID, Change: 25, EventType: "earn", Reference: "Conformance", Metadata: `{"run":"` + run + `"}`})
+	if err != nil {
+		return err
+	}
+	if earned.ID == 0 || earned.BalanceAfter != 125 {
+		return fmt.Errorf("earn entry %+v", earned)
+	}
+
+	entries, err := s.Ledger().List(LedgerFilter{UserID: user.ID}, ListPage{Limit: 10})
+	if err != nil {
+		return err
+	}
+	total, err := s.Ledger().Count(LedgerFilter{UserID: user.ID})
+	if err != nil {
+		return err
+	}
+	if total != 2 || len(entries) != 2 || entries[0].ID != earned.ID || entries[1].EventType != "adjust" {
+		return fmt.Errorf("list by user: total %d, entries %+v", total, entries)
+	}
+	if entries[0].Metadata != earned.Metadata || entries[0].Reference != "Conformance" || entries[0].TransferID != nil {
+		return fmt.Errorf("entry not stored as written: %+v", entries[0])
+	}
+
+	// Both entries may share a created_at second; the id breaks the tie
+	// consistently in both directions
+	after := ledgerKeyset(entries[0])
+	page, err := s.Ledger().List(LedgerFilter{UserID: user.ID}, ListPage{After: &after, Limit: 10})
+	if err != nil {
+		return err
+	}
+	if len(page) != 1 || page[0].ID != entries[1].ID {
+		return fmt.Errorf("page after newest entry: %+v", page)
+	}
+	before := ledgerKeyset(entries[1])
+	page, err = s.Ledger().List(LedgerFilter{UserID: user.ID}, ListPage{Before: &before, Limit: 10})
+	if err != nil {
+		return err
+	}
+	if len(page) != 1 || page[0].ID != earned.ID {
+		return fmt.Errorf("page before oldest entry: %+v", page)
+	}
+
+	total, err = s.Ledger().Count(LedgerFilter{UserID: user.ID, EventType: "earn"})
+	if err != nil {
+		return err
+	}
+	if total != 1 {
+		return fmt.Errorf("event type filter matched %d entries, want 1", total)
+	}
+
+	total, err = s.Ledger().Count(LedgerFilter{UserID: user.ID, To: "2000-01-01T00:00:00Z"})
+	if err != nil {
+		return err
+	}
+	if total != 0 {
+		return fmt.Errorf("date filter matched %d entries, want 0", total)
+	}
+	return expectBalance(s, user.ID, 125, 0)
+}
+
+func checkAPIKeyStore(s Store, run string) error {
+	user := User{MemberID: "conf-" + run + "-keyholder", FirstName: "Key", LastName: "Holder", RegisterDate: "2024-01-01", MembershipLevel: "Bronze"}
+	if err := s.Users().Create(&user); err != nil {
+		return err
+	}
+
+	hash := hashAPIKey("conf-" + run)
+	key := APIKey{Name: "conformance", Prefix: "lbk_conf", KeyHash: hash, Role: roleMember, UserID: &user.ID, CreatedAt: timestamp(time.Now())}
+	if err := s.APIKeys().Create(&key); err != nil {
+		return err
+	}
+
+	got, err := s.APIKeys().GetByHash(hash)
+	if err != nil {
+		return err
+	}
+	if got.ID != key.ID || got.UserID == nil || *got.UserID != user.ID || got.RevokedAt != nil {
+		return fmt.Errorf("get returned %+v", got)
+	}
+	if _, err := s.APIKeys().GetByHash(hashAPIKey("conf-" + run + "-missing")); err != errAPIKeyNotFound {
+		return expectErr("get missing key", err, errAPIKeyNotFound)
+	}
+
+	if err := s.APIKeys().Revoke(key.ID, timestamp(time.Now())); err != nil {
+		return err
+	}
+	if got, err = s.APIKeys().GetByHash(hash); err != nil || got.RevokedAt == nil {
+		return fmt.Errorf("revoked key: %+v, %v", got, err)
+	}
+	if err := expectErr("revoke missing key", s.APIKeys().Revoke(-1, timestamp(time.Now())), errAPIKeyNotFound); err != nil {
+		return err
+	}
+
+	// Partner keys carry the partner they record purchases for
+	now := timestamp(time.Now())
+	partner := Partner{Name: "conf-" + run + "-key-partner", Currency: "THB", EarnRate: 1, CreatedAt: now, UpdatedAt: now}
+	if err := s.Partners().Create(&partner); err != nil {
+		return err
+	}
+	partnerHash := hashAPIKey("conf-" + run + "-partner")
+	partnerKey := APIKey{Name: "conformance partner", Prefix: "lbk_conf", KeyHash: partnerHash, Role: rolePartner, PartnerID: &partner.ID, CreatedAt: now}
+	if err := s.APIKeys().Create(&partnerKey); err != nil {
+		return err
+	}
+	if got, err = s.APIKeys().GetByHash(partnerHash); err != nil || got.Role != rolePartner || got.PartnerID == nil || *got.PartnerID != partner.ID || got.UserID != nil {
+		return fmt.Errorf("partner key: %+v, %v", got, err)
+	}
+
+	// Deleting a member removes their keys
+	if err := s.Users().Delete(user.ID); err != nil {
+		return err
+	}
+	if _, err := s.APIKeys().GetByHash(hash); err != errAPIKeyNotFound {
+		return expectErr("key of deleted user", err, errAPIKeyNotFound)
+	}
+	return nil
+}
+
+func checkTierEngine(s Store, run string) error {
+	user, err := conformanceUser(s, run, "tier", 0)
+	if err != nil {
+		return err
+	}
+
+	// Only earn entries count towards a tier
+	top := cfg.Tiers[len(cfg.Tiers)-1]
+	for _, pc := range []pointChange{
+		{UserID: user.ID, Change: top.MinPoints, EventType: "earn"},
+		{UserID: user.ID, Change: 500, EventType: "adjust", Reference: "Conformance"},
+	} {
+		if _, err := changeBalance(s, pc); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	earned, err := s.Ledger().EarnedSince(tierWindowStart(now), user.ID)
+	if err != nil {
+		return err
+	}
+	if len(earned) != 1 || earned[user.ID] != top.MinPoints {
+		return fmt.Errorf("earned since window start: %v, want %d", earned, top.MinPoints)
+	}
+	if earned, err = s.Ledger().EarnedSince(timestamp(now.Add(time.Hour)), user.ID); err != nil || len(earned) != 0 {
+		return fmt.Errorf("earned since the future: %v, %v", earned, err)
+	}
+
+	// Upgrade to the top tier, then back down once nothing was earned
+	for _, step := range []struct {
+		earned int
+		level  string
+	}{
+		{top.MinPoints, top.Name},
+		{top.MinPoints, top.Name},
+		{0, lowestTier()},
+	} {
+		before, err := s.Users().Get(user.ID)
+		if err != nil {
+			return err
+		}
+		changed, err := evaluateMemberTier(s, user.ID, step.earned, now)
+		if err != nil {
+			return err
+		}
+		after, err := s.Users().Get(user.ID)
+		if err != nil {
+			return err
+		}
+		if after.MembershipLevel != step.level || changed != (before.MembershipLevel != step.level) {
+			return fmt.Errorf("evaluate with %d earned: level %s, changed %v", step.earned, after.MembershipLevel, changed)
+		}
+	}
+
+	history, err := s.Tiers().ListByUser(user.ID)
+	if err != nil {
+		return err
+	}
+	if len(history) != 2 || history[0].ToLevel != lowestTier() || history[1].ToLevel != top.Name ||
+		history[1].FromLevel != lowestTier() || history[1].PointsEarned != top.MinPoints || history[1].Reason != "evaluation" {
+		return fmt.Errorf("tier history %+v", history)
+	}
+
+	// Tier changes are ledgered without moving the balance
+	entries, err := s.Ledger().List(LedgerFilter{UserID: user.ID, EventType: "tier_change"}, ListPage{Limit: 10})
+	if err != nil {
+		return err
+	}
+	if len(entries) != 2 || entries[0].Change != 0 || entries[0].BalanceAfter != top.MinPoints+500 {
+		return fmt.Errorf("tier_change entries %+v", entries)
+	}
+	if err := expectBalance(s, user.ID, top.MinPoints+500, 0); err != nil {
+		return err
+	}
+
+	// A member who joins at a tier keeps it for a full window without earning
+	joined := User{
+		MemberID:        "conf-" + run + "-tier-baseline",
+		FirstName:       "Baseline",
+		LastName:        "Conformance",
+		RegisterDate:    "2024-01-01",
+		MembershipLevel: top.Name,
+	}
+	if err := createMember(s, &joined); err != nil {
+		return err
+	}
+	for _, step := range []struct {
+		at    time.Time
+		level string
+	}{
+		{now, top.Name},
+		{now.Add(cfg.TierWindow - time.Hour), top.Name},
+		{now.Add(cfg.TierWindow + time.Hour), lowestTier()},
+	} {
+		if _, err := evaluateMemberTier(s, joined.ID, 0, step.at); err != nil {
+			return err
+		}
+		after, err := s.Users().Get(joined.ID)
+		if err != nil {
+			return err
+		}
+		if after.MembershipLevel != step.level {
+			return fmt.Errorf("baseline member evaluated at %v: level %s, want %s", step.at, after.MembershipLevel, step.level)
+		}
+	}
+	history, err = s.Tiers().ListByUser(joined.ID)
+	if err != nil {
+		return err
+	}
+	if len(history) != 2 || history[1].Reason != "baseline" || history[0].Reason != "evaluation" {
+		return fmt.Errorf("baseline member tier history %+v", history)
+	}
+	return nil
+}
+
+func checkWebhookStore(s Store, run string) error {
+	now := time.Now()
+	event := WebhookEvent{EventType: "conformance." + run, Payload: `{"run":"` + run + `"}`, NextAttemptAt: timestamp(now), CreatedAt: timestamp(now)}
+	if err := s.Webhooks().Enqueue(&event); err != nil {
+		return err
+	}
+	if event.ID == 0 {
+		return fmt.Errorf("enqueue did not set the event id")
+	}
+
+	// due reports whether the event is due at t, and returns it if so
+	due := func(t time.Time) (WebhookEvent, bool, error) {
+		events, err := s.Webhooks().ListDue(timestamp(t), 1000)
+		if err != nil {
+			return WebhookEvent{}, false, err
+		}
+		for _, e := range events {
+			if e.ID == event.ID {
+				return e, true, nil
+			}
+		}
+		return WebhookEvent{}, false, nil
+	}
+
+	got, ok, err := due(now)
+	if err != nil {
+		return err
+	}
+	if !ok || got.Payload != event.Payload || got.EventType != event.EventType || got.Attempts != 0 {
+		return fmt.Errorf("due event %+v, found %v", got, ok)
+	}
+
+	retryAt := now.Add(time.Hour)
+	if err := s.Webhooks().MarkFailed(event.ID, "HTTP 500", timestamp(retryAt)); err != nil {
+		return err
+	}
+	if _, ok, err := due(now); err != nil || ok {
+		return fmt.Errorf("failed event due before its retry: %v, %v", ok, err)
+	}
+	if got, ok, err = due(retryAt); err != nil || !ok || got.Attempts != 1 || got.LastError != "HTTP 500" {
+		return fmt.Errorf("failed event at its retry: %+v, %v, %v", got, ok, err)
+	}
+
+	if err := s.Webhooks().MarkDelivered(event.ID, timestamp(retryAt)); err != nil {
+		return err
+	}
+	if _, ok, err := due(retryAt.Add(time.Hour)); err != nil || ok {
+		return fmt.Errorf("delivered event still due: %v, %v", ok, err)
+	}
+	return nil
+}
+
+func checkTransferLimitStore(s Store, run string) error {
+	sender, err := conformanceUser(s, run, "limited", 1000)
+	if err != nil {
+		return err
+	}
+	recipient, err := conformanceUser(s, run, "unlimited", 0)
+	if err != nil {
+		return err
+	}
+
+	// A level of its own keeps the limits away from real members
+	level := "conf-" + run
+	if err := s.Users().Update(sender.ID, UserPatch{MembershipLevel: &level}); err != nil {
+		return err
+	}
+	perTransfer, daily := 300, 500
+	limit := TransferLimit{MembershipLevel: level, PerTransferMax: &perTransfer, DailyMax: &daily, UpdatedAt: timestamp(time.Now())}
+	if err := s.TransferLimits().Set(limit); err != nil {
+		return err
+	}
+	defer s.TransferLimits().Delete(level)
+
+	got, err := s.TransferLimits().Get(level)
+	if err != nil {
+		return err
+	}
+	if got.PerTransferMax == nil || *got.PerTransferMax != 300 || got.DailyMax == nil || *got.DailyMax != 500 || got.MonthlyMax != nil {
+		return fmt.Errorf("get returned %+v", got)
+	}
+
+	var limitErr *transferLimitError
+	send := func(amount int, hold bool) error {
+		_, _, err := executeTransfer(s, TransferCreateRequest{FromUserID: sender.ID, ToUserID: recipient.ID, Amount: amount, Hold: hold}, "")
+		return err
+	}
+	if err := send(301, false); !errors.As(err, &limitErr) || limitErr.period != "per-transfer" {
+		return fmt.Errorf("transfer over the per-transfer cap: %v", err)
+	}
+	// Pending holds count towards the daily total
+	if err := send(300, true); err != nil {
+		return err
+	}
+	if err := send(200, false); err != nil {
+		return err
+	}
+	if err := send(1, false); !errors.As(err, &limitErr) || limitErr.period != "per day" || limitErr.remaining != 0 {
+		return fmt.Errorf("transfer over the daily cap: %v", err)
+	}
+
+	sent, err := s.Transfers().SumSent(sender.ID, timestamp(time.Now().Add(-time.Hour)))
+	if err != nil {
+		return err
+	}
+	if sent != 500 {
+		return fmt.Errorf("sum sent %d, want 500", sent)
+	}
+	if sent, err = s.Transfers().SumSent(recipient.ID, timestamp(time.Now().Add(-time.Hour))); err != nil || sent != 0 {
+		return fmt.Errorf("recipient sum sent %d, %v", sent, err)
+	}
+
+	// Raising the cap takes effect on the next transfer
+	monthly := 600
+	limit.DailyMax, limit.MonthlyMax = nil, &monthly
+	if err := s.TransferLimits().Set(limit); err != nil {
+		return err
+	}
+	if err := send(100, false); err != nil {
+		return err
+	}
+	if err := send(1, false); !errors.As(err, &limitErr) || limitErr.period != "per month" {
+		return fmt.Errorf("transfer over the monthly cap: %v", err)
+	}
+
+	limits, err := s.TransferLimits().List()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, l := range limits {
+		found = found || l.MembershipLevel == level
+	}
+	if !found {
+		return fmt.Errorf("list does not include %s", level)
+	}
+	if err := s.TransferLimits().Delete(level); err != nil {
+		return err
+	}
+	if err := expectErr("delete missing limit", s.TransferLimits().Delete(level), errTransferLimitNotFound); err != nil {
+		return err
+	}
+	if err := send(301, false); err != nil {
+		return fmt.Errorf("transfer without limits: %w", err)
+	}
+	return expectBalance(s, sender.ID, 399, 300)
+}
+
+func checkPointLots(s Store, run string) error {
+	user, err := conformanceUser(s, run, "lots", 100)
+	if err != nil {
+		return err
+	}
+	friend, err := conformanceUser(s, run, "lots-friend", 0)
+	if err != nil {
+		return err
+	}
+
+	// remaining checks the amounts left in the user's open lots, oldest first
+	remaining := func(userID int, want ...int) error {
+		lots, err := s.Lots().ListOpen(userID)
+		if err != nil {
+			return err
+		}
+		got := make([]int, len(lots))
+		for i, lot := range lots {
+			got[i] = lot.Remaining
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			return fmt.Errorf("user %d open lots %v, want %v", userID, got, want)
+		}
+		return nil
+	}
+
+	// The opening balance is used up before the later earn
+	earned, err := changeBalance(s, pointChange{UserID: user.ID, Change: 50, EventType: "earn"})
+	if err != nil {
+		return err
+	}
+	if _, err := changeBalance(s, pointChange{UserID: user.ID, Change: -120, EventType: "redeem"}); err != nil {
+		return err
+	}
+	if err := remaining(user.ID, 30); err != nil {
+		return err
+	}
+	lots, err := s.Lots().ListOpen(user.ID)
+	if err != nil {
+		return err
+	}
+	if lots[0].EntryID != earned.ID || lots[0].Amount != 50 {
+		return fmt.Errorf("lot %+v does not match earn entry %d", lots[0], earned.ID)
+	}
+
+	if _, _, err := executeTransfer(s, TransferCreateRequest{FromUserID: user.ID, ToUserID: friend.ID, Amount: 10}, ""); err != nil {
+		return err
+	}
+	if err := remaining(user.ID, 20); err != nil {
+		return err
+	}
+	if err := remaining(friend.ID, 10); err != nil {
+		return err
+	}
+
+	if cfg.PointExpiryMonths == 0 {
+		return nil
+	}
+	later := time.Now().AddDate(0, cfg.PointExpiryMonths, 1)
+	expired, err := expireUserPoints(s, user.ID, later)
+	if err != nil {
+		return err
+	}
+	if expired != 20 {
+		return fmt.Errorf("expired %d points, want 20", expired)
+	}
+	if err := remaining(user.ID); err != nil {
+		return err
+	}
+	entries, err := s.Ledger().List(LedgerFilter{UserID: user.ID, EventType: "expire"}, ListPage{Limit: 10})
+	if err != nil {
+		return err
+	}
+	if len(entries) != 1 || entries[0].Change != -20 || entries[0].BalanceAfter != 0 {
+		return fmt.Errorf("expire entries %+v", entries)
+	}
+
+	// Points held by a pending transfer do not expire while it is pending
+	if _, _, err := executeTransfer(s, TransferCreateRequest{FromUserID: friend.ID, ToUserID: user.ID, Amount: 4, Hold: true}, ""); err != nil {
+		return err
+	}
+	if expired, err = expireUserPoints(s, friend.ID, later); err != nil || expired != 6 {
+		return fmt.Errorf("expired %d points of a user with a hold (%v), want 6", expired, err)
+	}
+	if err := remaining(friend.ID, 4); err != nil {
+		return err
+	}
+	if err := expectBalance(s, friend.ID, 4, 4); err != nil {
+		return err
+	}
+	return expectBalance(s, user.ID, 0, 0)
+}
+
+func checkTransferredLots(s Store, run string) error {
+	alice, err := conformanceUser(s, run, "lots-alice", 0)
+	if err != nil {
+		return err
+	}
+	bob, err := conformanceUser(s, run, "lots-bob", 0)
+	if err != nil {
+		return err
+	}
+	earnedAt := timestamp(time.Now().AddDate(0, -1, 0))
+	if err := s.RunInTx(func(tx Store) error {
+		_, err := applyPointChange(tx, pointChange{UserID: alice.ID, Change: 100, EventType: "earn"}, earnedAt)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	// earnedAtOf checks every open lot of the user still carries earnedAt
+	earnedAtOf := func(userID, want int) error {
+		lots, err := s.Lots().ListOpen(userID)
+		if err != nil {
+			return err
+		}
+		total := 0
+		for _, lot := range lots {
+			if lot.EarnedAt != earnedAt {
+				return fmt.Errorf("user %d lot %+v, want earned at %s", userID, lot, earnedAt)
+			}
+			total += lot.Remaining
+		}
+		if total != want {
+			return fmt.Errorf("user %d open lots hold %d points, want %d", userID, total, want)
+		}
+		return nil
+	}
+
+	// Bouncing points between members does not restart their expiry
+	send := func(from, to, amount int) (Transfer, error) {
+		transfer, _, err := executeTransfer(s, TransferCreateRequest{FromUserID: from, ToUserID: to, Amount: amount}, "")
+		return transfer, err
+	}
+	if _, err := send(alice.ID, bob.ID, 60); err != nil {
+		return err
+	}
+	if err := earnedAtOf(bob.ID, 60); err != nil {
+		return err
+	}
+	if _, err := send(bob.ID, alice.ID, 60); err != nil {
+		return err
+	}
+	if err := earnedAtOf(alice.ID, 100); err != nil {
+		return err
+	}
+
+	// A reversal gives the sender back the lots the transfer took
+	transfer, err := send(alice.ID, bob.ID, 40)
+	if err != nil {
+		return err
+	}
+	if _, _, err := reverseCompletedTransfer(s, transfer.IdemKey, "Conformance", false); err != nil {
+		return err
+	}
+	if err := earnedAtOf(alice.ID, 100); err != nil {
+		return err
+	}
+	if err := earnedAtOf(bob.ID, 0); err != nil {
+		return err
+	}
+
+	// Cancelling a reward order puts back the lots the order used
+	now := time.Now()
+	reward := Reward{
+		Name:          "Conformance lots " + run,
+		PointCost:     30,
+		EligibleTiers: []string{},
+		Active:        true,
+		CreatedAt:     timestamp(now),
+		UpdatedAt:     timestamp(now),
+	}
+	if err := s.Rewards().Create(&reward); err != nil {
+		return err
+	}
+	defer func() {
+		reward.Active = false
+		s.Rewards().Update(reward)
+	}()
+	order, err := placeRedemption(s, alice.ID, reward.ID, 1, now)
+	if err != nil {
+		return err
+	}
+	used, err := s.Lots().ListUsedBy(alice.ID, *order.LedgerEntryID)
+	if err != nil {
+		return err
+	}
+	if len(used) == 0 || used[0].EarnedAt != earnedAt {
+		return fmt.Errorf("lots used by the order: %+v", used)
+	}
+	if err := earnedAtOf(alice.ID, 70); err != nil {
+		return err
+	}
+	if _, err := cancelRedemption(s, order.ID, "Conformance", now); err != nil {
+		return err
+	}
+	if err := earnedAtOf(alice.ID, 100); err != nil {
+		return err
+	}
+
+	if cfg.PointExpiryMonths == 0 {
+		return nil
+	}
+	earned, _ := time.Parse(time.RFC3339, earnedAt)
+	expiresAt := earned.AddDate(0, cfg.PointExpiryMonths, 0)
+	if expired, err := expireUserPoints(s, alice.ID, expiresAt.Add(-time.Hour)); err != nil || expired != 0 {
+		return fmt.Errorf("expired %d points before their expiry (%v)", expired, err)
+	}
+	if expired, err := expireUserPoints(s, alice.ID, expiresAt); err != nil || expired != 100 {
+		return fmt.Errorf("expired %d points at their original expiry (%v), want 100", expired, err)
+	}
+	return expectBalance(s, alice.ID, 0, 0)
+}
+
+func checkRewards(s Store, run string) error {
+	user, err := conformanceUser(s, run, "redeemer", 1000)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	stock := 2
+	reward := Reward{
+		Name:          "Conformance " + run,
+		PointCost:     300,
+		Stock:         &stock,
+		EligibleTiers: []string{lowestTier()},
+		Active:        true,
+		CreatedAt:     timestamp(now),
+		UpdatedAt:     timestamp(now),
+	}
+	if err := s.Rewards().Create(&reward); err != nil {
+		return err
+	}
+	// Leave the reward out of the live catalog once the check is done
+	defer func() {
+		reward.Active = false
+		s.Rewards().Update(reward)
+	}()
+
+	got, err := s.Rewards().Get(reward.ID)
+	if err != nil {
+		return err
+	}
+	if got.Name != reward.Name || got.Stock == nil || *got.Stock != 2 || fmt.Sprint(got.EligibleTiers) != fmt.Sprint(reward.EligibleTiers) || !got.Active {
+		return fmt.Errorf("get returned %+v", got)
+	}
+	if _, err := s.Rewards().Get(-1); err != errRewardNotFound {
+		return expectErr("get missing reward", err, errRewardNotFound)
+	}
+
+	place := func(quantity int) error {
+		_, err := placeRedemption(s, user.ID, reward.ID, quantity, now)
+		return err
+	}
+	order, err := placeRedemption(s, user.ID, reward.ID, 2, now)
+	if err != nil {
+		return err
+	}
+	if order.Status != "placed" || order.Points != 600 || order.LedgerEntryID == nil {
+		return fmt.Errorf("placed order %+v", order)
+	}
+	if err := expectBalance(s, user.ID, 400, 0); err != nil {
+		return err
+	}
+	if err := expectErr("order with no stock left", place(1), errOutOfStock); err != nil {
+		return err
+	}
+	available, err := s.Rewards().List(RewardFilter{AvailableAt: timestamp(now), InStock: true})
+	if err != nil {
+		return err
+	}
+	for _, r := range available {
+		if r.ID == reward.ID {
+			return fmt.Errorf("out of stock reward listed as available")
+		}
+	}
+
+	// Cancelling refunds the points and restocks the reward
+	cancelled, err := cancelRedemption(s, order.ID, "Conformance", now)
+	if err != nil {
+		return err
+	}
+	if cancelled.Status != "cancelled" || cancelled.RefundEntryID == nil || cancelled.CancelledAt == nil {
+		return fmt.Errorf("cancelled order %+v", cancelled)
+	}
+	if err := expectBalance(s, user.ID, 1000, 0); err != nil {
+		return err
+	}
+	var statusErr *redemptionStatusError
+	if _, err := fulfilRedemption(s, order.ID, now); !errors.As(err, &statusErr) {
+		return fmt.Errorf("fulfil a cancelled order: %v", err)
+	}
+
+	order, err = placeRedemption(s, user.ID, reward.ID, 1, now)
+	if err != nil {
+		return err
+	}
+	if order, err = fulfilRedemption(s, order.ID, now); err != nil || order.Status != "fulfilled" {
+		return fmt.Errorf("fulfil order: %+v, %v", order, err)
+	}
+	if _, err := cancelRedemption(s, order.ID, "Too late", now); !errors.As(err, &statusErr) {
+		return fmt.Errorf("cancel a fulfilled order: %v", err)
+	}
+	if got, err = s.Rewards().Get(reward.ID); err != nil || *got.Stock != 1 {
+		return fmt.Errorf("stock after one fulfilled order: %+v, %v", got, err)
+	}
+
+	// Failed orders change nothing
+	if err := expectErr("order beyond the stock", place(3), errOutOfStock); err != nil {
+		return err
+	}
+	reward.Stock = nil
+	if err := s.Rewards().Update(reward); err != nil {
+		return err
+	}
+	if err := expectErr("order beyond the balance", place(3), errInsufficientBalance); err != nil {
+		return err
+	}
+	orders, err := s.Redemptions().List(RedemptionFilter{UserID: user.ID}, ListPage{Limit: 10})
+	if err != nil {
+		return err
+	}
+	if len(orders) != 2 || orders[0].Status != "fulfilled" || orders[1].Status != "cancelled" {
+		return fmt.Errorf("listed orders %+v", orders)
+	}
+	if count, err := s.Redemptions().Count(RedemptionFilter{UserID: user.ID, Status: "cancelled"}); err != nil || count != 1 {
+		return fmt.Errorf("count cancelled orders %d, %v", count, err)
+	}
+
+	// Tier eligibility and the validity window
+	if len(cfg.Tiers) > 1 {
+		reward.EligibleTiers = []string{cfg.Tiers[1].Name}
+		if err := s.Rewards().Update(reward); err != nil {
+			return err
+		}
+		if err := expectErr("order from an ineligible tier", place(1), errRewardNotEligible); err != nil {
+			return err
+		}
+		reward.EligibleTiers = nil
+	}
+	reward.ValidUntil = timestamp(now.Add(-time.Hour))
+	if err := s.Rewards().Update(reward); err != nil {
+		return err
+	}
+	if err := expectErr("order after the validity window", place(1), errRewardUnavailable); err != nil {
+		return err
+	}
+	return expectBalance(s, user.ID, 700, 0)
+}
+
+func checkCampaigns(s Store, run string) error {
+	earner, err := conformanceUser(s, run, "campaigner", 0)
+	if err != nil {
+		return err
+	}
+	friend, err := conformanceUser(s, run, "campaign-friend", 0)
+	if err != nil {
+		return err
+	}
+	// A level of its own keeps the campaigns away from every other member
+	level := "conf-" + run
+	if err := s.Users().Update(earner.ID, UserPatch{MembershipLevel: &level}); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	budget, once := 120, 1
+	campaigns := []*Campaign{
+		{RuleType: "multiplier", Trigger: "earn", Multiplier: 2, Budget: &budget},
+		{RuleType: "threshold", Trigger: "earn", BonusPoints: 25, Threshold: 100},
+		{RuleType: "fixed", Trigger: "transfer", BonusPoints: 10, MaxAwardsPerMember: &once},
+	}
+	for i, campaign := range campaigns {
+		campaign.Name = fmt.Sprintf("Conformance %s #%d", run, i+1)
+		campaign.StartsAt = timestamp(now.Add(-time.Hour))
+		campaign.EndsAt = timestamp(now.Add(time.Hour))
+		campaign.Tiers = []string{level}
+		campaign.Active = true
+		campaign.CreatedAt = timestamp(now)
+		campaign.UpdatedAt = campaign.CreatedAt
+		if err := s.Campaigns().Create(campaign); err != nil {
+			return err
+		}
+	}
+	// Stop the campaigns once the check is done
+	defer func() {
+		for _, campaign := range campaigns {
+			campaign.Active = false
+			s.Campaigns().Update(*campaign)
+		}
+	}()
+	multiplier := campaigns[0]
+
+	earn := func(points int) ([]PointLedgerEntry, error) {
+		_, bonuses, err := creditEarned(s, pointChange{UserID: earner.ID, Change: points, EventType: "earn"})
+		return bonuses, err
+	}
+	bonuses, err := earn(100)
+	if err != nil {
+		return err
+	}
+	if len(bonuses) != 2 || bonuses[0].Change != 100 || bonuses[1].Change != 25 {
+		return fmt.Errorf("bonuses for 100 earned points: %+v", bonuses)
+	}
+	var metadata struct {
+		CampaignID int `json:"campaignId"`
+	}
+	if err := json.Unmarshal([]byte(bonuses[0].Metadata), &metadata); err != nil || metadata.CampaignID != multiplier.ID {
+		return fmt.Errorf("bonus metadata %q", bonuses[0].Metadata)
+	}
+
+	// The multiplier bonus is cut down to the budget left, then stops
+	if bonuses, err = earn(50); err != nil || len(bonuses) != 1 || bonuses[0].Change != 20 {
+		return fmt.Errorf("bonuses near the budget: %+v, %v", bonuses, err)
+	}
+	if bonuses, err = earn(100); err != nil || len(bonuses) != 1 || bonuses[0].Change != 25 {
+		return fmt.Errorf("bonuses with the budget spent: %+v, %v", bonuses, err)
+	}
+	if got, err := s.Campaigns().Get(multiplier.ID); err != nil || got.BudgetUsed != budget {
+		return fmt.Errorf("budget used %+v, %v", got, err)
+	}
+	if err := expectBalance(s, earner.ID, 420, 0); err != nil {
+		return err
+	}
+
+	// The transfer bonus goes to the sender, once
+	send := func(from User) (Transfer, error) {
+		transfer, _, err := executeTransfer(s, TransferCreateRequest{FromUserID: from.ID, ToUserID: friend.ID, Amount: 10}, "")
+		return transfer, err
+	}
+	var sent []Transfer
+	for i := 0; i < 2; i++ {
+		transfer, err := send(earner)
+		if err != nil {
+			return err
+		}
+		sent = append(sent, transfer)
+	}
+	if err := expectBalance(s, earner.ID, 410, 0); err != nil {
+		return err
+	}
+	if err := expectBalance(s, friend.ID, 20, 0); err != nil {
+		return err
+	}
+
+	// Reversing the transfer takes its bonus back, so it can be earned again
+	_, entries, err := reverseCompletedTransfer(s, sent[0].IdemKey, "Conformance", false)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 3 || entries[2].EventType != "earn" || entries[2].Change != -10 {
+		return fmt.Errorf("reversal entries %+v", entries)
+	}
+	if err := expectBalance(s, earner.ID, 410, 0); err != nil {
+		return err
+	}
+	if _, err := send(earner); err != nil {
+		return err
+	}
+	if err := expectBalance(s, earner.ID, 410, 0); err != nil {
+		return err
+	}
+
+	// A first-transfer bonus pays on the first transfer that stands, not
+	// the first one made during the campaign
+	newcomer, err := conformanceUser(s, run, "campaign-newcomer", 100)
+	if err != nil {
+		return err
+	}
+	if err := s.Users().Update(newcomer.ID, UserPatch{MembershipLevel: &level}); err != nil {
+		return err
+	}
+	firstBudget := 100
+	first := &Campaign{
+		Name:        fmt.Sprintf("Conformance %s first", run),
+		RuleType:    "first",
+		Trigger:     "transfer",
+		BonusPoints: 50,
+		Budget:      &firstBudget,
+		StartsAt:    timestamp(now.Add(-time.Hour)),
+		EndsAt:      timestamp(now.Add(time.Hour)),
+		Tiers:       []string{level},
+		Active:      true,
+		CreatedAt:   timestamp(now),
+		UpdatedAt:   timestamp(now),
+	}
+	if err := s.Campaigns().Create(first); err != nil {
+		return err
+	}
+	campaigns = append(campaigns, first)
+	if _, err := send(earner); err != nil {
+		return err
+	}
+	if err := expectBalance(s, earner.ID, 400, 0); err != nil {
+		return err
+	}
+	transfer, err := send(newcomer)
+	if err != nil {
+		return err
+	}
+	if err := expectBalance(s, newcomer.ID, 150, 0); err != nil {
+		return err
+	}
+	if _, _, err := reverseCompletedTransfer(s, transfer.IdemKey, "Conformance", false); err != nil {
+		return err
+	}
+	if err := expectBalance(s, newcomer.ID, 100, 0); err != nil {
+		return err
+	}
+	if got, err := s.Campaigns().Get(first.ID); err != nil || got.BudgetUsed != 0 {
+		return fmt.Errorf("budget used after the reversal %+v, %v", got, err)
+	}
+	for _, want := range []int{150, 140} {
+		if _, err := send(newcomer); err != nil {
+			return err
+		}
+		if err := expectBalance(s, newcomer.ID, want, 0); err != nil {
+			return err
+		}
+	}
+
+	// Members outside the targeted tiers get nothing
+	if _, bonuses, err := creditEarned(s, pointChange{UserID: friend.ID, Change: 100, EventType: "earn"}); err != nil || len(bonuses) != 0 {
+		return fmt.Errorf("bonuses for an untargeted member: %+v, %v", bonuses, err)
+	}
+
+	multiplier.Active = false
+	if err := s.Campaigns().Update(*multiplier); err != nil {
+		return err
+	}
+	running, err := s.Campaigns().List(CampaignFilter{RunningAt: timestamp(now), Trigger: "earn"})
+	if err != nil {
+		return err
+	}
+	found := map[int]bool{}
+	for _, campaign := range running {
+		found[campaign.ID] = true
+	}
+	if found[multiplier.ID] || !found[campaigns[1].ID] || found[campaigns[2].ID] {
+		return fmt.Errorf("running earn campaigns %+v", running)
+	}
+	if _, err := s.Campaigns().Get(-1); err != errCampaignNotFound {
+		return expectErr("get missing campaign", err, errCampaignNotFound)
+	}
+	return nil
+}
+
+func checkReferrals(s Store, run string) error {
+	referrer, err := conformanceUser(s, run, "referrer", 0)
+	if err != nil {
+		return err
+	}
+	if referrer.ReferralCode == "" || referrer.ReferredBy != nil {
+		return fmt.Errorf("created referrer %+v", referrer)
+	}
+	if got, err := s.Users().GetByReferralCode(referrer.ReferralCode); err != nil || got.ID != referrer.ID {
+		return fmt.Errorf("get by referral code: %+v, %v", got, err)
+	}
+	if _, err := s.Users().GetByReferralCode("conf-" + run); err != errUserNotFound {
+		return expectErr("get by unknown referral code", err, errUserNotFound)
+	}
+
+	// Another address of the referrer's mailbox is the referrer
+	abuser := User{
+		MemberID:        "conf-" + run + "-abuser",
+		FirstName:       "abuser",
+		LastName:        "Conformance",
+		Email:           "conf-" + run + "-referrer+again@example.com",
+		RegisterDate:    "2024-01-01",
+		MembershipLevel: lowestTier(),
+		ReferredBy:      &referrer.ID,
+	}
+	var rejected *referralRejectedError
+	if err := createMember(s, &abuser); !errors.As(err, &rejected) {
+		return fmt.Errorf("self-referral by email: %v", err)
+	}
+
+	referee := User{
+		MemberID:        "conf-" + run + "-referee",
+		FirstName:       "referee",
+		LastName:        "Conformance",
+		Email:           "conf-" + run + "-referee@example.com",
+		RegisterDate:    "2024-01-01",
+		MembershipLevel: lowestTier(),
+		ReferredBy:      &referrer.ID,
+	}
+	if err := createMember(s, &referee); err != nil {
+		return err
+	}
+	if referee.ReferredBy == nil || *referee.ReferredBy != referrer.ID || referee.ReferralCode == referrer.ReferralCode {
+		return fmt.Errorf("created referee %+v", referee)
+	}
+	referral, err := s.Referrals().GetByReferee(referee.ID)
+	if err != nil {
+		return err
+	}
+	if referral.ReferrerID != referrer.ID || referral.Status != "pending" || referral.ResolvedAt != nil {
+		return fmt.Errorf("pending referral %+v", referral)
+	}
+	if _, err := s.Referrals().GetByReferee(referrer.ID); err != errReferralNotFound {
+		return expectErr("get referral of an unreferred member", err, errReferralNotFound)
+	}
+
+	// The first qualifying earn rewards both members, once
+	earn := max(cfg.ReferralMinEarn, 100)
+	_, bonuses, err := creditEarned(s, pointChange{UserID: referee.ID, Change: earn, EventType: "earn"})
+	if err != nil {
+		return err
+	}
+	if cfg.RefereePoints > 0 && (len(bonuses) != 1 || bonuses[0].Change != cfg.RefereePoints) {
+		return fmt.Errorf("referee bonuses %+v", bonuses)
+	}
+	if _, bonuses, err = creditEarned(s, pointChange{UserID: referee.ID, Change: earn, EventType: "earn"}); err != nil || len(bonuses) != 0 {
+		return fmt.Errorf("bonuses for a second earn: %+v, %v", bonuses, err)
+	}
+	if err := expectBalance(s, referee.ID, 2*earn+cfg.RefereePoints, 0); err != nil {
+		return err
+	}
+	if err := expectBalance(s, referrer.ID, cfg.ReferrerPoints, 0); err != nil {
+		return err
+	}
+
+	referral, err = s.Referrals().GetByReferee(referee.ID)
+	if err != nil {
+		return err
+	}
+	if referral.Status != "rewarded" || referral.ResolvedAt == nil || (cfg.ReferrerPoints > 0) != (referral.ReferrerEntryID != nil) {
+		return fmt.Errorf("rewarded referral %+v", referral)
+	}
+	if err := expectErr("update a resolved referral", s.Referrals().Update(referral, "pending"), errReferralStatusChanged); err != nil {
+		return err
+	}
+	listed, err := s.Referrals().List(ReferralFilter{ReferrerID: referrer.ID})
+	if err != nil {
+		return err
+	}
+	if len(listed) != 1 || listed[0].ID != referral.ID {
+		return fmt.Errorf("listed referrals %+v", listed)
+	}
+	if count, err := s.Referrals().Count(ReferralFilter{ReferrerID: referrer.ID, Statuses: []string{"pending", "rejected"}}); err != nil || count != 0 {
+		return fmt.Errorf("count unrewarded referrals %d, %v", count, err)
+	}
+	return nil
+}
+
+func checkPartnerPurchases(s Store, run string) error {
+	shopper, err := conformanceUser(s, run, "shopper", 0)
+	if err != nil {
+		return err
+	}
+	now := timestamp(time.Now())
+	partner := Partner{
+		Name:      "Conformance " + run,
+		Currency:  "THB",
+		EarnRate:  0.5,
+		Active:    true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.Partners().Create(&partner); err != nil {
+		return err
+	}
+	// Retire the partner once the check is done
+	defer func() {
+		partner.Active = false
+		s.Partners().Update(partner)
+	}()
+
+	req := PurchaseRequest{MemberID: shopper.MemberID, ReceiptID: "r-" + run, Amount: 250.75, Currency: "THB"}
+	purchase, duplicate, err := ingestPurchase(s, partner, req)
+	if err != nil {
+		return err
+	}
+	if duplicate || purchase.Points != 125 || purchase.UserID != shopper.ID || purchase.LedgerEntryID == nil {
+		return fmt.Errorf("ingested purchase %+v, duplicate %v", purchase, duplicate)
+	}
+	if err := expectBalance(s, shopper.ID, 125, 0); err != nil {
+		return err
+	}
+
+	// A resent receipt replays the purchase without crediting it again
+	replayed, duplicate, err := ingestPurchase(s, partner, req)
+	if err != nil || !duplicate || replayed.ID != purchase.ID {
+		return fmt.Errorf("replayed purchase %+v, duplicate %v, %v", replayed, duplicate, err)
+	}
+	if err := expectBalance(s, shopper.ID, 125, 0); err != nil {
+		return err
+	}
+	reused := req
+	reused.Amount = 99
+	if _, _, err := ingestPurchase(s, partner, reused); err != errReceiptReused {
+		return expectErr("reuse a receipt id", err, errReceiptReused)
+	}
+	if err := expectErr("create a duplicate receipt", s.Purchases().Create(&Purchase{
+		PartnerID: partner.ID, ReceiptID: req.ReceiptID, UserID: shopper.ID, MemberID: shopper.MemberID,
+		Amount: 1, Currency: "THB", EarnRate: 1, Points: 1, PurchasedAt: now, CreatedAt: now,
+	}), errDuplicateReceipt); err != nil {
+		return err
+	}
+
+	// Points are rounded down; spend worth less than a point is recorded
+	// without a ledger entry
+	small, _, err := ingestPurchase(s, partner, PurchaseRequest{MemberID: shopper.MemberID, ReceiptID: "r-" + run + "-small", Amount: 2.5, Currency: "THB"})
+	if err != nil {
+		return err
+	}
+	if small.Points != 1 || small.LedgerEntryID == nil {
+		return fmt.Errorf("small purchase %+v", small)
+	}
+	tiny, _, err := ingestPurchase(s, partner, PurchaseRequest{MemberID: shopper.MemberID, ReceiptID: "r-" + run + "-tiny", Amount: 1.5, Currency: "THB"})
+	if err != nil {
+		return err
+	}
+	if tiny.Points != 0 || tiny.LedgerEntryID != nil {
+		return fmt.Errorf("tiny purchase %+v", tiny)
+	}
+
+	unknown := PurchaseRequest{MemberID: "conf-" + run + "-nobody", ReceiptID: "r-" + run + "-unknown", Amount: 10, Currency: "THB"}
+	if _, _, err := ingestPurchase(s, partner, unknown); err != errMemberNotFound {
+		return expectErr("purchase by an unknown member", err, errMemberNotFound)
+	}
+
+	filter := PurchaseFilter{PartnerID: partner.ID}
+	listed, err := s.Purchases().List(filter, ListPage{Asc: true, Limit: 10})
+	if err != nil {
+		return err
+	}
+	if len(listed) != 3 || listed[0].ID != purchase.ID {
+		return fmt.Errorf("listed purchases %+v", listed)
+	}
+	if count, err := s.Purchases().Count(PurchaseFilter{PartnerID: partner.ID, UserID: shopper.ID}); err != nil || count != 3 {
+		return fmt.Errorf("count purchases %d, %v", count, err)
+	}
+
+	partner.Active = false
+	if err := s.Partners().Update(partner); err != nil {
+		return err
+	}
+	late := PurchaseRequest{MemberID: shopper.MemberID, ReceiptID: "r-" + run + "-late", Amount: 10, Currency: "THB"}
+	if _, _, err := ingestPurchase(s, partner, late); err != errPartnerInactive {
+		return expectErr("purchase at an inactive partner", err, errPartnerInactive)
+	}
+	if got, err := s.Partners().Get(partner.ID); err != nil || got.Active || got.EarnRate != 0.5 {
+		return fmt.Errorf("updated partner %+v, %v", got, err)
+	}
+	if _, err := s.Partners().Get(-1); err != errPartnerNotFound {
+		return expectErr("get missing partner", err, errPartnerNotFound)
+	}
+	return nil
+}
+
+func checkUserImport(s Store, run string) error {
+	memberID := "conf-" + run + "-imported"
+	data := []byte("member_id,first_name,last_name,email,point_balance,held_balance\n" +
+		memberID + ",Imported,Conformance,conf-" + run + "-imported@example.com,40,99\n")
+	rows, message := parseUserCSV(data)
+	if message != "" || len(rows) != 1 {
+		return fmt.Errorf("parsed rows %+v, %q", rows, message)
+	}
+
+	// A dry run reports the row without creating the member
+	if result := importUserRow(s, rows[0], false, true); result.Status != "created" || result.UserID != 0 {
+		return fmt.Errorf("dry-run result %+v", result)
+	}
+	if _, err := s.Users().GetByMemberID(memberID); err != errUserNotFound {
+		return expectErr("get a member created by a dry run", err, errUserNotFound)
+	}
+
+	result := importUserRow(s, rows[0], false, false)
+	if result.Status != "created" || result.UserID == 0 {
+		return fmt.Errorf("import result %+v", result)
+	}
+	if err := expectBalance(s, result.UserID, 40, 0); err != nil {
+		return err
+	}
+	if again := importUserRow(s, rows[0], false, false); again.Error != "DUPLICATE_USER" {
+		return fmt.Errorf("import of an existing member without upsert %+v", again)
+	}
+
+	// An upsert changes the fields the row carries and leaves the rest
+	rows, _ = parseUserNDJSON([]byte(`{"member_id": "` + memberID + `", "last_name": "Upserted", "mobile_number": "0800000000", "point_balance": 40}`))
+	if updated := importUserRow(s, rows[0], true, false); updated.Status != "updated" || updated.UserID != result.UserID {
+		return fmt.Errorf("upsert result %+v", updated)
+	}
+	user, err := s.Users().Get(result.UserID)
+	if err != nil {
+		return err
+	}
+	if user.FirstName != "Imported" || user.LastName != "Upserted" || user.MobileNumber != "0800000000" {
+		return fmt.Errorf("upserted user %+v", user)
+	}
+
+	rows, _ = parseUserNDJSON([]byte(`{"member_id": "` + memberID + `", "point_balance": 41}` + "\n" + `{"member_id": "` + memberID + `", "first_name": ""}`))
+	for _, row := range rows {
+		if failed := importUserRow(s, row, true, false); failed.Error != "VALIDATION_ERROR" {
+			return fmt.Errorf("invalid upsert of row %d: %+v", row.line, failed)
+		}
+	}
+	return expectBalance(s, result.UserID, 40, 0)
+}
+
+func checkTransferBatches(s Store, run string) error {
+	sender, err := conformanceUser(s, run, "batch-sender", 500)
+	if err != nil {
+		return err
+	}
+	var recipients []User
+	for _, name := range []string{"batch-a", "batch-b"} {
+		recipient, err := conformanceUser(s, run, name, 0)
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, recipient)
+	}
+	batch := func(amounts ...int) TransferBatchRequest {
+		req := TransferBatchRequest{FromUserID: sender.ID}
+		for i, amount := range amounts {
+			req.Transfers = append(req.Transfers, TransferBatchLeg{ToUserID: recipients[i%len(recipients)].ID, Amount: amount})
+		}
+		return req
+	}
+
+	// The sender's total is checked before any leg moves
+	if _, _, err := executeTransferBatch(s, batch(300, 300), "conf-"+run+"-over"); err != errInsufficientBalance {
+		return expectErr("batch over the balance", err, errInsufficientBalance)
+	}
+
+	// A failing leg rolls back the legs before it
+	failing := batch(100, 100)
+	failing.Transfers[1].ToUserID = sender.ID
+	_, _, err = executeTransferBatch(s, failing, "conf-"+run+"-failing")
+	var legErr *batchLegError
+	if !errors.As(err, &legErr) || legErr.index != 1 || legErr.err != errSelfTransfer {
+		return fmt.Errorf("batch with a self-transfer: %v", err)
+	}
+	if err := expectBalance(s, sender.ID, 500, 0); err != nil {
+		return err
+	}
+
+	batchID := "conf-" + run + "-batch"
+	transfers, replayed, err := executeTransferBatch(s, batch(200, 100), batchID)
+	if err != nil {
+		return err
+	}
+	if replayed || len(transfers) != 2 || transfers[1].BatchID == nil || *transfers[1].BatchID != batchID || transfers[1].Status != "completed" {
+		return fmt.Errorf("batch transfers %+v, replayed %v", transfers, replayed)
+	}
+	again, replayed, err := executeTransferBatch(s, batch(200, 100), batchID)
+	if err != nil || !replayed || again[0].TransferID != transfers[0].TransferID {
+		return fmt.Errorf("replayed batch %+v, replayed %v, %v", again, replayed, err)
+	}
+	if _, _, err := executeTransferBatch(s, batch(200), batchID); err != errIdemKeyReused {
+		return expectErr("replay a batch with other legs", err, errIdemKeyReused)
+	}
+	if count, err := s.Transfers().Count(TransferFilter{BatchID: batchID}); err != nil || count != 2 {
+		return fmt.Errorf("count batch transfers %d, %v", count, err)
+	}
+
+	// Leg keys carry the reserved prefix, out of reach of client keys
+	if transfers[0].IdemKey != "batch:"+batchID+"-1" {
+		return fmt.Errorf("batch leg key %q", transfers[0].IdemKey)
+	}
+	if _, err := s.Transfers().GetByIdemKey(batchID + "-1"); err != errTransferNotFound {
+		return expectErr("look up a leg without its prefix", err, errTransferNotFound)
+	}
+	if err := expectBalance(s, sender.ID, 200, 0); err != nil {
+		return err
+	}
+
+	// Best effort sends the legs that can go, and a retry only the rest
+	bestEffortID := "conf-" + run + "-best-effort"
+	results, _ := executeTransferBatchBestEffort(s, batch(150, 100), bestEffortID)
+	if results[0].Status != "completed" || results[1].Status != "failed" || results[1].Error != "INSUFFICIENT_BALANCE" {
+		return fmt.Errorf("best-effort results %+v", results)
+	}
+	if _, err := changeBalance(s, pointChange{UserID: sender.ID, Change: 100, EventType: "adjust"}); err != nil {
+		return err
+	}
+	results, replayed = executeTransferBatchBestEffort(s, batch(150, 100), bestEffortID)
+	if replayed || results[0].Status != "completed" || results[1].Status != "completed" {
+		return fmt.Errorf("retried best-effort results %+v, replayed %v", results, replayed)
+	}
+	if err := expectBalance(s, recipients[1].ID, 200, 0); err != nil {
+		return err
+	}
+	return expectBalance(s, sender.ID, 50, 0)
+}
+
+func checkScheduledTransfers(s Store, run string) error {
+	sender, err := conformanceUser(s, run, "schedule-sender", 300)
+	if err != nil {
+		return err
+	}
+	recipient, err := conformanceUser(s, run, "schedule-recipient", 0)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Truncate(time.Second)
+	start := timestamp(now.Add(-time.Minute))
+	schedule := func(amount int, startsAt, recurrence string) (ScheduledTransfer, error) {
+		st, message := parseScheduleRequest(ScheduledTransferRequest{
+			FromUserID: sender.ID,
+			ToUserID:   recipient.ID,
+			Amount:     amount,
+			StartsAt:   startsAt,
+			Recurrence: recurrence,
+		}, now)
+		if message != "" {
+			return st, errors.New(message)
+		}
+		return st, s.Schedules().Create(&st)
+	}
+	scheduled := func(id int, status string) (int, error) {
+		return s.Transfers().Count(TransferFilter{ScheduleID: id, Statuses: []string{status}})
+	}
+
+	// Monthly runs keep the start day, clamped to shorter months
+	jan31 := time.Date(2025, 1, 31, 9, 0, 0, 0, time.UTC)
+	if got := (recurrence{freq: "MONTHLY", interval: 1}).occurrence(jan31, 1); got.Day() != 28 || got.Month() != time.February {
+		return fmt.Errorf("monthly run after Jan 31 is %v", got)
+	}
+	if r, err := parseRecurrence("FREQ=MONTHLY;COUNT=3;"); err != nil || r.count != 3 {
+		return fmt.Errorf("trailing semicolon: %+v, %v", r, err)
+	}
+	if _, err := schedule(10, start, "FREQ=HOURLY"); err == nil {
+		return errors.New("hourly recurrence accepted")
+	}
+
+	// A one-off sends once through the transfer path, then completes
+	oneOff, err := schedule(100, start, "")
+	if err != nil {
+		return err
+	}
+	due, err := s.Schedules().ListDue(timestamp(now))
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, st := range due {
+		found = found || st.ID == oneOff.ID
+	}
+	if !found {
+		return fmt.Errorf("due schedules %+v miss %d", due, oneOff.ID)
+	}
+	oneOff, err = runScheduledTransfer(s, oneOff, now)
+	if err != nil {
+		return err
+	}
+	if oneOff.Status != "completed" || oneOff.RunCount != 1 || oneOff.NextRunAt != nil {
+		return fmt.Errorf("one-off after its run %+v", oneOff)
+	}
+	if count, err := scheduled(oneOff.ID, "completed"); err != nil || count != 1 {
+		return fmt.Errorf("one-off transfers %d, %v", count, err)
+	}
+	if err := expectBalance(s, sender.ID, 200, 0); err != nil {
+		return err
+	}
+
+	// A recurrence carries on past a failed run and completes after COUNT runs
+	monthly, err := schedule(150, start, "FREQ=MONTHLY;COUNT=2")
+	if err != nil {
+		return err
+	}
+	if monthly, err = runScheduledTransfer(s, monthly, now); err != nil {
+		return err
+	}
+	if monthly.Status != "active" || monthly.NextRunAt == nil || *monthly.NextRunAt != timestamp(now.Add(-time.Minute).AddDate(0, 1, 0)) {
+		return fmt.Errorf("monthly after its first run %+v", monthly)
+	}
+	if monthly, err = runScheduledTransfer(s, monthly, now.AddDate(0, 1, 0)); err != nil {
+		return err
+	}
+	if monthly.Status != "completed" || monthly.RunCount != 2 || monthly.FailReason == nil || *monthly.FailReason != "Insufficient point balance" {
+		return fmt.Errorf("monthly after a failed last run %+v", monthly)
+	}
+	if count, err := scheduled(monthly.ID, "failed"); err != nil || count != 1 {
+		return fmt.Errorf("failed monthly transfers %d, %v", count, err)
+	}
+	if err := expectBalance(s, sender.ID, 50, 0); err != nil {
+		return err
+	}
+
+	// A one-off that fails fails for good
+	tooBig, err := schedule(1000, start, "")
+	if err != nil {
+		return err
+	}
+	if tooBig, err = runScheduledTransfer(s, tooBig, now); err != nil {
+		return err
+	}
+	if tooBig.Status != "failed" || tooBig.NextRunAt != nil {
+		return fmt.Errorf("failed one-off %+v", tooBig)
+	}
+
+	// Pause, resume and cancel follow the status rules
+	later := timestamp(now.Add(time.Hour))
+	weekly, err := schedule(10, later, "FREQ=WEEKLY")
+	if err != nil {
+		return err
+	}
+	if weekly, err = setScheduleStatus(s, weekly.ID, "paused", "paused", now, "active"); err != nil || weekly.Status != "paused" {
+		return fmt.Errorf("pause %+v, %v", weekly, err)
+	}
+	due, err = s.Schedules().ListDue(timestamp(now.AddDate(1, 0, 0)))
+	if err != nil {
+		return err
+	}
+	for _, st := range due {
+		if st.ID == weekly.ID {
+			return errors.New("paused schedule listed as due")
+		}
+	}
+	var statusErr *scheduleStatusError
+	if _, err := setScheduleStatus(s, weekly.ID, "paused", "paused", now, "active"); !errors.As(err, &statusErr) {
+		return fmt.Errorf("pause a paused schedule: %v", err)
+	}
+	if weekly, err = setScheduleStatus(s, weekly.ID, "active", "resumed", now, "paused"); err != nil || weekly.Status != "active" || *weekly.NextRunAt != later {
+		return fmt.Errorf("resume %+v, %v", weekly, err)
+	}
+	if weekly, err = setScheduleStatus(s, weekly.ID, "cancelled", "cancelled", now, "active", "paused"); err != nil || weekly.NextRunAt != nil {
+		return fmt.Errorf("cancel %+v, %v", weekly, err)
+	}
+	if err := s.Schedules().Update(weekly, "active"); err != errScheduleStatusChanged {
+		return expectErr("update from a stale status", err, errScheduleStatusChanged)
+	}
+	cancelled, err := s.Schedules().List(ScheduleFilter{UserID: sender.ID, Statuses: []string{"cancelled"}})
+	if err != nil || len(cancelled) != 1 || cancelled[0].ID != weekly.ID {
+		return fmt.Errorf("cancelled schedules %+v, %v", cancelled, err)
+	}
+	if _, err := s.Schedules().Get(-1); err != errScheduleNotFound {
+		return expectErr("get a missing schedule", err, errScheduleNotFound)
+	}
+	return nil
+}
+
+func checkTransactions(s Store, run string) error {
+	user, err := conformanceUser(s, run, "tx", 10)
+	if err != nil {
+		return err
+	}
+
+	rollback := errors.New("roll back")
+	err = s.RunInTx(func(tx Store) error {
+		if err := tx.Users().SetBalance(user.ID, 999); err != nil {
+			return err
+		}
+		// A nested call joins the outer transaction and rolls back with it
+		if err := tx.RunInTx(func(inner Store) error {
+			return inner.Users().AddHeld(user.ID, 5)
+		}); err != nil {
+			return err
+		}
+		if err := expectBalance(tx, user.ID, 999, 5); err != nil {
+			return err
+		}
+		return rollback
+	})
+	if err != rollback {
+		return fmt.Errorf("RunInTx returned %v, want the callback's error", err)
+	}
+	if err := expectBalance(s, user.ID, 10, 0); err != nil {
+		return fmt.Errorf("after rollback: %w", err)
+	}
+
+	if err := s.RunInTx(func(tx Store) error {
+		return tx.Users().SetBalance(user.ID, 11)
+	}); err != nil {
+		return err
+	}
+	return expectBalance(s, user.ID, 11, 0)
+}
+
+func checkTransferFlow(s Store, run string) error {
+	alice, err := conformanceUser(s, run, "flow-alice", 100)
+	if err != nil {
+		return err
+	}
+	bob, err := conformanceUser(s, run, "flow-bob", 0)
+	if err != nil {
+		return err
+	}
+
+	req := TransferCreateRequest{FromUserID: alice.ID, ToUserID: bob.ID, Amount: 30}
+	transfer, replayed, err := executeTransfer(s, req, "conf-"+run+"-flow")
+	if err != nil {
+		return err
+	}
+	if replayed || transfer.Status != "completed" {
+		return fmt.Errorf("transfer %+v replayed=%v", transfer, replayed)
+	}
+	if err := expectBalance(s, alice.ID, 70, 0); err != nil {
+		return err
+	}
+	if err := expectBalance(s, bob.ID, 30, 0); err != nil {
+		return err
+	}
+
+	total, err := s.Ledger().Count(LedgerFilter{TransferID: transfer.TransferID})
+	if err != nil {
+		return err
+	}
+	if total != 2 {
+		return fmt.Errorf("transfer wrote %d ledger entries, want 2", total)
+	}
+
+	if again, replayed, err := executeTransfer(s, req, transfer.IdemKey); err != nil || !replayed || again.TransferID != transfer.TransferID {
+		return fmt.Errorf("replay: transfer %d replayed=%v err=%v", again.TransferID, replayed, err)
+	}
+	req.Amount = 31
+	if _, _, err := executeTransfer(s, req, transfer.IdemKey); err != errIdemKeyReused {
+		return expectErr("reused key with new payload", err, errIdemKeyReused)
+	}
+	req.Amount = 1000
+	if _, _, err := executeTransfer(s, req, ""); err != errInsufficientBalance {
+		return expectErr("overdraw", err, errInsufficientBalance)
+	}
+
+	// A hold reserves points until it is cancelled
+	hold := TransferCreateRequest{FromUserID: alice.ID, ToUserID: bob.ID, Amount: 60, Hold: true}
+	pending, _, err := executeTransfer(s, hold, "")
+	if err != nil {
+		return err
+	}
+	if err := expectBalance(s, alice.ID, 70, 60); err != nil {
+		return err
+	}
+	req.Amount = 20
+	if _, _, err := executeTransfer(s, req, ""); err != errInsufficientBalance {
+		return expectErr("spend held points", err, errInsufficientBalance)
+	}
+	if _, err := cancelPendingTransfer(s, pending.IdemKey, "Conformance"); err != nil {
+		return err
+	}
+	if err := expectBalance(s, alice.ID, 70, 0); err != nil {
+		return err
+	}
+
+	if _, _, err := reverseCompletedTransfer(s, transfer.IdemKey, "Conformance", false); err != nil {
+		return err
+	}
+	if err := expectBalance(s, alice.ID, 100, 0); err != nil {
+		return err
+	}
+	return expectBalance(s, bob.ID, 0, 0)
+}
+
+func checkConcurrentTransfers(s Store, run string) error {
+	alice, err := conformanceUser(s, run, "race-alice", 100)
+	if err != nil {
+		return err
+	}
+	bob, err := conformanceUser(s, run, "race-bob", 50)
+	if err != nil {
+		return err
+	}
+
+	// Transfers in both directions at once: more than Alice can afford one
+	// way, so some must fail for insufficient balance and none may overdraw
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var unexpected []error
+	for i := 0; i < 20; i++ {
+		req := TransferCreateRequest{FromUserID: alice.ID, ToUserID: bob.ID, Amount: 15}
+		if i%2 == 1 {
+			req = TransferCreateRequest{FromUserID: bob.ID, ToUserID: alice.ID, Amount: 5}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := executeTransfer(s, req, ""); err != nil && err != errInsufficientBalance {
+				mu.Lock()
+				unexpected = append(unexpected, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(unexpected) > 0 {
+		return fmt.Errorf("%d transfers failed unexpectedly, first: %v", len(unexpected), unexpected[0])
+	}
+
+	total := 0
+	for _, user := range []User{alice, bob} {
+		balance, _, err := s.Users().Balances(user.ID)
+		if err != nil {
+			return err
+		}
+		if balance < 0 {
+			return fmt.Errorf("user %d overdrawn to %d", user.ID, balance)
+		}
+
+		// The balance must equal the sum of the user's ledger entries
+		entries, err := s.Ledger().List(LedgerFilter{UserID: user.ID}, ListPage{Limit: 1000})
+		if err != nil {
+			return err
+		}
+		sum := 0
+		for _, e := range entries {
+			sum += e.Change
+		}
+		if sum != balance {
+			return fmt.Errorf("user %d balance %d but ledger sums to %d", user.ID, balance, sum)
+		}
+		total += balance
+	}
+	if total != 150 {
+		return fmt.Errorf("points not conserved: %d, want 150", total)
+	}
+	return nil
+}
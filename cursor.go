@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// pageCursor is the decoded form of the opaque cursor strings returned by
+// list endpoints. It records the ordering it was issued for, so a cursor
+// cannot be replayed against a listing sorted another way. Prev marks a
+// cursor that pages backwards, towards the start of the listing.
+type pageCursor struct {
+	Sort  string `json:"s,omitempty"`
+	Desc  bool   `json:"d,omitempty"`
+	Prev  bool   `json:"p,omitempty"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// encodeCursor returns the opaque form of c
+func encodeCursor(c pageCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a cursor and checks it belongs to the given ordering
+func decodeCursor(raw, sort string, desc bool) (pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return pageCursor{}, errInvalidCursor
+	}
+
+	var c pageCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.ID <= 0 {
+		return pageCursor{}, errInvalidCursor
+	}
+	if c.Sort != sort || c.Desc != desc {
+		return pageCursor{}, errInvalidCursor
+	}
+	return c, nil
+}
+
+// keyset returns the row position the cursor points at
+func (c pageCursor) keyset() Keyset {
+	return Keyset{Value: c.Value, ID: c.ID}
+}
+
+// applyCursor points page at the rows after or before a decoded cursor
+func (page *ListPage) applyCursor(c pageCursor) {
+	at := c.keyset()
+	if c.Prev {
+		page.Before = &at
+	} else {
+		page.After = &at
+	}
+}
+
+// sortField is the field page is sorted by
+func (page ListPage) sortField() string {
+	if page.Sort == "" {
+		return "created_at"
+	}
+	return page.Sort
+}
+
+// keysetPage trims rows, fetched for page with a limit of one more than
+// pageSize, to pageSize and returns the cursors of the pages either side of
+// it. The extra row sits at the end of a forward page and at the start of a
+// backward one; its presence tells whether more rows follow in that
+// direction. key returns a row's position in the listing.
+func keysetPage[T any](rows []T, page ListPage, pageSize int, key func(T) Keyset) (trimmed []T, next, prev string) {
+	hasNext := page.Before != nil
+	hasPrev := page.After != nil || page.Offset > 0
+	if len(rows) > pageSize {
+		if page.Before != nil {
+			rows = rows[len(rows)-pageSize:]
+			hasPrev = true
+		} else {
+			rows = rows[:pageSize]
+			hasNext = true
+		}
+	}
+	if len(rows) == 0 {
+		return rows, "", ""
+	}
+
+	cursor := func(row T, backwards bool) string {
+		at := key(row)
+		return encodeCursor(pageCursor{Sort: page.sortField(), Desc: !page.Asc, Prev: backwards, Value: at.Value, ID: at.ID})
+	}
+	if hasNext {
+		next = cursor(rows[len(rows)-1], false)
+	}
+	if hasPrev {
+		prev = cursor(rows[0], true)
+	}
+	return rows, next, prev
+}
+
+// reverse flips rows in place
+func reverse[T any](rows []T) {
+	for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+		rows[i], rows[j] = rows[j], rows[i]
+	}
+}
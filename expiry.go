@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// PointLot is one credit to a user's balance: the points it added and how
+// many of them are left. Debits use up lots first in, first out, and what is
+// left of a lot expires PointExpiryMonths after EarnedAt.
+type PointLot struct {
+	ID        int    `json:"id"`
+	UserID    int    `json:"user_id"`
+	EntryID   int    `json:"ledger_entry_id,omitempty"`
+	Amount    int    `json:"amount"`
+	Remaining int    `json:"remaining"`
+	EarnedAt  string `json:"earned_at"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// ExpiringPointsResponse lists a member's lots that expire within the requested window
+type ExpiringPointsResponse struct {
+	Data  []PointLot `json:"data"`
+	Total int        `json:"total"`
+	Until string     `json:"until,omitempty"`
+}
+
+// lotExpiry returns when the points of a lot earned at earnedAt expire, or
+// "" when points never expire
+func lotExpiry(earnedAt string) string {
+	if cfg.PointExpiryMonths == 0 {
+		return ""
+	}
+	t, err := time.Parse(time.RFC3339, earnedAt)
+	if err != nil {
+		return ""
+	}
+	return timestamp(t.AddDate(0, cfg.PointExpiryMonths, 0))
+}
+
+// expiryCutoff is the latest earned_at of lots that have expired by now
+func expiryCutoff(now time.Time) string {
+	return timestamp(now.AddDate(0, -cfg.PointExpiryMonths, 0))
+}
+
+// updateLots keeps the user's lots in step with a balance change recorded as
+// entry. A credit opens lots for the part of it that lifts the balance above
+// zero: points moved from another member or put back by a refund keep the
+// EarnedAt of their lots, while earns and adjustments start expiring at now.
+// A debit uses up open lots, oldest first, records what it took from each
+// and returns it. It must run inside the transaction that changed the
+// balance.
+func updateLots(tx Store, entry PointLedgerEntry, moved []PointLot, now string) ([]PointLot, error) {
+	if entry.Change > 0 {
+		amount := min(entry.Change, entry.BalanceAfter)
+		// The part that only paid off a negative balance comes out of the
+		// oldest points
+		skip := entry.Change - amount
+		for _, lot := range moved {
+			take := lot.Amount - min(skip, lot.Amount)
+			skip -= lot.Amount - take
+			take = min(take, amount)
+			if take <= 0 {
+				continue
+			}
+			if err := tx.Lots().Add(&PointLot{
+				UserID:    entry.UserID,
+				EntryID:   entry.ID,
+				Amount:    take,
+				Remaining: take,
+				EarnedAt:  lot.EarnedAt,
+			}); err != nil {
+				return nil, err
+			}
+			amount -= take
+		}
+		if amount <= 0 {
+			return nil, nil
+		}
+		return nil, tx.Lots().Add(&PointLot{
+			UserID:    entry.UserID,
+			EntryID:   entry.ID,
+			Amount:    amount,
+			Remaining: amount,
+			EarnedAt:  now,
+		})
+	}
+
+	debit := -entry.Change
+	if debit <= 0 {
+		return nil, nil
+	}
+	lots, err := tx.Lots().ListOpen(entry.UserID)
+	if err != nil {
+		return nil, err
+	}
+	var used []PointLot
+	for _, lot := range lots {
+		if debit == 0 {
+			break
+		}
+		taken := min(debit, lot.Remaining)
+		if err := tx.Lots().SetRemaining(lot.ID, lot.Remaining-taken); err != nil {
+			return nil, err
+		}
+		if err := tx.Lots().RecordUse(entry.ID, lot.ID, taken); err != nil {
+			return nil, err
+		}
+		lot.Amount, lot.Remaining = taken, 0
+		used = append(used, lot)
+		debit -= taken
+	}
+	return used, nil
+}
+
+// transferredLots returns the lots a completed transfer opened for its
+// recipient, which carry the earned dates of the sender's points
+func transferredLots(tx Store, t Transfer) ([]PointLot, error) {
+	entries, err := tx.Ledger().List(LedgerFilter{
+		UserID:     t.ToUserID,
+		EventType:  "transfer_in",
+		TransferID: t.TransferID,
+	}, ListPage{Limit: 1})
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return tx.Lots().ListByEntry(t.ToUserID, entries[0].ID)
+}
+
+// expireUserPoints writes off what is left of the user's lots that expired
+// by now as a single expire ledger entry. Points held by pending transfers
+// are left alone; they are spent or released first, and expire on a later
+// run if still unspent. It returns the number of points expired.
+func expireUserPoints(s Store, userID int, now time.Time) (int, error) {
+	if cfg.PointExpiryMonths == 0 {
+		return 0, nil
+	}
+	cutoff := expiryCutoff(now)
+	expired := 0
+
+	err := s.RunInTx(func(tx Store) error {
+		if err := tx.Users().Lock(userID); err != nil {
+			return err
+		}
+		balance, held, err := tx.Users().Balances(userID)
+		if err != nil {
+			return err
+		}
+		lots, err := tx.Lots().ListOpen(userID)
+		if err != nil {
+			return err
+		}
+
+		var lotIDs []int
+		for _, lot := range lots {
+			if lot.EarnedAt > cutoff {
+				break
+			}
+			expired += lot.Remaining
+			lotIDs = append(lotIDs, lot.ID)
+		}
+		// Lots are used oldest first, so the debit below uses up exactly
+		// the expired lots
+		expired = min(expired, balance-held)
+		if expired <= 0 {
+			expired = 0
+			return nil
+		}
+
+		metadata, _ := json.Marshal(map[string]interface{}{"lot_ids": lotIDs})
+		_, err = applyPointChange(tx, pointChange{
+			UserID:    userID,
+			Change:    -expired,
+			EventType: "expire",
+			Reference: fmt.Sprintf("Points earned on or before %s expired", cutoff[:10]),
+			Metadata:  string(metadata),
+		}, timestamp(now))
+		return err
+	})
+	return expired, err
+}
+
+// expirePoints runs expireUserPoints for every user holding expired lots.
+// It returns the number of users whose points expired.
+func expirePoints(s Store, now time.Time) (int, error) {
+	userIDs, err := s.Lots().ListUsersWithExpired(expiryCutoff(now))
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, userID := range userIDs {
+		expired, err := expireUserPoints(s, userID, now)
+		if err != nil {
+			return count, err
+		}
+		if expired > 0 {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// runPointExpiryWorker periodically expires old points until the process exits
+func runPointExpiryWorker(store Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		count, err := expirePoints(store, time.Now())
+		if err != nil {
+			log.Println("Failed to expire points:", err)
+			continue
+		}
+		if count > 0 {
+			log.Printf("Expired points of %d user(s)", count)
+		}
+	}
+}
+
+// GET /users/:id/points/expiring - List a member's points by when they expire.
+// days limits the list to points expiring within that many days.
+func (a *API) getExpiringPoints(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil || userID <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "User ID must be a positive integer",
+		})
+	}
+
+	until := ""
+	if daysStr := c.Query("days"); daysStr != "" {
+		days, err := strconv.Atoi(daysStr)
+		if err != nil || days <= 0 {
+			return c.Status(400).JSON(fiber.Map{
+				"error":   "VALIDATION_ERROR",
+				"message": "days must be a positive integer",
+			})
+		}
+		until = timestamp(time.Now().AddDate(0, 0, days))
+	}
+
+	if _, err := a.store.Users().Get(userID); err != nil {
+		return transferErrorResponse(c, err, "check user")
+	}
+
+	response := ExpiringPointsResponse{Data: []PointLot{}, Until: until}
+	if cfg.PointExpiryMonths == 0 {
+		return c.JSON(response)
+	}
+
+	lots, err := a.store.Lots().ListOpen(userID)
+	if err != nil {
+		return transferErrorResponse(c, err, "fetch point lots")
+	}
+	for _, lot := range lots {
+		lot.ExpiresAt = lotExpiry(lot.EarnedAt)
+		if until != "" && lot.ExpiresAt > until {
+			break
+		}
+		response.Data = append(response.Data, lot)
+		response.Total += lot.Remaining
+	}
+
+	return c.JSON(response)
+}
@@ -4,8 +4,11 @@ go 1.21
 
 require (
 	github.com/gofiber/fiber/v2 v2.52.0
+	github.com/golang-jwt/jwt/v5 v5.2.1
 	github.com/google/uuid v1.5.0
+	github.com/lib/pq v1.12.3
 	github.com/mattn/go-sqlite3 v1.14.17
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -1,51 +1,135 @@
 package main
 
 import (
-	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/google/uuid"
 )
 
-// GET /users - Get all users
-func getUsers(c *fiber.Ctx) error {
-	rows, err := db.Query(`
-		SELECT id, member_id, first_name, last_name, mobile_number, email, 
-		       register_date, membership_level, point_balance, created_at, updated_at 
-		FROM users ORDER BY created_at DESC
-	`)
+// API holds the dependencies shared by the HTTP handlers
+type API struct {
+	store Store
+}
+
+func newAPI(store Store) *API {
+	return &API{store: store}
+}
+
+// GET /users - Search, filter, sort and paginate users.
+// Pages are selected with page/pageSize, or by passing back nextCursor as cursor.
+func (a *API) getUsers(c *fiber.Ctx) error {
+	query := UserQuery{
+		MembershipLevel: c.Query("membershipLevel"),
+		Search:          strings.TrimSpace(c.Query("search")),
+		Sort:            c.Query("sort", "created_at"),
+		Desc:            c.Query("order", "desc") == "desc",
+	}
+
+	if _, ok := userSortFields[query.Sort]; !ok {
+		fields := make([]string, 0, len(userSortFields))
+		for field := range userSortFields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		return c.Status(400).JSON(fiber.Map{
+			"error": "sort must be one of: " + strings.Join(fields, ", "),
+		})
+	}
+	if order := c.Query("order", "desc"); order != "asc" && order != "desc" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "order must be asc or desc",
+		})
+	}
+
+	for _, bound := range []struct {
+		param string
+		dst   *string
+	}{
+		{"registeredFrom", &query.RegisteredFrom},
+		{"registeredTo", &query.RegisteredTo},
+	} {
+		if value := c.Query(bound.param); value != "" {
+			if _, err := time.Parse("2006-01-02", value); err != nil {
+				return c.Status(400).JSON(fiber.Map{
+					"error": bound.param + " must be a date (YYYY-MM-DD)",
+				})
+			}
+			*bound.dst = value
+		}
+	}
+
+	for _, bound := range []struct {
+		param string
+		dst   **int
+	}{
+		{"minBalance", &query.MinBalance},
+		{"maxBalance", &query.MaxBalance},
+	} {
+		if value := c.Query(bound.param); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{
+					"error": bound.param + " must be an integer",
+				})
+			}
+			*bound.dst = &n
+		}
+	}
+
+	page, pageSize := parsePagination(c)
+	query.Offset = (page - 1) * pageSize
+	if raw := c.Query("cursor"); raw != "" {
+		// Users are only paged forwards, so no backward cursor is ever issued
+		cursor, err := decodeCursor(raw, query.Sort, query.Desc)
+		if err != nil || cursor.Prev {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "cursor is invalid or was issued for a different sort order",
+			})
+		}
+		after := cursor.keyset()
+		query.After = &after
+		page = 0
+	}
+
+	// Fetch one extra row to learn whether another page follows
+	query.Limit = pageSize + 1
+	users, total, err := a.store.Users().List(query)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to fetch users",
 		})
 	}
-	defer rows.Close()
 
-	var users []User
-	for rows.Next() {
-		var user User
-		err := rows.Scan(&user.ID, &user.MemberID, &user.FirstName, &user.LastName,
-			&user.MobileNumber, &user.Email, &user.RegisterDate, &user.MembershipLevel,
-			&user.PointBalance, &user.CreatedAt, &user.UpdatedAt)
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{
-				"error": "Failed to scan user data",
-			})
-		}
-		users = append(users, user)
+	response := UserListResponse{
+		Data:     users,
+		Page:     page,
+		PageSize: pageSize,
+		Total:    total,
 	}
+	if len(users) > pageSize {
+		response.Data = users[:pageSize]
+		last := response.Data[pageSize-1]
+		response.NextCursor = encodeCursor(pageCursor{
+			Sort:  query.Sort,
+			Desc:  query.Desc,
+			Value: userSortValue(last, query.Sort),
+			ID:    last.ID,
+		})
+	}
+	response.Count = len(response.Data)
 
-	return c.JSON(fiber.Map{
-		"data":  users,
-		"count": len(users),
-	})
+	return c.JSON(response)
 }
 
 // GET /users/:id - Get user by ID
-func getUserByID(c *fiber.Ctx) error {
+func (a *API) getUserByID(c *fiber.Ctx) error {
 	id := c.Params("id")
 	userID, err := strconv.Atoi(id)
 	if err != nil {
@@ -54,15 +138,7 @@ func getUserByID(c *fiber.Ctx) error {
 		})
 	}
 
-	var user User
-	err = db.QueryRow(`
-		SELECT id, member_id, first_name, last_name, mobile_number, email, 
-		       register_date, membership_level, point_balance, created_at, updated_at 
-		FROM users WHERE id = ?
-	`, userID).Scan(&user.ID, &user.MemberID, &user.FirstName, &user.LastName,
-		&user.MobileNumber, &user.Email, &user.RegisterDate, &user.MembershipLevel,
-		&user.PointBalance, &user.CreatedAt, &user.UpdatedAt)
-
+	user, err := a.store.Users().Get(userID)
 	if err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "User not found",
@@ -74,8 +150,32 @@ func getUserByID(c *fiber.Ctx) error {
 	})
 }
 
+// validateNewUser fills in the defaults of a user about to be created and
+// returns the message explaining why it is invalid, or ""
+func validateNewUser(user *User) string {
+	// Validate required fields
+	if user.FirstName == "" || user.LastName == "" || user.MemberID == "" {
+		return "First name, last name, and member ID are required"
+	}
+
+	// Set default values
+	if user.MembershipLevel == "" {
+		user.MembershipLevel = lowestTier()
+	} else if !isTier(user.MembershipLevel) {
+		return "membership_level must be one of: " + strings.Join(tierNames(), ", ")
+	}
+	if user.RegisterDate == "" {
+		user.RegisterDate = time.Now().Format("2006-01-02")
+	}
+
+	if user.PointBalance < 0 {
+		return "Point balance cannot be negative"
+	}
+	return ""
+}
+
 // POST /users - Create new user
-func createUser(c *fiber.Ctx) error {
+func (a *API) createUser(c *fiber.Ctx) error {
 	var user User
 	if err := c.BodyParser(&user); err != nil {
 		return c.Status(400).JSON(fiber.Map{
@@ -83,45 +183,81 @@ func createUser(c *fiber.Ctx) error {
 		})
 	}
 
-	// Validate required fields
-	if user.FirstName == "" || user.LastName == "" || user.MemberID == "" {
+	if message := validateNewUser(&user); message != "" {
 		return c.Status(400).JSON(fiber.Map{
-			"error": "First name, last name, and member ID are required",
+			"error": message,
 		})
 	}
 
-	// Set default values
-	if user.MembershipLevel == "" {
-		user.MembershipLevel = "Bronze"
+	// Referral codes are issued, not chosen; referrer_code names the member
+	// who referred this one
+	user.ReferralCode = ""
+	user.ReferredBy = nil
+	var referral struct {
+		Code string `json:"referrer_code"`
 	}
-	if user.RegisterDate == "" {
-		user.RegisterDate = time.Now().Format("2006-01-02")
+	if err := c.BodyParser(&referral); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if code := strings.TrimSpace(referral.Code); code != "" {
+		referrer, err := a.store.Users().GetByReferralCode(strings.ToUpper(code))
+		if err == errUserNotFound {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "referrer_code does not match any member",
+			})
+		} else if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to look up referrer: " + err.Error(),
+			})
+		}
+		user.ReferredBy = &referrer.ID
 	}
 
-	result, err := db.Exec(`
-		INSERT INTO users (member_id, first_name, last_name, mobile_number, email, 
-		                   register_date, membership_level, point_balance) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, user.MemberID, user.FirstName, user.LastName, user.MobileNumber, user.Email,
-		user.RegisterDate, user.MembershipLevel, user.PointBalance)
-
-	if err != nil {
+	if err := createMember(a.store, &user); err != nil {
+		if err == errDuplicateUser {
+			return c.Status(409).JSON(fiber.Map{
+				"error": "A user with this member ID or email already exists",
+			})
+		}
+		var rejected *referralRejectedError
+		if errors.As(err, &rejected) {
+			return c.Status(422).JSON(fiber.Map{
+				"error": rejected.Error(),
+			})
+		}
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to create user: " + err.Error(),
 		})
 	}
 
-	id, _ := result.LastInsertId()
-	user.ID = int(id)
-
 	return c.Status(201).JSON(fiber.Map{
 		"message": "User created successfully",
 		"data":    user,
 	})
 }
 
-// PUT /users/:id - Update user
-func updateUser(c *fiber.Ctx) error {
+// userPatchFields maps the JSON fields accepted by updateUser to UserPatch.
+// Nullable fields may be cleared by sending an explicit null.
+var userPatchFields = []struct {
+	field    string
+	nullable bool
+	target   func(p *UserPatch) **string
+}{
+	{"member_id", false, func(p *UserPatch) **string { return &p.MemberID }},
+	{"first_name", false, func(p *UserPatch) **string { return &p.FirstName }},
+	{"last_name", false, func(p *UserPatch) **string { return &p.LastName }},
+	{"mobile_number", true, func(p *UserPatch) **string { return &p.MobileNumber }},
+	{"email", true, func(p *UserPatch) **string { return &p.Email }},
+	{"register_date", false, func(p *UserPatch) **string { return &p.RegisterDate }},
+	{"membership_level", false, func(p *UserPatch) **string { return &p.MembershipLevel }},
+}
+
+// PUT/PATCH /users/:id - Partially update a user's profile.
+// Only fields present in the body are changed; point_balance is read-only
+// here and can only move through the ledgered points and transfer endpoints.
+func (a *API) updateUser(c *fiber.Ctx) error {
 	id := c.Params("id")
 	userID, err := strconv.Atoi(id)
 	if err != nil {
@@ -130,54 +266,79 @@ func updateUser(c *fiber.Ctx) error {
 		})
 	}
 
-	var user User
-	if err := c.BodyParser(&user); err != nil {
+	// Decode into raw fields so an absent field can be told apart from null
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(c.Body(), &fields); err != nil {
 		return c.Status(400).JSON(fiber.Map{
 			"error": "Invalid request body",
 		})
 	}
 
 	// Check if user exists
-	var exists bool
-	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists)
-	if err != nil || !exists {
+	current, err := a.store.Users().Get(userID)
+	if err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "User not found",
 		})
 	}
 
-	_, err = db.Exec(`
-		UPDATE users SET 
-		member_id = COALESCE(NULLIF(?, ''), member_id),
-		first_name = COALESCE(NULLIF(?, ''), first_name),
-		last_name = COALESCE(NULLIF(?, ''), last_name),
-		mobile_number = COALESCE(NULLIF(?, ''), mobile_number),
-		email = COALESCE(NULLIF(?, ''), email),
-		register_date = COALESCE(NULLIF(?, ''), register_date),
-		membership_level = COALESCE(NULLIF(?, ''), membership_level),
-		point_balance = CASE WHEN ? >= 0 THEN ? ELSE point_balance END,
-		updated_at = CURRENT_TIMESTAMP
-		WHERE id = ?
-	`, user.MemberID, user.FirstName, user.LastName, user.MobileNumber, user.Email,
-		user.RegisterDate, user.MembershipLevel, user.PointBalance, user.PointBalance, userID)
+	if raw, ok := fields["point_balance"]; ok {
+		var balance int
+		if err := json.Unmarshal(raw, &balance); err != nil || balance != current.PointBalance {
+			return c.Status(422).JSON(fiber.Map{
+				"error": "point_balance cannot be updated directly; use the /users/:id/points endpoints",
+			})
+		}
+	}
 
-	if err != nil {
+	var patch UserPatch
+	for _, f := range userPatchFields {
+		raw, ok := fields[f.field]
+		if !ok {
+			continue
+		}
+
+		value := ""
+		if string(raw) == "null" {
+			if !f.nullable {
+				return c.Status(400).JSON(fiber.Map{
+					"error": f.field + " cannot be null",
+				})
+			}
+		} else {
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return c.Status(400).JSON(fiber.Map{
+					"error": f.field + " must be a string",
+				})
+			}
+			if value == "" && !f.nullable {
+				return c.Status(400).JSON(fiber.Map{
+					"error": f.field + " cannot be empty",
+				})
+			}
+		}
+		*f.target(&patch) = &value
+	}
+
+	if level := patch.MembershipLevel; level != nil && !isTier(*level) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "membership_level must be one of: " + strings.Join(tierNames(), ", "),
+		})
+	}
+
+	if err := updateMember(a.store, current, patch); err != nil {
+		if err == errDuplicateUser {
+			return c.Status(409).JSON(fiber.Map{
+				"error": "A user with this member ID or email already exists",
+			})
+		}
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to update user: " + err.Error(),
 		})
 	}
 
 	// Fetch updated user
-	var updatedUser User
-	err = db.QueryRow(`
-		SELECT id, member_id, first_name, last_name, mobile_number, email, 
-		       register_date, membership_level, point_balance, created_at, updated_at 
-		FROM users WHERE id = ?
-	`, userID).Scan(&updatedUser.ID, &updatedUser.MemberID, &updatedUser.FirstName,
-		&updatedUser.LastName, &updatedUser.MobileNumber, &updatedUser.Email,
-		&updatedUser.RegisterDate, &updatedUser.MembershipLevel,
-		&updatedUser.PointBalance, &updatedUser.CreatedAt, &updatedUser.UpdatedAt)
-
+	updatedUser, err := a.store.Users().Get(userID)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to fetch updated user",
@@ -191,7 +352,7 @@ func updateUser(c *fiber.Ctx) error {
 }
 
 // DELETE /users/:id - Delete user
-func deleteUser(c *fiber.Ctx) error {
+func (a *API) deleteUser(c *fiber.Ctx) error {
 	id := c.Params("id")
 	userID, err := strconv.Atoi(id)
 	if err != nil {
@@ -200,16 +361,17 @@ func deleteUser(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check if user exists
-	var exists bool
-	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists)
-	if err != nil || !exists {
+	err = a.store.Users().Delete(userID)
+	if err == errUserNotFound {
 		return c.Status(404).JSON(fiber.Map{
 			"error": "User not found",
 		})
 	}
-
-	_, err = db.Exec("DELETE FROM users WHERE id = ?", userID)
+	if err == errUserHasHistory {
+		return c.Status(409).JSON(fiber.Map{
+			"error": "User has transfers or ledger entries and cannot be deleted",
+		})
+	}
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to delete user",
@@ -221,8 +383,103 @@ func deleteUser(c *fiber.Ctx) error {
 	})
 }
 
+// uploadedFile returns the file sent as the request body or as the "file"
+// field of a multipart form, with its name if it has one, or the message
+// explaining why it cannot be read
+func uploadedFile(c *fiber.Ctx) ([]byte, string, string) {
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		return c.Body(), "", ""
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		return nil, "", "the multipart form needs a file field"
+	}
+	file, err := header.Open()
+	if err != nil {
+		return nil, "", "the uploaded file cannot be read"
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, "", "the uploaded file cannot be read"
+	}
+	return data, header.Filename, ""
+}
+
+// describeError returns the HTTP status, error code and message a business
+// error is reported with. ok is false for errors with no client-facing
+// meaning, which are reported as internal errors.
+func describeError(err error) (status int, code, message string, ok bool) {
+	var statusErr *transferStatusError
+	if errors.As(err, &statusErr) {
+		return 409, "INVALID_STATUS", statusErr.Error(), true
+	}
+	var redemptionErr *redemptionStatusError
+	if errors.As(err, &redemptionErr) {
+		return 409, "INVALID_STATUS", redemptionErr.Error(), true
+	}
+	var scheduleErr *scheduleStatusError
+	if errors.As(err, &scheduleErr) {
+		return 409, "INVALID_STATUS", scheduleErr.Error(), true
+	}
+	var limitErr *transferLimitError
+	if errors.As(err, &limitErr) {
+		return 422, "LIMIT_EXCEEDED", limitErr.Error(), true
+	}
+
+	responses := map[error]struct {
+		status  int
+		code    string
+		message string
+	}{
+		errFromUserNotFound:    {404, "NOT_FOUND", "From user not found"},
+		errToUserNotFound:      {404, "NOT_FOUND", "To user not found"},
+		errUserNotFound:        {404, "NOT_FOUND", "User not found"},
+		errTransferNotFound:    {404, "NOT_FOUND", "Transfer not found"},
+		errSelfTransfer:        {422, "BUSINESS_ERROR", "Cannot transfer points to yourself"},
+		errInsufficientBalance: {409, "INSUFFICIENT_BALANCE", "Insufficient point balance"},
+		errPointsAlreadySpent:  {409, "INSUFFICIENT_BALANCE", "Recipient has already spent the transferred points"},
+		errIdemKeyReused:       {422, "IDEMPOTENCY_KEY_REUSED", "Idempotency-Key has already been used with a different request payload"},
+		errTransferNotPending:  {409, "INVALID_STATUS", "Transfer is no longer pending"},
+		errHoldExpired:         {409, "HOLD_EXPIRED", "Pending transfer has expired"},
+		errNotSender:           {403, "FORBIDDEN", "Only the sender can confirm or cancel a pending transfer"},
+
+		errRewardNotFound:          {404, "NOT_FOUND", "Reward not found"},
+		errRedemptionNotFound:      {404, "NOT_FOUND", "Order not found"},
+		errRedemptionStatusChanged: {409, "INVALID_STATUS", "Order is no longer placed"},
+		errRewardUnavailable:       {422, "REWARD_UNAVAILABLE", "Reward is inactive or outside its validity window"},
+		errRewardNotEligible:       {422, "NOT_ELIGIBLE", "Reward is not available to this membership tier"},
+		errOutOfStock:              {409, "OUT_OF_STOCK", "Reward is out of stock"},
+		errCampaignNotFound:        {404, "NOT_FOUND", "Campaign not found"},
+		errPartnerNotFound:         {404, "NOT_FOUND", "Partner not found"},
+		errPartnerInactive:         {422, "PARTNER_INACTIVE", "Partner is inactive"},
+		errMemberNotFound:          {404, "NOT_FOUND", "No member with this memberId"},
+		errReceiptReused:           {409, "RECEIPT_REUSED", "Receipt ID has already been used for a different purchase"},
+		errScheduleNotFound:        {404, "NOT_FOUND", "Scheduled transfer not found"},
+		errScheduleStatusChanged:   {409, "INVALID_STATUS", "Scheduled transfer status changed, try again"},
+	}
+	if r, ok := responses[err]; ok {
+		return r.status, r.code, r.message, true
+	}
+	return 500, "INTERNAL_ERROR", "", false
+}
+
+// transferErrorResponse writes the HTTP response for an error returned by
+// the point operations. action completes "Failed to ..." for unexpected errors.
+func transferErrorResponse(c *fiber.Ctx, err error, action string) error {
+	status, code, message, ok := describeError(err)
+	if !ok {
+		message = "Failed to " + action
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"error":   code,
+		"message": message,
+	})
+}
+
 // POST /transfers - Create a new point transfer
-func createTransfer(c *fiber.Ctx) error {
+func (a *API) createTransfer(c *fiber.Ctx) error {
 	var req TransferCreateRequest
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{
@@ -239,314 +496,273 @@ func createTransfer(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check if trying to transfer to themselves
-	if req.FromUserID == req.ToUserID {
-		return c.Status(422).JSON(fiber.Map{
-			"error":   "BUSINESS_ERROR",
-			"message": "Cannot transfer points to yourself",
-		})
+	// Members can only send their own points
+	if principal := principalFrom(c); principal.Role == roleMember && req.FromUserID != principal.UserID {
+		return forbidden(c, "Members can only transfer from their own account")
 	}
 
-	// Generate idempotency key
-	idemKey := uuid.New().String()
-	now := time.Now().UTC().Format(time.RFC3339)
-
-	// Start transaction
-	tx, err := db.Begin()
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "INTERNAL_ERROR",
-			"message": "Failed to start transaction",
+	// Use the client-supplied idempotency key, or let executeTransfer generate one
+	idemKey := c.Get("Idempotency-Key")
+	if len(idemKey) > maxIdemKeyLength {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdemKeyLength),
 		})
 	}
-	defer tx.Rollback()
-
-	// Check if both users exist and get their current balances
-	var fromUserBalance, toUserBalance int
-	err = tx.QueryRow("SELECT point_balance FROM users WHERE id = ?", req.FromUserID).Scan(&fromUserBalance)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.Status(404).JSON(fiber.Map{
-				"error":   "NOT_FOUND",
-				"message": "From user not found",
-			})
-		}
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "INTERNAL_ERROR",
-			"message": "Failed to check from user",
+	if strings.HasPrefix(idemKey, batchLegKeyPrefix) {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": fmt.Sprintf("Idempotency-Key must not start with %q, which is reserved for batch transfers", batchLegKeyPrefix),
 		})
 	}
 
-	err = tx.QueryRow("SELECT point_balance FROM users WHERE id = ?", req.ToUserID).Scan(&toUserBalance)
+	transfer, replayed, err := executeTransfer(a.store, req, idemKey)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.Status(404).JSON(fiber.Map{
-				"error":   "NOT_FOUND",
-				"message": "To user not found",
-			})
-		}
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "INTERNAL_ERROR",
-			"message": "Failed to check to user",
-		})
+		return transferErrorResponse(c, err, "create transfer")
 	}
 
-	// Check if from user has sufficient balance
-	if fromUserBalance < req.Amount {
-		return c.Status(409).JSON(fiber.Map{
-			"error":   "INSUFFICIENT_BALANCE",
-			"message": "Insufficient point balance",
-		})
+	// Set response header
+	c.Set("Idempotency-Key", transfer.IdemKey)
+	if replayed {
+		c.Set("Idempotent-Replayed", "true")
 	}
 
-	// Create transfer record
-	result, err := tx.Exec(`
-		INSERT INTO transfers (from_user_id, to_user_id, amount, status, note, idempotency_key, created_at, updated_at, completed_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, req.FromUserID, req.ToUserID, req.Amount, "completed", req.Note, idemKey, now, now, now)
+	return c.Status(201).JSON(TransferCreateResponse{
+		Transfer: transfer,
+	})
+}
 
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "INTERNAL_ERROR",
-			"message": "Failed to create transfer: " + err.Error(),
+// GET /transfers/:id - Get transfer by idempotency key
+func (a *API) getTransferByID(c *fiber.Ctx) error {
+	idemKey := c.Params("id")
+	if idemKey == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "Transfer ID is required",
 		})
 	}
 
-	transferID, _ := result.LastInsertId()
-
-	// Update user balances
-	newFromBalance := fromUserBalance - req.Amount
-	newToBalance := toUserBalance + req.Amount
-
-	_, err = tx.Exec("UPDATE users SET point_balance = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", newFromBalance, req.FromUserID)
+	transfer, err := a.store.Transfers().GetByIdemKey(idemKey)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "INTERNAL_ERROR",
-			"message": "Failed to update from user balance",
-		})
+		return transferErrorResponse(c, err, "fetch transfer")
 	}
 
-	_, err = tx.Exec("UPDATE users SET point_balance = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", newToBalance, req.ToUserID)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "INTERNAL_ERROR",
-			"message": "Failed to update to user balance",
-		})
+	// Other members' transfers look exactly like missing ones
+	if !principalFrom(c).canSeeTransfer(transfer) {
+		return transferErrorResponse(c, errTransferNotFound, "fetch transfer")
 	}
 
-	// Create ledger entries
-	_, err = tx.Exec(`
-		INSERT INTO point_ledger (user_id, change, balance_after, event_type, transfer_id, reference, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, req.FromUserID, -req.Amount, newFromBalance, "transfer_out", transferID, fmt.Sprintf("Transfer to user %d", req.ToUserID), now)
+	return c.JSON(TransferGetResponse{
+		Transfer: transfer,
+	})
+}
 
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "INTERNAL_ERROR",
-			"message": "Failed to create from user ledger entry",
-		})
+// parsePagination reads the page and pageSize query parameters, falling back
+// to page 1 and the configured default page size when they are missing or
+// out of range
+func parsePagination(c *fiber.Ctx) (int, int) {
+	page := 1
+	if pageStr := c.Query("page"); pageStr != "" {
+		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
+			page = p
+		}
 	}
 
-	_, err = tx.Exec(`
-		INSERT INTO point_ledger (user_id, change, balance_after, event_type, transfer_id, reference, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, req.ToUserID, req.Amount, newToBalance, "transfer_in", transferID, fmt.Sprintf("Transfer from user %d", req.FromUserID), now)
-
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "INTERNAL_ERROR",
-			"message": "Failed to create to user ledger entry",
-		})
+	pageSize := cfg.DefaultPageSize
+	if pageSizeStr := c.Query("pageSize"); pageSizeStr != "" {
+		if ps, err := strconv.Atoi(pageSizeStr); err == nil && ps > 0 && ps <= cfg.MaxPageSize {
+			pageSize = ps
+		}
 	}
 
-	// Commit transaction
-	if err := tx.Commit(); err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "INTERNAL_ERROR",
-			"message": "Failed to commit transaction",
-		})
-	}
+	return page, pageSize
+}
 
-	// Prepare response
-	transfer := Transfer{
-		IdemKey:     idemKey,
-		TransferID:  int(transferID),
-		FromUserID:  req.FromUserID,
-		ToUserID:    req.ToUserID,
-		Amount:      req.Amount,
-		Status:      "completed",
-		CreatedAt:   now,
-		UpdatedAt:   now,
-	}
-	
-	if req.Note != "" {
-		transfer.Note = &req.Note
+// parseListPage reads the paging of a listing in listPage's order: a
+// cursor from nextCursor or prevCursor when one is passed, otherwise
+// page/pageSize. The page returned is 0 when a cursor selected the rows. The
+// ListPage asks for one extra row so keysetPage can tell whether more rows
+// follow.
+func parseListPage(c *fiber.Ctx, listPage ListPage) (ListPage, int, int, error) {
+	page, pageSize := parsePagination(c)
+	listPage.Limit = pageSize + 1
+	listPage.Offset = (page - 1) * pageSize
+
+	if raw := c.Query("cursor"); raw != "" {
+		cursor, err := decodeCursor(raw, listPage.sortField(), !listPage.Asc)
+		if err != nil {
+			return ListPage{}, 0, 0, err
+		}
+		listPage.applyCursor(cursor)
+		listPage.Offset = 0
+		page = 0
 	}
-	transfer.CompletedAt = &now
-
-	// Set response header
-	c.Set("Idempotency-Key", idemKey)
+	return listPage, page, pageSize, nil
+}
 
-	return c.Status(201).JSON(TransferCreateResponse{
-		Transfer: transfer,
-	})
+// transferKeyset is a transfer's position in a listing sorted by field
+func transferKeyset(t Transfer, field string) Keyset {
+	return Keyset{Value: transferSortValue(t, field), ID: t.TransferID}
 }
 
-// GET /transfers/:id - Get transfer by idempotency key
-func getTransferByID(c *fiber.Ctx) error {
-	idemKey := c.Params("id")
-	if idemKey == "" {
+// transferStatuses lists the statuses allowed by the transfers CHECK constraint
+var transferStatuses = []string{"pending", "processing", "completed", "failed", "cancelled", "reversed"}
+
+// GET /transfers - Filter, sort and paginate transfers.
+// Members may omit userId to list their own transfers and cannot list anyone
+// else's; staff may omit it to search every member's transfers.
+// Pages are selected with page/pageSize, or by passing back nextCursor or prevCursor as cursor.
+func (a *API) getTransfers(c *fiber.Ctx) error {
+	principal := principalFrom(c)
+	validationError := func(message string) error {
 		return c.Status(400).JSON(fiber.Map{
 			"error":   "VALIDATION_ERROR",
-			"message": "Transfer ID is required",
+			"message": message,
 		})
 	}
 
-	var transfer Transfer
-	var note, completedAt, failReason sql.NullString
-	
-	err := db.QueryRow(`
-		SELECT idempotency_key, id, from_user_id, to_user_id, amount, status, note, 
-		       created_at, updated_at, completed_at, fail_reason
-		FROM transfers 
-		WHERE idempotency_key = ?
-	`, idemKey).Scan(&transfer.IdemKey, &transfer.TransferID, &transfer.FromUserID, 
-		&transfer.ToUserID, &transfer.Amount, &transfer.Status, &note,
-		&transfer.CreatedAt, &transfer.UpdatedAt, &completedAt, &failReason)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.Status(404).JSON(fiber.Map{
-				"error":   "NOT_FOUND",
-				"message": "Transfer not found",
-			})
+	var filter TransferFilter
+	userIDStr := c.Query("userId")
+	if userIDStr == "" && principal.Role == roleMember {
+		userIDStr = strconv.Itoa(principal.UserID)
+	}
+	if userIDStr != "" {
+		userID, err := strconv.Atoi(userIDStr)
+		if err != nil || userID <= 0 {
+			return validationError("userId must be a positive integer")
 		}
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "INTERNAL_ERROR",
-			"message": "Failed to fetch transfer: " + err.Error(),
-		})
+		filter.UserID = userID
 	}
 
-	// Handle nullable fields
-	if note.Valid {
-		transfer.Note = &note.String
-	}
-	if completedAt.Valid {
-		transfer.CompletedAt = &completedAt.String
-	}
-	if failReason.Valid {
-		transfer.FailReason = &failReason.String
+	// Answer as if the user did not exist rather than revealing them
+	if principal.Role == roleMember && filter.UserID != principal.UserID {
+		return transferErrorResponse(c, errUserNotFound, "fetch transfers")
 	}
 
-	return c.JSON(TransferGetResponse{
-		Transfer: transfer,
-	})
-}
+	if direction := c.Query("direction"); direction != "" {
+		if direction != "sent" && direction != "received" {
+			return validationError("direction must be sent or received")
+		}
+		if filter.UserID == 0 {
+			return validationError("direction needs a userId")
+		}
+		filter.Direction = direction
+	}
 
-// GET /transfers - List transfers with user filtering and pagination
-func getTransfers(c *fiber.Ctx) error {
-	// Get query parameters
-	userIDStr := c.Query("userId")
-	if userIDStr == "" {
-		return c.Status(400).JSON(fiber.Map{
-			"error":   "VALIDATION_ERROR",
-			"message": "userId query parameter is required",
-		})
+	if value := c.Query("counterpartyId"); value != "" {
+		counterpartyID, err := strconv.Atoi(value)
+		if err != nil || counterpartyID <= 0 {
+			return validationError("counterpartyId must be a positive integer")
+		}
+		filter.CounterpartyID = counterpartyID
 	}
 
-	userID, err := strconv.Atoi(userIDStr)
-	if err != nil || userID <= 0 {
-		return c.Status(400).JSON(fiber.Map{
-			"error":   "VALIDATION_ERROR",
-			"message": "userId must be a positive integer",
-		})
+	if value := c.Query("scheduleId"); value != "" {
+		scheduleID, err := strconv.Atoi(value)
+		if err != nil || scheduleID <= 0 {
+			return validationError("scheduleId must be a positive integer")
+		}
+		filter.ScheduleID = scheduleID
+	}
+
+	if value := c.Query("status"); value != "" {
+		for _, status := range strings.Split(value, ",") {
+			status = strings.TrimSpace(status)
+			valid := false
+			for _, s := range transferStatuses {
+				valid = valid || s == status
+			}
+			if !valid {
+				return validationError("status must be a comma-separated list of: " + strings.Join(transferStatuses, ", "))
+			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
 	}
 
-	page := 1
-	if pageStr := c.Query("page"); pageStr != "" {
-		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
-			page = p
+	for _, bound := range []struct {
+		param string
+		dst   **int
+	}{
+		{"minAmount", &filter.MinAmount},
+		{"maxAmount", &filter.MaxAmount},
+	} {
+		if value := c.Query(bound.param); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return validationError(bound.param + " must be an integer")
+			}
+			*bound.dst = &n
 		}
 	}
 
-	pageSize := 20
-	if pageSizeStr := c.Query("pageSize"); pageSizeStr != "" {
-		if ps, err := strconv.Atoi(pageSizeStr); err == nil && ps > 0 && ps <= 200 {
-			pageSize = ps
+	for _, bound := range []struct {
+		param    string
+		endOfDay bool
+		dst      *string
+	}{
+		{"createdFrom", false, &filter.CreatedFrom},
+		{"createdTo", true, &filter.CreatedTo},
+		{"completedFrom", false, &filter.CompletedFrom},
+		{"completedTo", true, &filter.CompletedTo},
+	} {
+		if value := c.Query(bound.param); value != "" {
+			parsed, err := parseDateBound(value, bound.endOfDay)
+			if err != nil {
+				return validationError(bound.param + " must be a date (YYYY-MM-DD) or RFC3339 timestamp")
+			}
+			*bound.dst = parsed
 		}
 	}
 
-	offset := (page - 1) * pageSize
+	filter.Note = strings.TrimSpace(c.Query("note"))
+	filter.BatchID = c.Query("batchId")
 
-	// Get total count
-	var total int
-	err = db.QueryRow(`
-		SELECT COUNT(*) FROM transfers 
-		WHERE from_user_id = ? OR to_user_id = ?
-	`, userID, userID).Scan(&total)
+	order := ListPage{Sort: c.Query("sort", "created_at")}
+	if _, ok := transferSortFields[order.Sort]; !ok {
+		return validationError("sort must be created_at or amount")
+	}
+	switch c.Query("order", "desc") {
+	case "asc":
+		order.Asc = true
+	case "desc":
+	default:
+		return validationError("order must be asc or desc")
+	}
 
+	listPage, page, pageSize, err := parseListPage(c, order)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error":   "INTERNAL_ERROR",
-			"message": "Failed to count transfers",
-		})
+		return validationError("cursor is invalid or was issued for a different sort order")
 	}
 
-	// Get transfers
-	rows, err := db.Query(`
-		SELECT idempotency_key, id, from_user_id, to_user_id, amount, status, note,
-		       created_at, updated_at, completed_at, fail_reason
-		FROM transfers 
-		WHERE from_user_id = ? OR to_user_id = ?
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`, userID, userID, pageSize, offset)
-
+	transfers, err := a.store.Transfers().List(filter, listPage)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error":   "INTERNAL_ERROR",
 			"message": "Failed to fetch transfers",
 		})
 	}
-	defer rows.Close()
 
-	var transfers []Transfer
-	for rows.Next() {
-		var transfer Transfer
-		var note, completedAt, failReason sql.NullString
-		
-		err := rows.Scan(&transfer.IdemKey, &transfer.TransferID, &transfer.FromUserID,
-			&transfer.ToUserID, &transfer.Amount, &transfer.Status, &note,
-			&transfer.CreatedAt, &transfer.UpdatedAt, &completedAt, &failReason)
+	response := TransferListResponse{
+		Page:     page,
+		PageSize: pageSize,
+	}
+	key := func(t Transfer) Keyset { return transferKeyset(t, listPage.Sort) }
+	response.Data, response.NextCursor, response.PrevCursor = keysetPage(transfers, listPage, pageSize, key)
+	if response.Data == nil {
+		response.Data = []Transfer{}
+	}
+
+	// Cursor pages skip the count; it is only needed to number pages
+	if page > 0 {
+		total, err := a.store.Transfers().Count(filter)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
 				"error":   "INTERNAL_ERROR",
-				"message": "Failed to scan transfer data",
+				"message": "Failed to count transfers",
 			})
 		}
-		
-		// Handle nullable fields
-		if note.Valid {
-			transfer.Note = &note.String
-		}
-		if completedAt.Valid {
-			transfer.CompletedAt = &completedAt.String
-		}
-		if failReason.Valid {
-			transfer.FailReason = &failReason.String
-		}
-		
-		transfers = append(transfers, transfer)
+		response.Total = &total
 	}
 
-	if transfers == nil {
-		transfers = []Transfer{}
-	}
-
-	return c.JSON(TransferListResponse{
-		Data:     transfers,
-		Page:     page,
-		PageSize: pageSize,
-		Total:    total,
-	})
-}
\ No newline at end of file
+	return c.JSON(response)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// LedgerListResponse represents the response for listing ledger entries.
+// Like TransferListResponse, Page and Total are only set for page-numbered requests.
+type LedgerListResponse struct {
+	Data       []PointLedgerEntry `json:"data"`
+	Page       int                `json:"page,omitempty"`
+	PageSize   int                `json:"pageSize"`
+	Total      *int               `json:"total,omitempty"`
+	NextCursor string             `json:"nextCursor,omitempty"`
+	PrevCursor string             `json:"prevCursor,omitempty"`
+}
+
+// PointsChangeRequest represents the request body for earning, redeeming or adjusting points
+type PointsChangeRequest struct {
+	Amount    int             `json:"amount"`
+	Reference string          `json:"reference,omitempty"`
+	Metadata  json.RawMessage `json:"metadata,omitempty"`
+}
+
+// PointsChangeResponse represents the response for a ledgered balance change.
+// Bonuses lists the campaign and referral bonuses an earn entry credited
+// the member.
+type PointsChangeResponse struct {
+	Entry   PointLedgerEntry   `json:"entry"`
+	Bonuses []PointLedgerEntry `json:"bonuses,omitempty"`
+}
+
+// ledgerEventTypes lists the event types allowed by the point_ledger CHECK constraint
+var ledgerEventTypes = []string{"transfer_out", "transfer_in", "adjust", "earn", "redeem", "tier_change", "expire"}
+
+func isLedgerEventType(eventType string) bool {
+	for _, t := range ledgerEventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDateBound parses a date-range query value given either as RFC3339 or
+// as YYYY-MM-DD. When endOfDay is set, a plain date is widened to cover the
+// whole day so that "to=2024-01-31" includes entries made on the 31st.
+func parseDateBound(value string, endOfDay bool) (string, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC().Format(time.RFC3339), nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return "", err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Second)
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
+
+// GET /users/:id/ledger - List a user's point ledger entries with filtering and pagination.
+// Pages are selected with page/pageSize, or by passing back nextCursor or prevCursor as cursor.
+func (a *API) getUserLedger(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil || userID <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "User ID must be a positive integer",
+		})
+	}
+
+	if _, err := a.store.Users().Get(userID); err != nil {
+		return transferErrorResponse(c, err, "check user")
+	}
+
+	// Build filters
+	filter := LedgerFilter{UserID: userID}
+
+	if eventType := c.Query("eventType"); eventType != "" {
+		if !isLedgerEventType(eventType) {
+			return c.Status(400).JSON(fiber.Map{
+				"error":   "VALIDATION_ERROR",
+				"message": "eventType must be one of: " + strings.Join(ledgerEventTypes, ", "),
+			})
+		}
+		filter.EventType = eventType
+	}
+
+	if transferIDStr := c.Query("transferId"); transferIDStr != "" {
+		transferID, err := strconv.Atoi(transferIDStr)
+		if err != nil || transferID <= 0 {
+			return c.Status(400).JSON(fiber.Map{
+				"error":   "VALIDATION_ERROR",
+				"message": "transferId must be a positive integer",
+			})
+		}
+		filter.TransferID = transferID
+	}
+
+	if fromStr := c.Query("from"); fromStr != "" {
+		from, err := parseDateBound(fromStr, false)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error":   "VALIDATION_ERROR",
+				"message": "from must be a date (YYYY-MM-DD) or RFC3339 timestamp",
+			})
+		}
+		filter.From = from
+	}
+
+	if toStr := c.Query("to"); toStr != "" {
+		to, err := parseDateBound(toStr, true)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error":   "VALIDATION_ERROR",
+				"message": "to must be a date (YYYY-MM-DD) or RFC3339 timestamp",
+			})
+		}
+		filter.To = to
+	}
+
+	listPage, page, pageSize, err := parseListPage(c, ListPage{})
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "cursor is invalid",
+		})
+	}
+
+	entries, err := a.store.Ledger().List(filter, listPage)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "INTERNAL_ERROR",
+			"message": "Failed to fetch ledger entries",
+		})
+	}
+
+	response := LedgerListResponse{
+		Page:     page,
+		PageSize: pageSize,
+	}
+	response.Data, response.NextCursor, response.PrevCursor = keysetPage(entries, listPage, pageSize, ledgerKeyset)
+
+	// Cursor pages skip the count; it is only needed to number pages
+	if page > 0 {
+		total, err := a.store.Ledger().Count(filter)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error":   "INTERNAL_ERROR",
+				"message": "Failed to count ledger entries",
+			})
+		}
+		response.Total = &total
+	}
+
+	return c.JSON(response)
+}
+
+// ledgerKeyset is a ledger entry's position in a newest-first listing
+func ledgerKeyset(e PointLedgerEntry) Keyset {
+	return Keyset{Value: e.CreatedAt, ID: e.ID}
+}
+
+// POST /users/:id/points/earn - Credit points to a user
+func (a *API) earnPoints(c *fiber.Ctx) error {
+	return a.changePoints(c, "earn")
+}
+
+// POST /users/:id/points/redeem - Debit points from a user
+func (a *API) redeemPoints(c *fiber.Ctx) error {
+	return a.changePoints(c, "redeem")
+}
+
+// POST /users/:id/points/adjust - Manually correct a user's balance in either direction
+func (a *API) adjustPoints(c *fiber.Ctx) error {
+	return a.changePoints(c, "adjust")
+}
+
+// changePoints validates a PointsChangeRequest and applies it as a single
+// ledgered balance change of the given event type
+func (a *API) changePoints(c *fiber.Ctx, eventType string) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil || userID <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "User ID must be a positive integer",
+		})
+	}
+
+	var req PointsChangeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "Invalid request body",
+		})
+	}
+
+	// earn and redeem take a positive amount; adjust is signed
+	change := req.Amount
+	switch eventType {
+	case "earn", "redeem":
+		if req.Amount <= 0 {
+			return c.Status(400).JSON(fiber.Map{
+				"error":   "VALIDATION_ERROR",
+				"message": "amount must be a positive integer",
+			})
+		}
+		if eventType == "redeem" {
+			change = -req.Amount
+		}
+	case "adjust":
+		if req.Amount == 0 {
+			return c.Status(400).JSON(fiber.Map{
+				"error":   "VALIDATION_ERROR",
+				"message": "amount must be a non-zero integer",
+			})
+		}
+		if req.Reference == "" {
+			return c.Status(400).JSON(fiber.Map{
+				"error":   "VALIDATION_ERROR",
+				"message": "reference is required for adjustments",
+			})
+		}
+	}
+
+	metadata := ""
+	if len(req.Metadata) > 0 && string(req.Metadata) != "null" {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(req.Metadata, &obj); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error":   "VALIDATION_ERROR",
+				"message": "metadata must be a JSON object",
+			})
+		}
+		metadata = string(req.Metadata)
+	}
+
+	pc := pointChange{
+		UserID:    userID,
+		Change:    change,
+		EventType: eventType,
+		Reference: req.Reference,
+		Metadata:  metadata,
+	}
+	var entry PointLedgerEntry
+	var bonuses []PointLedgerEntry
+	if eventType == "earn" {
+		entry, bonuses, err = creditEarned(a.store, pc)
+	} else {
+		entry, err = changeBalance(a.store, pc)
+	}
+	if err != nil {
+		return transferErrorResponse(c, err, "record "+eventType+" entry")
+	}
+
+	return c.Status(201).JSON(PointsChangeResponse{
+		Entry:   entry,
+		Bonuses: bonuses,
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TransferLimit caps the points a member of MembershipLevel may send. A nil
+// cap is unlimited, and a level without a TransferLimit has no limits at
+// all. Daily and monthly totals cover transfers created since midnight UTC
+// and the first of the month UTC that are pending, processing or completed.
+type TransferLimit struct {
+	MembershipLevel string `json:"membershipLevel"`
+	PerTransferMax  *int   `json:"perTransferMax"`
+	DailyMax        *int   `json:"dailyMax"`
+	MonthlyMax      *int   `json:"monthlyMax"`
+	UpdatedAt       string `json:"updatedAt"`
+}
+
+// TransferLimitRequest represents the request body for setting a level's transfer limits
+type TransferLimitRequest struct {
+	PerTransferMax *int `json:"perTransferMax"`
+	DailyMax       *int `json:"dailyMax"`
+	MonthlyMax     *int `json:"monthlyMax"`
+}
+
+// transferLimitError reports a transfer refused by one of the sender's limits
+type transferLimitError struct {
+	level     string
+	period    string
+	max       int
+	remaining int
+}
+
+func (e *transferLimitError) Error() string {
+	if e.period == "per-transfer" {
+		return fmt.Sprintf("%s members can send at most %d points per transfer", e.level, e.max)
+	}
+	return fmt.Sprintf("%s members can send at most %d points %s; %d remaining", e.level, e.max, e.period, e.remaining)
+}
+
+// checkTransferLimits refuses a transfer of amount points from userID that
+// would break the limits of their membership level. It must run inside the
+// transaction that creates the transfer, after the sender has been locked.
+func checkTransferLimits(tx Store, userID, amount int, now time.Time) error {
+	user, err := tx.Users().Get(userID)
+	if err != nil {
+		return err
+	}
+	limit, err := tx.TransferLimits().Get(user.MembershipLevel)
+	if err == errTransferLimitNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if limit.PerTransferMax != nil && amount > *limit.PerTransferMax {
+		return &transferLimitError{level: user.MembershipLevel, period: "per-transfer", max: *limit.PerTransferMax}
+	}
+
+	now = now.UTC()
+	for _, window := range []struct {
+		period string
+		max    *int
+		since  time.Time
+	}{
+		{"per day", limit.DailyMax, time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)},
+		{"per month", limit.MonthlyMax, time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		if window.max == nil {
+			continue
+		}
+		sent, err := tx.Transfers().SumSent(userID, timestamp(window.since))
+		if err != nil {
+			return err
+		}
+		if sent+amount > *window.max {
+			return &transferLimitError{
+				level:     user.MembershipLevel,
+				period:    window.period,
+				max:       *window.max,
+				remaining: max(0, *window.max-sent),
+			}
+		}
+	}
+	return nil
+}
+
+// GET /transfer-limits - List the transfer limits of every membership level
+func (a *API) getTransferLimits(c *fiber.Ctx) error {
+	limits, err := a.store.TransferLimits().List()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "INTERNAL_ERROR",
+			"message": "Failed to fetch transfer limits",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": limits,
+	})
+}
+
+// PUT /transfer-limits/:level - Set a membership level's transfer limits.
+// Omitted or null caps are unlimited; changes apply to the next transfer.
+func (a *API) setTransferLimit(c *fiber.Ctx) error {
+	// Fiber reuses the parameter's memory once the request ends; the memory store keeps it
+	level := strings.Clone(c.Params("level"))
+	if !isTier(level) {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "level must be one of: " + strings.Join(tierNames(), ", "),
+		})
+	}
+
+	var req TransferLimitRequest
+	if err := json.Unmarshal(c.Body(), &req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "Invalid request body",
+		})
+	}
+	for _, field := range []struct {
+		name  string
+		value *int
+	}{
+		{"perTransferMax", req.PerTransferMax},
+		{"dailyMax", req.DailyMax},
+		{"monthlyMax", req.MonthlyMax},
+	} {
+		if field.value != nil && *field.value <= 0 {
+			return c.Status(400).JSON(fiber.Map{
+				"error":   "VALIDATION_ERROR",
+				"message": field.name + " must be a positive integer or null",
+			})
+		}
+	}
+
+	limit := TransferLimit{
+		MembershipLevel: level,
+		PerTransferMax:  req.PerTransferMax,
+		DailyMax:        req.DailyMax,
+		MonthlyMax:      req.MonthlyMax,
+		UpdatedAt:       timestamp(time.Now()),
+	}
+	if err := a.store.TransferLimits().Set(limit); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "INTERNAL_ERROR",
+			"message": "Failed to save transfer limits",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": limit,
+	})
+}
+
+// DELETE /transfer-limits/:level - Remove a membership level's transfer limits
+func (a *API) deleteTransferLimit(c *fiber.Ctx) error {
+	err := a.store.TransferLimits().Delete(c.Params("level"))
+	if err == errTransferLimitNotFound {
+		return c.Status(404).JSON(fiber.Map{
+			"error":   "NOT_FOUND",
+			"message": "No transfer limits are set for this level",
+		})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "INTERNAL_ERROR",
+			"message": "Failed to delete transfer limits",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Transfer limits deleted",
+	})
+}
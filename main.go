@@ -4,9 +4,12 @@ import (
 	"database/sql"
 	"encoding/json"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -20,6 +23,9 @@ type User struct {
 	RegisterDate    string `json:"register_date"`
 	MembershipLevel string `json:"membership_level"`
 	PointBalance    int    `json:"point_balance"`
+	HeldBalance     int    `json:"held_balance"`
+	ReferralCode    string `json:"referral_code"`
+	ReferredBy      *int   `json:"referred_by"`
 	CreatedAt       string `json:"created_at"`
 	UpdatedAt       string `json:"updated_at"`
 }
@@ -37,6 +43,15 @@ type Transfer struct {
 	UpdatedAt   string  `json:"updatedAt"`
 	CompletedAt *string `json:"completedAt,omitempty"`
 	FailReason  *string `json:"failReason,omitempty"`
+
+	ExpiresAt      *string `json:"expiresAt,omitempty"`
+	ReversedAt     *string `json:"reversedAt,omitempty"`
+	ReversalReason *string `json:"reversalReason,omitempty"`
+
+	// BatchID groups the transfers created by one POST /transfers/batch;
+	// ScheduleID is the scheduled transfer that sent this one
+	BatchID    *string `json:"batchId,omitempty"`
+	ScheduleID *int    `json:"scheduleId,omitempty"`
 }
 
 // TransferCreateRequest represents the request body for creating a transfer
@@ -45,6 +60,21 @@ type TransferCreateRequest struct {
 	ToUserID   int    `json:"toUserId"`
 	Amount     int    `json:"amount"`
 	Note       string `json:"note,omitempty"`
+
+	// Hold creates the transfer in pending state, reserving the sender's
+	// points until it is confirmed, cancelled or expires
+	Hold bool `json:"hold,omitempty"`
+}
+
+// UserListResponse represents the response for listing users. Count is the
+// number of users on this page; NextCursor is set when more users follow.
+type UserListResponse struct {
+	Data       []User `json:"data"`
+	Count      int    `json:"count"`
+	Page       int    `json:"page,omitempty"`
+	PageSize   int    `json:"pageSize"`
+	Total      int    `json:"total"`
+	NextCursor string `json:"nextCursor,omitempty"`
 }
 
 // TransferCreateResponse represents the response for creating a transfer
@@ -57,12 +87,16 @@ type TransferGetResponse struct {
 	Transfer Transfer `json:"transfer"`
 }
 
-// TransferListResponse represents the response for listing transfers
+// TransferListResponse represents the response for listing transfers. Page
+// and Total are only set for page-numbered requests; the cursors are set when
+// rows follow or precede this page.
 type TransferListResponse struct {
-	Data     []Transfer `json:"data"`
-	Page     int        `json:"page"`
-	PageSize int        `json:"pageSize"`
-	Total    int        `json:"total"`
+	Data       []Transfer `json:"data"`
+	Page       int        `json:"page,omitempty"`
+	PageSize   int        `json:"pageSize"`
+	Total      *int       `json:"total,omitempty"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+	PrevCursor string     `json:"prevCursor,omitempty"`
 }
 
 // PointLedgerEntry represents an entry in the point ledger
@@ -78,125 +112,133 @@ type PointLedgerEntry struct {
 	CreatedAt    string `json:"created_at"`
 }
 
+// maxIdemKeyLength bounds client-supplied Idempotency-Key headers
+const maxIdemKeyLength = 255
+
 var db *sql.DB
 
-func initDatabase() {
+// dbDialect is the SQL dialect of db
+var dbDialect = sqliteDialect
+
+// openDatabase connects db to the configured SQLite or Postgres database
+func openDatabase(driver, dsn string) {
+	dbDialect = sqlDialect(driver)
+
+	// Have SQLite transactions take the write lock when they begin, so that
+	// concurrent writers wait for each other instead of failing with
+	// "database is locked" when they try to upgrade a read lock
+	if dbDialect == sqliteDialect && !strings.Contains(dsn, "_txlock=") {
+		if strings.Contains(dsn, "?") {
+			dsn += "&_txlock=immediate"
+		} else {
+			dsn += "?_txlock=immediate"
+		}
+	}
+
 	var err error
-	db, err = sql.Open("sqlite3", "./users.db")
+	db, err = sql.Open(dbDialect.driverName(), dsn)
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
-
-	// Create users table
-	createUsersTableSQL := `
-	CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		member_id TEXT UNIQUE NOT NULL,
-		first_name TEXT NOT NULL,
-		last_name TEXT NOT NULL,
-		mobile_number TEXT,
-		email TEXT UNIQUE,
-		register_date TEXT,
-		membership_level TEXT DEFAULT 'Bronze',
-		point_balance INTEGER DEFAULT 0,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);`
-
-	_, err = db.Exec(createUsersTableSQL)
-	if err != nil {
-		log.Fatal("Failed to create users table:", err)
+	if err := db.Ping(); err != nil {
+		log.Fatal("Failed to connect to database:", err)
 	}
+}
 
-	// Create transfers table
-	createTransfersTableSQL := `
-	CREATE TABLE IF NOT EXISTS transfers (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		from_user_id INTEGER NOT NULL,
-		to_user_id INTEGER NOT NULL,
-		amount INTEGER NOT NULL CHECK (amount > 0),
-		status TEXT NOT NULL CHECK (status IN ('pending','processing','completed','failed','cancelled','reversed')),
-		note TEXT,
-		idempotency_key TEXT NOT NULL UNIQUE,
-		created_at TEXT NOT NULL,
-		updated_at TEXT NOT NULL,
-		completed_at TEXT,
-		fail_reason TEXT,
-		FOREIGN KEY (from_user_id) REFERENCES users(id),
-		FOREIGN KEY (to_user_id) REFERENCES users(id)
-	);`
-
-	_, err = db.Exec(createTransfersTableSQL)
-	if err != nil {
-		log.Fatal("Failed to create transfers table:", err)
-	}
+func initDatabase(driver, dsn string, autoMigrate bool) {
+	openDatabase(driver, dsn)
 
-	// Create indexes for transfers table
-	indexesSQL := []string{
-		`CREATE INDEX IF NOT EXISTS idx_transfers_from ON transfers(from_user_id);`,
-		`CREATE INDEX IF NOT EXISTS idx_transfers_to ON transfers(to_user_id);`,
-		`CREATE INDEX IF NOT EXISTS idx_transfers_created ON transfers(created_at);`,
+	// Bring the schema up to date, or refuse to start against a newer one
+	if err := prepareSchema(autoMigrate); err != nil {
+		log.Fatal("Failed to prepare database schema: ", err)
 	}
 
-	for _, indexSQL := range indexesSQL {
-		_, err = db.Exec(indexSQL)
-		if err != nil {
-			log.Fatal("Failed to create transfer indexes:", err)
-		}
+	log.Println("Database initialized successfully")
+}
+
+// openStore returns the Store for the configured backend. The memory
+// backend keeps nothing once the process exits.
+func openStore() Store {
+	if cfg.DatabaseDriver == "memory" {
+		log.Println("Using in-memory store; data will not be persisted")
+		return newMemoryStore()
 	}
 
-	// Create point_ledger table
-	createPointLedgerTableSQL := `
-	CREATE TABLE IF NOT EXISTS point_ledger (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		user_id INTEGER NOT NULL,
-		change INTEGER NOT NULL,
-		balance_after INTEGER NOT NULL,
-		event_type TEXT NOT NULL CHECK (event_type IN ('transfer_out','transfer_in','adjust','earn','redeem')),
-		transfer_id INTEGER,
-		reference TEXT,
-		metadata TEXT,
-		created_at TEXT NOT NULL,
-		FOREIGN KEY (user_id) REFERENCES users(id),
-		FOREIGN KEY (transfer_id) REFERENCES transfers(id)
-	);`
-
-	_, err = db.Exec(createPointLedgerTableSQL)
+	initDatabase(cfg.DatabaseDriver, cfg.DatabaseDSN, cfg.AutoMigrate)
+	return newSQLStore(db, dbDialect)
+}
+
+func main() {
+	// Load configuration
+	var err error
+	cfg, err = loadConfig()
 	if err != nil {
-		log.Fatal("Failed to create point_ledger table:", err)
+		log.Fatal(err)
 	}
 
-	// Create indexes for point_ledger table
-	ledgerIndexesSQL := []string{
-		`CREATE INDEX IF NOT EXISTS idx_ledger_user ON point_ledger(user_id);`,
-		`CREATE INDEX IF NOT EXISTS idx_ledger_transfer ON point_ledger(transfer_id);`,
-		`CREATE INDEX IF NOT EXISTS idx_ledger_created ON point_ledger(created_at);`,
+	// `migrate up|down|status` manages the schema without starting the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if cfg.DatabaseDriver == "memory" {
+			log.Fatal("migrate needs a database; database_driver is memory")
+		}
+		openDatabase(cfg.DatabaseDriver, cfg.DatabaseDSN)
+		defer db.Close()
+
+		if err := runMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	for _, indexSQL := range ledgerIndexesSQL {
-		_, err = db.Exec(indexSQL)
-		if err != nil {
-			log.Fatal("Failed to create point ledger indexes:", err)
+	// `apikey create|list|revoke` manages API keys, including the first admin key
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		if cfg.DatabaseDriver == "memory" {
+			log.Fatal("apikey needs a database; database_driver is memory")
 		}
+		store := openStore()
+		defer db.Close()
+
+		if err := runAPIKeyCommand(store, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	log.Println("Database initialized successfully")
-}
+	// Initialize storage
+	store := openStore()
+	if db != nil {
+		defer db.Close()
+	}
+	api := newAPI(store)
 
-func main() {
-	// Initialize database
-	initDatabase()
-	defer db.Close()
+	// Release holds on pending transfers that were never confirmed
+	go runHoldExpiryWorker(store, cfg.HoldExpiryInterval)
+
+	// Send scheduled transfers as they fall due
+	go runScheduleWorker(store, cfg.ScheduledTransferInterval)
+
+	// Re-evaluate membership tiers nightly and send queued webhook events
+	go runTierWorker(store)
+	if cfg.PointExpiryMonths > 0 {
+		go runPointExpiryWorker(store, cfg.PointExpiryInterval)
+	}
+	if cfg.WebhookURL != "" {
+		go runWebhookWorker(store, cfg.WebhookInterval)
+	}
 
 	// Create a new Fiber app with JSON encoder configuration
-	app := fiber.New(fiber.Config{
-		JSONEncoder: func(v interface{}) ([]byte, error) {
+	appConfig := fiber.Config{}
+	if cfg.JSONPretty {
+		appConfig.JSONEncoder = func(v interface{}) ([]byte, error) {
 			return json.MarshalIndent(v, "", "  ")
-		},
-	})
+		}
+	}
+	app := fiber.New(appConfig)
 
-	// Enable CORS
-	app.Use(cors.New())
+	// Enable CORS for the configured origins
+	app.Use(cors.New(cors.Config{
+		AllowOrigins: strings.Join(cfg.CORSAllowedOrigins, ","),
+	}))
 
 	// Routes
 	app.Get("/", func(c *fiber.Ctx) error {
@@ -206,18 +248,89 @@ func main() {
 		})
 	})
 
+	// Every route registered after this needs an API key or bearer token
+	app.Use(api.authenticate)
+
+	// Partner purchase ingestion, with the partner's own API key
+	app.Post("/partners/:partnerId/purchases", allowPartnerOr(), api.createPurchase)
+	app.Post("/partners/:partnerId/purchases/bulk", allowPartnerOr(), api.createPurchasesBulk)
+	app.Get("/partners/:partnerId/purchases", allowPartnerOr(roleStaff, roleAdmin), api.getPurchases)
+
+	// Partner keys reach nothing but the routes above
+	app.Use(allowRoles(roleMember, roleStaff, roleAdmin))
+
 	// User CRUD routes
-	app.Get("/users", getUsers)
-	app.Get("/users/:id", getUserByID)
-	app.Post("/users", createUser)
-	app.Put("/users/:id", updateUser)
-	app.Delete("/users/:id", deleteUser)
-
-	// Transfer routes
-	app.Post("/transfers", createTransfer)
-	app.Get("/transfers/:id", getTransferByID)
-	app.Get("/transfers", getTransfers)
-
-	log.Println("Server starting on :3000")
-	app.Listen(":3000")
+	app.Get("/users", allowRoles(roleStaff, roleAdmin), api.getUsers)
+	app.Get("/users/:id", allowSelfOr(roleStaff, roleAdmin), api.getUserByID)
+	app.Post("/users", allowRoles(roleStaff, roleAdmin), api.createUser)
+	app.Put("/users/:id", allowRoles(roleStaff, roleAdmin), api.updateUser)
+	app.Patch("/users/:id", allowRoles(roleStaff, roleAdmin), api.updateUser)
+	app.Delete("/users/:id", allowRoles(roleAdmin), api.deleteUser)
+
+	// Point ledger routes
+	app.Get("/users/:id/ledger", allowSelfOr(roleStaff, roleAdmin), api.getUserLedger)
+	app.Post("/users/:id/points/earn", allowRoles(roleStaff, roleAdmin), api.earnPoints)
+	app.Post("/users/:id/points/redeem", allowRoles(roleStaff, roleAdmin), api.redeemPoints)
+	app.Post("/users/:id/points/adjust", allowRoles(roleAdmin), api.adjustPoints)
+	app.Get("/users/:id/points/expiring", allowSelfOr(roleStaff, roleAdmin), api.getExpiringPoints)
+
+	// Membership tier routes
+	app.Get("/tiers", api.getTiers)
+	app.Post("/tiers/evaluate", allowRoles(roleAdmin), api.evaluateTiersNow)
+	app.Get("/users/:id/tier", allowSelfOr(roleStaff, roleAdmin), api.getUserTier)
+
+	// Referral program
+	app.Get("/users/:id/referrals", allowSelfOr(roleStaff, roleAdmin), api.getUserReferrals)
+
+	// Transfer routes; members are limited to their own transfers in the handlers
+	app.Post("/transfers", api.createTransfer)
+	app.Post("/transfers/batch", api.createTransferBatch)
+	app.Get("/transfers/:id", api.getTransferByID)
+	app.Get("/transfers", api.getTransfers)
+	app.Post("/transfers/:id/reverse", allowRoles(roleStaff, roleAdmin), api.reverseTransfer)
+	app.Post("/transfers/:id/confirm", api.confirmTransfer)
+	app.Post("/transfers/:id/cancel", api.cancelTransfer)
+
+	// Transfer limits per membership level
+	app.Get("/transfer-limits", allowRoles(roleStaff, roleAdmin), api.getTransferLimits)
+	app.Put("/transfer-limits/:level", allowRoles(roleAdmin), api.setTransferLimit)
+	app.Delete("/transfer-limits/:level", allowRoles(roleAdmin), api.deleteTransferLimit)
+
+	// Rewards catalog and redemption orders; members are limited to their own orders in the handlers
+	app.Get("/rewards", api.getRewards)
+	app.Get("/rewards/:id", api.getRewardByID)
+	app.Post("/rewards", allowRoles(roleAdmin), api.createReward)
+	app.Put("/rewards/:id", allowRoles(roleAdmin), api.updateReward)
+	app.Post("/redemptions", api.createRedemption)
+	app.Get("/redemptions", api.getRedemptions)
+	app.Get("/redemptions/:id", api.getRedemptionByID)
+	app.Post("/redemptions/:id/fulfil", allowRoles(roleStaff, roleAdmin), api.fulfilRedemptionOrder)
+	app.Post("/redemptions/:id/cancel", api.cancelRedemptionOrder)
+
+	// Scheduled transfer routes; members are limited to the schedules they send in the handlers
+	app.Post("/scheduled-transfers", api.createScheduledTransfer)
+	app.Get("/scheduled-transfers", api.getScheduledTransfers)
+	app.Get("/scheduled-transfers/:id", api.getScheduledTransferByID)
+	app.Post("/scheduled-transfers/:id/pause", api.changeScheduledTransfer("paused", "paused", "active"))
+	app.Post("/scheduled-transfers/:id/resume", api.changeScheduledTransfer("active", "resumed", "paused"))
+	app.Post("/scheduled-transfers/:id/cancel", api.changeScheduledTransfer("cancelled", "cancelled", "active", "paused"))
+
+	// Promotional campaigns; their bonuses are credited as earn entries
+	app.Get("/campaigns", allowRoles(roleStaff, roleAdmin), api.getCampaigns)
+	app.Get("/campaigns/:id", allowRoles(roleStaff, roleAdmin), api.getCampaignByID)
+	app.Post("/campaigns", allowRoles(roleAdmin), api.createCampaign)
+	app.Put("/campaigns/:id", allowRoles(roleAdmin), api.updateCampaign)
+
+	// Bulk user import and export
+	app.Post("/admin/users/import", allowRoles(roleAdmin), api.importUsers)
+	app.Get("/admin/users/export", allowRoles(roleAdmin), api.exportUsers)
+
+	// Partners that earn points for purchases
+	app.Get("/partners", allowRoles(roleStaff, roleAdmin), api.getPartners)
+	app.Get("/partners/:partnerId", allowRoles(roleStaff, roleAdmin), api.getPartnerByID)
+	app.Post("/partners", allowRoles(roleAdmin), api.createPartner)
+	app.Put("/partners/:partnerId", allowRoles(roleAdmin), api.updatePartner)
+
+	log.Println("Server starting on " + cfg.ListenAddr)
+	log.Fatal(app.Listen(cfg.ListenAddr))
 }
\ No newline at end of file
@@ -0,0 +1,1032 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migration is one numbered, reversible schema change. Versions must be
+// consecutive starting at 1; never edit a migration once it has shipped,
+// add a new one instead.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+	down    func(tx *sql.Tx) error
+}
+
+// sqliteMigrations lists every SQLite schema change in the order it is
+// applied. postgresMigrations must keep the same versions and names.
+var sqliteMigrations = []migration{
+	{
+		version: 1,
+		name:    "initial_schema",
+		up: func(tx *sql.Tx) error {
+			// IF NOT EXISTS lets databases created before migrations adopt this version
+			return execAll(tx,
+				`CREATE TABLE IF NOT EXISTS users (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					member_id TEXT UNIQUE NOT NULL,
+					first_name TEXT NOT NULL,
+					last_name TEXT NOT NULL,
+					mobile_number TEXT,
+					email TEXT UNIQUE,
+					register_date TEXT,
+					membership_level TEXT DEFAULT 'Bronze',
+					point_balance INTEGER DEFAULT 0,
+					created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+					updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+				)`,
+				`CREATE TABLE IF NOT EXISTS transfers (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					from_user_id INTEGER NOT NULL,
+					to_user_id INTEGER NOT NULL,
+					amount INTEGER NOT NULL CHECK (amount > 0),
+					status TEXT NOT NULL CHECK (status IN ('pending','processing','completed','failed','cancelled','reversed')),
+					note TEXT,
+					idempotency_key TEXT NOT NULL UNIQUE,
+					created_at TEXT NOT NULL,
+					updated_at TEXT NOT NULL,
+					completed_at TEXT,
+					fail_reason TEXT,
+					FOREIGN KEY (from_user_id) REFERENCES users(id),
+					FOREIGN KEY (to_user_id) REFERENCES users(id)
+				)`,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_from ON transfers(from_user_id)`,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_to ON transfers(to_user_id)`,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_created ON transfers(created_at)`,
+				`CREATE TABLE IF NOT EXISTS point_ledger (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL,
+					change INTEGER NOT NULL,
+					balance_after INTEGER NOT NULL,
+					event_type TEXT NOT NULL CHECK (event_type IN ('transfer_out','transfer_in','adjust','earn','redeem')),
+					transfer_id INTEGER,
+					reference TEXT,
+					metadata TEXT,
+					created_at TEXT NOT NULL,
+					FOREIGN KEY (user_id) REFERENCES users(id),
+					FOREIGN KEY (transfer_id) REFERENCES transfers(id)
+				)`,
+				`CREATE INDEX IF NOT EXISTS idx_ledger_user ON point_ledger(user_id)`,
+				`CREATE INDEX IF NOT EXISTS idx_ledger_transfer ON point_ledger(transfer_id)`,
+				`CREATE INDEX IF NOT EXISTS idx_ledger_created ON point_ledger(created_at)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP TABLE point_ledger`,
+				`DROP TABLE transfers`,
+				`DROP TABLE users`,
+			)
+		},
+	},
+	{
+		version: 2,
+		name:    "transfer_reversals",
+		up: func(tx *sql.Tx) error {
+			if err := addColumn(tx, "transfers", "reversed_at", "TEXT"); err != nil {
+				return err
+			}
+			return addColumn(tx, "transfers", "reversal_reason", "TEXT")
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`ALTER TABLE transfers DROP COLUMN reversal_reason`,
+				`ALTER TABLE transfers DROP COLUMN reversed_at`,
+			)
+		},
+	},
+	{
+		version: 3,
+		name:    "pending_transfer_holds",
+		up: func(tx *sql.Tx) error {
+			if err := addColumn(tx, "users", "held_balance", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+			if err := addColumn(tx, "transfers", "expires_at", "TEXT"); err != nil {
+				return err
+			}
+			return execAll(tx,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_pending_expiry ON transfers(status, expires_at)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP INDEX IF EXISTS idx_transfers_pending_expiry`,
+				`ALTER TABLE transfers DROP COLUMN expires_at`,
+				`ALTER TABLE users DROP COLUMN held_balance`,
+			)
+		},
+	},
+	{
+		version: 4,
+		name:    "api_keys",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE api_keys (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					name TEXT NOT NULL,
+					key_prefix TEXT NOT NULL,
+					key_hash TEXT NOT NULL UNIQUE,
+					role TEXT NOT NULL CHECK (role IN ('member','staff','admin')),
+					user_id INTEGER,
+					created_at TEXT NOT NULL,
+					revoked_at TEXT,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx, `DROP TABLE api_keys`)
+		},
+	},
+	{
+		version: 5,
+		name:    "user_list_indexes",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				// Rows created before timestamps were written by the application
+				// hold SQLite's "YYYY-MM-DD HH:MM:SS"; rewrite them as RFC3339 so
+				// created_at sorts and pages consistently
+				`UPDATE users SET created_at = strftime('%Y-%m-%dT%H:%M:%SZ', created_at) WHERE created_at NOT LIKE '%T%'`,
+				`UPDATE users SET updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', updated_at) WHERE updated_at NOT LIKE '%T%'`,
+				`CREATE INDEX IF NOT EXISTS idx_users_created ON users(created_at)`,
+				`CREATE INDEX IF NOT EXISTS idx_users_last_name ON users(last_name)`,
+				`CREATE INDEX IF NOT EXISTS idx_users_register_date ON users(register_date)`,
+				`CREATE INDEX IF NOT EXISTS idx_users_level ON users(membership_level)`,
+				`CREATE INDEX IF NOT EXISTS idx_users_balance ON users(point_balance)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP INDEX IF EXISTS idx_users_balance`,
+				`DROP INDEX IF EXISTS idx_users_level`,
+				`DROP INDEX IF EXISTS idx_users_register_date`,
+				`DROP INDEX IF EXISTS idx_users_last_name`,
+				`DROP INDEX IF EXISTS idx_users_created`,
+			)
+		},
+	},
+	{
+		version: 6,
+		name:    "keyset_pagination_indexes",
+		up: func(tx *sql.Tx) error {
+			// Transfer and ledger listings page on (created_at, id) within one user
+			return execAll(tx,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_from_created ON transfers(from_user_id, created_at, id)`,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_to_created ON transfers(to_user_id, created_at, id)`,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_created_id ON transfers(created_at, id)`,
+				`CREATE INDEX IF NOT EXISTS idx_ledger_user_created ON point_ledger(user_id, created_at, id)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP INDEX IF EXISTS idx_ledger_user_created`,
+				`DROP INDEX IF EXISTS idx_transfers_created_id`,
+				`DROP INDEX IF EXISTS idx_transfers_to_created`,
+				`DROP INDEX IF EXISTS idx_transfers_from_created`,
+			)
+		},
+	},
+	{
+		version: 7,
+		name:    "transfer_filter_indexes",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_amount ON transfers(amount, id)`,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_status_created ON transfers(status, created_at, id)`,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_completed ON transfers(completed_at)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP INDEX IF EXISTS idx_transfers_completed`,
+				`DROP INDEX IF EXISTS idx_transfers_status_created`,
+				`DROP INDEX IF EXISTS idx_transfers_amount`,
+			)
+		},
+	},
+	{
+		version: 8,
+		name:    "tier_engine",
+		up: func(tx *sql.Tx) error {
+			if err := setLedgerEventTypes(tx, "transfer_out", "transfer_in", "adjust", "earn", "redeem", "tier_change"); err != nil {
+				return err
+			}
+			return execAll(tx,
+				`CREATE TABLE tier_history (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL,
+					from_level TEXT NOT NULL,
+					to_level TEXT NOT NULL,
+					reason TEXT NOT NULL CHECK (reason IN ('evaluation','manual')),
+					points_earned INTEGER NOT NULL,
+					created_at TEXT NOT NULL,
+					FOREIGN KEY (user_id) REFERENCES users(id)
+				)`,
+				`CREATE INDEX idx_tier_history_user ON tier_history(user_id, created_at, id)`,
+				`CREATE TABLE webhook_events (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					event_type TEXT NOT NULL,
+					payload TEXT NOT NULL,
+					attempts INTEGER NOT NULL DEFAULT 0,
+					next_attempt_at TEXT,
+					delivered_at TEXT,
+					last_error TEXT,
+					created_at TEXT NOT NULL
+				)`,
+				`CREATE INDEX idx_webhook_events_due ON webhook_events(delivered_at, next_attempt_at)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			if err := execAll(tx,
+				`DROP TABLE webhook_events`,
+				`DROP TABLE tier_history`,
+				`DELETE FROM point_ledger WHERE event_type = 'tier_change'`,
+			); err != nil {
+				return err
+			}
+			return setLedgerEventTypes(tx, "transfer_out", "transfer_in", "adjust", "earn", "redeem")
+		},
+	},
+	{
+		version: 9,
+		name:    "transfer_limits",
+		up: func(tx *sql.Tx) error {
+			// NULL caps are unlimited
+			return execAll(tx,
+				`CREATE TABLE transfer_limits (
+					membership_level TEXT PRIMARY KEY,
+					per_transfer_max INTEGER CHECK (per_transfer_max > 0),
+					daily_max INTEGER CHECK (daily_max > 0),
+					monthly_max INTEGER CHECK (monthly_max > 0),
+					updated_at TEXT NOT NULL
+				)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx, `DROP TABLE transfer_limits`)
+		},
+	},
+	{
+		version: 10,
+		name:    "point_lots",
+		up: func(tx *sql.Tx) error {
+			if err := setLedgerEventTypes(tx, "transfer_out", "transfer_in", "adjust", "earn", "redeem", "tier_change", "expire"); err != nil {
+				return err
+			}
+			return execAll(tx,
+				`CREATE TABLE point_lots (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL,
+					ledger_entry_id INTEGER,
+					amount INTEGER NOT NULL CHECK (amount > 0),
+					remaining INTEGER NOT NULL CHECK (remaining >= 0 AND remaining <= amount),
+					earned_at TEXT NOT NULL,
+					FOREIGN KEY (user_id) REFERENCES users(id),
+					FOREIGN KEY (ledger_entry_id) REFERENCES point_ledger(id)
+				)`,
+				`CREATE INDEX idx_point_lots_user ON point_lots(user_id, earned_at, id)`,
+				`CREATE INDEX idx_point_lots_earned ON point_lots(earned_at)`,
+				// Existing balances become one lot per user, earned now, so
+				// they get the full expiry period
+				`INSERT INTO point_lots (user_id, amount, remaining, earned_at)
+					SELECT id, point_balance, point_balance, strftime('%Y-%m-%dT%H:%M:%SZ', 'now')
+					FROM users WHERE point_balance > 0`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			if err := execAll(tx,
+				`DROP TABLE point_lots`,
+				// Expired points stay written off, as adjustments
+				`UPDATE point_ledger SET event_type = 'adjust' WHERE event_type = 'expire'`,
+			); err != nil {
+				return err
+			}
+			return setLedgerEventTypes(tx, "transfer_out", "transfer_in", "adjust", "earn", "redeem", "tier_change")
+		},
+	},
+	{
+		version: 11,
+		name:    "rewards",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE rewards (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					name TEXT NOT NULL,
+					description TEXT,
+					point_cost INTEGER NOT NULL CHECK (point_cost > 0),
+					stock INTEGER CHECK (stock >= 0),
+					valid_from TEXT,
+					valid_until TEXT,
+					eligible_tiers TEXT,
+					active BOOLEAN NOT NULL DEFAULT 1,
+					created_at TEXT NOT NULL,
+					updated_at TEXT NOT NULL
+				)`,
+				`CREATE TABLE redemption_orders (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL,
+					reward_id INTEGER NOT NULL,
+					quantity INTEGER NOT NULL CHECK (quantity > 0),
+					points INTEGER NOT NULL CHECK (points > 0),
+					status TEXT NOT NULL CHECK (status IN ('placed','fulfilled','cancelled')),
+					ledger_entry_id INTEGER,
+					refund_entry_id INTEGER,
+					cancel_reason TEXT,
+					created_at TEXT NOT NULL,
+					updated_at TEXT NOT NULL,
+					fulfilled_at TEXT,
+					cancelled_at TEXT,
+					FOREIGN KEY (user_id) REFERENCES users(id),
+					FOREIGN KEY (reward_id) REFERENCES rewards(id),
+					FOREIGN KEY (ledger_entry_id) REFERENCES point_ledger(id),
+					FOREIGN KEY (refund_entry_id) REFERENCES point_ledger(id)
+				)`,
+				`CREATE INDEX idx_redemption_orders_created ON redemption_orders(created_at, id)`,
+				`CREATE INDEX idx_redemption_orders_user ON redemption_orders(user_id, created_at, id)`,
+				`CREATE INDEX idx_redemption_orders_reward ON redemption_orders(reward_id)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			// The redeem ledger entries of past orders stay, without their orders
+			return execAll(tx,
+				`DROP TABLE redemption_orders`,
+				`DROP TABLE rewards`,
+			)
+		},
+	},
+	{
+		version: 12,
+		name:    "campaigns",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE campaigns (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					name TEXT NOT NULL,
+					description TEXT,
+					rule_type TEXT NOT NULL CHECK (rule_type IN ('multiplier','fixed','threshold')),
+					trigger_type TEXT NOT NULL CHECK (trigger_type IN ('earn','transfer')),
+					multiplier REAL NOT NULL DEFAULT 0,
+					bonus_points INTEGER NOT NULL DEFAULT 0,
+					threshold INTEGER NOT NULL DEFAULT 0,
+					starts_at TEXT NOT NULL,
+					ends_at TEXT NOT NULL,
+					tiers TEXT,
+					registered_from TEXT,
+					registered_to TEXT,
+					max_awards_per_member INTEGER CHECK (max_awards_per_member > 0),
+					budget INTEGER CHECK (budget > 0),
+					budget_used INTEGER NOT NULL DEFAULT 0,
+					active BOOLEAN NOT NULL DEFAULT 1,
+					created_at TEXT NOT NULL,
+					updated_at TEXT NOT NULL
+				)`,
+				`CREATE TABLE campaign_awards (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					campaign_id INTEGER NOT NULL,
+					user_id INTEGER NOT NULL,
+					ledger_entry_id INTEGER NOT NULL,
+					points INTEGER NOT NULL CHECK (points > 0),
+					created_at TEXT NOT NULL,
+					FOREIGN KEY (campaign_id) REFERENCES campaigns(id),
+					FOREIGN KEY (user_id) REFERENCES users(id),
+					FOREIGN KEY (ledger_entry_id) REFERENCES point_ledger(id)
+				)`,
+				`CREATE INDEX idx_campaigns_window ON campaigns(starts_at, ends_at)`,
+				`CREATE INDEX idx_campaign_awards_member ON campaign_awards(campaign_id, user_id)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			// The bonus ledger entries stay, still carrying their campaign id
+			return execAll(tx,
+				`DROP TABLE campaign_awards`,
+				`DROP TABLE campaigns`,
+			)
+		},
+	},
+	{
+		version: 13,
+		name:    "referrals",
+		up: func(tx *sql.Tx) error {
+			if err := addColumn(tx, "users", "referral_code", "TEXT"); err != nil {
+				return err
+			}
+			if err := addColumn(tx, "users", "referred_by", "INTEGER"); err != nil {
+				return err
+			}
+			if err := backfillReferralCodes(tx, `UPDATE users SET referral_code = ? WHERE id = ?`); err != nil {
+				return err
+			}
+			return execAll(tx,
+				`CREATE UNIQUE INDEX idx_users_referral_code ON users(referral_code)`,
+				`CREATE TABLE referrals (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					referrer_id INTEGER NOT NULL,
+					referee_id INTEGER NOT NULL UNIQUE,
+					status TEXT NOT NULL CHECK (status IN ('pending','rewarded','rejected')),
+					referrer_entry_id INTEGER,
+					referee_entry_id INTEGER,
+					reject_reason TEXT,
+					created_at TEXT NOT NULL,
+					resolved_at TEXT,
+					FOREIGN KEY (referrer_id) REFERENCES users(id),
+					FOREIGN KEY (referee_id) REFERENCES users(id),
+					FOREIGN KEY (referrer_entry_id) REFERENCES point_ledger(id),
+					FOREIGN KEY (referee_entry_id) REFERENCES point_ledger(id)
+				)`,
+				`CREATE INDEX idx_referrals_referrer ON referrals(referrer_id, status)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			// Paid referral bonuses stay as earn entries
+			return execAll(tx,
+				`DROP TABLE referrals`,
+				`DROP INDEX idx_users_referral_code`,
+				`ALTER TABLE users DROP COLUMN referred_by`,
+				`ALTER TABLE users DROP COLUMN referral_code`,
+			)
+		},
+	},
+	{
+		version: 14,
+		name:    "partner_purchases",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE partners (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					name TEXT NOT NULL,
+					currency TEXT NOT NULL,
+					earn_rate REAL NOT NULL CHECK (earn_rate > 0),
+					active BOOLEAN NOT NULL DEFAULT 1,
+					created_at TEXT NOT NULL,
+					updated_at TEXT NOT NULL
+				)`,
+				`CREATE TABLE partner_purchases (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					partner_id INTEGER NOT NULL,
+					receipt_id TEXT NOT NULL,
+					user_id INTEGER NOT NULL,
+					member_id TEXT NOT NULL,
+					amount REAL NOT NULL CHECK (amount > 0),
+					currency TEXT NOT NULL,
+					earn_rate REAL NOT NULL,
+					points INTEGER NOT NULL CHECK (points >= 0),
+					ledger_entry_id INTEGER,
+					purchased_at TEXT NOT NULL,
+					created_at TEXT NOT NULL,
+					UNIQUE (partner_id, receipt_id),
+					FOREIGN KEY (partner_id) REFERENCES partners(id),
+					FOREIGN KEY (user_id) REFERENCES users(id),
+					FOREIGN KEY (ledger_entry_id) REFERENCES point_ledger(id)
+				)`,
+				`CREATE INDEX idx_partner_purchases_created ON partner_purchases(partner_id, created_at, id)`,
+				`CREATE INDEX idx_partner_purchases_user ON partner_purchases(user_id)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			// The earn entries of past purchases stay, without their receipts
+			return execAll(tx,
+				`DROP TABLE partner_purchases`,
+				`DROP TABLE partners`,
+			)
+		},
+	},
+	{
+		version: 15,
+		name:    "transfer_batches",
+		up: func(tx *sql.Tx) error {
+			if err := addColumn(tx, "transfers", "batch_id", "TEXT"); err != nil {
+				return err
+			}
+			return execAll(tx,
+				`CREATE INDEX idx_transfers_batch ON transfers(batch_id)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			// Batch transfers stay as ordinary transfers
+			return execAll(tx,
+				`DROP INDEX idx_transfers_batch`,
+				`ALTER TABLE transfers DROP COLUMN batch_id`,
+			)
+		},
+	},
+	{
+		version: 16,
+		name:    "scheduled_transfers",
+		up: func(tx *sql.Tx) error {
+			if err := execAll(tx,
+				`CREATE TABLE scheduled_transfers (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					from_user_id INTEGER NOT NULL,
+					to_user_id INTEGER NOT NULL,
+					amount INTEGER NOT NULL CHECK (amount > 0),
+					note TEXT,
+					starts_at TEXT NOT NULL,
+					recurrence TEXT,
+					status TEXT NOT NULL CHECK (status IN ('active','paused','completed','failed','cancelled')),
+					next_run_at TEXT,
+					run_count INTEGER NOT NULL DEFAULT 0,
+					last_run_at TEXT,
+					fail_reason TEXT,
+					created_at TEXT NOT NULL,
+					updated_at TEXT NOT NULL,
+					FOREIGN KEY (from_user_id) REFERENCES users(id),
+					FOREIGN KEY (to_user_id) REFERENCES users(id)
+				)`,
+				`CREATE INDEX idx_scheduled_transfers_due ON scheduled_transfers(status, next_run_at)`,
+				`CREATE INDEX idx_scheduled_transfers_from ON scheduled_transfers(from_user_id)`,
+			); err != nil {
+				return err
+			}
+			if err := addColumn(tx, "transfers", "schedule_id", "INTEGER"); err != nil {
+				return err
+			}
+			return execAll(tx,
+				`CREATE INDEX idx_transfers_schedule ON transfers(schedule_id)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			// Transfers already sent stay as ordinary transfers
+			return execAll(tx,
+				`DROP INDEX idx_transfers_schedule`,
+				`ALTER TABLE transfers DROP COLUMN schedule_id`,
+				`DROP TABLE scheduled_transfers`,
+			)
+		},
+	},
+	{
+		version: 17,
+		name:    "tier_baselines",
+		up: func(tx *sql.Tx) error {
+			if err := setTierHistoryReasons(tx, "evaluation", "manual", "baseline"); err != nil {
+				return err
+			}
+			// Members from before the ledger keep their level for a window
+			_, err := tx.Exec(`
+				INSERT INTO tier_history (user_id, from_level, to_level, reason, points_earned, created_at)
+				SELECT id, membership_level, membership_level, 'baseline', 0, ? FROM users
+			`, timestamp(time.Now()))
+			return err
+		},
+		down: func(tx *sql.Tx) error {
+			if err := execAll(tx, `DELETE FROM tier_history WHERE reason = 'baseline'`); err != nil {
+				return err
+			}
+			return setTierHistoryReasons(tx, "evaluation", "manual")
+		},
+	},
+	{
+		version: 18,
+		name:    "point_lot_uses",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE point_lot_uses (
+					ledger_entry_id INTEGER NOT NULL,
+					lot_id INTEGER NOT NULL,
+					amount INTEGER NOT NULL CHECK (amount > 0),
+					PRIMARY KEY (ledger_entry_id, lot_id),
+					FOREIGN KEY (ledger_entry_id) REFERENCES point_ledger(id),
+					FOREIGN KEY (lot_id) REFERENCES point_lots(id)
+				)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx, `DROP TABLE point_lot_uses`)
+		},
+	},
+	{
+		version: 19,
+		name:    "campaign_first_activity",
+		up: func(tx *sql.Tx) error {
+			if err := setCampaignRuleTypes(tx, "multiplier", "fixed", "threshold", "first"); err != nil {
+				return err
+			}
+			if err := addColumn(tx, "campaign_awards", "transfer_id", "INTEGER"); err != nil {
+				return err
+			}
+			if err := addColumn(tx, "campaign_awards", "reversed_at", "TEXT"); err != nil {
+				return err
+			}
+			return execAll(tx,
+				`CREATE INDEX idx_campaign_awards_transfer ON campaign_awards(transfer_id)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			if err := execAll(tx,
+				`DROP INDEX idx_campaign_awards_transfer`,
+				`ALTER TABLE campaign_awards DROP COLUMN reversed_at`,
+				`ALTER TABLE campaign_awards DROP COLUMN transfer_id`,
+				// First-activity campaigns cannot be expressed; stop them
+				`UPDATE campaigns SET rule_type = 'fixed', active = 0 WHERE rule_type = 'first'`,
+			); err != nil {
+				return err
+			}
+			return setCampaignRuleTypes(tx, "multiplier", "fixed", "threshold")
+		},
+	},
+	{
+		version: 20,
+		name:    "batch_leg_keys",
+		up: func(tx *sql.Tx) error {
+			// Batch legs get a key prefix client keys may not use
+			return execAll(tx,
+				`UPDATE transfers SET idempotency_key = 'batch:' || idempotency_key
+					WHERE batch_id IS NOT NULL`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`UPDATE transfers SET idempotency_key = substr(idempotency_key, 7)
+					WHERE batch_id IS NOT NULL AND idempotency_key LIKE 'batch:%'`,
+			)
+		},
+	},
+	{
+		version: 21,
+		name:    "partner_api_keys",
+		up: func(tx *sql.Tx) error {
+			if err := addColumn(tx, "api_keys", "partner_id", "INTEGER"); err != nil {
+				return err
+			}
+			return setAPIKeyRoles(tx, "member", "staff", "admin", "partner")
+		},
+		down: func(tx *sql.Tx) error {
+			if err := execAll(tx, `DELETE FROM api_keys WHERE role = 'partner'`); err != nil {
+				return err
+			}
+			if err := setAPIKeyRoles(tx, "member", "staff", "admin"); err != nil {
+				return err
+			}
+			return execAll(tx, `ALTER TABLE api_keys DROP COLUMN partner_id`)
+		},
+	},
+}
+
+// setLedgerEventTypes replaces the point_ledger event_type CHECK constraint.
+// SQLite cannot alter a constraint, so the table is rebuilt with the new
+// one; it does not enforce foreign keys here, so nothing referencing the
+// ledger has to be dropped first.
+func setLedgerEventTypes(tx *sql.Tx, eventTypes ...string) error {
+	return execAll(tx,
+		`CREATE TABLE point_ledger_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			change INTEGER NOT NULL,
+			balance_after INTEGER NOT NULL,
+			event_type TEXT NOT NULL CHECK (event_type IN ('`+strings.Join(eventTypes, "','")+`')),
+			transfer_id INTEGER,
+			reference TEXT,
+			metadata TEXT,
+			created_at TEXT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id),
+			FOREIGN KEY (transfer_id) REFERENCES transfers(id)
+		)`,
+		`INSERT INTO point_ledger_new (id, user_id, change, balance_after, event_type, transfer_id, reference, metadata, created_at)
+			SELECT id, user_id, change, balance_after, event_type, transfer_id, reference, metadata, created_at FROM point_ledger`,
+		`DROP TABLE point_ledger`,
+		`ALTER TABLE point_ledger_new RENAME TO point_ledger`,
+		`CREATE INDEX idx_ledger_user ON point_ledger(user_id)`,
+		`CREATE INDEX idx_ledger_transfer ON point_ledger(transfer_id)`,
+		`CREATE INDEX idx_ledger_created ON point_ledger(created_at)`,
+		`CREATE INDEX idx_ledger_user_created ON point_ledger(user_id, created_at, id)`,
+	)
+}
+
+// setTierHistoryReasons replaces the tier_history reason CHECK constraint,
+// rebuilding the table as setLedgerEventTypes does for the ledger
+func setTierHistoryReasons(tx *sql.Tx, reasons ...string) error {
+	return execAll(tx,
+		`CREATE TABLE tier_history_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			from_level TEXT NOT NULL,
+			to_level TEXT NOT NULL,
+			reason TEXT NOT NULL CHECK (reason IN ('`+strings.Join(reasons, "','")+`')),
+			points_earned INTEGER NOT NULL,
+			created_at TEXT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+		`INSERT INTO tier_history_new (id, user_id, from_level, to_level, reason, points_earned, created_at)
+			SELECT id, user_id, from_level, to_level, reason, points_earned, created_at FROM tier_history`,
+		`DROP TABLE tier_history`,
+		`ALTER TABLE tier_history_new RENAME TO tier_history`,
+		`CREATE INDEX idx_tier_history_user ON tier_history(user_id, created_at, id)`,
+	)
+}
+
+// setCampaignRuleTypes replaces the campaigns rule_type CHECK constraint,
+// rebuilding the table as setLedgerEventTypes does for the ledger
+func setCampaignRuleTypes(tx *sql.Tx, ruleTypes ...string) error {
+	return execAll(tx,
+		`CREATE TABLE campaigns_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			description TEXT,
+			rule_type TEXT NOT NULL CHECK (rule_type IN ('`+strings.Join(ruleTypes, "','")+`')),
+			trigger_type TEXT NOT NULL CHECK (trigger_type IN ('earn','transfer')),
+			multiplier REAL NOT NULL DEFAULT 0,
+			bonus_points INTEGER NOT NULL DEFAULT 0,
+			threshold INTEGER NOT NULL DEFAULT 0,
+			starts_at TEXT NOT NULL,
+			ends_at TEXT NOT NULL,
+			tiers TEXT,
+			registered_from TEXT,
+			registered_to TEXT,
+			max_awards_per_member INTEGER CHECK (max_awards_per_member > 0),
+			budget INTEGER CHECK (budget > 0),
+			budget_used INTEGER NOT NULL DEFAULT 0,
+			active BOOLEAN NOT NULL DEFAULT 1,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL
+		)`,
+		`INSERT INTO campaigns_new (id, name, description, rule_type, trigger_type, multiplier, bonus_points, threshold, starts_at, ends_at, tiers,
+				registered_from, registered_to, max_awards_per_member, budget, budget_used, active, created_at, updated_at)
+			SELECT id, name, description, rule_type, trigger_type, multiplier, bonus_points, threshold, starts_at, ends_at, tiers,
+				registered_from, registered_to, max_awards_per_member, budget, budget_used, active, created_at, updated_at FROM campaigns`,
+		`DROP TABLE campaigns`,
+		`ALTER TABLE campaigns_new RENAME TO campaigns`,
+		`CREATE INDEX idx_campaigns_window ON campaigns(starts_at, ends_at)`,
+	)
+}
+
+// execAll runs each statement in order, stopping at the first error
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column unless it already exists, so that databases
+// patched before migrations existed can still be brought up to date
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	var count int
+	err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// backfillReferralCodes gives every user without a referral code a new one,
+// using update with the code and the user's id as its parameters
+func backfillReferralCodes(tx *sql.Tx, update string) error {
+	rows, err := tx.Query(`SELECT id FROM users WHERE referral_code IS NULL`)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if _, err := tx.Exec(update, newReferralCode(), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaMigrations returns the migrations for the open database's dialect
+func schemaMigrations() []migration {
+	if dbDialect == postgresDialect {
+		return postgresMigrations
+	}
+	return sqliteMigrations
+}
+
+// latestMigrationVersion is the schema version this binary expects
+func latestMigrationVersion() int {
+	migrations := schemaMigrations()
+	return migrations[len(migrations)-1].version
+}
+
+// ensureMigrationsTable creates the bookkeeping table that records applied versions
+func ensureMigrationsTable() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TEXT NOT NULL
+		)`)
+	return err
+}
+
+// currentSchemaVersion returns the highest applied migration version, or 0
+func currentSchemaVersion() (int, error) {
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// migrateUp applies every pending migration, each in its own transaction
+func migrateUp() (int, error) {
+	current, err := currentSchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, m := range schemaMigrations() {
+		if m.version <= current {
+			continue
+		}
+		if err := runMigration(m, m.up, func(tx *sql.Tx) error {
+			_, err := tx.Exec(dbDialect.rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"),
+				m.version, m.name, time.Now().UTC().Format(time.RFC3339))
+			return err
+		}); err != nil {
+			return applied, fmt.Errorf("migration %d (%s) up: %w", m.version, m.name, err)
+		}
+		log.Printf("Applied migration %d (%s)", m.version, m.name)
+		applied++
+	}
+	return applied, nil
+}
+
+// migrateDown rolls back the most recent steps migrations
+func migrateDown(steps int) (int, error) {
+	current, err := currentSchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+	if current > latestMigrationVersion() {
+		return 0, fmt.Errorf("database schema version %d is newer than this binary (%d); use a newer binary to roll it back", current, latestMigrationVersion())
+	}
+
+	migrations := schemaMigrations()
+	reverted := 0
+	for i := len(migrations) - 1; i >= 0 && reverted < steps; i-- {
+		m := migrations[i]
+		if m.version > current {
+			continue
+		}
+		if err := runMigration(m, m.down, func(tx *sql.Tx) error {
+			_, err := tx.Exec(dbDialect.rebind("DELETE FROM schema_migrations WHERE version = ?"), m.version)
+			return err
+		}); err != nil {
+			return reverted, fmt.Errorf("migration %d (%s) down: %w", m.version, m.name, err)
+		}
+		log.Printf("Reverted migration %d (%s)", m.version, m.name)
+		reverted++
+	}
+	return reverted, nil
+}
+
+// runMigration executes one direction of a migration together with its
+// schema_migrations bookkeeping in a single transaction
+func runMigration(m migration, step, record func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := step(tx); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// prepareSchema brings the database up to the version this binary expects,
+// refusing to run against a database migrated by a newer binary
+func prepareSchema(autoMigrate bool) error {
+	if err := ensureMigrationsTable(); err != nil {
+		return err
+	}
+
+	current, err := currentSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	latest := latestMigrationVersion()
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d)", current, latest)
+	}
+	if current == latest {
+		return nil
+	}
+	if !autoMigrate {
+		return fmt.Errorf("database schema version %d is behind %d; run `migrate up` first", current, latest)
+	}
+
+	_, err = migrateUp()
+	return err
+}
+
+// runMigrateCommand implements the `migrate up|down [steps]|status` subcommand
+func runMigrateCommand(args []string) error {
+	if err := ensureMigrationsTable(); err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up | down [steps] | status")
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrateUp()
+		if err != nil {
+			return err
+		}
+		log.Printf("%d migration(s) applied", applied)
+		return nil
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("steps must be a positive integer")
+			}
+			steps = n
+		}
+		reverted, err := migrateDown(steps)
+		if err != nil {
+			return err
+		}
+		log.Printf("%d migration(s) reverted", reverted)
+		return nil
+
+	case "status":
+		applied := map[int]string{}
+		rows, err := db.Query("SELECT version, applied_at FROM schema_migrations ORDER BY version")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var version int
+			var appliedAt string
+			if err := rows.Scan(&version, &appliedAt); err != nil {
+				return err
+			}
+			applied[version] = appliedAt
+		}
+
+		for _, m := range schemaMigrations() {
+			state := "pending"
+			if at, ok := applied[m.version]; ok {
+				state = "applied " + at
+				delete(applied, m.version)
+			}
+			fmt.Printf("%4d  %-28s %s\n", m.version, m.name, state)
+		}
+		for version, at := range applied {
+			fmt.Printf("%4d  %-28s applied %s (unknown to this binary)\n", version, "?", at)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown migrate command %q (want up, down or status)", args[0])
+}
+
+// setAPIKeyRoles replaces the api_keys role CHECK constraint by rebuilding
+// the table, keeping partner_id free of a foreign key so it can be dropped
+func setAPIKeyRoles(tx *sql.Tx, roles ...string) error {
+	return execAll(tx,
+		`CREATE TABLE api_keys_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			key_prefix TEXT NOT NULL,
+			key_hash TEXT NOT NULL UNIQUE,
+			role TEXT NOT NULL CHECK (role IN ('`+strings.Join(roles, "','")+`')),
+			user_id INTEGER,
+			created_at TEXT NOT NULL,
+			revoked_at TEXT,
+			partner_id INTEGER,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`INSERT INTO api_keys_new (id, name, key_prefix, key_hash, role, user_id, created_at, revoked_at, partner_id)
+			SELECT id, name, key_prefix, key_hash, role, user_id, created_at, revoked_at, partner_id FROM api_keys`,
+		`DROP TABLE api_keys`,
+		`ALTER TABLE api_keys_new RENAME TO api_keys`,
+	)
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// postgresMigrations mirrors sqliteMigrations version for version, so a
+// schema version means the same tables on either database. Timestamps stay
+// TEXT in RFC3339 UTC, as on SQLite, so both backends return identical JSON.
+var postgresMigrations = []migration{
+	{
+		version: 1,
+		name:    "initial_schema",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE IF NOT EXISTS users (
+					id BIGSERIAL PRIMARY KEY,
+					member_id TEXT UNIQUE NOT NULL,
+					first_name TEXT NOT NULL,
+					last_name TEXT NOT NULL,
+					mobile_number TEXT,
+					email TEXT UNIQUE,
+					register_date TEXT,
+					membership_level TEXT DEFAULT 'Bronze',
+					point_balance INTEGER DEFAULT 0,
+					created_at TEXT NOT NULL,
+					updated_at TEXT NOT NULL
+				)`,
+				`CREATE TABLE IF NOT EXISTS transfers (
+					id BIGSERIAL PRIMARY KEY,
+					from_user_id BIGINT NOT NULL REFERENCES users(id),
+					to_user_id BIGINT NOT NULL REFERENCES users(id),
+					amount INTEGER NOT NULL CHECK (amount > 0),
+					status TEXT NOT NULL CHECK (status IN ('pending','processing','completed','failed','cancelled','reversed')),
+					note TEXT,
+					idempotency_key TEXT NOT NULL UNIQUE,
+					created_at TEXT NOT NULL,
+					updated_at TEXT NOT NULL,
+					completed_at TEXT,
+					fail_reason TEXT
+				)`,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_from ON transfers(from_user_id)`,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_to ON transfers(to_user_id)`,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_created ON transfers(created_at)`,
+				`CREATE TABLE IF NOT EXISTS point_ledger (
+					id BIGSERIAL PRIMARY KEY,
+					user_id BIGINT NOT NULL REFERENCES users(id),
+					change INTEGER NOT NULL,
+					balance_after INTEGER NOT NULL,
+					event_type TEXT NOT NULL CHECK (event_type IN ('transfer_out','transfer_in','adjust','earn','redeem')),
+					transfer_id BIGINT REFERENCES transfers(id),
+					reference TEXT,
+					metadata TEXT,
+					created_at TEXT NOT NULL
+				)`,
+				`CREATE INDEX IF NOT EXISTS idx_ledger_user ON point_ledger(user_id)`,
+				`CREATE INDEX IF NOT EXISTS idx_ledger_transfer ON point_ledger(transfer_id)`,
+				`CREATE INDEX IF NOT EXISTS idx_ledger_created ON point_ledger(created_at)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP TABLE point_ledger`,
+				`DROP TABLE transfers`,
+				`DROP TABLE users`,
+			)
+		},
+	},
+	{
+		version: 2,
+		name:    "transfer_reversals",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`ALTER TABLE transfers ADD COLUMN IF NOT EXISTS reversed_at TEXT`,
+				`ALTER TABLE transfers ADD COLUMN IF NOT EXISTS reversal_reason TEXT`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`ALTER TABLE transfers DROP COLUMN reversal_reason`,
+				`ALTER TABLE transfers DROP COLUMN reversed_at`,
+			)
+		},
+	},
+	{
+		version: 3,
+		name:    "pending_transfer_holds",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`ALTER TABLE users ADD COLUMN IF NOT EXISTS held_balance INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE transfers ADD COLUMN IF NOT EXISTS expires_at TEXT`,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_pending_expiry ON transfers(status, expires_at)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP INDEX IF EXISTS idx_transfers_pending_expiry`,
+				`ALTER TABLE transfers DROP COLUMN expires_at`,
+				`ALTER TABLE users DROP COLUMN held_balance`,
+			)
+		},
+	},
+	{
+		version: 4,
+		name:    "api_keys",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE api_keys (
+					id BIGSERIAL PRIMARY KEY,
+					name TEXT NOT NULL,
+					key_prefix TEXT NOT NULL,
+					key_hash TEXT NOT NULL UNIQUE,
+					role TEXT NOT NULL CHECK (role IN ('member','staff','admin')),
+					user_id BIGINT REFERENCES users(id) ON DELETE CASCADE,
+					created_at TEXT NOT NULL,
+					revoked_at TEXT
+				)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx, `DROP TABLE api_keys`)
+		},
+	},
+	{
+		version: 5,
+		name:    "user_list_indexes",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE INDEX IF NOT EXISTS idx_users_created ON users(created_at)`,
+				`CREATE INDEX IF NOT EXISTS idx_users_last_name ON users(last_name)`,
+				`CREATE INDEX IF NOT EXISTS idx_users_register_date ON users(register_date)`,
+				`CREATE INDEX IF NOT EXISTS idx_users_level ON users(membership_level)`,
+				`CREATE INDEX IF NOT EXISTS idx_users_balance ON users(point_balance)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP INDEX IF EXISTS idx_users_balance`,
+				`DROP INDEX IF EXISTS idx_users_level`,
+				`DROP INDEX IF EXISTS idx_users_register_date`,
+				`DROP INDEX IF EXISTS idx_users_last_name`,
+				`DROP INDEX IF EXISTS idx_users_created`,
+			)
+		},
+	},
+	{
+		version: 6,
+		name:    "keyset_pagination_indexes",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_from_created ON transfers(from_user_id, created_at, id)`,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_to_created ON transfers(to_user_id, created_at, id)`,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_created_id ON transfers(created_at, id)`,
+				`CREATE INDEX IF NOT EXISTS idx_ledger_user_created ON point_ledger(user_id, created_at, id)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP INDEX IF EXISTS idx_ledger_user_created`,
+				`DROP INDEX IF EXISTS idx_transfers_created_id`,
+				`DROP INDEX IF EXISTS idx_transfers_to_created`,
+				`DROP INDEX IF EXISTS idx_transfers_from_created`,
+			)
+		},
+	},
+	{
+		version: 7,
+		name:    "transfer_filter_indexes",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_amount ON transfers(amount, id)`,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_status_created ON transfers(status, created_at, id)`,
+				`CREATE INDEX IF NOT EXISTS idx_transfers_completed ON transfers(completed_at)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP INDEX IF EXISTS idx_transfers_completed`,
+				`DROP INDEX IF EXISTS idx_transfers_status_created`,
+				`DROP INDEX IF EXISTS idx_transfers_amount`,
+			)
+		},
+	},
+	{
+		version: 8,
+		name:    "tier_engine",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`ALTER TABLE point_ledger DROP CONSTRAINT point_ledger_event_type_check`,
+				`ALTER TABLE point_ledger ADD CONSTRAINT point_ledger_event_type_check
+					CHECK (event_type IN ('transfer_out','transfer_in','adjust','earn','redeem','tier_change'))`,
+				`CREATE TABLE tier_history (
+					id BIGSERIAL PRIMARY KEY,
+					user_id BIGINT NOT NULL REFERENCES users(id),
+					from_level TEXT NOT NULL,
+					to_level TEXT NOT NULL,
+					reason TEXT NOT NULL CHECK (reason IN ('evaluation','manual')),
+					points_earned INTEGER NOT NULL,
+					created_at TEXT NOT NULL
+				)`,
+				`CREATE INDEX idx_tier_history_user ON tier_history(user_id, created_at, id)`,
+				`CREATE TABLE webhook_events (
+					id BIGSERIAL PRIMARY KEY,
+					event_type TEXT NOT NULL,
+					payload TEXT NOT NULL,
+					attempts INTEGER NOT NULL DEFAULT 0,
+					next_attempt_at TEXT,
+					delivered_at TEXT,
+					last_error TEXT,
+					created_at TEXT NOT NULL
+				)`,
+				`CREATE INDEX idx_webhook_events_due ON webhook_events(delivered_at, next_attempt_at)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP TABLE webhook_events`,
+				`DROP TABLE tier_history`,
+				`DELETE FROM point_ledger WHERE event_type = 'tier_change'`,
+				`ALTER TABLE point_ledger DROP CONSTRAINT point_ledger_event_type_check`,
+				`ALTER TABLE point_ledger ADD CONSTRAINT point_ledger_event_type_check
+					CHECK (event_type IN ('transfer_out','transfer_in','adjust','earn','redeem'))`,
+			)
+		},
+	},
+	{
+		version: 9,
+		name:    "transfer_limits",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE transfer_limits (
+					membership_level TEXT PRIMARY KEY,
+					per_transfer_max INTEGER CHECK (per_transfer_max > 0),
+					daily_max INTEGER CHECK (daily_max > 0),
+					monthly_max INTEGER CHECK (monthly_max > 0),
+					updated_at TEXT NOT NULL
+				)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx, `DROP TABLE transfer_limits`)
+		},
+	},
+	{
+		version: 10,
+		name:    "point_lots",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`ALTER TABLE point_ledger DROP CONSTRAINT point_ledger_event_type_check`,
+				`ALTER TABLE point_ledger ADD CONSTRAINT point_ledger_event_type_check
+					CHECK (event_type IN ('transfer_out','transfer_in','adjust','earn','redeem','tier_change','expire'))`,
+				`CREATE TABLE point_lots (
+					id BIGSERIAL PRIMARY KEY,
+					user_id BIGINT NOT NULL REFERENCES users(id),
+					ledger_entry_id BIGINT REFERENCES point_ledger(id),
+					amount INTEGER NOT NULL CHECK (amount > 0),
+					remaining INTEGER NOT NULL CHECK (remaining >= 0 AND remaining <= amount),
+					earned_at TEXT NOT NULL
+				)`,
+				`CREATE INDEX idx_point_lots_user ON point_lots(user_id, earned_at, id)`,
+				`CREATE INDEX idx_point_lots_earned ON point_lots(earned_at)`,
+				`INSERT INTO point_lots (user_id, amount, remaining, earned_at)
+					SELECT id, point_balance, point_balance, to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')
+					FROM users WHERE point_balance > 0`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP TABLE point_lots`,
+				// Expired points stay written off, as adjustments
+				`UPDATE point_ledger SET event_type = 'adjust' WHERE event_type = 'expire'`,
+				`ALTER TABLE point_ledger DROP CONSTRAINT point_ledger_event_type_check`,
+				`ALTER TABLE point_ledger ADD CONSTRAINT point_ledger_event_type_check
+					CHECK (event_type IN ('transfer_out','transfer_in','adjust','earn','redeem','tier_change'))`,
+			)
+		},
+	},
+	{
+		version: 11,
+		name:    "rewards",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE rewards (
+					id BIGSERIAL PRIMARY KEY,
+					name TEXT NOT NULL,
+					description TEXT,
+					point_cost INTEGER NOT NULL CHECK (point_cost > 0),
+					stock INTEGER CHECK (stock >= 0),
+					valid_from TEXT,
+					valid_until TEXT,
+					eligible_tiers TEXT,
+					active BOOLEAN NOT NULL DEFAULT TRUE,
+					created_at TEXT NOT NULL,
+					updated_at TEXT NOT NULL
+				)`,
+				`CREATE TABLE redemption_orders (
+					id BIGSERIAL PRIMARY KEY,
+					user_id BIGINT NOT NULL REFERENCES users(id),
+					reward_id BIGINT NOT NULL REFERENCES rewards(id),
+					quantity INTEGER NOT NULL CHECK (quantity > 0),
+					points INTEGER NOT NULL CHECK (points > 0),
+					status TEXT NOT NULL CHECK (status IN ('placed','fulfilled','cancelled')),
+					ledger_entry_id BIGINT REFERENCES point_ledger(id),
+					refund_entry_id BIGINT REFERENCES point_ledger(id),
+					cancel_reason TEXT,
+					created_at TEXT NOT NULL,
+					updated_at TEXT NOT NULL,
+					fulfilled_at TEXT,
+					cancelled_at TEXT
+				)`,
+				`CREATE INDEX idx_redemption_orders_created ON redemption_orders(created_at, id)`,
+				`CREATE INDEX idx_redemption_orders_user ON redemption_orders(user_id, created_at, id)`,
+				`CREATE INDEX idx_redemption_orders_reward ON redemption_orders(reward_id)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP TABLE redemption_orders`,
+				`DROP TABLE rewards`,
+			)
+		},
+	},
+	{
+		version: 12,
+		name:    "campaigns",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE campaigns (
+					id BIGSERIAL PRIMARY KEY,
+					name TEXT NOT NULL,
+					description TEXT,
+					rule_type TEXT NOT NULL CHECK (rule_type IN ('multiplier','fixed','threshold')),
+					trigger_type TEXT NOT NULL CHECK (trigger_type IN ('earn','transfer')),
+					multiplier DOUBLE PRECISION NOT NULL DEFAULT 0,
+					bonus_points INTEGER NOT NULL DEFAULT 0,
+					threshold INTEGER NOT NULL DEFAULT 0,
+					starts_at TEXT NOT NULL,
+					ends_at TEXT NOT NULL,
+					tiers TEXT,
+					registered_from TEXT,
+					registered_to TEXT,
+					max_awards_per_member INTEGER CHECK (max_awards_per_member > 0),
+					budget INTEGER CHECK (budget > 0),
+					budget_used INTEGER NOT NULL DEFAULT 0,
+					active BOOLEAN NOT NULL DEFAULT TRUE,
+					created_at TEXT NOT NULL,
+					updated_at TEXT NOT NULL
+				)`,
+				`CREATE TABLE campaign_awards (
+					id BIGSERIAL PRIMARY KEY,
+					campaign_id BIGINT NOT NULL REFERENCES campaigns(id),
+					user_id BIGINT NOT NULL REFERENCES users(id),
+					ledger_entry_id BIGINT NOT NULL REFERENCES point_ledger(id),
+					points INTEGER NOT NULL CHECK (points > 0),
+					created_at TEXT NOT NULL
+				)`,
+				`CREATE INDEX idx_campaigns_window ON campaigns(starts_at, ends_at)`,
+				`CREATE INDEX idx_campaign_awards_member ON campaign_awards(campaign_id, user_id)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP TABLE campaign_awards`,
+				`DROP TABLE campaigns`,
+			)
+		},
+	},
+	{
+		version: 13,
+		name:    "referrals",
+		up: func(tx *sql.Tx) error {
+			if err := execAll(tx,
+				`ALTER TABLE users ADD COLUMN referral_code TEXT`,
+				`ALTER TABLE users ADD COLUMN referred_by BIGINT REFERENCES users(id) ON DELETE SET NULL`,
+			); err != nil {
+				return err
+			}
+			if err := backfillReferralCodes(tx, `UPDATE users SET referral_code = $1 WHERE id = $2`); err != nil {
+				return err
+			}
+			return execAll(tx,
+				`CREATE UNIQUE INDEX idx_users_referral_code ON users(referral_code)`,
+				`CREATE TABLE referrals (
+					id BIGSERIAL PRIMARY KEY,
+					referrer_id BIGINT NOT NULL REFERENCES users(id),
+					referee_id BIGINT NOT NULL UNIQUE REFERENCES users(id),
+					status TEXT NOT NULL CHECK (status IN ('pending','rewarded','rejected')),
+					referrer_entry_id BIGINT REFERENCES point_ledger(id),
+					referee_entry_id BIGINT REFERENCES point_ledger(id),
+					reject_reason TEXT,
+					created_at TEXT NOT NULL,
+					resolved_at TEXT
+				)`,
+				`CREATE INDEX idx_referrals_referrer ON referrals(referrer_id, status)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP TABLE referrals`,
+				`DROP INDEX idx_users_referral_code`,
+				`ALTER TABLE users DROP COLUMN referred_by`,
+				`ALTER TABLE users DROP COLUMN referral_code`,
+			)
+		},
+	},
+	{
+		version: 14,
+		name:    "partner_purchases",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE partners (
+					id BIGSERIAL PRIMARY KEY,
+					name TEXT NOT NULL,
+					currency TEXT NOT NULL,
+					earn_rate DOUBLE PRECISION NOT NULL CHECK (earn_rate > 0),
+					active BOOLEAN NOT NULL DEFAULT TRUE,
+					created_at TEXT NOT NULL,
+					updated_at TEXT NOT NULL
+				)`,
+				`CREATE TABLE partner_purchases (
+					id BIGSERIAL PRIMARY KEY,
+					partner_id BIGINT NOT NULL REFERENCES partners(id),
+					receipt_id TEXT NOT NULL,
+					user_id BIGINT NOT NULL REFERENCES users(id),
+					member_id TEXT NOT NULL,
+					amount DOUBLE PRECISION NOT NULL CHECK (amount > 0),
+					currency TEXT NOT NULL,
+					earn_rate DOUBLE PRECISION NOT NULL,
+					points INTEGER NOT NULL CHECK (points >= 0),
+					ledger_entry_id BIGINT REFERENCES point_ledger(id),
+					purchased_at TEXT NOT NULL,
+					created_at TEXT NOT NULL,
+					UNIQUE (partner_id, receipt_id)
+				)`,
+				`CREATE INDEX idx_partner_purchases_created ON partner_purchases(partner_id, created_at, id)`,
+				`CREATE INDEX idx_partner_purchases_user ON partner_purchases(user_id)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP TABLE partner_purchases`,
+				`DROP TABLE partners`,
+			)
+		},
+	},
+	{
+		version: 15,
+		name:    "transfer_batches",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`ALTER TABLE transfers ADD COLUMN batch_id TEXT`,
+				`CREATE INDEX idx_transfers_batch ON transfers(batch_id)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP INDEX idx_transfers_batch`,
+				`ALTER TABLE transfers DROP COLUMN batch_id`,
+			)
+		},
+	},
+	{
+		version: 16,
+		name:    "scheduled_transfers",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE scheduled_transfers (
+					id BIGSERIAL PRIMARY KEY,
+					from_user_id BIGINT NOT NULL REFERENCES users(id),
+					to_user_id BIGINT NOT NULL REFERENCES users(id),
+					amount INTEGER NOT NULL CHECK (amount > 0),
+					note TEXT,
+					starts_at TEXT NOT NULL,
+					recurrence TEXT,
+					status TEXT NOT NULL CHECK (status IN ('active','paused','completed','failed','cancelled')),
+					next_run_at TEXT,
+					run_count INTEGER NOT NULL DEFAULT 0,
+					last_run_at TEXT,
+					fail_reason TEXT,
+					created_at TEXT NOT NULL,
+					updated_at TEXT NOT NULL
+				)`,
+				`CREATE INDEX idx_scheduled_transfers_due ON scheduled_transfers(status, next_run_at)`,
+				`CREATE INDEX idx_scheduled_transfers_from ON scheduled_transfers(from_user_id)`,
+				`ALTER TABLE transfers ADD COLUMN schedule_id BIGINT REFERENCES scheduled_transfers(id)`,
+				`CREATE INDEX idx_transfers_schedule ON transfers(schedule_id)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP INDEX idx_transfers_schedule`,
+				`ALTER TABLE transfers DROP COLUMN schedule_id`,
+				`DROP TABLE scheduled_transfers`,
+			)
+		},
+	},
+	{
+		version: 17,
+		name:    "tier_baselines",
+		up: func(tx *sql.Tx) error {
+			if err := execAll(tx,
+				`ALTER TABLE tier_history DROP CONSTRAINT tier_history_reason_check`,
+				`ALTER TABLE tier_history ADD CONSTRAINT tier_history_reason_check
+					CHECK (reason IN ('evaluation','manual','baseline'))`,
+			); err != nil {
+				return err
+			}
+			// Members from before the ledger keep their level for a window
+			_, err := tx.Exec(`
+				INSERT INTO tier_history (user_id, from_level, to_level, reason, points_earned, created_at)
+				SELECT id, membership_level, membership_level, 'baseline', 0, $1 FROM users
+			`, timestamp(time.Now()))
+			return err
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DELETE FROM tier_history WHERE reason = 'baseline'`,
+				`ALTER TABLE tier_history DROP CONSTRAINT tier_history_reason_check`,
+				`ALTER TABLE tier_history ADD CONSTRAINT tier_history_reason_check
+					CHECK (reason IN ('evaluation','manual'))`,
+			)
+		},
+	},
+	{
+		version: 18,
+		name:    "point_lot_uses",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`CREATE TABLE point_lot_uses (
+					ledger_entry_id BIGINT NOT NULL REFERENCES point_ledger(id),
+					lot_id BIGINT NOT NULL REFERENCES point_lots(id),
+					amount INTEGER NOT NULL CHECK (amount > 0),
+					PRIMARY KEY (ledger_entry_id, lot_id)
+				)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx, `DROP TABLE point_lot_uses`)
+		},
+	},
+	{
+		version: 19,
+		name:    "campaign_first_activity",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`ALTER TABLE campaigns DROP CONSTRAINT campaigns_rule_type_check`,
+				`ALTER TABLE campaigns ADD CONSTRAINT campaigns_rule_type_check
+					CHECK (rule_type IN ('multiplier','fixed','threshold','first'))`,
+				`ALTER TABLE campaign_awards ADD COLUMN transfer_id BIGINT REFERENCES transfers(id)`,
+				`ALTER TABLE campaign_awards ADD COLUMN reversed_at TEXT`,
+				`CREATE INDEX idx_campaign_awards_transfer ON campaign_awards(transfer_id)`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DROP INDEX idx_campaign_awards_transfer`,
+				`ALTER TABLE campaign_awards DROP COLUMN reversed_at`,
+				`ALTER TABLE campaign_awards DROP COLUMN transfer_id`,
+				// First-activity campaigns cannot be expressed; stop them
+				`UPDATE campaigns SET rule_type = 'fixed', active = FALSE WHERE rule_type = 'first'`,
+				`ALTER TABLE campaigns DROP CONSTRAINT campaigns_rule_type_check`,
+				`ALTER TABLE campaigns ADD CONSTRAINT campaigns_rule_type_check
+					CHECK (rule_type IN ('multiplier','fixed','threshold'))`,
+			)
+		},
+	},
+	{
+		version: 20,
+		name:    "batch_leg_keys",
+		up: func(tx *sql.Tx) error {
+			// Batch legs get a key prefix client keys may not use
+			return execAll(tx,
+				`UPDATE transfers SET idempotency_key = 'batch:' || idempotency_key
+					WHERE batch_id IS NOT NULL`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`UPDATE transfers SET idempotency_key = substr(idempotency_key, 7)
+					WHERE batch_id IS NOT NULL AND idempotency_key LIKE 'batch:%'`,
+			)
+		},
+	},
+	{
+		version: 21,
+		name:    "partner_api_keys",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`ALTER TABLE api_keys ADD COLUMN partner_id BIGINT REFERENCES partners(id)`,
+				`ALTER TABLE api_keys DROP CONSTRAINT api_keys_role_check`,
+				`ALTER TABLE api_keys ADD CONSTRAINT api_keys_role_check
+					CHECK (role IN ('member','staff','admin','partner'))`,
+			)
+		},
+		down: func(tx *sql.Tx) error {
+			return execAll(tx,
+				`DELETE FROM api_keys WHERE role = 'partner'`,
+				`ALTER TABLE api_keys DROP COLUMN partner_id`,
+				`ALTER TABLE api_keys DROP CONSTRAINT api_keys_role_check`,
+				`ALTER TABLE api_keys ADD CONSTRAINT api_keys_role_check
+					CHECK (role IN ('member','staff','admin'))`,
+			)
+		},
+	},
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Partner is a retailer whose purchases earn members points. EarnRate is
+// the points earned per unit of Currency spent.
+type Partner struct {
+	ID        int     `json:"id"`
+	Name      string  `json:"name"`
+	Currency  string  `json:"currency"`
+	EarnRate  float64 `json:"earnRate"`
+	Active    bool    `json:"active"`
+	CreatedAt string  `json:"createdAt"`
+	UpdatedAt string  `json:"updatedAt"`
+}
+
+// PartnerRequest represents the request body for creating or replacing a partner
+type PartnerRequest struct {
+	Name     string  `json:"name"`
+	Currency string  `json:"currency"`
+	EarnRate float64 `json:"earnRate"`
+	// Active defaults to true when omitted
+	Active *bool `json:"active,omitempty"`
+}
+
+// Purchase is a partner's receipt that earned a member points. The earn rate
+// in force when it was recorded is kept with it.
+type Purchase struct {
+	ID            int     `json:"id"`
+	PartnerID     int     `json:"partnerId"`
+	ReceiptID     string  `json:"receiptId"`
+	UserID        int     `json:"userId"`
+	MemberID      string  `json:"memberId"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	EarnRate      float64 `json:"earnRate"`
+	Points        int     `json:"points"`
+	LedgerEntryID *int    `json:"ledgerEntryId"`
+	PurchasedAt   string  `json:"purchasedAt"`
+	CreatedAt     string  `json:"createdAt"`
+}
+
+// PurchaseRequest is one purchase record sent by a partner
+type PurchaseRequest struct {
+	MemberID  string  `json:"memberId"`
+	ReceiptID string  `json:"receiptId"`
+	Amount    float64 `json:"amount"`
+	// Currency defaults to the partner's; PurchasedAt to the time received
+	Currency    string `json:"currency,omitempty"`
+	PurchasedAt string `json:"purchasedAt,omitempty"`
+}
+
+// PurchaseListResponse represents a page of a partner's purchases
+type PurchaseListResponse struct {
+	Data       []Purchase `json:"data"`
+	Page       int        `json:"page,omitempty"`
+	PageSize   int        `json:"pageSize"`
+	Total      *int       `json:"total,omitempty"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+	PrevCursor string     `json:"prevCursor,omitempty"`
+}
+
+// BulkPurchaseResult reports what became of one row of a bulk upload
+type BulkPurchaseResult struct {
+	Row       int    `json:"row"`
+	ReceiptID string `json:"receiptId,omitempty"`
+	// Status is created, duplicate or failed
+	Status   string    `json:"status"`
+	Purchase *Purchase `json:"purchase,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+const (
+	// maxPurchaseAmount bounds a single purchase so its points cannot overflow
+	maxPurchaseAmount = 1e9
+	// maxBulkPurchases bounds the rows of one bulk upload
+	maxBulkPurchases = 5000
+)
+
+var (
+	errPartnerInactive = errors.New("partner is inactive")
+	errMemberNotFound  = errors.New("no member with this member_id")
+	errReceiptReused   = errors.New("receipt id reused for a different purchase")
+)
+
+// purchasePoints converts spend into points at rate, rounding down. The
+// small epsilon keeps amounts such as 0.29 × 100 from landing just below a
+// whole number.
+func purchasePoints(amount, rate float64) int {
+	return int(math.Floor(amount*rate + 1e-9))
+}
+
+// samePurchase reports whether req describes the purchase p recorded
+func samePurchase(p Purchase, req PurchaseRequest) bool {
+	return p.MemberID == req.MemberID && p.Amount == req.Amount && p.Currency == req.Currency
+}
+
+// validatePurchase normalises req for partner and returns the message
+// explaining why it is invalid, or ""
+func validatePurchase(partner Partner, req *PurchaseRequest) string {
+	req.MemberID = strings.TrimSpace(req.MemberID)
+	req.ReceiptID = strings.TrimSpace(req.ReceiptID)
+	if req.MemberID == "" || req.ReceiptID == "" {
+		return "memberId and receiptId are required"
+	}
+	if len(req.ReceiptID) > 255 {
+		return "receiptId must be at most 255 characters"
+	}
+	if req.Amount <= 0 || req.Amount > maxPurchaseAmount || math.IsNaN(req.Amount) {
+		return fmt.Sprintf("amount must be positive and at most %.0f", maxPurchaseAmount)
+	}
+	if req.Currency == "" {
+		req.Currency = partner.Currency
+	} else if req.Currency = strings.ToUpper(req.Currency); req.Currency != partner.Currency {
+		return "currency must be the partner's currency, " + partner.Currency
+	}
+	if req.PurchasedAt != "" {
+		purchasedAt, err := parseDateBound(req.PurchasedAt, false)
+		if err != nil {
+			return "purchasedAt must be a date (YYYY-MM-DD) or RFC3339 timestamp"
+		}
+		req.PurchasedAt = purchasedAt
+	}
+	return ""
+}
+
+// ingestPurchase records a validated purchase for partner and credits the
+// member its points as an earn entry, together with any campaign and
+// referral bonuses the earn qualifies for. A receipt the partner already
+// sent returns the original purchase with duplicate set, or fails with
+// errReceiptReused if the record differs.
+func ingestPurchase(s Store, partner Partner, req PurchaseRequest) (purchase Purchase, duplicate bool, err error) {
+	if !partner.Active {
+		return Purchase{}, false, errPartnerInactive
+	}
+	if existing, err := s.Purchases().GetByReceipt(partner.ID, req.ReceiptID); err == nil {
+		return replayPurchase(existing, req)
+	} else if err != errPurchaseNotFound {
+		return Purchase{}, false, err
+	}
+
+	user, err := s.Users().GetByMemberID(req.MemberID)
+	if err == errUserNotFound {
+		return Purchase{}, false, errMemberNotFound
+	} else if err != nil {
+		return Purchase{}, false, err
+	}
+
+	now := timestamp(time.Now())
+	purchase = Purchase{
+		PartnerID:   partner.ID,
+		ReceiptID:   req.ReceiptID,
+		UserID:      user.ID,
+		MemberID:    user.MemberID,
+		Amount:      req.Amount,
+		Currency:    req.Currency,
+		EarnRate:    partner.EarnRate,
+		Points:      purchasePoints(req.Amount, partner.EarnRate),
+		PurchasedAt: req.PurchasedAt,
+		CreatedAt:   now,
+	}
+	if purchase.PurchasedAt == "" {
+		purchase.PurchasedAt = now
+	}
+
+	err = s.RunInTx(func(tx Store) error {
+		// Spend too small to earn a point is still recorded, so the receipt
+		// is not sent again
+		if purchase.Points > 0 {
+			metadata, _ := json.Marshal(map[string]interface{}{
+				"partnerId": partner.ID,
+				"receiptId": purchase.ReceiptID,
+				"amount":    purchase.Amount,
+				"currency":  purchase.Currency,
+			})
+			entry, _, err := creditEarned(tx, pointChange{
+				UserID:    user.ID,
+				Change:    purchase.Points,
+				EventType: "earn",
+				Reference: "Purchase at " + partner.Name,
+				Metadata:  string(metadata),
+			})
+			if err != nil {
+				return err
+			}
+			purchase.LedgerEntryID = &entry.ID
+		}
+		return tx.Purchases().Create(&purchase)
+	})
+
+	// A concurrent upload of the same receipt may have won the race
+	if err == errDuplicateReceipt {
+		existing, findErr := s.Purchases().GetByReceipt(partner.ID, req.ReceiptID)
+		if findErr != nil {
+			return Purchase{}, false, findErr
+		}
+		return replayPurchase(existing, req)
+	}
+	if err != nil {
+		return Purchase{}, false, err
+	}
+	return purchase, false, nil
+}
+
+// replayPurchase answers a resent receipt with the original purchase, or
+// rejects it if the receipt id was used for a different purchase
+func replayPurchase(existing Purchase, req PurchaseRequest) (Purchase, bool, error) {
+	if !samePurchase(existing, req) {
+		return Purchase{}, false, errReceiptReused
+	}
+	return existing, true, nil
+}
+
+// parsePartnerRequest validates a PartnerRequest body and returns the
+// partner it describes, or the message explaining why it is invalid
+func parsePartnerRequest(body []byte) (Partner, string) {
+	var req PartnerRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return Partner{}, "Invalid request body"
+	}
+
+	partner := Partner{
+		Name:     strings.TrimSpace(req.Name),
+		Currency: strings.ToUpper(strings.TrimSpace(req.Currency)),
+		EarnRate: req.EarnRate,
+		Active:   req.Active == nil || *req.Active,
+	}
+	if partner.Name == "" {
+		return Partner{}, "name is required"
+	}
+	if len(partner.Currency) != 3 || strings.Trim(partner.Currency, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return Partner{}, "currency must be a 3-letter ISO 4217 code"
+	}
+	if partner.EarnRate <= 0 || partner.EarnRate > 1000 {
+		return Partner{}, "earnRate must be positive and at most 1000"
+	}
+	return partner, ""
+}
+
+// partnerFromParams loads the partner named by the :partnerId route parameter
+func (a *API) partnerFromParams(c *fiber.Ctx) (Partner, error) {
+	id, err := strconv.Atoi(c.Params("partnerId"))
+	if err != nil || id <= 0 {
+		return Partner{}, errPartnerNotFound
+	}
+	return a.store.Partners().Get(id)
+}
+
+// GET /partners - List partners
+func (a *API) getPartners(c *fiber.Ctx) error {
+	partners, err := a.store.Partners().List()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "INTERNAL_ERROR",
+			"message": "Failed to fetch partners",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": partners,
+	})
+}
+
+// GET /partners/:partnerId - Get a partner
+func (a *API) getPartnerByID(c *fiber.Ctx) error {
+	partner, err := a.partnerFromParams(c)
+	if err != nil {
+		return transferErrorResponse(c, err, "fetch partner")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": partner,
+	})
+}
+
+// POST /partners - Add a partner
+func (a *API) createPartner(c *fiber.Ctx) error {
+	partner, message := parsePartnerRequest(c.Body())
+	if message != "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": message,
+		})
+	}
+
+	partner.CreatedAt = timestamp(time.Now())
+	partner.UpdatedAt = partner.CreatedAt
+	if err := a.store.Partners().Create(&partner); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "INTERNAL_ERROR",
+			"message": "Failed to create partner",
+		})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"data": partner,
+	})
+}
+
+// PUT /partners/:partnerId - Replace a partner. A new earn rate only applies
+// to purchases recorded from now on.
+func (a *API) updatePartner(c *fiber.Ctx) error {
+	existing, err := a.partnerFromParams(c)
+	if err != nil {
+		return transferErrorResponse(c, err, "fetch partner")
+	}
+
+	partner, message := parsePartnerRequest(c.Body())
+	if message != "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": message,
+		})
+	}
+
+	partner.ID = existing.ID
+	partner.CreatedAt = existing.CreatedAt
+	partner.UpdatedAt = timestamp(time.Now())
+	if err := a.store.Partners().Update(partner); err != nil {
+		return transferErrorResponse(c, err, "update partner")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": partner,
+	})
+}
+
+// POST /partners/:partnerId/purchases - Record a purchase and credit its points.
+// Resending a receipt returns the original purchase with 200 and "duplicate": true.
+func (a *API) createPurchase(c *fiber.Ctx) error {
+	partner, err := a.partnerFromParams(c)
+	if err != nil {
+		return transferErrorResponse(c, err, "fetch partner")
+	}
+
+	var req PurchaseRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "Invalid request body",
+		})
+	}
+	if message := validatePurchase(partner, &req); message != "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": message,
+		})
+	}
+
+	purchase, duplicate, err := ingestPurchase(a.store, partner, req)
+	if err != nil {
+		return transferErrorResponse(c, err, "record purchase")
+	}
+	if duplicate {
+		return c.JSON(fiber.Map{
+			"data":      purchase,
+			"duplicate": true,
+		})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"data": purchase,
+	})
+}
+
+// purchaseCSVColumns lists the columns of a bulk upload; the header row
+// names them in any order, and currency and purchased_at may be left out
+var purchaseCSVColumns = []string{"member_id", "receipt_id", "amount", "currency", "purchased_at"}
+
+// POST /partners/:partnerId/purchases/bulk - Record a CSV file of purchases,
+// sent as the request body or as the "file" field of a multipart form. Each
+// row is recorded on its own, so one bad row does not hold back the rest.
+func (a *API) createPurchasesBulk(c *fiber.Ctx) error {
+	partner, err := a.partnerFromParams(c)
+	if err != nil {
+		return transferErrorResponse(c, err, "fetch partner")
+	}
+	validationError := func(message string) error {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": message,
+		})
+	}
+
+	data, _, message := uploadedFile(c)
+	if message != "" {
+		return validationError(message)
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return validationError("the file must start with a header row")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		// Spreadsheet exports may start with a byte order mark
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if !containsString(purchaseCSVColumns, name) {
+			return validationError("unknown column " + strconv.Quote(name) + "; columns are " + strings.Join(purchaseCSVColumns, ", "))
+		}
+		columns[name] = i
+	}
+	for _, required := range purchaseCSVColumns[:3] {
+		if _, ok := columns[required]; !ok {
+			return validationError("the header must include " + required)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var records [][]string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return validationError("the file is not valid CSV: " + err.Error())
+		}
+		if len(records) == maxBulkPurchases {
+			return validationError(fmt.Sprintf("a file can hold at most %d purchases", maxBulkPurchases))
+		}
+		records = append(records, record)
+	}
+
+	results := make([]BulkPurchaseResult, 0, len(records))
+	counts := map[string]int{"created": 0, "duplicate": 0, "failed": 0}
+	for i, record := range records {
+		// Row 1 is the header
+		result := BulkPurchaseResult{Row: i + 2, ReceiptID: field(record, "receipt_id")}
+		req := PurchaseRequest{
+			MemberID:    field(record, "member_id"),
+			ReceiptID:   result.ReceiptID,
+			Currency:    field(record, "currency"),
+			PurchasedAt: field(record, "purchased_at"),
+		}
+		message := ""
+		if req.Amount, err = strconv.ParseFloat(field(record, "amount"), 64); err != nil {
+			message = "amount must be a number"
+		} else {
+			message = validatePurchase(partner, &req)
+		}
+
+		if message != "" {
+			result.Status, result.Error, result.Message = "failed", "VALIDATION_ERROR", message
+		} else if purchase, duplicate, err := ingestPurchase(a.store, partner, req); err != nil {
+			_, code, message, ok := describeError(err)
+			if !ok {
+				message = "Failed to record purchase"
+			}
+			result.Status, result.Error, result.Message = "failed", code, message
+		} else {
+			result.Status, result.Purchase = "created", &purchase
+			if duplicate {
+				result.Status = "duplicate"
+			}
+		}
+		counts[result.Status]++
+		results = append(results, result)
+	}
+
+	return c.JSON(fiber.Map{
+		"created":    counts["created"],
+		"duplicates": counts["duplicate"],
+		"failed":     counts["failed"],
+		"results":    results,
+	})
+}
+
+// GET /partners/:partnerId/purchases - List a partner's purchases, newest
+// first, optionally for one userId. Pages are selected with page/pageSize,
+// or by passing back nextCursor or prevCursor as cursor.
+func (a *API) getPurchases(c *fiber.Ctx) error {
+	partner, err := a.partnerFromParams(c)
+	if err != nil {
+		return transferErrorResponse(c, err, "fetch partner")
+	}
+	validationError := func(message string) error {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": message,
+		})
+	}
+
+	filter := PurchaseFilter{PartnerID: partner.ID}
+	if value := c.Query("userId"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return validationError("userId must be a positive integer")
+		}
+		filter.UserID = n
+	}
+
+	listPage, page, pageSize, err := parseListPage(c, ListPage{})
+	if err != nil {
+		return validationError("cursor is invalid")
+	}
+
+	purchases, err := a.store.Purchases().List(filter, listPage)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "INTERNAL_ERROR",
+			"message": "Failed to fetch purchases",
+		})
+	}
+
+	response := PurchaseListResponse{
+		Page:     page,
+		PageSize: pageSize,
+	}
+	response.Data, response.NextCursor, response.PrevCursor = keysetPage(purchases, listPage, pageSize, purchaseKeyset)
+
+	// Cursor pages skip the count; it is only needed to number pages
+	if page > 0 {
+		total, err := a.store.Purchases().Count(filter)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error":   "INTERNAL_ERROR",
+				"message": "Failed to count purchases",
+			})
+		}
+		response.Total = &total
+	}
+
+	return c.JSON(response)
+}
+
+// purchaseKeyset is a purchase's position in a newest-first listing
+func purchaseKeyset(p Purchase) Keyset {
+	return Keyset{Value: p.CreatedAt, ID: p.ID}
+}
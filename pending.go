@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TransferCancelRequest represents the optional request body for cancelling a pending transfer
+type TransferCancelRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// errNotSender is returned when a member tries to settle a transfer they received
+var errNotSender = errors.New("only the sender can confirm or cancel")
+
+// checkSender lets members act only on transfers they sent. Transfers they
+// cannot see are reported as not found so their keys cannot be probed;
+// recipients see the transfer but may not confirm or cancel it.
+func (a *API) checkSender(c *fiber.Ctx, idemKey string) error {
+	principal := principalFrom(c)
+	if principal.Role != roleMember {
+		return nil
+	}
+
+	transfer, err := a.store.Transfers().GetByIdemKey(idemKey)
+	if err != nil {
+		return err
+	}
+	if !principal.canSeeTransfer(transfer) {
+		return errTransferNotFound
+	}
+	if transfer.FromUserID != principal.UserID {
+		return errNotSender
+	}
+	return nil
+}
+
+// POST /transfers/:id/confirm - Complete a pending transfer by idempotency key
+func (a *API) confirmTransfer(c *fiber.Ctx) error {
+	if err := a.checkSender(c, c.Params("id")); err != nil {
+		return transferErrorResponse(c, err, "confirm transfer")
+	}
+
+	transfer, err := confirmPendingTransfer(a.store, c.Params("id"))
+	if err != nil {
+		return transferErrorResponse(c, err, "confirm transfer")
+	}
+
+	return c.JSON(TransferGetResponse{
+		Transfer: transfer,
+	})
+}
+
+// POST /transfers/:id/cancel - Cancel a pending transfer and release its hold
+func (a *API) cancelTransfer(c *fiber.Ctx) error {
+	var req TransferCancelRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error":   "VALIDATION_ERROR",
+				"message": "Invalid request body",
+			})
+		}
+	}
+	if req.Reason == "" {
+		req.Reason = "Cancelled by sender"
+	}
+
+	if err := a.checkSender(c, c.Params("id")); err != nil {
+		return transferErrorResponse(c, err, "cancel transfer")
+	}
+
+	transfer, err := cancelPendingTransfer(a.store, c.Params("id"), req.Reason)
+	if err != nil {
+		return transferErrorResponse(c, err, "cancel transfer")
+	}
+
+	return c.JSON(TransferGetResponse{
+		Transfer: transfer,
+	})
+}
+
+// runHoldExpiryWorker periodically releases stale pending holds until the process exits
+func runHoldExpiryWorker(store Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		count, err := expirePendingTransfers(store, time.Now())
+		if err != nil {
+			log.Println("Failed to expire pending transfers:", err)
+			continue
+		}
+		if count > 0 {
+			log.Printf("Expired %d pending transfer(s)", count)
+		}
+	}
+}
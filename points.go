@@ -0,0 +1,573 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Business errors returned by the point operations. Handlers translate them
+// into HTTP responses in transferErrorResponse.
+var (
+	errInsufficientBalance = errors.New("insufficient point balance")
+	errFromUserNotFound    = errors.New("from user not found")
+	errToUserNotFound      = errors.New("to user not found")
+	errSelfTransfer        = errors.New("cannot transfer points to yourself")
+	errIdemKeyReused       = errors.New("idempotency key reused with a different payload")
+	errTransferNotPending  = errors.New("transfer is not pending")
+	errHoldExpired         = errors.New("pending transfer has expired")
+	errPointsAlreadySpent  = errors.New("recipient has already spent the transferred points")
+	errDuplicateUser       = errors.New("member_id or email already exists")
+)
+
+// transferStatusError reports an operation attempted on a transfer in the wrong status
+type transferStatusError struct {
+	want   string
+	action string
+	status string
+}
+
+func (e *transferStatusError) Error() string {
+	return fmt.Sprintf("Only %s transfers can be %s (status is %s)", e.want, e.action, e.status)
+}
+
+// pointChange describes a single ledgered movement of a user's balance
+type pointChange struct {
+	UserID     int
+	Change     int
+	EventType  string
+	TransferID *int
+	Reference  string
+	Metadata   string
+
+	// AllowNegative lets the balance drop below zero, e.g. for an admin
+	// reversal after the recipient has already spent the points
+	AllowNegative bool
+
+	// Lots are the points a credit moves from another member or puts back
+	// after a refund, oldest first. The credit reopens them with their
+	// EarnedAt, so moving or refunding points does not restart their expiry.
+	Lots []PointLot
+}
+
+// timestamp formats t the way transfers and ledger entries store times
+func timestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// applyPointChange moves a user's balance and records the matching ledger
+// entry and point lots. It must run inside a transaction. Unless
+// AllowNegative is set it refuses to take the balance below the amount held
+// for pending transfers.
+func applyPointChange(tx Store, pc pointChange, now string) (PointLedgerEntry, error) {
+	entry, _, err := movePoints(tx, pc, now)
+	return entry, err
+}
+
+// movePoints is applyPointChange that also returns the lots a debit used
+// up, each with Amount set to the points taken from it
+func movePoints(tx Store, pc pointChange, now string) (PointLedgerEntry, []PointLot, error) {
+	if err := tx.Users().Lock(pc.UserID); err != nil {
+		return PointLedgerEntry{}, nil, err
+	}
+	balance, held, err := tx.Users().Balances(pc.UserID)
+	if err != nil {
+		return PointLedgerEntry{}, nil, err
+	}
+
+	// Points held by pending transfers are not available to spend
+	newBalance := balance + pc.Change
+	if newBalance < held && pc.Change < 0 && !pc.AllowNegative {
+		return PointLedgerEntry{}, nil, errInsufficientBalance
+	}
+
+	if err := tx.Users().SetBalance(pc.UserID, newBalance); err != nil {
+		return PointLedgerEntry{}, nil, err
+	}
+
+	entry := PointLedgerEntry{
+		UserID:       pc.UserID,
+		Change:       pc.Change,
+		BalanceAfter: newBalance,
+		EventType:    pc.EventType,
+		TransferID:   pc.TransferID,
+		Reference:    pc.Reference,
+		Metadata:     pc.Metadata,
+		CreatedAt:    now,
+	}
+	if err := tx.Ledger().Append(&entry); err != nil {
+		return PointLedgerEntry{}, nil, err
+	}
+	used, err := updateLots(tx, entry, pc.Lots, now)
+	if err != nil {
+		return PointLedgerEntry{}, nil, err
+	}
+	return entry, used, nil
+}
+
+// changeBalance applies a single point change in its own transaction
+func changeBalance(s Store, pc pointChange) (PointLedgerEntry, error) {
+	var entry PointLedgerEntry
+	err := s.RunInTx(func(tx Store) error {
+		var err error
+		entry, err = applyPointChange(tx, pc, timestamp(time.Now()))
+		return err
+	})
+	return entry, err
+}
+
+// createMember inserts a user and records any opening balance in the ledger
+// as an adjust entry, so that every point is accounted for. A member created
+// above the lowest tier gets a baseline tier entry, as their level was
+// earned elsewhere. It gives the user a referral code, and records a pending
+// referral when ReferredBy is set.
+func createMember(s Store, user *User) error {
+	opening := user.PointBalance
+	if user.ReferralCode == "" {
+		user.ReferralCode = newReferralCode()
+	}
+
+	return s.RunInTx(func(tx Store) error {
+		if user.ReferredBy != nil {
+			if err := checkReferral(tx, *user); err != nil {
+				return err
+			}
+		}
+		if err := tx.Users().Create(user); err != nil {
+			return err
+		}
+		if user.ReferredBy != nil {
+			err := tx.Referrals().Create(&Referral{
+				ReferrerID: *user.ReferredBy,
+				RefereeID:  user.ID,
+				Status:     "pending",
+				CreatedAt:  timestamp(time.Now()),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if opening > 0 {
+			_, err := applyPointChange(tx, pointChange{
+				UserID:    user.ID,
+				Change:    opening,
+				EventType: "adjust",
+				Reference: "Opening balance",
+			}, timestamp(time.Now()))
+			if err != nil {
+				return err
+			}
+		}
+		if tierRank(user.MembershipLevel) > 0 {
+			if err := recordTierBaseline(tx, *user, timestamp(time.Now())); err != nil {
+				return err
+			}
+		}
+
+		created, err := tx.Users().Get(user.ID)
+		if err != nil {
+			return err
+		}
+		*user = created
+		return nil
+	})
+}
+
+// updateMember applies patch to the profile of current. A tier change is
+// recorded in the tier history like one made by the tier engine.
+func updateMember(s Store, current User, patch UserPatch) error {
+	level := patch.MembershipLevel
+	patch.MembershipLevel = nil
+
+	return s.RunInTx(func(tx Store) error {
+		if err := tx.Users().Update(current.ID, patch); err != nil {
+			return err
+		}
+		if level == nil || *level == current.MembershipLevel {
+			return nil
+		}
+
+		now := time.Now()
+		earned, err := tx.Ledger().EarnedSince(tierWindowStart(now), current.ID)
+		if err != nil {
+			return err
+		}
+		_, err = setMemberTier(tx, current, *level, "manual", earned[current.ID], timestamp(now))
+		return err
+	})
+}
+
+// executeTransfer creates a transfer for req. With req.Hold it stays pending
+// and reserves the sender's points; otherwise the points move immediately.
+// A non-empty idemKey makes the call retry-safe: reusing it with the same
+// payload returns the original transfer with replayed set, and with a
+// different payload fails with errIdemKeyReused.
+func executeTransfer(s Store, req TransferCreateRequest, idemKey string) (transfer Transfer, replayed bool, err error) {
+	return executeTransferFrom(s, req, idemKey, transferOrigin{})
+}
+
+// transferOrigin names the batch or schedule a transfer was created by
+type transferOrigin struct {
+	BatchID    string
+	ScheduleID int
+}
+
+// tag records the origin on t
+func (o transferOrigin) tag(t *Transfer) {
+	if o.BatchID != "" {
+		t.BatchID = &o.BatchID
+	}
+	if o.ScheduleID != 0 {
+		t.ScheduleID = &o.ScheduleID
+	}
+}
+
+// executeTransferFrom is executeTransfer for a transfer created by origin
+func executeTransferFrom(s Store, req TransferCreateRequest, idemKey string, origin transferOrigin) (transfer Transfer, replayed bool, err error) {
+	if req.FromUserID == req.ToUserID {
+		return Transfer{}, false, errSelfTransfer
+	}
+
+	if idemKey == "" {
+		idemKey = uuid.New().String()
+	} else if existing, err := s.Transfers().GetByIdemKey(idemKey); err == nil {
+		return replayTransfer(existing, req)
+	} else if err != errTransferNotFound {
+		return Transfer{}, false, err
+	}
+
+	now := time.Now()
+	nowStr := timestamp(now)
+	transfer = Transfer{
+		IdemKey:    idemKey,
+		FromUserID: req.FromUserID,
+		ToUserID:   req.ToUserID,
+		Amount:     req.Amount,
+		Status:     "completed",
+		CreatedAt:  nowStr,
+		UpdatedAt:  nowStr,
+	}
+	if req.Note != "" {
+		transfer.Note = &req.Note
+	}
+	origin.tag(&transfer)
+
+	err = s.RunInTx(func(tx Store) error {
+		if err := tx.Users().Lock(req.FromUserID, req.ToUserID); err != nil {
+			return err
+		}
+
+		// Check if both users exist and get the sender's available balance
+		fromBalance, fromHeld, err := tx.Users().Balances(req.FromUserID)
+		if err == errUserNotFound {
+			return errFromUserNotFound
+		} else if err != nil {
+			return err
+		}
+		if _, _, err := tx.Users().Balances(req.ToUserID); err == errUserNotFound {
+			return errToUserNotFound
+		} else if err != nil {
+			return err
+		}
+
+		// Points held by pending transfers are not available
+		if fromBalance-fromHeld < req.Amount {
+			return errInsufficientBalance
+		}
+		if err := checkTransferLimits(tx, req.FromUserID, req.Amount, now); err != nil {
+			return err
+		}
+
+		if req.Hold {
+			expiresAt := timestamp(now.Add(cfg.PendingHoldTTL))
+			transfer.Status = "pending"
+			transfer.ExpiresAt = &expiresAt
+			if err := tx.Transfers().Create(&transfer); err != nil {
+				return err
+			}
+			return tx.Users().AddHeld(req.FromUserID, req.Amount)
+		}
+
+		transfer.CompletedAt = &nowStr
+		if err := tx.Transfers().Create(&transfer); err != nil {
+			return err
+		}
+		return settleTransfer(tx, transfer, nowStr)
+	})
+
+	// A concurrent request with the same key may have won the race
+	if err == errIdemKeyConflict {
+		existing, findErr := s.Transfers().GetByIdemKey(idemKey)
+		if findErr != nil {
+			return Transfer{}, false, findErr
+		}
+		return replayTransfer(existing, req)
+	}
+	if err != nil {
+		return Transfer{}, false, err
+	}
+	return transfer, false, nil
+}
+
+// replayTransfer answers a retried transfer request with the original
+// transfer, or rejects it if the key was issued for a different payload
+func replayTransfer(existing Transfer, req TransferCreateRequest) (Transfer, bool, error) {
+	if !sameTransferRequest(existing, req) {
+		return Transfer{}, false, errIdemKeyReused
+	}
+	return existing, true, nil
+}
+
+// sameTransferRequest reports whether req matches the payload that created t
+func sameTransferRequest(t Transfer, req TransferCreateRequest) bool {
+	note := ""
+	if t.Note != nil {
+		note = *t.Note
+	}
+	return t.FromUserID == req.FromUserID &&
+		t.ToUserID == req.ToUserID &&
+		t.Amount == req.Amount &&
+		note == req.Note &&
+		(t.ExpiresAt != nil) == req.Hold
+}
+
+// settleTransfer moves a transfer's points from sender to recipient, writes
+// the transfer_out / transfer_in ledger entries and credits the sender any
+// campaign bonuses for the transfer. The recipient gets the sender's lots,
+// keeping the dates the points were earned.
+func settleTransfer(tx Store, t Transfer, now string) error {
+	_, moved, err := movePoints(tx, pointChange{
+		UserID:     t.FromUserID,
+		Change:     -t.Amount,
+		EventType:  "transfer_out",
+		TransferID: &t.TransferID,
+		Reference:  fmt.Sprintf("Transfer to user %d", t.ToUserID),
+	}, now)
+	if err != nil {
+		return err
+	}
+
+	_, err = applyPointChange(tx, pointChange{
+		UserID:     t.ToUserID,
+		Change:     t.Amount,
+		EventType:  "transfer_in",
+		TransferID: &t.TransferID,
+		Reference:  fmt.Sprintf("Transfer from user %d", t.FromUserID),
+		Lots:       moved,
+	}, now)
+	if err != nil {
+		return err
+	}
+
+	_, err = applyCampaigns(tx, t.FromUserID, "transfer", t.Amount, &t.TransferID, now)
+	return err
+}
+
+// getPendingTransfer loads a transfer and checks that it is still pending
+func getPendingTransfer(tx Store, idemKey string) (Transfer, error) {
+	transfer, err := tx.Transfers().GetByIdemKey(idemKey)
+	if err != nil {
+		return Transfer{}, err
+	}
+	if transfer.Status != "pending" {
+		return Transfer{}, &transferStatusError{want: "pending", action: "confirmed or cancelled", status: transfer.Status}
+	}
+	return transfer, nil
+}
+
+// confirmPendingTransfer completes a pending transfer, releasing its hold
+// and moving the points. A hold that has run out is cancelled instead and
+// errHoldExpired is returned.
+func confirmPendingTransfer(s Store, idemKey string) (Transfer, error) {
+	now := timestamp(time.Now())
+	var transfer Transfer
+	expired := false
+
+	err := s.RunInTx(func(tx Store) error {
+		var err error
+		transfer, err = getPendingTransfer(tx, idemKey)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Users().Lock(transfer.FromUserID, transfer.ToUserID); err != nil {
+			return err
+		}
+
+		// Commit the expiry rather than confirming a lapsed hold
+		if transfer.ExpiresAt != nil && *transfer.ExpiresAt <= now {
+			expired = true
+			return closePendingTransfer(tx, &transfer, "Hold expired", now)
+		}
+
+		transfer.Status = "completed"
+		transfer.UpdatedAt = now
+		transfer.CompletedAt = &now
+		if err := tx.Transfers().Update(transfer, "pending"); err != nil {
+			return err
+		}
+
+		// Release the hold, then move the points as an ordinary transfer would
+		if err := tx.Users().AddHeld(transfer.FromUserID, -transfer.Amount); err != nil {
+			return err
+		}
+		return settleTransfer(tx, transfer, now)
+	})
+	if err == errTransferStatusChanged {
+		return Transfer{}, errTransferNotPending
+	}
+	if err != nil {
+		return Transfer{}, err
+	}
+	if expired {
+		return transfer, errHoldExpired
+	}
+	return transfer, nil
+}
+
+// cancelPendingTransfer cancels a pending transfer and releases its hold
+func cancelPendingTransfer(s Store, idemKey, reason string) (Transfer, error) {
+	now := timestamp(time.Now())
+	var transfer Transfer
+
+	err := s.RunInTx(func(tx Store) error {
+		var err error
+		transfer, err = getPendingTransfer(tx, idemKey)
+		if err != nil {
+			return err
+		}
+		return closePendingTransfer(tx, &transfer, reason, now)
+	})
+	if err == errTransferStatusChanged {
+		return Transfer{}, errTransferNotPending
+	}
+	return transfer, err
+}
+
+// closePendingTransfer cancels a pending transfer with the given reason and
+// releases the sender's hold. transfer is updated in place.
+func closePendingTransfer(tx Store, transfer *Transfer, reason, now string) error {
+	transfer.Status = "cancelled"
+	transfer.UpdatedAt = now
+	transfer.FailReason = &reason
+	if err := tx.Transfers().Update(*transfer, "pending"); err != nil {
+		return err
+	}
+	return tx.Users().AddHeld(transfer.FromUserID, -transfer.Amount)
+}
+
+// expirePendingTransfers cancels every pending transfer whose hold has run
+// out and returns how many were released
+func expirePendingTransfers(s Store, now time.Time) (int, error) {
+	nowStr := timestamp(now)
+	count := 0
+
+	err := s.RunInTx(func(tx Store) error {
+		expired, err := tx.Transfers().ListExpiredPending(nowStr)
+		if err != nil {
+			return err
+		}
+		for i := range expired {
+			if err := closePendingTransfer(tx, &expired[i], "Hold expired", nowStr); err != nil {
+				return err
+			}
+		}
+		count = len(expired)
+		return nil
+	})
+	return count, err
+}
+
+// reverseCompletedTransfer moves a completed transfer's points back to the
+// sender and marks it reversed. The compensating ledger entries reference the
+// original transfer. Unless allowNegative is set, the reversal is refused
+// when the recipient no longer has the points.
+func reverseCompletedTransfer(s Store, idemKey, reason string, allowNegative bool) (Transfer, []PointLedgerEntry, error) {
+	now := timestamp(time.Now())
+	var transfer Transfer
+	var entries []PointLedgerEntry
+
+	err := s.RunInTx(func(tx Store) error {
+		var err error
+		transfer, err = tx.Transfers().GetByIdemKey(idemKey)
+		if err != nil {
+			return err
+		}
+		if transfer.Status != "completed" {
+			return &transferStatusError{want: "completed", action: "reversed", status: transfer.Status}
+		}
+
+		if err := tx.Users().Lock(transfer.FromUserID, transfer.ToUserID); err != nil {
+			return err
+		}
+
+		// Claim the transfer so a concurrent reversal cannot apply twice
+		transfer.Status = "reversed"
+		transfer.UpdatedAt = now
+		transfer.ReversedAt = &now
+		transfer.ReversalReason = &reason
+		if err := tx.Transfers().Update(transfer, "completed"); err != nil {
+			return err
+		}
+
+		metadata, _ := json.Marshal(map[string]string{
+			"reason":     reason,
+			"reversalOf": transfer.IdemKey,
+		})
+
+		// Take the points back from the recipient first so an already-spent
+		// balance is detected before the sender is credited
+		recipientEntry, err := applyPointChange(tx, pointChange{
+			UserID:        transfer.ToUserID,
+			Change:        -transfer.Amount,
+			EventType:     "transfer_out",
+			TransferID:    &transfer.TransferID,
+			Reference:     fmt.Sprintf("Reversal of transfer from user %d", transfer.FromUserID),
+			Metadata:      string(metadata),
+			AllowNegative: allowNegative,
+		}, now)
+		if err == errInsufficientBalance {
+			return errPointsAlreadySpent
+		} else if err != nil {
+			return err
+		}
+
+		// The sender gets back the lots the transfer took from them
+		restored, err := transferredLots(tx, transfer)
+		if err != nil {
+			return err
+		}
+		senderEntry, err := applyPointChange(tx, pointChange{
+			UserID:     transfer.FromUserID,
+			Change:     transfer.Amount,
+			EventType:  "transfer_in",
+			TransferID: &transfer.TransferID,
+			Reference:  fmt.Sprintf("Reversal of transfer to user %d", transfer.ToUserID),
+			Metadata:   string(metadata),
+			Lots:       restored,
+		}, now)
+		if err != nil {
+			return err
+		}
+
+		// Campaign bonuses the transfer earned the sender go too
+		clawbacks, err := reverseCampaignAwards(tx, transfer, now)
+		if err != nil {
+			return err
+		}
+
+		entries = append([]PointLedgerEntry{senderEntry, recipientEntry}, clawbacks...)
+		return nil
+	})
+	if err == errTransferStatusChanged {
+		return Transfer{}, nil, &transferStatusError{want: "completed", action: "reversed", status: "reversed"}
+	}
+	if err != nil {
+		return Transfer{}, nil, err
+	}
+	return transfer, entries, nil
+}
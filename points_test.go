@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newTransferStore returns a memory store holding alice with 100 points and
+// bob with none
+func newTransferStore(t *testing.T) (Store, User, User) {
+	t.Helper()
+	s := newMemoryStore()
+	alice, err := conformanceUser(s, "unit", "alice", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := conformanceUser(s, "unit", "bob", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, alice, bob
+}
+
+func TestExecuteTransferInsufficientBalance(t *testing.T) {
+	s, alice, bob := newTransferStore(t)
+
+	req := TransferCreateRequest{FromUserID: alice.ID, ToUserID: bob.ID, Amount: 101}
+	if _, _, err := executeTransfer(s, req, "too-much"); !errors.Is(err, errInsufficientBalance) {
+		t.Fatalf("got error %v, want %v", err, errInsufficientBalance)
+	}
+	if _, err := s.Transfers().GetByIdemKey("too-much"); err != errTransferNotFound {
+		t.Fatalf("failed transfer was stored: %v", err)
+	}
+	if err := expectBalance(s, alice.ID, 100, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectBalance(s, bob.ID, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExecuteTransferToSelf(t *testing.T) {
+	s, alice, _ := newTransferStore(t)
+
+	req := TransferCreateRequest{FromUserID: alice.ID, ToUserID: alice.ID, Amount: 10}
+	if _, _, err := executeTransfer(s, req, ""); !errors.Is(err, errSelfTransfer) {
+		t.Fatalf("got error %v, want %v", err, errSelfTransfer)
+	}
+	if err := expectBalance(s, alice.ID, 100, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExecuteTransferReplay(t *testing.T) {
+	s, alice, bob := newTransferStore(t)
+
+	req := TransferCreateRequest{FromUserID: alice.ID, ToUserID: bob.ID, Amount: 40, Note: "lunch"}
+	first, replayed, err := executeTransfer(s, req, "replay-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed || first.Status != "completed" || first.IdemKey != "replay-key" {
+		t.Fatalf("first call: replayed %v, transfer %+v", replayed, first)
+	}
+
+	second, replayed, err := executeTransfer(s, req, "replay-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replayed || second.TransferID != first.TransferID {
+		t.Fatalf("retry: replayed %v, transfer %+v, want transfer %d", replayed, second, first.TransferID)
+	}
+
+	// The points moved once
+	if err := expectBalance(s, alice.ID, 60, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectBalance(s, bob.ID, 40, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExecuteTransferKeyReusedWithDifferentPayload(t *testing.T) {
+	s, alice, bob := newTransferStore(t)
+
+	req := TransferCreateRequest{FromUserID: alice.ID, ToUserID: bob.ID, Amount: 40}
+	if _, _, err := executeTransfer(s, req, "reused-key"); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := []TransferCreateRequest{
+		{FromUserID: alice.ID, ToUserID: bob.ID, Amount: 41},
+		{FromUserID: alice.ID, ToUserID: bob.ID, Amount: 40, Note: "different"},
+		{FromUserID: alice.ID, ToUserID: bob.ID, Amount: 40, Hold: true},
+		{FromUserID: bob.ID, ToUserID: alice.ID, Amount: 40},
+	}
+	for _, req := range changed {
+		if _, _, err := executeTransfer(s, req, "reused-key"); !errors.Is(err, errIdemKeyReused) {
+			t.Errorf("%+v: got error %v, want %v", req, err, errIdemKeyReused)
+		}
+	}
+	if err := expectBalance(s, alice.ID, 60, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectBalance(s, bob.ID, 40, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateTransferRejectsBatchKey(t *testing.T) {
+	s, alice, bob := newTransferStore(t)
+
+	app := fiber.New()
+	app.Post("/transfers", newAPI(s).createTransfer)
+
+	body := `{"fromUserId": ` + strconv.Itoa(alice.ID) + `, "toUserId": ` + strconv.Itoa(bob.ID) + `, "amount": 10}`
+	req := httptest.NewRequest("POST", "/transfers", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", batchLegKey("payroll", 0))
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 400 {
+		t.Fatalf("status %d, want 400", resp.StatusCode)
+	}
+	if err := expectBalance(s, alice.ID, 100, 0); err != nil {
+		t.Fatal(err)
+	}
+}
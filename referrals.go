@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Referral links a new member to the member whose referral code they signed
+// up with. It stays pending until the referee's first qualifying earn, which
+// credits both members, or is rejected by the anti-abuse checks.
+type Referral struct {
+	ID              int     `json:"id"`
+	ReferrerID      int     `json:"referrerId"`
+	RefereeID       int     `json:"refereeId"`
+	Status          string  `json:"status"`
+	ReferrerEntryID *int    `json:"referrerEntryId"`
+	RefereeEntryID  *int    `json:"refereeEntryId"`
+	RejectReason    string  `json:"rejectReason,omitempty"`
+	CreatedAt       string  `json:"createdAt"`
+	ResolvedAt      *string `json:"resolvedAt"`
+}
+
+// referralCodeAlphabet leaves out characters that are easily misread
+const referralCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// referralRejectedError reports a referral refused by the anti-abuse checks
+type referralRejectedError struct {
+	reason string
+}
+
+func (e *referralRejectedError) Error() string {
+	return "Referral rejected: " + e.reason
+}
+
+// newReferralCode returns a random 8-character referral code
+func newReferralCode() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("generate referral code: %v", err))
+	}
+	for i := range b {
+		b[i] = referralCodeAlphabet[int(b[i])%len(referralCodeAlphabet)]
+	}
+	return string(b)
+}
+
+// normalizeEmail lowercases an address and drops any +tag, so that
+// variants of one mailbox compare equal
+func normalizeEmail(email string) string {
+	local, domain, ok := strings.Cut(strings.ToLower(strings.TrimSpace(email)), "@")
+	if !ok {
+		return local
+	}
+	local, _, _ = strings.Cut(local, "+")
+	return local + "@" + domain
+}
+
+// normalizeMobile keeps only the digits of a mobile number
+func normalizeMobile(mobile string) string {
+	return strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return -1
+		}
+		return r
+	}, mobile)
+}
+
+// referralAbuse returns why a referral between referrer and referee looks
+// like one person referring themselves, or "" if it does not
+func referralAbuse(referrer, referee User) string {
+	switch {
+	case referrer.ID == referee.ID:
+		return "members cannot refer themselves"
+	case referee.Email != "" && normalizeEmail(referrer.Email) == normalizeEmail(referee.Email):
+		return "referrer and referee share an email address"
+	case normalizeMobile(referee.MobileNumber) != "" && normalizeMobile(referrer.MobileNumber) == normalizeMobile(referee.MobileNumber):
+		return "referrer and referee share a mobile number"
+	}
+	return ""
+}
+
+// checkReferral checks that user, about to be created, may be referred by
+// user.ReferredBy. It must run inside the transaction that creates user.
+func checkReferral(tx Store, user User) error {
+	if err := tx.Users().Lock(*user.ReferredBy); err != nil {
+		return err
+	}
+	referrer, err := tx.Users().Get(*user.ReferredBy)
+	if err == errUserNotFound {
+		return &referralRejectedError{"referrer not found"}
+	} else if err != nil {
+		return err
+	}
+	if reason := referralAbuse(referrer, user); reason != "" {
+		return &referralRejectedError{reason}
+	}
+
+	// Rejected referrals do not use up the referrer's allowance
+	if cfg.ReferralMaxPerReferrer > 0 {
+		count, err := tx.Referrals().Count(ReferralFilter{ReferrerID: referrer.ID, Statuses: []string{"pending", "rewarded"}})
+		if err != nil {
+			return err
+		}
+		if count >= cfg.ReferralMaxPerReferrer {
+			return &referralRejectedError{"referrer has reached the referral limit"}
+		}
+	}
+	return nil
+}
+
+// applyReferral rewards the pending referral of a referee whose earn of
+// amount qualifies: both members are credited an earn entry carrying the
+// referral id in its metadata. The checks run again, since profiles may have
+// changed since sign-up; a referral failing them is rejected for good. It
+// returns the referee's entry, or nil, and must run inside the transaction
+// that recorded the earn.
+func applyReferral(tx Store, refereeID, amount int, now string) (*PointLedgerEntry, error) {
+	if amount < cfg.ReferralMinEarn {
+		return nil, nil
+	}
+	referral, err := tx.Referrals().GetByReferee(refereeID)
+	if err == errReferralNotFound || (err == nil && referral.Status != "pending") {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	referee, err := tx.Users().Get(refereeID)
+	if err != nil {
+		return nil, err
+	}
+	referrer, err := tx.Users().Get(referral.ReferrerID)
+	reason := ""
+	if err == errUserNotFound {
+		reason = "referrer not found"
+	} else if err != nil {
+		return nil, err
+	} else {
+		reason = referralAbuse(referrer, referee)
+	}
+	if reason == "" && cfg.ReferralMaxPerReferrer > 0 {
+		rewarded, err := tx.Referrals().Count(ReferralFilter{ReferrerID: referrer.ID, Statuses: []string{"rewarded"}})
+		if err != nil {
+			return nil, err
+		}
+		if rewarded >= cfg.ReferralMaxPerReferrer {
+			reason = "referrer has reached the referral limit"
+		}
+	}
+
+	referral.ResolvedAt = &now
+	if reason != "" {
+		referral.Status = "rejected"
+		referral.RejectReason = reason
+		return nil, tx.Referrals().Update(referral, "pending")
+	}
+
+	var refereeEntry *PointLedgerEntry
+	for _, bonus := range []struct {
+		userID   int
+		points   int
+		metadata map[string]interface{}
+		entryID  **int
+	}{
+		{referrer.ID, cfg.ReferrerPoints, map[string]interface{}{"referralId": referral.ID, "refereeId": referee.ID}, &referral.ReferrerEntryID},
+		{referee.ID, cfg.RefereePoints, map[string]interface{}{"referralId": referral.ID, "referrerId": referrer.ID}, &referral.RefereeEntryID},
+	} {
+		if bonus.points <= 0 {
+			continue
+		}
+		metadata, _ := json.Marshal(bonus.metadata)
+		entry, err := applyPointChange(tx, pointChange{
+			UserID:    bonus.userID,
+			Change:    bonus.points,
+			EventType: "earn",
+			Reference: "Referral bonus",
+			Metadata:  string(metadata),
+		}, now)
+		if err != nil {
+			return nil, err
+		}
+		*bonus.entryID = &entry.ID
+		if bonus.userID == referee.ID {
+			refereeEntry = &entry
+		}
+	}
+
+	referral.Status = "rewarded"
+	if err := tx.Referrals().Update(referral, "pending"); err != nil {
+		return nil, err
+	}
+	return refereeEntry, enqueueWebhook(tx, "referral.rewarded", referral, now)
+}
+
+// GET /users/:id/referrals - A member's referral code and the members they referred
+func (a *API) getUserReferrals(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "Invalid user ID",
+		})
+	}
+
+	user, err := a.store.Users().Get(userID)
+	if err != nil {
+		return transferErrorResponse(c, err, "fetch user")
+	}
+	referrals, err := a.store.Referrals().List(ReferralFilter{ReferrerID: userID})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "INTERNAL_ERROR",
+			"message": "Failed to fetch referrals",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"referralCode": user.ReferralCode,
+		"data":         referrals,
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// TransferReverseRequest represents the request body for reversing a transfer
+type TransferReverseRequest struct {
+	Reason string `json:"reason"`
+
+	// AllowNegativeBalance lets the reversal go through even when the
+	// recipient has already spent the points, leaving them in debt
+	AllowNegativeBalance bool `json:"allowNegativeBalance,omitempty"`
+}
+
+// TransferReverseResponse represents the response for reversing a transfer
+type TransferReverseResponse struct {
+	Transfer Transfer           `json:"transfer"`
+	Entries  []PointLedgerEntry `json:"entries"`
+}
+
+// POST /transfers/:id/reverse - Reverse a completed transfer by idempotency key
+func (a *API) reverseTransfer(c *fiber.Ctx) error {
+	var req TransferReverseRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "Invalid request body",
+		})
+	}
+
+	if req.Reason == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "reason is required",
+		})
+	}
+
+	// Leaving the recipient in debt is an admin decision
+	if req.AllowNegativeBalance && !principalFrom(c).hasRole(roleAdmin) {
+		return forbidden(c, "allowNegativeBalance requires the admin role")
+	}
+
+	transfer, entries, err := reverseCompletedTransfer(a.store, c.Params("id"), req.Reason, req.AllowNegativeBalance)
+	if err != nil {
+		return transferErrorResponse(c, err, "reverse transfer")
+	}
+
+	return c.JSON(TransferReverseResponse{
+		Transfer: transfer,
+		Entries:  entries,
+	})
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Reward is an item in the rewards catalog. A nil Stock is unlimited, empty
+// validity bounds are open, and an empty EligibleTiers lets every tier
+// redeem it. Inactive rewards stay in the catalog for existing orders but
+// cannot be redeemed.
+type Reward struct {
+	ID            int      `json:"id"`
+	Name          string   `json:"name"`
+	Description   string   `json:"description,omitempty"`
+	PointCost     int      `json:"pointCost"`
+	Stock         *int     `json:"stock"`
+	ValidFrom     string   `json:"validFrom,omitempty"`
+	ValidUntil    string   `json:"validUntil,omitempty"`
+	EligibleTiers []string `json:"eligibleTiers"`
+	Active        bool     `json:"active"`
+	CreatedAt     string   `json:"createdAt"`
+	UpdatedAt     string   `json:"updatedAt"`
+}
+
+// RewardRequest represents the request body for creating or replacing a reward
+type RewardRequest struct {
+	Name          string   `json:"name"`
+	Description   string   `json:"description,omitempty"`
+	PointCost     int      `json:"pointCost"`
+	Stock         *int     `json:"stock"`
+	ValidFrom     string   `json:"validFrom,omitempty"`
+	ValidUntil    string   `json:"validUntil,omitempty"`
+	EligibleTiers []string `json:"eligibleTiers,omitempty"`
+	// Active defaults to true when omitted
+	Active *bool `json:"active,omitempty"`
+}
+
+// RedemptionOrder is a member's order for a reward. Points is what the order
+// cost, fixed when it was placed; a cancelled order refunds exactly that.
+// Orders move from placed to fulfilled or cancelled and stop there.
+type RedemptionOrder struct {
+	ID            int     `json:"id"`
+	UserID        int     `json:"userId"`
+	RewardID      int     `json:"rewardId"`
+	Quantity      int     `json:"quantity"`
+	Points        int     `json:"points"`
+	Status        string  `json:"status"`
+	LedgerEntryID *int    `json:"ledgerEntryId,omitempty"`
+	RefundEntryID *int    `json:"refundEntryId,omitempty"`
+	CancelReason  *string `json:"cancelReason,omitempty"`
+	CreatedAt     string  `json:"createdAt"`
+	UpdatedAt     string  `json:"updatedAt"`
+	FulfilledAt   *string `json:"fulfilledAt,omitempty"`
+	CancelledAt   *string `json:"cancelledAt,omitempty"`
+}
+
+// RedemptionCreateRequest represents the request body for placing an order
+type RedemptionCreateRequest struct {
+	UserID   int `json:"userId"`
+	RewardID int `json:"rewardId"`
+	// Quantity defaults to 1
+	Quantity int `json:"quantity,omitempty"`
+}
+
+// RedemptionCancelRequest represents the optional request body for cancelling an order
+type RedemptionCancelRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// RedemptionListResponse represents the response for listing orders. Like
+// TransferListResponse, Page and Total are only set for page-numbered requests.
+type RedemptionListResponse struct {
+	Data       []RedemptionOrder `json:"data"`
+	Page       int               `json:"page,omitempty"`
+	PageSize   int               `json:"pageSize"`
+	Total      *int              `json:"total,omitempty"`
+	NextCursor string            `json:"nextCursor,omitempty"`
+	PrevCursor string            `json:"prevCursor,omitempty"`
+}
+
+// maxRedemptionQuantity bounds the quantity of a single order
+const maxRedemptionQuantity = 100
+
+// redemptionStatuses lists the statuses allowed by the redemption_orders CHECK constraint
+var redemptionStatuses = []string{"placed", "fulfilled", "cancelled"}
+
+var (
+	errRewardUnavailable = errors.New("reward is not available for redemption")
+	errRewardNotEligible = errors.New("reward is not available to the member's tier")
+	errOutOfStock        = errors.New("reward is out of stock")
+)
+
+// redemptionStatusError reports an operation attempted on an order in the wrong status
+type redemptionStatusError struct {
+	action string
+	status string
+}
+
+func (e *redemptionStatusError) Error() string {
+	return fmt.Sprintf("Only placed orders can be %s (status is %s)", e.action, e.status)
+}
+
+// availableAt reports whether the reward can be redeemed at now, ignoring stock
+func (r Reward) availableAt(now string) bool {
+	return r.Active && (r.ValidFrom == "" || r.ValidFrom <= now) && (r.ValidUntil == "" || now <= r.ValidUntil)
+}
+
+// eligible reports whether members of level may redeem the reward
+func (r Reward) eligible(level string) bool {
+	if len(r.EligibleTiers) == 0 {
+		return true
+	}
+	for _, tier := range r.EligibleTiers {
+		if tier == level {
+			return true
+		}
+	}
+	return false
+}
+
+// placeRedemption orders quantity of a reward for a user. In one
+// transaction it takes the reward out of stock, debits the points as a
+// redeem ledger entry and records the order as placed.
+func placeRedemption(s Store, userID, rewardID, quantity int, now time.Time) (RedemptionOrder, error) {
+	nowStr := timestamp(now)
+	var order RedemptionOrder
+
+	err := s.RunInTx(func(tx Store) error {
+		if err := tx.Users().Lock(userID); err != nil {
+			return err
+		}
+		user, err := tx.Users().Get(userID)
+		if err != nil {
+			return err
+		}
+		reward, err := tx.Rewards().Get(rewardID)
+		if err != nil {
+			return err
+		}
+		if !reward.availableAt(nowStr) {
+			return errRewardUnavailable
+		}
+		if !reward.eligible(user.MembershipLevel) {
+			return errRewardNotEligible
+		}
+		if err := tx.Rewards().AdjustStock(rewardID, -quantity); err != nil {
+			return err
+		}
+
+		order = RedemptionOrder{
+			UserID:    userID,
+			RewardID:  rewardID,
+			Quantity:  quantity,
+			Points:    reward.PointCost * quantity,
+			Status:    "placed",
+			CreatedAt: nowStr,
+			UpdatedAt: nowStr,
+		}
+		if err := tx.Redemptions().Create(&order); err != nil {
+			return err
+		}
+
+		metadata, _ := json.Marshal(map[string]int{
+			"orderId":  order.ID,
+			"rewardId": rewardID,
+			"quantity": quantity,
+		})
+		entry, err := applyPointChange(tx, pointChange{
+			UserID:    userID,
+			Change:    -order.Points,
+			EventType: "redeem",
+			Reference: fmt.Sprintf("Reward order %d: %dx %s", order.ID, quantity, reward.Name),
+			Metadata:  string(metadata),
+		}, nowStr)
+		if err != nil {
+			return err
+		}
+
+		order.LedgerEntryID = &entry.ID
+		if err := tx.Redemptions().Update(order, "placed"); err != nil {
+			return err
+		}
+		return enqueueWebhook(tx, "redemption.placed", order, nowStr)
+	})
+	return order, err
+}
+
+// fulfilRedemption marks a placed order fulfilled
+func fulfilRedemption(s Store, orderID int, now time.Time) (RedemptionOrder, error) {
+	nowStr := timestamp(now)
+	var order RedemptionOrder
+
+	err := s.RunInTx(func(tx Store) error {
+		var err error
+		order, err = tx.Redemptions().Get(orderID)
+		if err != nil {
+			return err
+		}
+		if order.Status != "placed" {
+			return &redemptionStatusError{action: "fulfilled", status: order.Status}
+		}
+
+		order.Status = "fulfilled"
+		order.UpdatedAt = nowStr
+		order.FulfilledAt = &nowStr
+		if err := tx.Redemptions().Update(order, "placed"); err != nil {
+			return err
+		}
+		return enqueueWebhook(tx, "redemption.fulfilled", order, nowStr)
+	})
+	return order, err
+}
+
+// cancelRedemption cancels a placed order, putting the reward back in stock
+// and refunding its points as a positive redeem ledger entry. The refund
+// reopens the lots the order used with their earned dates, so cancelling
+// an order does not restart the expiry of its points.
+func cancelRedemption(s Store, orderID int, reason string, now time.Time) (RedemptionOrder, error) {
+	nowStr := timestamp(now)
+	var order RedemptionOrder
+
+	err := s.RunInTx(func(tx Store) error {
+		var err error
+		order, err = tx.Redemptions().Get(orderID)
+		if err != nil {
+			return err
+		}
+		if order.Status != "placed" {
+			return &redemptionStatusError{action: "cancelled", status: order.Status}
+		}
+
+		if err := tx.Rewards().AdjustStock(order.RewardID, order.Quantity); err != nil {
+			return err
+		}
+
+		var used []PointLot
+		if order.LedgerEntryID != nil {
+			if used, err = tx.Lots().ListUsedBy(order.UserID, *order.LedgerEntryID); err != nil {
+				return err
+			}
+		}
+
+		metadata, _ := json.Marshal(map[string]interface{}{
+			"orderId":  order.ID,
+			"rewardId": order.RewardID,
+			"refund":   true,
+			"reason":   reason,
+		})
+		entry, err := applyPointChange(tx, pointChange{
+			UserID:    order.UserID,
+			Change:    order.Points,
+			EventType: "redeem",
+			Reference: fmt.Sprintf("Refund of reward order %d", order.ID),
+			Metadata:  string(metadata),
+			Lots:      used,
+		}, nowStr)
+		if err != nil {
+			return err
+		}
+
+		order.Status = "cancelled"
+		order.UpdatedAt = nowStr
+		order.CancelledAt = &nowStr
+		order.CancelReason = &reason
+		order.RefundEntryID = &entry.ID
+		if err := tx.Redemptions().Update(order, "placed"); err != nil {
+			return err
+		}
+		return enqueueWebhook(tx, "redemption.cancelled", order, nowStr)
+	})
+	return order, err
+}
+
+// parseRewardRequest validates a RewardRequest body and returns the reward
+// it describes, or the message explaining why it is invalid
+func parseRewardRequest(body []byte) (Reward, string) {
+	var req RewardRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return Reward{}, "Invalid request body"
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return Reward{}, "name is required"
+	}
+	if req.PointCost <= 0 {
+		return Reward{}, "pointCost must be a positive integer"
+	}
+	if req.Stock != nil && *req.Stock < 0 {
+		return Reward{}, "stock must be zero or more, or null for unlimited"
+	}
+
+	reward := Reward{
+		Name:          req.Name,
+		Description:   req.Description,
+		PointCost:     req.PointCost,
+		Stock:         req.Stock,
+		EligibleTiers: []string{},
+		Active:        req.Active == nil || *req.Active,
+	}
+	for _, bound := range []struct {
+		param    string
+		value    string
+		endOfDay bool
+		dst      *string
+	}{
+		{"validFrom", req.ValidFrom, false, &reward.ValidFrom},
+		{"validUntil", req.ValidUntil, true, &reward.ValidUntil},
+	} {
+		if bound.value == "" {
+			continue
+		}
+		parsed, err := parseDateBound(bound.value, bound.endOfDay)
+		if err != nil {
+			return Reward{}, bound.param + " must be a date (YYYY-MM-DD) or RFC3339 timestamp"
+		}
+		*bound.dst = parsed
+	}
+	if reward.ValidFrom != "" && reward.ValidUntil != "" && reward.ValidFrom > reward.ValidUntil {
+		return Reward{}, "validFrom must not be after validUntil"
+	}
+
+	for _, tier := range req.EligibleTiers {
+		if !isTier(tier) {
+			return Reward{}, "eligibleTiers must only contain: " + strings.Join(tierNames(), ", ")
+		}
+		reward.EligibleTiers = append(reward.EligibleTiers, tier)
+	}
+	return reward, ""
+}
+
+// GET /rewards - List the rewards catalog. Members, and anyone passing
+// available=true, only see rewards they could redeem now, stock permitting.
+func (a *API) getRewards(c *fiber.Ctx) error {
+	var filter RewardFilter
+	if c.Query("available") == "true" || principalFrom(c).Role == roleMember {
+		filter.AvailableAt = timestamp(time.Now())
+		filter.InStock = true
+	}
+
+	rewards, err := a.store.Rewards().List(filter)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "INTERNAL_ERROR",
+			"message": "Failed to fetch rewards",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": rewards,
+	})
+}
+
+// GET /rewards/:id - Get a reward
+func (a *API) getRewardByID(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil || id <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "Reward ID must be a positive integer",
+		})
+	}
+
+	reward, err := a.store.Rewards().Get(id)
+	if err != nil {
+		return transferErrorResponse(c, err, "fetch reward")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": reward,
+	})
+}
+
+// POST /rewards - Add a reward to the catalog
+func (a *API) createReward(c *fiber.Ctx) error {
+	reward, message := parseRewardRequest(c.Body())
+	if message != "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": message,
+		})
+	}
+
+	reward.CreatedAt = timestamp(time.Now())
+	reward.UpdatedAt = reward.CreatedAt
+	if err := a.store.Rewards().Create(&reward); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "INTERNAL_ERROR",
+			"message": "Failed to create reward",
+		})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"data": reward,
+	})
+}
+
+// PUT /rewards/:id - Replace a reward. Orders already placed keep the
+// points they cost; stock is set to the given count.
+func (a *API) updateReward(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil || id <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "Reward ID must be a positive integer",
+		})
+	}
+
+	reward, message := parseRewardRequest(c.Body())
+	if message != "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": message,
+		})
+	}
+
+	existing, err := a.store.Rewards().Get(id)
+	if err != nil {
+		return transferErrorResponse(c, err, "fetch reward")
+	}
+	reward.ID = id
+	reward.CreatedAt = existing.CreatedAt
+	reward.UpdatedAt = timestamp(time.Now())
+	if err := a.store.Rewards().Update(reward); err != nil {
+		return transferErrorResponse(c, err, "update reward")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": reward,
+	})
+}
+
+// POST /redemptions - Place an order for a reward. Members order for themselves.
+func (a *API) createRedemption(c *fiber.Ctx) error {
+	var req RedemptionCreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "Invalid request body",
+		})
+	}
+
+	principal := principalFrom(c)
+	if req.UserID == 0 && principal.Role == roleMember {
+		req.UserID = principal.UserID
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	if req.UserID <= 0 || req.RewardID <= 0 || req.Quantity < 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "userId, rewardId and quantity must be positive integers",
+		})
+	}
+	if req.Quantity > maxRedemptionQuantity {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": fmt.Sprintf("quantity must be at most %d", maxRedemptionQuantity),
+		})
+	}
+	if principal.Role == roleMember && req.UserID != principal.UserID {
+		return forbidden(c, "Members can only redeem their own points")
+	}
+
+	order, err := placeRedemption(a.store, req.UserID, req.RewardID, req.Quantity, time.Now())
+	if err != nil {
+		return transferErrorResponse(c, err, "place order")
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"data": order,
+	})
+}
+
+// GET /redemptions - List orders, newest first. Members only see their own;
+// staff may filter by userId, rewardId and status.
+// Pages are selected with page/pageSize, or by passing back nextCursor or prevCursor as cursor.
+func (a *API) getRedemptions(c *fiber.Ctx) error {
+	principal := principalFrom(c)
+	validationError := func(message string) error {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": message,
+		})
+	}
+
+	var filter RedemptionFilter
+	for _, param := range []struct {
+		name string
+		dst  *int
+	}{
+		{"userId", &filter.UserID},
+		{"rewardId", &filter.RewardID},
+	} {
+		if value := c.Query(param.name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return validationError(param.name + " must be a positive integer")
+			}
+			*param.dst = n
+		}
+	}
+	if principal.Role == roleMember {
+		if filter.UserID != 0 && filter.UserID != principal.UserID {
+			return transferErrorResponse(c, errUserNotFound, "fetch orders")
+		}
+		filter.UserID = principal.UserID
+	}
+
+	if status := c.Query("status"); status != "" {
+		valid := false
+		for _, s := range redemptionStatuses {
+			valid = valid || s == status
+		}
+		if !valid {
+			return validationError("status must be one of: " + strings.Join(redemptionStatuses, ", "))
+		}
+		filter.Status = status
+	}
+
+	listPage, page, pageSize, err := parseListPage(c, ListPage{})
+	if err != nil {
+		return validationError("cursor is invalid")
+	}
+
+	orders, err := a.store.Redemptions().List(filter, listPage)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "INTERNAL_ERROR",
+			"message": "Failed to fetch orders",
+		})
+	}
+
+	response := RedemptionListResponse{
+		Page:     page,
+		PageSize: pageSize,
+	}
+	response.Data, response.NextCursor, response.PrevCursor = keysetPage(orders, listPage, pageSize, redemptionKeyset)
+
+	// Cursor pages skip the count; it is only needed to number pages
+	if page > 0 {
+		total, err := a.store.Redemptions().Count(filter)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error":   "INTERNAL_ERROR",
+				"message": "Failed to count orders",
+			})
+		}
+		response.Total = &total
+	}
+
+	return c.JSON(response)
+}
+
+// redemptionKeyset is an order's position in a newest-first listing
+func redemptionKeyset(o RedemptionOrder) Keyset {
+	return Keyset{Value: o.CreatedAt, ID: o.ID}
+}
+
+// getVisibleRedemption loads an order, reporting other members' orders as missing
+func (a *API) getVisibleRedemption(c *fiber.Ctx, id int) (RedemptionOrder, error) {
+	order, err := a.store.Redemptions().Get(id)
+	if err != nil {
+		return RedemptionOrder{}, err
+	}
+	if principal := principalFrom(c); principal.Role == roleMember && order.UserID != principal.UserID {
+		return RedemptionOrder{}, errRedemptionNotFound
+	}
+	return order, nil
+}
+
+// GET /redemptions/:id - Get an order
+func (a *API) getRedemptionByID(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil || id <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "Order ID must be a positive integer",
+		})
+	}
+
+	order, err := a.getVisibleRedemption(c, id)
+	if err != nil {
+		return transferErrorResponse(c, err, "fetch order")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": order,
+	})
+}
+
+// POST /redemptions/:id/fulfil - Mark a placed order as handed over to the member
+func (a *API) fulfilRedemptionOrder(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil || id <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "Order ID must be a positive integer",
+		})
+	}
+
+	order, err := fulfilRedemption(a.store, id, time.Now())
+	if err != nil {
+		return transferErrorResponse(c, err, "fulfil order")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": order,
+	})
+}
+
+// POST /redemptions/:id/cancel - Cancel a placed order, refunding its points.
+// Members may cancel their own orders.
+func (a *API) cancelRedemptionOrder(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil || id <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "Order ID must be a positive integer",
+		})
+	}
+
+	var req RedemptionCancelRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error":   "VALIDATION_ERROR",
+				"message": "Invalid request body",
+			})
+		}
+	}
+	if req.Reason == "" {
+		req.Reason = "Cancelled by " + principalFrom(c).Role
+	}
+
+	if _, err := a.getVisibleRedemption(c, id); err != nil {
+		return transferErrorResponse(c, err, "cancel order")
+	}
+
+	order, err := cancelRedemption(a.store, id, req.Reason, time.Now())
+	if err != nil {
+		return transferErrorResponse(c, err, "cancel order")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": order,
+	})
+}
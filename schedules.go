@@ -0,0 +1,528 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ScheduledTransfer sends points at a future time, once or on a recurrence
+type ScheduledTransfer struct {
+	ID         int     `json:"id"`
+	FromUserID int     `json:"fromUserId"`
+	ToUserID   int     `json:"toUserId"`
+	Amount     int     `json:"amount"`
+	Note       *string `json:"note,omitempty"`
+	StartsAt   string  `json:"startsAt"`
+	// Recurrence is an RRULE such as FREQ=MONTHLY;COUNT=12, or "" for a
+	// one-off transfer at StartsAt
+	Recurrence string  `json:"recurrence,omitempty"`
+	Status     string  `json:"status"`
+	NextRunAt  *string `json:"nextRunAt"`
+	RunCount   int     `json:"runCount"`
+	LastRunAt  *string `json:"lastRunAt"`
+	// FailReason explains why the latest run failed
+	FailReason *string `json:"failReason,omitempty"`
+	CreatedAt  string  `json:"createdAt"`
+	UpdatedAt  string  `json:"updatedAt"`
+}
+
+// ScheduledTransferRequest represents the request body for scheduling a transfer
+type ScheduledTransferRequest struct {
+	FromUserID int    `json:"fromUserId"`
+	ToUserID   int    `json:"toUserId"`
+	Amount     int    `json:"amount"`
+	Note       string `json:"note,omitempty"`
+	StartsAt   string `json:"startsAt"`
+	Recurrence string `json:"recurrence,omitempty"`
+}
+
+// scheduleStatuses lists the statuses allowed by the scheduled_transfers CHECK constraint
+var scheduleStatuses = []string{"active", "paused", "completed", "failed", "cancelled"}
+
+// scheduleStatusError reports an operation attempted on a schedule in the wrong status
+type scheduleStatusError struct {
+	action string
+	status string
+}
+
+func (e *scheduleStatusError) Error() string {
+	return fmt.Sprintf("Scheduled transfer cannot be %s (status is %s)", e.action, e.status)
+}
+
+// recurrence is the subset of RFC 5545 RRULE that schedules support:
+// FREQ=DAILY|WEEKLY|MONTHLY with optional INTERVAL, COUNT and UNTIL
+type recurrence struct {
+	freq     string
+	interval int
+	count    int
+	until    time.Time
+}
+
+// parseRecurrence parses an RRULE, with or without its "RRULE:" prefix
+func parseRecurrence(rule string) (recurrence, error) {
+	r := recurrence{interval: 1}
+	rule = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(rule)), "RRULE:")
+	for _, part := range strings.Split(rule, ";") {
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return recurrence{}, fmt.Errorf("%q is not a NAME=VALUE pair", part)
+		}
+		switch name {
+		case "FREQ":
+			if value != "DAILY" && value != "WEEKLY" && value != "MONTHLY" {
+				return recurrence{}, errors.New("FREQ must be DAILY, WEEKLY or MONTHLY")
+			}
+			r.freq = value
+		case "INTERVAL", "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return recurrence{}, fmt.Errorf("%s must be a positive integer", name)
+			}
+			if name == "INTERVAL" {
+				r.interval = n
+			} else {
+				r.count = n
+			}
+		case "UNTIL":
+			until, err := time.Parse("20060102T150405Z", value)
+			if err != nil {
+				until, err = time.Parse("20060102", value)
+			}
+			if err != nil {
+				return recurrence{}, errors.New("UNTIL must be a UTC date (YYYYMMDD) or date-time (YYYYMMDDTHHMMSSZ)")
+			}
+			r.until = until
+		default:
+			return recurrence{}, fmt.Errorf("%s is not supported", name)
+		}
+	}
+	if r.freq == "" {
+		return recurrence{}, errors.New("FREQ is required")
+	}
+	if r.count > 0 && !r.until.IsZero() {
+		return recurrence{}, errors.New("COUNT and UNTIL cannot both be set")
+	}
+	return r, nil
+}
+
+// occurrence returns the n-th run of r starting at start, counting from 0.
+// Monthly runs keep start's day of the month, moved back to the last day of
+// shorter months.
+func (r recurrence) occurrence(start time.Time, n int) time.Time {
+	switch r.freq {
+	case "DAILY":
+		return start.AddDate(0, 0, n*r.interval)
+	case "WEEKLY":
+		return start.AddDate(0, 0, 7*n*r.interval)
+	}
+	first := time.Date(start.Year(), start.Month()+time.Month(n*r.interval), 1,
+		start.Hour(), start.Minute(), start.Second(), 0, time.UTC)
+	lastDay := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(start.Day(), lastDay)-1)
+}
+
+// next returns the first run of r starting at start that is not before
+// after, or false once COUNT or UNTIL rule out any further run
+func (r recurrence) next(start, after time.Time) (time.Time, bool) {
+	for n := 0; r.count == 0 || n < r.count; n++ {
+		t := r.occurrence(start, n)
+		if !r.until.IsZero() && t.After(r.until) {
+			return time.Time{}, false
+		}
+		if !t.Before(after) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// scheduleRecurrence parses the recurrence of a recurring schedule
+func scheduleRecurrence(st ScheduledTransfer) (recurrence, time.Time, error) {
+	start, err := time.Parse(time.RFC3339, st.StartsAt)
+	if err != nil {
+		return recurrence{}, time.Time{}, err
+	}
+	r, err := parseRecurrence(st.Recurrence)
+	return r, start, err
+}
+
+// rescheduleFrom sets st's next run to the first occurrence not before
+// after. A one-off schedule, or a recurrence with no run left, completes.
+func rescheduleFrom(st *ScheduledTransfer, after time.Time) error {
+	if st.Recurrence == "" {
+		st.Status, st.NextRunAt = "completed", nil
+		return nil
+	}
+	r, start, err := scheduleRecurrence(*st)
+	if err != nil {
+		return err
+	}
+	t, ok := r.next(start, after)
+	if !ok {
+		st.Status, st.NextRunAt = "completed", nil
+		return nil
+	}
+	nextRunAt := timestamp(t)
+	st.NextRunAt = &nextRunAt
+	return nil
+}
+
+// scheduleRunKey is the idempotency key of run n of a schedule, so a run
+// retried after a crash cannot send the points twice
+func scheduleRunKey(scheduleID, n int) string {
+	return fmt.Sprintf("schedule-%d-%d", scheduleID, n)
+}
+
+// runScheduledTransfer makes the run of st that is due at now through the
+// same path as POST /transfers, and moves st on to its next run in the same
+// transaction. A run refused by the business rules is recorded as a failed
+// transfer carrying the reason; a one-off schedule then fails, while a
+// recurring one carries on. Runs missed while the scheduler was down are
+// skipped rather than sent late in a burst. Other errors are returned and
+// the run is retried on the next tick.
+func runScheduledTransfer(s Store, st ScheduledTransfer, now time.Time) (ScheduledTransfer, error) {
+	nowStr := timestamp(now)
+	req := TransferCreateRequest{
+		FromUserID: st.FromUserID,
+		ToUserID:   st.ToUserID,
+		Amount:     st.Amount,
+	}
+	if st.Note != nil {
+		req.Note = *st.Note
+	}
+	idemKey := scheduleRunKey(st.ID, st.RunCount+1)
+
+	// advance records the run and moves st on; giveUp fails st for good
+	advance := func(tx Store, failReason *string, giveUp bool) error {
+		st.RunCount++
+		st.LastRunAt = &nowStr
+		st.UpdatedAt = nowStr
+		st.FailReason = failReason
+		if err := rescheduleFrom(&st, now.Add(time.Second)); err != nil {
+			return err
+		}
+		if giveUp || (failReason != nil && st.Recurrence == "") {
+			st.Status, st.NextRunAt = "failed", nil
+		}
+		return tx.Schedules().Update(st, "active")
+	}
+
+	err := s.RunInTx(func(tx Store) error {
+		if _, _, err := executeTransferFrom(tx, req, idemKey, transferOrigin{ScheduleID: st.ID}); err != nil {
+			return err
+		}
+		return advance(tx, nil, false)
+	})
+	_, _, message, ok := describeError(err)
+	if err == nil || !ok || err == errScheduleStatusChanged {
+		return st, err
+	}
+
+	// The transfer itself was refused: record why
+	return st, s.RunInTx(func(tx Store) error {
+		// A member who has since been deleted leaves nothing to send
+		if err == errFromUserNotFound || err == errToUserNotFound {
+			return advance(tx, &message, true)
+		}
+
+		failed := Transfer{
+			IdemKey:    idemKey,
+			FromUserID: req.FromUserID,
+			ToUserID:   req.ToUserID,
+			Amount:     req.Amount,
+			Status:     "failed",
+			Note:       st.Note,
+			CreatedAt:  nowStr,
+			UpdatedAt:  nowStr,
+			FailReason: &message,
+		}
+		transferOrigin{ScheduleID: st.ID}.tag(&failed)
+		if err := tx.Transfers().Create(&failed); err != nil {
+			return err
+		}
+		return advance(tx, &message, false)
+	})
+}
+
+// runDueScheduledTransfers makes every scheduled run due at now and returns
+// how many ran
+func runDueScheduledTransfers(s Store, now time.Time) (int, error) {
+	due, err := s.Schedules().ListDue(timestamp(now))
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, st := range due {
+		if _, err := runScheduledTransfer(s, st, now); err == errScheduleStatusChanged {
+			// Paused or cancelled while the run was in flight
+			continue
+		} else if err != nil {
+			log.Printf("Failed to run scheduled transfer %d: %v", st.ID, err)
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
+
+// runScheduleWorker periodically makes the scheduled transfers that are due
+// until the process exits
+func runScheduleWorker(store Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		count, err := runDueScheduledTransfers(store, time.Now())
+		if err != nil {
+			log.Println("Failed to run scheduled transfers:", err)
+			continue
+		}
+		if count > 0 {
+			log.Printf("Ran %d scheduled transfer(s)", count)
+		}
+	}
+}
+
+// setScheduleStatus moves a schedule from one of the from statuses to
+// status; action names the change in the error for any other status.
+// Resuming a recurring schedule skips the runs missed while it was paused.
+func setScheduleStatus(s Store, id int, status, action string, now time.Time, from ...string) (ScheduledTransfer, error) {
+	st, err := s.Schedules().Get(id)
+	if err != nil {
+		return ScheduledTransfer{}, err
+	}
+	if !containsString(from, st.Status) {
+		return ScheduledTransfer{}, &scheduleStatusError{action: action, status: st.Status}
+	}
+
+	fromStatus := st.Status
+	st.Status = status
+	st.UpdatedAt = timestamp(now)
+	switch {
+	case status == "cancelled":
+		st.NextRunAt = nil
+	case status == "active" && st.Recurrence != "":
+		if err := rescheduleFrom(&st, now); err != nil {
+			return ScheduledTransfer{}, err
+		}
+	}
+	if err := s.Schedules().Update(st, fromStatus); err != nil {
+		return ScheduledTransfer{}, err
+	}
+	return st, nil
+}
+
+// parseScheduleRequest validates a ScheduledTransferRequest and returns the
+// schedule it describes, or the message explaining why it is invalid
+func parseScheduleRequest(req ScheduledTransferRequest, now time.Time) (ScheduledTransfer, string) {
+	if req.FromUserID <= 0 || req.ToUserID <= 0 || req.Amount <= 0 {
+		return ScheduledTransfer{}, "fromUserId, toUserId, and amount must be positive integers"
+	}
+	if req.StartsAt == "" {
+		return ScheduledTransfer{}, "startsAt is required"
+	}
+	startsAt, err := parseDateBound(req.StartsAt, false)
+	if err != nil {
+		return ScheduledTransfer{}, "startsAt must be a date (YYYY-MM-DD) or RFC3339 timestamp"
+	}
+
+	nowStr := timestamp(now)
+	st := ScheduledTransfer{
+		FromUserID: req.FromUserID,
+		ToUserID:   req.ToUserID,
+		Amount:     req.Amount,
+		StartsAt:   startsAt,
+		Recurrence: strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(req.Recurrence)), "RRULE:"),
+		Status:     "active",
+		CreatedAt:  nowStr,
+		UpdatedAt:  nowStr,
+	}
+	if req.Note != "" {
+		st.Note = &req.Note
+	}
+
+	// The first run is at startsAt, on the next tick if that has passed
+	st.NextRunAt = &st.StartsAt
+	if st.Recurrence != "" {
+		r, start, err := scheduleRecurrence(st)
+		if err != nil {
+			return ScheduledTransfer{}, "recurrence is invalid: " + err.Error()
+		}
+		if _, ok := r.next(start, start); !ok {
+			return ScheduledTransfer{}, "recurrence ends before startsAt"
+		}
+	}
+	return st, ""
+}
+
+// getVisibleSchedule loads a schedule, reporting other members' schedules as missing
+func (a *API) getVisibleSchedule(c *fiber.Ctx, id int) (ScheduledTransfer, error) {
+	st, err := a.store.Schedules().Get(id)
+	if err != nil {
+		return ScheduledTransfer{}, err
+	}
+	if principal := principalFrom(c); principal.Role == roleMember && st.FromUserID != principal.UserID {
+		return ScheduledTransfer{}, errScheduleNotFound
+	}
+	return st, nil
+}
+
+// POST /scheduled-transfers - Schedule a transfer, once at startsAt or on a
+// recurrence starting then
+func (a *API) createScheduledTransfer(c *fiber.Ctx) error {
+	var req ScheduledTransferRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "Invalid request body",
+		})
+	}
+	st, message := parseScheduleRequest(req, time.Now())
+	if message != "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": message,
+		})
+	}
+
+	// Members can only send their own points
+	if principal := principalFrom(c); principal.Role == roleMember && st.FromUserID != principal.UserID {
+		return forbidden(c, "Members can only transfer from their own account")
+	}
+
+	// Refuse what every run would fail on; balance and limits are checked
+	// when each run is due
+	if st.FromUserID == st.ToUserID {
+		return transferErrorResponse(c, errSelfTransfer, "schedule transfer")
+	}
+	for _, user := range []struct {
+		id       int
+		notFound error
+	}{
+		{st.FromUserID, errFromUserNotFound},
+		{st.ToUserID, errToUserNotFound},
+	} {
+		if _, err := a.store.Users().Get(user.id); err == errUserNotFound {
+			return transferErrorResponse(c, user.notFound, "schedule transfer")
+		} else if err != nil {
+			return transferErrorResponse(c, err, "schedule transfer")
+		}
+	}
+
+	if err := a.store.Schedules().Create(&st); err != nil {
+		return transferErrorResponse(c, err, "schedule transfer")
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"data": st,
+	})
+}
+
+// GET /scheduled-transfers - List scheduled transfers; members only see the
+// ones they send
+func (a *API) getScheduledTransfers(c *fiber.Ctx) error {
+	principal := principalFrom(c)
+	validationError := func(message string) error {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": message,
+		})
+	}
+
+	var filter ScheduleFilter
+	if value := c.Query("userId"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return validationError("userId must be a positive integer")
+		}
+		filter.UserID = n
+	}
+	if principal.Role == roleMember {
+		if filter.UserID != 0 && filter.UserID != principal.UserID {
+			return transferErrorResponse(c, errUserNotFound, "fetch scheduled transfers")
+		}
+		filter.UserID = principal.UserID
+	}
+
+	if status := c.Query("status"); status != "" {
+		if !containsString(scheduleStatuses, status) {
+			return validationError("status must be one of: " + strings.Join(scheduleStatuses, ", "))
+		}
+		filter.Statuses = []string{status}
+	}
+
+	schedules, err := a.store.Schedules().List(filter)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "INTERNAL_ERROR",
+			"message": "Failed to fetch scheduled transfers",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": schedules,
+	})
+}
+
+// parseScheduleID parses the :id route parameter, writing the 400 response if it
+// is not a positive integer
+func parseScheduleID(c *fiber.Ctx) (int, bool, error) {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil || id <= 0 {
+		return 0, false, c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "Scheduled transfer ID must be a positive integer",
+		})
+	}
+	return id, true, nil
+}
+
+// GET /scheduled-transfers/:id - Get a scheduled transfer
+func (a *API) getScheduledTransferByID(c *fiber.Ctx) error {
+	id, ok, err := parseScheduleID(c)
+	if !ok {
+		return err
+	}
+
+	st, err := a.getVisibleSchedule(c, id)
+	if err != nil {
+		return transferErrorResponse(c, err, "fetch scheduled transfer")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": st,
+	})
+}
+
+// changeScheduledTransfer returns the handler that moves a schedule from one
+// of the from statuses to status
+func (a *API) changeScheduledTransfer(status, action string, from ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, ok, err := parseScheduleID(c)
+		if !ok {
+			return err
+		}
+
+		if _, err := a.getVisibleSchedule(c, id); err != nil {
+			return transferErrorResponse(c, err, "update scheduled transfer")
+		}
+
+		st, err := setScheduleStatus(a.store, id, status, action, time.Now(), from...)
+		if err != nil {
+			return transferErrorResponse(c, err, "update scheduled transfer")
+		}
+
+		return c.JSON(fiber.Map{
+			"data": st,
+		})
+	}
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Store groups the repositories the handlers and point operations use.
+// Implementations exist for SQLite and Postgres (store_sql.go) and for
+// memory (store_memory.go), the latter so business logic can be exercised
+// without a database. All of them must pass the conformance suite in
+// conformance_test.go.
+type Store interface {
+	Users() UserStore
+	Transfers() TransferStore
+	Ledger() LedgerStore
+	APIKeys() APIKeyStore
+	Tiers() TierStore
+	Webhooks() WebhookStore
+	TransferLimits() TransferLimitStore
+	Lots() PointLotStore
+	Rewards() RewardStore
+	Redemptions() RedemptionStore
+	Campaigns() CampaignStore
+	Referrals() ReferralStore
+	Partners() PartnerStore
+	Purchases() PurchaseStore
+	Schedules() ScheduleStore
+
+	// RunInTx calls fn with a Store whose operations all commit if fn
+	// returns nil and all roll back otherwise. Calling RunInTx on the Store
+	// passed to fn joins the existing transaction.
+	RunInTx(fn func(tx Store) error) error
+}
+
+// UserStore persists members and their point balances
+type UserStore interface {
+	// List returns the users matching q in q's order, together with the
+	// total number of matches ignoring q.After, q.Limit and q.Offset, or 0
+	// with q.SkipCount
+	List(q UserQuery) ([]User, int, error)
+	// Get returns errUserNotFound when the user does not exist
+	Get(id int) (User, error)
+	// GetByReferralCode returns errUserNotFound when no user has code
+	GetByReferralCode(code string) (User, error)
+	// GetByMemberID returns errUserNotFound when no user has memberID
+	GetByMemberID(memberID string) (User, error)
+	// Create inserts user with a zero balance and sets its ID and timestamps;
+	// opening balances are applied through the ledger afterwards
+	Create(user *User) error
+	// Update applies the non-nil fields of patch, returning errUserNotFound
+	// when the user does not exist
+	Update(id int, patch UserPatch) error
+	// Delete removes the user and their API keys. It returns
+	// errUserNotFound when the user does not exist, and errUserHasHistory
+	// when the database enforces foreign keys and the user still has
+	// transfers or ledger entries.
+	Delete(id int) error
+
+	// Balances returns the user's point balance and the part of it held by
+	// pending transfers, or errUserNotFound
+	Balances(id int) (balance, held int, err error)
+	SetBalance(id, balance int) error
+	AddHeld(id, delta int) error
+	// Lock keeps other transactions from changing the users' balances until
+	// the current transaction ends. Call it before reading balances that a
+	// transaction is going to change.
+	Lock(ids ...int) error
+}
+
+// UserPatch lists the profile fields to change in UserStore.Update. A nil
+// field is left untouched; an empty MobileNumber or Email clears the column.
+type UserPatch struct {
+	MemberID        *string
+	FirstName       *string
+	LastName        *string
+	MobileNumber    *string
+	Email           *string
+	RegisterDate    *string
+	MembershipLevel *string
+}
+
+// UserQuery selects a page of users for UserStore.List. Zero values are
+// ignored. Rows are ordered by Sort, a key of userSortFields, and then by id,
+// both in the same direction.
+type UserQuery struct {
+	MembershipLevel string
+	// RegisteredFrom and RegisteredTo are inclusive YYYY-MM-DD bounds
+	RegisteredFrom string
+	RegisteredTo   string
+	MinBalance     *int
+	MaxBalance     *int
+	// Search matches a case-insensitive substring of the first or last
+	// name, email, mobile number or member ID
+	Search string
+
+	Sort string
+	Desc bool
+
+	// After resumes the listing after that row, for keyset pagination;
+	// Offset is ignored when it is set
+	After  *Keyset
+	Limit  int
+	Offset int
+
+	// SkipCount saves counting the matches, for callers that walk every
+	// page and never show a total
+	SkipCount bool
+}
+
+// Keyset is a row's position in a sorted listing: its sort value and id
+type Keyset struct {
+	Value string
+	ID    int
+}
+
+// userSortFields lists the columns users can be sorted by, each backed by an
+// index. Numeric columns are marked true and compare as integers.
+var userSortFields = map[string]bool{
+	"id":               true,
+	"member_id":        false,
+	"last_name":        false,
+	"register_date":    false,
+	"membership_level": false,
+	"point_balance":    true,
+	"created_at":       false,
+}
+
+// userSortValue returns u's value for a userSortFields key, as kept in a Keyset
+func userSortValue(u User, field string) string {
+	switch field {
+	case "id":
+		return strconv.Itoa(u.ID)
+	case "member_id":
+		return u.MemberID
+	case "last_name":
+		return u.LastName
+	case "register_date":
+		return u.RegisterDate
+	case "membership_level":
+		return u.MembershipLevel
+	case "point_balance":
+		return strconv.Itoa(u.PointBalance)
+	}
+	return u.CreatedAt
+}
+
+// TransferStore persists point transfers
+type TransferStore interface {
+	// Create inserts t and sets its TransferID, returning errIdemKeyConflict
+	// when another transfer already uses t.IdemKey
+	Create(t *Transfer) error
+	// GetByIdemKey returns errTransferNotFound when no transfer uses the key
+	GetByIdemKey(idemKey string) (Transfer, error)
+	// List returns a page of the transfers matching filter, newest first
+	List(filter TransferFilter, page ListPage) ([]Transfer, error)
+	// Count returns the number of transfers matching filter
+	Count(filter TransferFilter) (int, error)
+	// Update saves t's status and lifecycle fields, but only if the stored
+	// transfer is still in fromStatus; otherwise it returns errTransferStatusChanged
+	Update(t Transfer, fromStatus string) error
+	// ListExpiredPending returns pending transfers whose hold ends at or before now
+	ListExpiredPending(now string) ([]Transfer, error)
+	// SumSent totals the amounts of the user's outgoing transfers created
+	// at or after since that are pending, processing or completed
+	SumSent(userID int, since string) (int, error)
+}
+
+// LedgerStore persists point ledger entries
+type LedgerStore interface {
+	// Append inserts entry and sets its ID
+	Append(entry *PointLedgerEntry) error
+	// List returns a page of the entries matching filter, newest first
+	List(filter LedgerFilter, page ListPage) ([]PointLedgerEntry, error)
+	// Count returns the number of entries matching filter
+	Count(filter LedgerFilter) (int, error)
+	// EarnedSince sums the points each user gained from earn entries
+	// created at or after since, net of campaign bonuses taken back, keyed
+	// by user id. A non-zero userID limits the sum to that user.
+	EarnedSince(since string, userID int) (map[int]int, error)
+}
+
+// TransferFilter narrows TransferStore.List and Count. Zero values are
+// ignored; the date bounds are inclusive RFC3339 timestamps.
+type TransferFilter struct {
+	// UserID matches transfers the user sent or received
+	UserID int
+	// Direction narrows UserID's transfers to those they "sent" or "received"
+	Direction string
+	// CounterpartyID matches transfers the user sent or received; with
+	// UserID, that is the transfers between the two of them
+	CounterpartyID int
+	// Statuses matches any of the listed statuses
+	Statuses      []string
+	MinAmount     *int
+	MaxAmount     *int
+	CreatedFrom   string
+	CreatedTo     string
+	CompletedFrom string
+	CompletedTo   string
+	// Note matches a case-insensitive substring of the note
+	Note       string
+	BatchID    string
+	ScheduleID int
+}
+
+// transferSortFields lists the columns transfers can be sorted by. Numeric
+// columns are marked true and compare as integers.
+var transferSortFields = map[string]bool{
+	"created_at": false,
+	"amount":     true,
+}
+
+// transferSortValue returns t's value for a transferSortFields key, as kept in a Keyset
+func transferSortValue(t Transfer, field string) string {
+	if field == "amount" {
+		return strconv.Itoa(t.Amount)
+	}
+	return t.CreatedAt
+}
+
+// ListPage selects a page of a listing ordered by Sort and then id, both
+// descending (newest first) unless Asc is set. Count is kept separate from
+// List because keyset pages do not need a total, and counting a large table
+// on every page is slow.
+type ListPage struct {
+	// Sort is one of the listing's sort fields; empty means created_at.
+	// Ledger entries are always listed by created_at.
+	Sort string
+	Asc  bool
+
+	// After and Before resume the listing after or before that row, for
+	// keyset pagination; Offset is ignored when either is set. Rows are
+	// returned in listing order either way.
+	After  *Keyset
+	Before *Keyset
+	Limit  int
+	Offset int
+}
+
+// LedgerFilter narrows LedgerStore.List and Count. Zero values are ignored;
+// From and To are inclusive RFC3339 bounds on created_at.
+type LedgerFilter struct {
+	UserID     int
+	EventType  string
+	TransferID int
+	From       string
+	To         string
+}
+
+// APIKeyStore persists API keys by hash
+type APIKeyStore interface {
+	// Create inserts key and sets its ID
+	Create(key *APIKey) error
+	// GetByHash returns errAPIKeyNotFound when no key has the hash
+	GetByHash(hash string) (APIKey, error)
+	List() ([]APIKey, error)
+	// Revoke marks the key revoked as of now, returning errAPIKeyNotFound
+	// when it does not exist
+	Revoke(id int, now string) error
+}
+
+// TierStore persists the history of members' tier changes
+type TierStore interface {
+	// Record inserts change and sets its ID
+	Record(change *TierChange) error
+	// ListByUser returns the user's tier changes, newest first
+	ListByUser(userID int) ([]TierChange, error)
+}
+
+// WebhookStore is the outbox of webhook events. Events are written in the
+// same transaction as the change they describe and delivered afterwards.
+type WebhookStore interface {
+	// Enqueue inserts event and sets its ID
+	Enqueue(event *WebhookEvent) error
+	// ListDue returns up to limit undelivered events whose next attempt is
+	// at or before now, oldest first
+	ListDue(now string, limit int) ([]WebhookEvent, error)
+	MarkDelivered(id int, now string) error
+	// MarkFailed records a failed attempt. An empty nextAttemptAt gives up
+	// on the event.
+	MarkFailed(id int, lastError, nextAttemptAt string) error
+}
+
+// TransferLimitStore persists the transfer limits of each membership level
+type TransferLimitStore interface {
+	// Get returns errTransferLimitNotFound when the level has no limits
+	Get(level string) (TransferLimit, error)
+	List() ([]TransferLimit, error)
+	// Set creates or replaces the limits of limit.MembershipLevel
+	Set(limit TransferLimit) error
+	// Delete returns errTransferLimitNotFound when the level has no limits
+	Delete(level string) error
+}
+
+// PointLotStore persists point lots: the credits that make up a user's
+// balance, each with the amount not yet spent or expired. A user's open lots
+// add up to their balance whenever it is positive.
+type PointLotStore interface {
+	// Add inserts lot and sets its ID
+	Add(lot *PointLot) error
+	// ListOpen returns the user's lots with points remaining, oldest first
+	ListOpen(userID int) ([]PointLot, error)
+	// ListByEntry returns the user's lots opened by the ledger entry,
+	// oldest first, whether or not points remain
+	ListByEntry(userID, entryID int) ([]PointLot, error)
+	SetRemaining(id, remaining int) error
+	// RecordUse records that the ledger entry took amount points from the lot
+	RecordUse(entryID, lotID, amount int) error
+	// ListUsedBy returns the user's lots the ledger entry took points from,
+	// oldest first, each with Amount set to the points taken and Remaining 0
+	ListUsedBy(userID, entryID int) ([]PointLot, error)
+	// ListUsersWithExpired returns the users holding lots with points
+	// remaining that were earned at or before cutoff
+	ListUsersWithExpired(cutoff string) ([]int, error)
+}
+
+// RewardStore persists the rewards catalog
+type RewardStore interface {
+	// Create inserts reward and sets its ID
+	Create(reward *Reward) error
+	// Get returns errRewardNotFound when the reward does not exist
+	Get(id int) (Reward, error)
+	// List returns the rewards matching filter, ordered by id
+	List(filter RewardFilter) ([]Reward, error)
+	// Update saves every field of reward but its ID and CreatedAt,
+	// returning errRewardNotFound when it does not exist
+	Update(reward Reward) error
+	// AdjustStock adds delta to the reward's stock, returning errOutOfStock
+	// when that would take it below zero. Unlimited stock is left alone.
+	AdjustStock(id, delta int) error
+}
+
+// RewardFilter narrows RewardStore.List. Zero values are ignored.
+type RewardFilter struct {
+	// AvailableAt matches active rewards whose validity window includes it
+	AvailableAt string
+	// InStock matches rewards with unlimited or positive stock
+	InStock bool
+}
+
+// RedemptionStore persists reward redemption orders
+type RedemptionStore interface {
+	// Create inserts order and sets its ID
+	Create(order *RedemptionOrder) error
+	// Get returns errRedemptionNotFound when the order does not exist
+	Get(id int) (RedemptionOrder, error)
+	// List returns a page of the orders matching filter, newest first
+	List(filter RedemptionFilter, page ListPage) ([]RedemptionOrder, error)
+	// Count returns the number of orders matching filter
+	Count(filter RedemptionFilter) (int, error)
+	// Update saves order's status, ledger entries and lifecycle fields, but
+	// only if the stored order is still in fromStatus; otherwise it returns
+	// errRedemptionStatusChanged
+	Update(order RedemptionOrder, fromStatus string) error
+}
+
+// RedemptionFilter narrows RedemptionStore.List and Count. Zero values are ignored.
+type RedemptionFilter struct {
+	UserID   int
+	RewardID int
+	Status   string
+}
+
+// CampaignStore persists promotional campaigns and the bonuses they paid
+type CampaignStore interface {
+	// Create inserts campaign and sets its ID
+	Create(campaign *Campaign) error
+	// Get returns errCampaignNotFound when the campaign does not exist
+	Get(id int) (Campaign, error)
+	// List returns the campaigns matching filter, ordered by id
+	List(filter CampaignFilter) ([]Campaign, error)
+	// Update saves every field of campaign but its ID, BudgetUsed and
+	// CreatedAt, returning errCampaignNotFound when it does not exist
+	Update(campaign Campaign) error
+	// AddBudgetUsed adds points to the campaign's spent budget, returning
+	// errCampaignBudgetExhausted when that would exceed the budget
+	AddBudgetUsed(id, points int) error
+	// RecordAward inserts award and sets its ID
+	RecordAward(award *CampaignAward) error
+	// CountAwards returns how many bonuses the campaign has paid the user
+	// that were not reversed
+	CountAwards(campaignID, userID int) (int, error)
+	// ListAwardsByTransfer returns the awards paid for the transfer that
+	// were not reversed, ordered by id
+	ListAwardsByTransfer(transferID int) ([]CampaignAward, error)
+	// ReverseAward marks the award reversed at now
+	ReverseAward(id int, now string) error
+}
+
+// CampaignFilter narrows CampaignStore.List. Zero values are ignored.
+type CampaignFilter struct {
+	// RunningAt matches active campaigns whose date window includes it
+	RunningAt string
+	Trigger   string
+}
+
+// ReferralStore persists referrals between members
+type ReferralStore interface {
+	// Create inserts referral and sets its ID
+	Create(referral *Referral) error
+	// GetByReferee returns errReferralNotFound when the member was not referred
+	GetByReferee(refereeID int) (Referral, error)
+	// List returns the referrals matching filter, ordered by id
+	List(filter ReferralFilter) ([]Referral, error)
+	Count(filter ReferralFilter) (int, error)
+	// Update saves referral if its status is still fromStatus, and returns
+	// errReferralStatusChanged otherwise
+	Update(referral Referral, fromStatus string) error
+}
+
+// ReferralFilter narrows ReferralStore.List and Count. Zero values are ignored.
+type ReferralFilter struct {
+	ReferrerID int
+	// Statuses matches referrals in any of the listed statuses
+	Statuses []string
+}
+
+// PartnerStore persists the retail partners whose purchases earn points
+type PartnerStore interface {
+	// Create inserts partner and sets its ID
+	Create(partner *Partner) error
+	// Get returns errPartnerNotFound when the partner does not exist
+	Get(id int) (Partner, error)
+	// List returns every partner, ordered by id
+	List() ([]Partner, error)
+	// Update saves every field of partner but its ID and CreatedAt,
+	// returning errPartnerNotFound when it does not exist
+	Update(partner Partner) error
+}
+
+// PurchaseStore persists the purchases partners send
+type PurchaseStore interface {
+	// Create inserts purchase and sets its ID. It returns
+	// errDuplicateReceipt when the partner already sent its receipt id.
+	Create(purchase *Purchase) error
+	// GetByReceipt returns errPurchaseNotFound when the partner has not
+	// sent the receipt id
+	GetByReceipt(partnerID int, receiptID string) (Purchase, error)
+	// List returns a page of the purchases matching filter, newest first
+	List(filter PurchaseFilter, page ListPage) ([]Purchase, error)
+	Count(filter PurchaseFilter) (int, error)
+}
+
+// PurchaseFilter narrows PurchaseStore.List and Count. Zero values are ignored.
+type PurchaseFilter struct {
+	PartnerID int
+	UserID    int
+}
+
+// ScheduleStore persists scheduled and recurring transfers
+type ScheduleStore interface {
+	// Create inserts schedule and sets its ID
+	Create(schedule *ScheduledTransfer) error
+	// Get returns errScheduleNotFound when the schedule does not exist
+	Get(id int) (ScheduledTransfer, error)
+	// List returns the schedules matching filter, ordered by id
+	List(filter ScheduleFilter) ([]ScheduledTransfer, error)
+	// ListDue returns active schedules whose next run is at or before now,
+	// earliest first
+	ListDue(now string) ([]ScheduledTransfer, error)
+	// Update saves schedule if its status is still fromStatus, and returns
+	// errScheduleStatusChanged otherwise
+	Update(schedule ScheduledTransfer, fromStatus string) error
+}
+
+// ScheduleFilter narrows ScheduleStore.List. Zero values are ignored.
+type ScheduleFilter struct {
+	// UserID matches the schedules the user sends from
+	UserID int
+	// Statuses matches schedules in any of the listed statuses
+	Statuses []string
+}
+
+var (
+	errUserNotFound          = errors.New("user not found")
+	errUserHasHistory        = errors.New("user has transfers or ledger entries")
+	errTransferNotFound      = errors.New("transfer not found")
+	errIdemKeyConflict       = errors.New("idempotency key already used")
+	errTransferStatusChanged = errors.New("transfer status changed concurrently")
+	errAPIKeyNotFound        = errors.New("api key not found")
+	errTransferLimitNotFound = errors.New("transfer limit not found")
+
+	errRewardNotFound          = errors.New("reward not found")
+	errRedemptionNotFound      = errors.New("redemption order not found")
+	errRedemptionStatusChanged = errors.New("redemption order status changed concurrently")
+	errCampaignNotFound        = errors.New("campaign not found")
+	errCampaignBudgetExhausted = errors.New("campaign budget exhausted")
+	errReferralNotFound        = errors.New("referral not found")
+	errReferralStatusChanged   = errors.New("referral status changed concurrently")
+	errPartnerNotFound         = errors.New("partner not found")
+	errPurchaseNotFound        = errors.New("purchase not found")
+	errDuplicateReceipt        = errors.New("partner already sent this receipt id")
+	errScheduleNotFound        = errors.New("scheduled transfer not found")
+	errScheduleStatusChanged   = errors.New("scheduled transfer status changed concurrently")
+)
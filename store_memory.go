@@ -0,0 +1,1421 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore is a Store that keeps everything in process memory. It is
+// meant for exercising business logic without a database file; data is lost
+// when the process exits.
+type memoryStore struct {
+	mu   *sync.Mutex
+	data *memoryData
+	inTx bool
+}
+
+// memoryData holds the tables of a memoryStore
+type memoryData struct {
+	users          map[int]User
+	transfers      []Transfer
+	ledger         []PointLedgerEntry
+	apiKeys        []APIKey
+	tierHistory    []TierChange
+	webhookEvents  []WebhookEvent
+	transferLimits map[string]TransferLimit
+	lots           []PointLot
+	lotUses        []memoryLotUse
+	rewards        []Reward
+	redemptions    []RedemptionOrder
+	campaigns      []Campaign
+	campaignAwards []CampaignAward
+	referrals      []Referral
+	partners       []Partner
+	purchases      []Purchase
+	schedules      []ScheduledTransfer
+	nextUserID     int
+	nextTransferID int
+	nextLedgerID   int
+	nextAPIKeyID   int
+	nextTierID     int
+	nextWebhookID  int
+	nextLotID      int
+	nextRewardID   int
+	nextOrderID    int
+	nextCampaignID int
+	nextAwardID    int
+	nextReferralID int
+	nextPartnerID  int
+	nextPurchaseID int
+	nextScheduleID int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		mu: &sync.Mutex{},
+		data: &memoryData{
+			users:          map[int]User{},
+			transferLimits: map[string]TransferLimit{},
+			nextUserID:     1,
+			nextTransferID: 1,
+			nextLedgerID:   1,
+			nextAPIKeyID:   1,
+			nextTierID:     1,
+			nextWebhookID:  1,
+			nextLotID:      1,
+			nextRewardID:   1,
+			nextOrderID:    1,
+			nextCampaignID: 1,
+			nextAwardID:    1,
+			nextReferralID: 1,
+			nextPartnerID:  1,
+			nextPurchaseID: 1,
+			nextScheduleID: 1,
+		},
+	}
+}
+
+// clone copies the tables so a failed transaction can be rolled back
+func (d *memoryData) clone() *memoryData {
+	c := *d
+	c.users = make(map[int]User, len(d.users))
+	for id, u := range d.users {
+		c.users[id] = u
+	}
+	c.transfers = append([]Transfer(nil), d.transfers...)
+	c.ledger = append([]PointLedgerEntry(nil), d.ledger...)
+	c.apiKeys = append([]APIKey(nil), d.apiKeys...)
+	c.tierHistory = append([]TierChange(nil), d.tierHistory...)
+	c.transferLimits = make(map[string]TransferLimit, len(d.transferLimits))
+	for level, l := range d.transferLimits {
+		c.transferLimits[level] = l
+	}
+	c.webhookEvents = append([]WebhookEvent(nil), d.webhookEvents...)
+	c.lots = append([]PointLot(nil), d.lots...)
+	c.lotUses = append([]memoryLotUse(nil), d.lotUses...)
+	c.rewards = append([]Reward(nil), d.rewards...)
+	c.redemptions = append([]RedemptionOrder(nil), d.redemptions...)
+	c.campaigns = append([]Campaign(nil), d.campaigns...)
+	c.campaignAwards = append([]CampaignAward(nil), d.campaignAwards...)
+	c.referrals = append([]Referral(nil), d.referrals...)
+	c.partners = append([]Partner(nil), d.partners...)
+	c.purchases = append([]Purchase(nil), d.purchases...)
+	c.schedules = append([]ScheduledTransfer(nil), d.schedules...)
+	return &c
+}
+
+// lock serialises access outside of a transaction; a transaction already
+// holds the lock for its whole duration
+func (s *memoryStore) lock() func() {
+	if s.inTx {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+func (s *memoryStore) Users() UserStore                   { return memoryUserStore{s} }
+func (s *memoryStore) Transfers() TransferStore           { return memoryTransferStore{s} }
+func (s *memoryStore) Ledger() LedgerStore                { return memoryLedgerStore{s} }
+func (s *memoryStore) APIKeys() APIKeyStore               { return memoryAPIKeyStore{s} }
+func (s *memoryStore) Tiers() TierStore                   { return memoryTierStore{s} }
+func (s *memoryStore) Webhooks() WebhookStore             { return memoryWebhookStore{s} }
+func (s *memoryStore) TransferLimits() TransferLimitStore { return memoryTransferLimitStore{s} }
+func (s *memoryStore) Lots() PointLotStore                { return memoryPointLotStore{s} }
+func (s *memoryStore) Rewards() RewardStore               { return memoryRewardStore{s} }
+func (s *memoryStore) Redemptions() RedemptionStore       { return memoryRedemptionStore{s} }
+func (s *memoryStore) Campaigns() CampaignStore           { return memoryCampaignStore{s} }
+func (s *memoryStore) Referrals() ReferralStore           { return memoryReferralStore{s} }
+func (s *memoryStore) Partners() PartnerStore             { return memoryPartnerStore{s} }
+func (s *memoryStore) Purchases() PurchaseStore           { return memoryPurchaseStore{s} }
+func (s *memoryStore) Schedules() ScheduleStore           { return memoryScheduleStore{s} }
+
+func (s *memoryStore) RunInTx(fn func(tx Store) error) error {
+	// Already inside a transaction: join it
+	if s.inTx {
+		return fn(s)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := s.data.clone()
+	if err := fn(&memoryStore{mu: s.mu, data: s.data, inTx: true}); err != nil {
+		*s.data = *snapshot
+		return err
+	}
+	return nil
+}
+
+// memoryTimestamp matches the RFC3339 timestamps the SQL store writes
+func memoryTimestamp() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+type memoryUserStore struct {
+	s *memoryStore
+}
+
+func (m memoryUserStore) List(q UserQuery) ([]User, int, error) {
+	defer m.s.lock()()
+
+	search := strings.ToLower(q.Search)
+	var matches []User
+	for _, u := range m.s.data.users {
+		if q.MembershipLevel != "" && u.MembershipLevel != q.MembershipLevel {
+			continue
+		}
+		if (q.RegisteredFrom != "" && u.RegisterDate < q.RegisteredFrom) ||
+			(q.RegisteredTo != "" && u.RegisterDate > q.RegisteredTo) {
+			continue
+		}
+		if (q.MinBalance != nil && u.PointBalance < *q.MinBalance) ||
+			(q.MaxBalance != nil && u.PointBalance > *q.MaxBalance) {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(u.FirstName+"\n"+u.LastName+"\n"+u.Email+"\n"+u.MobileNumber+"\n"+u.MemberID), search) {
+			continue
+		}
+		matches = append(matches, u)
+	}
+
+	sortField := q.Sort
+	if _, ok := userSortFields[sortField]; !ok {
+		sortField = "created_at"
+	}
+
+	// compare orders a before b by the sort field and then id, ascending
+	compare := func(aValue string, aID int, b User) int {
+		bValue := userSortValue(b, sortField)
+		if userSortFields[sortField] {
+			x, _ := strconv.Atoi(aValue)
+			y, _ := strconv.Atoi(bValue)
+			if x != y {
+				return x - y
+			}
+		} else if c := strings.Compare(aValue, bValue); c != 0 {
+			return c
+		}
+		return aID - b.ID
+	}
+	before := func(aValue string, aID int, b User) bool {
+		if q.Desc {
+			return compare(aValue, aID, b) > 0
+		}
+		return compare(aValue, aID, b) < 0
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return before(userSortValue(matches[i], sortField), matches[i].ID, matches[j])
+	})
+
+	total := len(matches)
+	if q.SkipCount {
+		total = 0
+	}
+	offset := q.Offset
+	if q.After != nil {
+		offset = sort.Search(len(matches), func(i int) bool {
+			return before(q.After.Value, q.After.ID, matches[i])
+		})
+	}
+	return paginate(matches, q.Limit, offset), total, nil
+}
+
+func (m memoryUserStore) Get(id int) (User, error) {
+	defer m.s.lock()()
+
+	u, ok := m.s.data.users[id]
+	if !ok {
+		return User{}, errUserNotFound
+	}
+	return u, nil
+}
+
+func (m memoryUserStore) GetByReferralCode(code string) (User, error) {
+	defer m.s.lock()()
+
+	for _, u := range m.s.data.users {
+		if u.ReferralCode == code {
+			return u, nil
+		}
+	}
+	return User{}, errUserNotFound
+}
+
+func (m memoryUserStore) GetByMemberID(memberID string) (User, error) {
+	defer m.s.lock()()
+
+	for _, u := range m.s.data.users {
+		if u.MemberID == memberID {
+			return u, nil
+		}
+	}
+	return User{}, errUserNotFound
+}
+
+func (m memoryUserStore) Create(user *User) error {
+	defer m.s.lock()()
+
+	for _, u := range m.s.data.users {
+		if u.MemberID == user.MemberID || (user.Email != "" && u.Email == user.Email) ||
+			(user.ReferralCode != "" && u.ReferralCode == user.ReferralCode) {
+			return errDuplicateUser
+		}
+	}
+
+	now := memoryTimestamp()
+	user.ID = m.s.data.nextUserID
+	user.PointBalance = 0
+	user.HeldBalance = 0
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	m.s.data.nextUserID++
+	m.s.data.users[user.ID] = *user
+	return nil
+}
+
+func (m memoryUserStore) Update(id int, patch UserPatch) error {
+	defer m.s.lock()()
+
+	u, ok := m.s.data.users[id]
+	if !ok {
+		return errUserNotFound
+	}
+
+	for _, other := range m.s.data.users {
+		if other.ID == id {
+			continue
+		}
+		if (patch.MemberID != nil && other.MemberID == *patch.MemberID) ||
+			(patch.Email != nil && *patch.Email != "" && other.Email == *patch.Email) {
+			return errDuplicateUser
+		}
+	}
+
+	set := func(dst *string, value *string) {
+		if value != nil {
+			*dst = *value
+		}
+	}
+	set(&u.MemberID, patch.MemberID)
+	set(&u.FirstName, patch.FirstName)
+	set(&u.LastName, patch.LastName)
+	set(&u.MobileNumber, patch.MobileNumber)
+	set(&u.Email, patch.Email)
+	set(&u.RegisterDate, patch.RegisterDate)
+	set(&u.MembershipLevel, patch.MembershipLevel)
+	u.UpdatedAt = memoryTimestamp()
+
+	m.s.data.users[id] = u
+	return nil
+}
+
+func (m memoryUserStore) Delete(id int) error {
+	defer m.s.lock()()
+
+	if _, ok := m.s.data.users[id]; !ok {
+		return errUserNotFound
+	}
+	delete(m.s.data.users, id)
+
+	keys := m.s.data.apiKeys[:0]
+	for _, k := range m.s.data.apiKeys {
+		if k.UserID == nil || *k.UserID != id {
+			keys = append(keys, k)
+		}
+	}
+	m.s.data.apiKeys = keys
+	return nil
+}
+
+func (m memoryUserStore) Balances(id int) (int, int, error) {
+	defer m.s.lock()()
+
+	u, ok := m.s.data.users[id]
+	if !ok {
+		return 0, 0, errUserNotFound
+	}
+	return u.PointBalance, u.HeldBalance, nil
+}
+
+func (m memoryUserStore) SetBalance(id, balance int) error {
+	defer m.s.lock()()
+
+	u, ok := m.s.data.users[id]
+	if !ok {
+		return errUserNotFound
+	}
+	u.PointBalance = balance
+	u.UpdatedAt = memoryTimestamp()
+	m.s.data.users[id] = u
+	return nil
+}
+
+func (m memoryUserStore) AddHeld(id, delta int) error {
+	defer m.s.lock()()
+
+	u, ok := m.s.data.users[id]
+	if !ok {
+		return errUserNotFound
+	}
+	u.HeldBalance += delta
+	u.UpdatedAt = memoryTimestamp()
+	m.s.data.users[id] = u
+	return nil
+}
+
+// Lock is a no-op: a memory transaction holds the store's lock throughout
+func (m memoryUserStore) Lock(ids ...int) error {
+	return nil
+}
+
+type memoryTransferStore struct {
+	s *memoryStore
+}
+
+func (m memoryTransferStore) Create(t *Transfer) error {
+	defer m.s.lock()()
+
+	for _, existing := range m.s.data.transfers {
+		if existing.IdemKey == t.IdemKey {
+			return errIdemKeyConflict
+		}
+	}
+
+	t.TransferID = m.s.data.nextTransferID
+	m.s.data.nextTransferID++
+	m.s.data.transfers = append(m.s.data.transfers, *t)
+	return nil
+}
+
+func (m memoryTransferStore) GetByIdemKey(idemKey string) (Transfer, error) {
+	defer m.s.lock()()
+
+	for _, t := range m.s.data.transfers {
+		if t.IdemKey == idemKey {
+			return t, nil
+		}
+	}
+	return Transfer{}, errTransferNotFound
+}
+
+// matches reports whether t passes filter
+func (m memoryTransferStore) matches(t Transfer, filter TransferFilter) bool {
+	if filter.UserID != 0 {
+		sent, received := t.FromUserID == filter.UserID, t.ToUserID == filter.UserID
+		switch filter.Direction {
+		case "sent":
+			received = false
+		case "received":
+			sent = false
+		}
+		if !sent && !received {
+			return false
+		}
+	}
+	if filter.CounterpartyID != 0 && t.FromUserID != filter.CounterpartyID && t.ToUserID != filter.CounterpartyID {
+		return false
+	}
+	if len(filter.Statuses) > 0 {
+		found := false
+		for _, status := range filter.Statuses {
+			found = found || t.Status == status
+		}
+		if !found {
+			return false
+		}
+	}
+	if (filter.MinAmount != nil && t.Amount < *filter.MinAmount) ||
+		(filter.MaxAmount != nil && t.Amount > *filter.MaxAmount) {
+		return false
+	}
+	if (filter.CreatedFrom != "" && t.CreatedAt < filter.CreatedFrom) ||
+		(filter.CreatedTo != "" && t.CreatedAt > filter.CreatedTo) {
+		return false
+	}
+	if (filter.CompletedFrom != "" || filter.CompletedTo != "") && t.CompletedAt == nil {
+		return false
+	}
+	if (filter.CompletedFrom != "" && *t.CompletedAt < filter.CompletedFrom) ||
+		(filter.CompletedTo != "" && *t.CompletedAt > filter.CompletedTo) {
+		return false
+	}
+	if filter.Note != "" && (t.Note == nil || !strings.Contains(strings.ToLower(*t.Note), strings.ToLower(filter.Note))) {
+		return false
+	}
+	if filter.BatchID != "" && (t.BatchID == nil || *t.BatchID != filter.BatchID) {
+		return false
+	}
+	if filter.ScheduleID != 0 && (t.ScheduleID == nil || *t.ScheduleID != filter.ScheduleID) {
+		return false
+	}
+	return true
+}
+
+func (m memoryTransferStore) List(filter TransferFilter, page ListPage) ([]Transfer, error) {
+	defer m.s.lock()()
+
+	var matches []Transfer
+	for _, t := range m.s.data.transfers {
+		if m.matches(t, filter) {
+			matches = append(matches, t)
+		}
+	}
+	key := func(t Transfer) Keyset { return transferKeyset(t, page.sortField()) }
+	return keysetSlice(matches, page, key, transferSortFields[page.sortField()]), nil
+}
+
+func (m memoryTransferStore) Count(filter TransferFilter) (int, error) {
+	defer m.s.lock()()
+
+	count := 0
+	for _, t := range m.s.data.transfers {
+		if m.matches(t, filter) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m memoryTransferStore) Update(t Transfer, fromStatus string) error {
+	defer m.s.lock()()
+
+	for i, existing := range m.s.data.transfers {
+		if existing.TransferID != t.TransferID {
+			continue
+		}
+		if existing.Status != fromStatus {
+			return errTransferStatusChanged
+		}
+		existing.Status = t.Status
+		existing.UpdatedAt = t.UpdatedAt
+		existing.CompletedAt = t.CompletedAt
+		existing.FailReason = t.FailReason
+		existing.ReversedAt = t.ReversedAt
+		existing.ReversalReason = t.ReversalReason
+		m.s.data.transfers[i] = existing
+		return nil
+	}
+	return errTransferStatusChanged
+}
+
+func (m memoryTransferStore) ListExpiredPending(now string) ([]Transfer, error) {
+	defer m.s.lock()()
+
+	var expired []Transfer
+	for _, t := range m.s.data.transfers {
+		if t.Status == "pending" && t.ExpiresAt != nil && *t.ExpiresAt <= now {
+			expired = append(expired, t)
+		}
+	}
+	return expired, nil
+}
+
+func (m memoryTransferStore) SumSent(userID int, since string) (int, error) {
+	defer m.s.lock()()
+
+	sent := 0
+	for _, t := range m.s.data.transfers {
+		if t.FromUserID != userID || t.CreatedAt < since {
+			continue
+		}
+		if t.Status == "pending" || t.Status == "processing" || t.Status == "completed" {
+			sent += t.Amount
+		}
+	}
+	return sent, nil
+}
+
+type memoryLedgerStore struct {
+	s *memoryStore
+}
+
+func (m memoryLedgerStore) Append(entry *PointLedgerEntry) error {
+	defer m.s.lock()()
+
+	entry.ID = m.s.data.nextLedgerID
+	m.s.data.nextLedgerID++
+	m.s.data.ledger = append(m.s.data.ledger, *entry)
+	return nil
+}
+
+// matches reports whether e passes filter
+func (m memoryLedgerStore) matches(e PointLedgerEntry, filter LedgerFilter) bool {
+	return (filter.UserID == 0 || e.UserID == filter.UserID) &&
+		(filter.EventType == "" || e.EventType == filter.EventType) &&
+		(filter.TransferID == 0 || (e.TransferID != nil && *e.TransferID == filter.TransferID)) &&
+		(filter.From == "" || e.CreatedAt >= filter.From) &&
+		(filter.To == "" || e.CreatedAt <= filter.To)
+}
+
+func (m memoryLedgerStore) List(filter LedgerFilter, page ListPage) ([]PointLedgerEntry, error) {
+	defer m.s.lock()()
+
+	var matches []PointLedgerEntry
+	for _, e := range m.s.data.ledger {
+		if m.matches(e, filter) {
+			matches = append(matches, e)
+		}
+	}
+	return keysetSlice(matches, page, ledgerKeyset, false), nil
+}
+
+func (m memoryLedgerStore) Count(filter LedgerFilter) (int, error) {
+	defer m.s.lock()()
+
+	count := 0
+	for _, e := range m.s.data.ledger {
+		if m.matches(e, filter) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m memoryLedgerStore) EarnedSince(since string, userID int) (map[int]int, error) {
+	defer m.s.lock()()
+
+	earned := map[int]int{}
+	for _, e := range m.s.data.ledger {
+		if e.EventType == "earn" && e.CreatedAt >= since && (userID == 0 || e.UserID == userID) {
+			earned[e.UserID] += e.Change
+		}
+	}
+	return earned, nil
+}
+
+type memoryAPIKeyStore struct {
+	s *memoryStore
+}
+
+func (m memoryAPIKeyStore) Create(key *APIKey) error {
+	defer m.s.lock()()
+
+	key.ID = m.s.data.nextAPIKeyID
+	m.s.data.nextAPIKeyID++
+	m.s.data.apiKeys = append(m.s.data.apiKeys, *key)
+	return nil
+}
+
+func (m memoryAPIKeyStore) GetByHash(hash string) (APIKey, error) {
+	defer m.s.lock()()
+
+	for _, k := range m.s.data.apiKeys {
+		if k.KeyHash == hash {
+			return k, nil
+		}
+	}
+	return APIKey{}, errAPIKeyNotFound
+}
+
+func (m memoryAPIKeyStore) List() ([]APIKey, error) {
+	defer m.s.lock()()
+
+	return append([]APIKey(nil), m.s.data.apiKeys...), nil
+}
+
+func (m memoryAPIKeyStore) Revoke(id int, now string) error {
+	defer m.s.lock()()
+
+	for i, k := range m.s.data.apiKeys {
+		if k.ID != id {
+			continue
+		}
+		if k.RevokedAt == nil {
+			m.s.data.apiKeys[i].RevokedAt = &now
+		}
+		return nil
+	}
+	return errAPIKeyNotFound
+}
+
+type memoryTierStore struct {
+	s *memoryStore
+}
+
+func (m memoryTierStore) Record(change *TierChange) error {
+	defer m.s.lock()()
+
+	change.ID = m.s.data.nextTierID
+	m.s.data.nextTierID++
+	m.s.data.tierHistory = append(m.s.data.tierHistory, *change)
+	return nil
+}
+
+func (m memoryTierStore) ListByUser(userID int) ([]TierChange, error) {
+	defer m.s.lock()()
+
+	changes := []TierChange{}
+	for _, c := range m.s.data.tierHistory {
+		if c.UserID == userID {
+			changes = append(changes, c)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].CreatedAt != changes[j].CreatedAt {
+			return changes[i].CreatedAt > changes[j].CreatedAt
+		}
+		return changes[i].ID > changes[j].ID
+	})
+	return changes, nil
+}
+
+type memoryWebhookStore struct {
+	s *memoryStore
+}
+
+func (m memoryWebhookStore) Enqueue(event *WebhookEvent) error {
+	defer m.s.lock()()
+
+	event.ID = m.s.data.nextWebhookID
+	m.s.data.nextWebhookID++
+	m.s.data.webhookEvents = append(m.s.data.webhookEvents, *event)
+	return nil
+}
+
+func (m memoryWebhookStore) ListDue(now string, limit int) ([]WebhookEvent, error) {
+	defer m.s.lock()()
+
+	events := []WebhookEvent{}
+	for _, e := range m.s.data.webhookEvents {
+		if len(events) == limit {
+			break
+		}
+		if e.DeliveredAt == nil && e.NextAttemptAt != "" && e.NextAttemptAt <= now {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (m memoryWebhookStore) MarkDelivered(id int, now string) error {
+	defer m.s.lock()()
+
+	for i, e := range m.s.data.webhookEvents {
+		if e.ID == id {
+			m.s.data.webhookEvents[i].DeliveredAt = &now
+			m.s.data.webhookEvents[i].Attempts++
+			m.s.data.webhookEvents[i].LastError = ""
+		}
+	}
+	return nil
+}
+
+func (m memoryWebhookStore) MarkFailed(id int, lastError, nextAttemptAt string) error {
+	defer m.s.lock()()
+
+	for i, e := range m.s.data.webhookEvents {
+		if e.ID == id {
+			m.s.data.webhookEvents[i].Attempts++
+			m.s.data.webhookEvents[i].LastError = lastError
+			m.s.data.webhookEvents[i].NextAttemptAt = nextAttemptAt
+		}
+	}
+	return nil
+}
+
+type memoryTransferLimitStore struct {
+	s *memoryStore
+}
+
+func (m memoryTransferLimitStore) Get(level string) (TransferLimit, error) {
+	defer m.s.lock()()
+
+	limit, ok := m.s.data.transferLimits[level]
+	if !ok {
+		return TransferLimit{}, errTransferLimitNotFound
+	}
+	return limit, nil
+}
+
+func (m memoryTransferLimitStore) List() ([]TransferLimit, error) {
+	defer m.s.lock()()
+
+	limits := []TransferLimit{}
+	for _, l := range m.s.data.transferLimits {
+		limits = append(limits, l)
+	}
+	sort.Slice(limits, func(i, j int) bool {
+		return limits[i].MembershipLevel < limits[j].MembershipLevel
+	})
+	return limits, nil
+}
+
+func (m memoryTransferLimitStore) Set(limit TransferLimit) error {
+	defer m.s.lock()()
+
+	m.s.data.transferLimits[limit.MembershipLevel] = limit
+	return nil
+}
+
+func (m memoryTransferLimitStore) Delete(level string) error {
+	defer m.s.lock()()
+
+	if _, ok := m.s.data.transferLimits[level]; !ok {
+		return errTransferLimitNotFound
+	}
+	delete(m.s.data.transferLimits, level)
+	return nil
+}
+
+type memoryPointLotStore struct {
+	s *memoryStore
+}
+
+// memoryLotUse is a row of point_lot_uses: points a ledger entry took from a lot
+type memoryLotUse struct {
+	entryID int
+	lotID   int
+	amount  int
+}
+
+func (m memoryPointLotStore) Add(lot *PointLot) error {
+	defer m.s.lock()()
+
+	lot.ID = m.s.data.nextLotID
+	m.s.data.nextLotID++
+	m.s.data.lots = append(m.s.data.lots, *lot)
+	return nil
+}
+
+func (m memoryPointLotStore) ListOpen(userID int) ([]PointLot, error) {
+	defer m.s.lock()()
+
+	lots := []PointLot{}
+	for _, l := range m.s.data.lots {
+		if l.UserID == userID && l.Remaining > 0 {
+			lots = append(lots, l)
+		}
+	}
+	sort.SliceStable(lots, func(i, j int) bool {
+		return lots[i].EarnedAt < lots[j].EarnedAt
+	})
+	return lots, nil
+}
+
+func (m memoryPointLotStore) ListByEntry(userID, entryID int) ([]PointLot, error) {
+	defer m.s.lock()()
+
+	lots := []PointLot{}
+	for _, l := range m.s.data.lots {
+		if l.UserID == userID && l.EntryID == entryID {
+			lots = append(lots, l)
+		}
+	}
+	sort.SliceStable(lots, func(i, j int) bool {
+		return lots[i].EarnedAt < lots[j].EarnedAt
+	})
+	return lots, nil
+}
+
+func (m memoryPointLotStore) SetRemaining(id, remaining int) error {
+	defer m.s.lock()()
+
+	for i, l := range m.s.data.lots {
+		if l.ID == id {
+			m.s.data.lots[i].Remaining = remaining
+		}
+	}
+	return nil
+}
+
+func (m memoryPointLotStore) RecordUse(entryID, lotID, amount int) error {
+	defer m.s.lock()()
+
+	m.s.data.lotUses = append(m.s.data.lotUses, memoryLotUse{entryID: entryID, lotID: lotID, amount: amount})
+	return nil
+}
+
+func (m memoryPointLotStore) ListUsedBy(userID, entryID int) ([]PointLot, error) {
+	defer m.s.lock()()
+
+	lots := []PointLot{}
+	for _, use := range m.s.data.lotUses {
+		if use.entryID != entryID {
+			continue
+		}
+		for _, l := range m.s.data.lots {
+			if l.ID == use.lotID && l.UserID == userID {
+				l.Amount, l.Remaining = use.amount, 0
+				lots = append(lots, l)
+			}
+		}
+	}
+	sort.SliceStable(lots, func(i, j int) bool {
+		return lots[i].EarnedAt < lots[j].EarnedAt
+	})
+	return lots, nil
+}
+
+func (m memoryPointLotStore) ListUsersWithExpired(cutoff string) ([]int, error) {
+	defer m.s.lock()()
+
+	seen := map[int]bool{}
+	userIDs := []int{}
+	for _, l := range m.s.data.lots {
+		if l.Remaining > 0 && l.EarnedAt <= cutoff && !seen[l.UserID] {
+			seen[l.UserID] = true
+			userIDs = append(userIDs, l.UserID)
+		}
+	}
+	sort.Ints(userIDs)
+	return userIDs, nil
+}
+
+type memoryRewardStore struct {
+	s *memoryStore
+}
+
+func (m memoryRewardStore) Create(reward *Reward) error {
+	defer m.s.lock()()
+
+	reward.ID = m.s.data.nextRewardID
+	m.s.data.nextRewardID++
+	m.s.data.rewards = append(m.s.data.rewards, *reward)
+	return nil
+}
+
+func (m memoryRewardStore) Get(id int) (Reward, error) {
+	defer m.s.lock()()
+
+	for _, r := range m.s.data.rewards {
+		if r.ID == id {
+			return r, nil
+		}
+	}
+	return Reward{}, errRewardNotFound
+}
+
+func (m memoryRewardStore) List(filter RewardFilter) ([]Reward, error) {
+	defer m.s.lock()()
+
+	rewards := []Reward{}
+	for _, r := range m.s.data.rewards {
+		if filter.AvailableAt != "" && !r.availableAt(filter.AvailableAt) {
+			continue
+		}
+		if filter.InStock && r.Stock != nil && *r.Stock <= 0 {
+			continue
+		}
+		rewards = append(rewards, r)
+	}
+	return rewards, nil
+}
+
+func (m memoryRewardStore) Update(reward Reward) error {
+	defer m.s.lock()()
+
+	for i, r := range m.s.data.rewards {
+		if r.ID == reward.ID {
+			reward.CreatedAt = r.CreatedAt
+			m.s.data.rewards[i] = reward
+			return nil
+		}
+	}
+	return errRewardNotFound
+}
+
+func (m memoryRewardStore) AdjustStock(id, delta int) error {
+	defer m.s.lock()()
+
+	for i, r := range m.s.data.rewards {
+		if r.ID != id {
+			continue
+		}
+		if r.Stock == nil {
+			return nil
+		}
+		if *r.Stock+delta < 0 {
+			return errOutOfStock
+		}
+		// Copy the count so earlier snapshots of the reward keep theirs
+		stock := *r.Stock + delta
+		m.s.data.rewards[i].Stock = &stock
+		return nil
+	}
+	return errRewardNotFound
+}
+
+type memoryRedemptionStore struct {
+	s *memoryStore
+}
+
+func (m memoryRedemptionStore) Create(order *RedemptionOrder) error {
+	defer m.s.lock()()
+
+	order.ID = m.s.data.nextOrderID
+	m.s.data.nextOrderID++
+	m.s.data.redemptions = append(m.s.data.redemptions, *order)
+	return nil
+}
+
+func (m memoryRedemptionStore) Get(id int) (RedemptionOrder, error) {
+	defer m.s.lock()()
+
+	for _, o := range m.s.data.redemptions {
+		if o.ID == id {
+			return o, nil
+		}
+	}
+	return RedemptionOrder{}, errRedemptionNotFound
+}
+
+// matches reports whether o passes filter
+func (m memoryRedemptionStore) matches(o RedemptionOrder, filter RedemptionFilter) bool {
+	return (filter.UserID == 0 || o.UserID == filter.UserID) &&
+		(filter.RewardID == 0 || o.RewardID == filter.RewardID) &&
+		(filter.Status == "" || o.Status == filter.Status)
+}
+
+func (m memoryRedemptionStore) List(filter RedemptionFilter, page ListPage) ([]RedemptionOrder, error) {
+	defer m.s.lock()()
+
+	var matches []RedemptionOrder
+	for _, o := range m.s.data.redemptions {
+		if m.matches(o, filter) {
+			matches = append(matches, o)
+		}
+	}
+	return keysetSlice(matches, page, redemptionKeyset, false), nil
+}
+
+func (m memoryRedemptionStore) Count(filter RedemptionFilter) (int, error) {
+	defer m.s.lock()()
+
+	count := 0
+	for _, o := range m.s.data.redemptions {
+		if m.matches(o, filter) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m memoryRedemptionStore) Update(order RedemptionOrder, fromStatus string) error {
+	defer m.s.lock()()
+
+	for i, existing := range m.s.data.redemptions {
+		if existing.ID != order.ID {
+			continue
+		}
+		if existing.Status != fromStatus {
+			return errRedemptionStatusChanged
+		}
+		existing.Status = order.Status
+		existing.LedgerEntryID = order.LedgerEntryID
+		existing.RefundEntryID = order.RefundEntryID
+		existing.CancelReason = order.CancelReason
+		existing.UpdatedAt = order.UpdatedAt
+		existing.FulfilledAt = order.FulfilledAt
+		existing.CancelledAt = order.CancelledAt
+		m.s.data.redemptions[i] = existing
+		return nil
+	}
+	return errRedemptionStatusChanged
+}
+
+// keysetSlice sorts rows into page's order by key and returns those page
+// selects. numeric compares the key values as integers.
+func keysetSlice[T any](rows []T, page ListPage, key func(T) Keyset, numeric bool) []T {
+	// precedes reports whether position a comes before b in the listing
+	precedes := func(a, b Keyset) bool {
+		c := strings.Compare(a.Value, b.Value)
+		if numeric {
+			x, _ := strconv.Atoi(a.Value)
+			y, _ := strconv.Atoi(b.Value)
+			c = x - y
+		}
+		if c == 0 {
+			c = a.ID - b.ID
+		}
+		if page.Asc {
+			return c < 0
+		}
+		return c > 0
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return precedes(key(rows[i]), key(rows[j]))
+	})
+
+	switch {
+	case page.After != nil:
+		start := sort.Search(len(rows), func(i int) bool {
+			return precedes(*page.After, key(rows[i]))
+		})
+		return paginate(rows, page.Limit, start)
+	case page.Before != nil:
+		end := sort.Search(len(rows), func(i int) bool {
+			return !precedes(key(rows[i]), *page.Before)
+		})
+		return rows[max(0, end-page.Limit):end]
+	}
+	return paginate(rows, page.Limit, page.Offset)
+}
+
+// paginate returns the limit items starting at offset
+func paginate[T any](items []T, limit, offset int) []T {
+	if offset >= len(items) {
+		return []T{}
+	}
+	end := offset + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[offset:end]
+}
+
+type memoryCampaignStore struct {
+	s *memoryStore
+}
+
+func (m memoryCampaignStore) Create(campaign *Campaign) error {
+	defer m.s.lock()()
+
+	campaign.ID = m.s.data.nextCampaignID
+	m.s.data.nextCampaignID++
+	m.s.data.campaigns = append(m.s.data.campaigns, *campaign)
+	return nil
+}
+
+func (m memoryCampaignStore) Get(id int) (Campaign, error) {
+	defer m.s.lock()()
+
+	for _, c := range m.s.data.campaigns {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return Campaign{}, errCampaignNotFound
+}
+
+func (m memoryCampaignStore) List(filter CampaignFilter) ([]Campaign, error) {
+	defer m.s.lock()()
+
+	campaigns := []Campaign{}
+	for _, c := range m.s.data.campaigns {
+		if filter.RunningAt != "" && (!c.Active || c.StartsAt > filter.RunningAt || c.EndsAt < filter.RunningAt) {
+			continue
+		}
+		if filter.Trigger != "" && c.Trigger != filter.Trigger {
+			continue
+		}
+		campaigns = append(campaigns, c)
+	}
+	return campaigns, nil
+}
+
+func (m memoryCampaignStore) Update(campaign Campaign) error {
+	defer m.s.lock()()
+
+	for i, c := range m.s.data.campaigns {
+		if c.ID == campaign.ID {
+			campaign.BudgetUsed = c.BudgetUsed
+			campaign.CreatedAt = c.CreatedAt
+			m.s.data.campaigns[i] = campaign
+			return nil
+		}
+	}
+	return errCampaignNotFound
+}
+
+func (m memoryCampaignStore) AddBudgetUsed(id, points int) error {
+	defer m.s.lock()()
+
+	for i, c := range m.s.data.campaigns {
+		if c.ID != id {
+			continue
+		}
+		if c.Budget != nil && c.BudgetUsed+points > *c.Budget {
+			return errCampaignBudgetExhausted
+		}
+		m.s.data.campaigns[i].BudgetUsed += points
+		return nil
+	}
+	return errCampaignNotFound
+}
+
+func (m memoryCampaignStore) RecordAward(award *CampaignAward) error {
+	defer m.s.lock()()
+
+	award.ID = m.s.data.nextAwardID
+	m.s.data.nextAwardID++
+	m.s.data.campaignAwards = append(m.s.data.campaignAwards, *award)
+	return nil
+}
+
+func (m memoryCampaignStore) CountAwards(campaignID, userID int) (int, error) {
+	defer m.s.lock()()
+
+	total := 0
+	for _, a := range m.s.data.campaignAwards {
+		if a.CampaignID == campaignID && a.UserID == userID && a.ReversedAt == nil {
+			total++
+		}
+	}
+	return total, nil
+}
+
+func (m memoryCampaignStore) ListAwardsByTransfer(transferID int) ([]CampaignAward, error) {
+	defer m.s.lock()()
+
+	awards := []CampaignAward{}
+	for _, a := range m.s.data.campaignAwards {
+		if a.TransferID != nil && *a.TransferID == transferID && a.ReversedAt == nil {
+			awards = append(awards, a)
+		}
+	}
+	return awards, nil
+}
+
+func (m memoryCampaignStore) ReverseAward(id int, now string) error {
+	defer m.s.lock()()
+
+	for i, a := range m.s.data.campaignAwards {
+		if a.ID == id {
+			m.s.data.campaignAwards[i].ReversedAt = &now
+		}
+	}
+	return nil
+}
+
+type memoryReferralStore struct {
+	s *memoryStore
+}
+
+func (m memoryReferralStore) Create(referral *Referral) error {
+	defer m.s.lock()()
+
+	referral.ID = m.s.data.nextReferralID
+	m.s.data.nextReferralID++
+	m.s.data.referrals = append(m.s.data.referrals, *referral)
+	return nil
+}
+
+func (m memoryReferralStore) GetByReferee(refereeID int) (Referral, error) {
+	defer m.s.lock()()
+
+	for _, r := range m.s.data.referrals {
+		if r.RefereeID == refereeID {
+			return r, nil
+		}
+	}
+	return Referral{}, errReferralNotFound
+}
+
+// matches reports whether r passes filter
+func (m memoryReferralStore) matches(r Referral, filter ReferralFilter) bool {
+	return (filter.ReferrerID == 0 || r.ReferrerID == filter.ReferrerID) &&
+		(len(filter.Statuses) == 0 || containsString(filter.Statuses, r.Status))
+}
+
+func (m memoryReferralStore) List(filter ReferralFilter) ([]Referral, error) {
+	defer m.s.lock()()
+
+	referrals := []Referral{}
+	for _, r := range m.s.data.referrals {
+		if m.matches(r, filter) {
+			referrals = append(referrals, r)
+		}
+	}
+	return referrals, nil
+}
+
+func (m memoryReferralStore) Count(filter ReferralFilter) (int, error) {
+	defer m.s.lock()()
+
+	total := 0
+	for _, r := range m.s.data.referrals {
+		if m.matches(r, filter) {
+			total++
+		}
+	}
+	return total, nil
+}
+
+func (m memoryReferralStore) Update(referral Referral, fromStatus string) error {
+	defer m.s.lock()()
+
+	for i, r := range m.s.data.referrals {
+		if r.ID == referral.ID {
+			if r.Status != fromStatus {
+				return errReferralStatusChanged
+			}
+			m.s.data.referrals[i] = referral
+			return nil
+		}
+	}
+	return errReferralNotFound
+}
+
+type memoryPartnerStore struct {
+	s *memoryStore
+}
+
+func (m memoryPartnerStore) Create(partner *Partner) error {
+	defer m.s.lock()()
+
+	partner.ID = m.s.data.nextPartnerID
+	m.s.data.nextPartnerID++
+	m.s.data.partners = append(m.s.data.partners, *partner)
+	return nil
+}
+
+func (m memoryPartnerStore) Get(id int) (Partner, error) {
+	defer m.s.lock()()
+
+	for _, p := range m.s.data.partners {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return Partner{}, errPartnerNotFound
+}
+
+func (m memoryPartnerStore) List() ([]Partner, error) {
+	defer m.s.lock()()
+
+	return append([]Partner{}, m.s.data.partners...), nil
+}
+
+func (m memoryPartnerStore) Update(partner Partner) error {
+	defer m.s.lock()()
+
+	for i, p := range m.s.data.partners {
+		if p.ID == partner.ID {
+			partner.CreatedAt = p.CreatedAt
+			m.s.data.partners[i] = partner
+			return nil
+		}
+	}
+	return errPartnerNotFound
+}
+
+type memoryPurchaseStore struct {
+	s *memoryStore
+}
+
+func (m memoryPurchaseStore) Create(purchase *Purchase) error {
+	defer m.s.lock()()
+
+	for _, p := range m.s.data.purchases {
+		if p.PartnerID == purchase.PartnerID && p.ReceiptID == purchase.ReceiptID {
+			return errDuplicateReceipt
+		}
+	}
+	purchase.ID = m.s.data.nextPurchaseID
+	m.s.data.nextPurchaseID++
+	m.s.data.purchases = append(m.s.data.purchases, *purchase)
+	return nil
+}
+
+func (m memoryPurchaseStore) GetByReceipt(partnerID int, receiptID string) (Purchase, error) {
+	defer m.s.lock()()
+
+	for _, p := range m.s.data.purchases {
+		if p.PartnerID == partnerID && p.ReceiptID == receiptID {
+			return p, nil
+		}
+	}
+	return Purchase{}, errPurchaseNotFound
+}
+
+// matches reports whether p passes filter
+func (m memoryPurchaseStore) matches(p Purchase, filter PurchaseFilter) bool {
+	return (filter.PartnerID == 0 || p.PartnerID == filter.PartnerID) &&
+		(filter.UserID == 0 || p.UserID == filter.UserID)
+}
+
+func (m memoryPurchaseStore) List(filter PurchaseFilter, page ListPage) ([]Purchase, error) {
+	defer m.s.lock()()
+
+	var matches []Purchase
+	for _, p := range m.s.data.purchases {
+		if m.matches(p, filter) {
+			matches = append(matches, p)
+		}
+	}
+	return keysetSlice(matches, page, purchaseKeyset, false), nil
+}
+
+func (m memoryPurchaseStore) Count(filter PurchaseFilter) (int, error) {
+	defer m.s.lock()()
+
+	total := 0
+	for _, p := range m.s.data.purchases {
+		if m.matches(p, filter) {
+			total++
+		}
+	}
+	return total, nil
+}
+
+type memoryScheduleStore struct {
+	s *memoryStore
+}
+
+func (m memoryScheduleStore) Create(schedule *ScheduledTransfer) error {
+	defer m.s.lock()()
+
+	schedule.ID = m.s.data.nextScheduleID
+	m.s.data.nextScheduleID++
+	m.s.data.schedules = append(m.s.data.schedules, *schedule)
+	return nil
+}
+
+func (m memoryScheduleStore) Get(id int) (ScheduledTransfer, error) {
+	defer m.s.lock()()
+
+	for _, st := range m.s.data.schedules {
+		if st.ID == id {
+			return st, nil
+		}
+	}
+	return ScheduledTransfer{}, errScheduleNotFound
+}
+
+func (m memoryScheduleStore) List(filter ScheduleFilter) ([]ScheduledTransfer, error) {
+	defer m.s.lock()()
+
+	schedules := []ScheduledTransfer{}
+	for _, st := range m.s.data.schedules {
+		if (filter.UserID == 0 || st.FromUserID == filter.UserID) &&
+			(len(filter.Statuses) == 0 || containsString(filter.Statuses, st.Status)) {
+			schedules = append(schedules, st)
+		}
+	}
+	return schedules, nil
+}
+
+func (m memoryScheduleStore) ListDue(now string) ([]ScheduledTransfer, error) {
+	defer m.s.lock()()
+
+	due := []ScheduledTransfer{}
+	for _, st := range m.s.data.schedules {
+		if st.Status == "active" && st.NextRunAt != nil && *st.NextRunAt <= now {
+			due = append(due, st)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return *due[i].NextRunAt < *due[j].NextRunAt
+	})
+	return due, nil
+}
+
+func (m memoryScheduleStore) Update(schedule ScheduledTransfer, fromStatus string) error {
+	defer m.s.lock()()
+
+	for i, st := range m.s.data.schedules {
+		if st.ID == schedule.ID {
+			if st.Status != fromStatus {
+				return errScheduleStatusChanged
+			}
+			m.s.data.schedules[i] = schedule
+			return nil
+		}
+	}
+	return errScheduleNotFound
+}
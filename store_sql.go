@@ -0,0 +1,2178 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// sqlDialect names a SQL database supported by sqlStore. The queries are
+// written once with ? placeholders and adapted to the dialect when run.
+type sqlDialect string
+
+const (
+	sqliteDialect   sqlDialect = "sqlite"
+	postgresDialect sqlDialect = "postgres"
+)
+
+// driverName is the database/sql driver registered for the dialect
+func (d sqlDialect) driverName() string {
+	if d == postgresDialect {
+		return "postgres"
+	}
+	return "sqlite3"
+}
+
+// rebind rewrites ? placeholders as $1, $2, ... for Postgres. Queries must
+// not contain a literal question mark.
+func (d sqlDialect) rebind(query string) string {
+	if d != postgresDialect || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// isUniqueViolation reports whether err is a UNIQUE constraint failure
+func (d sqlDialect) isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// isForeignKeyViolation reports whether err is a FOREIGN KEY constraint
+// failure. SQLite only reports these when foreign keys are enabled.
+func (d sqlDialect) isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23503"
+	}
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// sqlConn runs queries against a *sql.DB or *sql.Tx, adapting them to the dialect
+type sqlConn struct {
+	q       querier
+	dialect sqlDialect
+}
+
+func (c sqlConn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.q.Exec(c.dialect.rebind(query), args...)
+}
+
+func (c sqlConn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.q.Query(c.dialect.rebind(query), args...)
+}
+
+func (c sqlConn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.q.QueryRow(c.dialect.rebind(query), args...)
+}
+
+// insert runs an INSERT and returns the id of the new row. Postgres has no
+// LastInsertId, so the id is read back with RETURNING instead.
+func (c sqlConn) insert(query string, args ...interface{}) (int, error) {
+	if c.dialect == postgresDialect {
+		var id int
+		err := c.QueryRow(query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := c.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// sqlStore is the Store backed by a SQLite or Postgres database
+type sqlStore struct {
+	db *sql.DB
+	q  sqlConn
+}
+
+func newSQLStore(db *sql.DB, dialect sqlDialect) *sqlStore {
+	return &sqlStore{db: db, q: sqlConn{q: db, dialect: dialect}}
+}
+
+func (s *sqlStore) Users() UserStore                   { return sqlUserStore{s.q} }
+func (s *sqlStore) Transfers() TransferStore           { return sqlTransferStore{s.q} }
+func (s *sqlStore) Ledger() LedgerStore                { return sqlLedgerStore{s.q} }
+func (s *sqlStore) APIKeys() APIKeyStore               { return sqlAPIKeyStore{s.q} }
+func (s *sqlStore) Tiers() TierStore                   { return sqlTierStore{s.q} }
+func (s *sqlStore) Webhooks() WebhookStore             { return sqlWebhookStore{s.q} }
+func (s *sqlStore) TransferLimits() TransferLimitStore { return sqlTransferLimitStore{s.q} }
+func (s *sqlStore) Lots() PointLotStore                { return sqlPointLotStore{s.q} }
+func (s *sqlStore) Rewards() RewardStore               { return sqlRewardStore{s.q} }
+func (s *sqlStore) Redemptions() RedemptionStore       { return sqlRedemptionStore{s.q} }
+func (s *sqlStore) Campaigns() CampaignStore           { return sqlCampaignStore{s.q} }
+func (s *sqlStore) Referrals() ReferralStore           { return sqlReferralStore{s.q} }
+func (s *sqlStore) Partners() PartnerStore             { return sqlPartnerStore{s.q} }
+func (s *sqlStore) Purchases() PurchaseStore           { return sqlPurchaseStore{s.q} }
+func (s *sqlStore) Schedules() ScheduleStore           { return sqlScheduleStore{s.q} }
+
+func (s *sqlStore) RunInTx(fn func(tx Store) error) error {
+	// Already inside a transaction: join it
+	if _, ok := s.q.q.(*sql.Tx); ok {
+		return fn(s)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(&sqlStore{db: s.db, q: sqlConn{q: tx, dialect: s.q.dialect}}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// nullIfEmpty stores empty optional text columns as NULL
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+type sqlUserStore struct {
+	q sqlConn
+}
+
+// userColumns is the column list read by scanUser
+const userColumns = `id, member_id, first_name, last_name, COALESCE(mobile_number, ''), COALESCE(email, ''),
+		       register_date, membership_level, point_balance, held_balance, COALESCE(referral_code, ''),
+		       referred_by, created_at, updated_at`
+
+// scanUser reads a row selected with userColumns
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var referredBy sql.NullInt64
+	err := row.Scan(&user.ID, &user.MemberID, &user.FirstName, &user.LastName,
+		&user.MobileNumber, &user.Email, &user.RegisterDate, &user.MembershipLevel,
+		&user.PointBalance, &user.HeldBalance, &user.ReferralCode, &referredBy,
+		&user.CreatedAt, &user.UpdatedAt)
+	if referredBy.Valid {
+		id := int(referredBy.Int64)
+		user.ReferredBy = &id
+	}
+	return user, err
+}
+
+// sqlUserSortColumns maps userSortFields to the expressions ordered by.
+// Nullable text columns are read as '' so keyset comparisons still work.
+var sqlUserSortColumns = map[string]string{
+	"id":               "id",
+	"member_id":        "member_id",
+	"last_name":        "last_name",
+	"register_date":    "COALESCE(register_date, '')",
+	"membership_level": "COALESCE(membership_level, '')",
+	"point_balance":    "point_balance",
+	"created_at":       "created_at",
+}
+
+// likePattern builds a LIKE pattern matching value anywhere, escaping wildcards
+func likePattern(value string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+	return "%" + strings.ToLower(escaped) + "%"
+}
+
+func (s sqlUserStore) List(q UserQuery) ([]User, int, error) {
+	var conditions []string
+	var args []interface{}
+
+	if q.MembershipLevel != "" {
+		conditions = append(conditions, "membership_level = ?")
+		args = append(args, q.MembershipLevel)
+	}
+	if q.RegisteredFrom != "" {
+		conditions = append(conditions, "register_date >= ?")
+		args = append(args, q.RegisteredFrom)
+	}
+	if q.RegisteredTo != "" {
+		conditions = append(conditions, "register_date <= ?")
+		args = append(args, q.RegisteredTo)
+	}
+	if q.MinBalance != nil {
+		conditions = append(conditions, "point_balance >= ?")
+		args = append(args, *q.MinBalance)
+	}
+	if q.MaxBalance != nil {
+		conditions = append(conditions, "point_balance <= ?")
+		args = append(args, *q.MaxBalance)
+	}
+	if q.Search != "" {
+		var matches []string
+		for _, column := range []string{"first_name", "last_name", "email", "mobile_number", "member_id"} {
+			matches = append(matches, "LOWER("+column+`) LIKE ? ESCAPE '\'`)
+			args = append(args, likePattern(q.Search))
+		}
+		conditions = append(conditions, "("+strings.Join(matches, " OR ")+")")
+	}
+
+	where := "1 = 1"
+	if len(conditions) > 0 {
+		where = strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if !q.SkipCount {
+		if err := s.q.QueryRow("SELECT COUNT(*) FROM users WHERE "+where, args...).Scan(&total); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	column, ok := sqlUserSortColumns[q.Sort]
+	if !ok {
+		column = sqlUserSortColumns["created_at"]
+	}
+	direction, comparison := "ASC", ">"
+	if q.Desc {
+		direction, comparison = "DESC", "<"
+	}
+
+	offset := q.Offset
+	if q.After != nil {
+		var value interface{} = q.After.Value
+		if userSortFields[q.Sort] {
+			n, err := strconv.Atoi(q.After.Value)
+			if err != nil {
+				return nil, 0, err
+			}
+			value = n
+		}
+		where += " AND (" + column + " " + comparison + " ? OR (" + column + " = ? AND id " + comparison + " ?))"
+		args = append(args, value, value, q.After.ID)
+		offset = 0
+	}
+
+	rows, err := s.q.Query(`
+		SELECT `+userColumns+`
+		FROM users
+		WHERE `+where+`
+		ORDER BY `+column+` `+direction+`, id `+direction+`
+		LIMIT ? OFFSET ?
+	`, append(args, q.Limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, user)
+	}
+	return users, total, rows.Err()
+}
+
+func (s sqlUserStore) Get(id int) (User, error) {
+	user, err := scanUser(s.q.QueryRow(`
+		SELECT `+userColumns+`
+		FROM users WHERE id = ?
+	`, id))
+	if err == sql.ErrNoRows {
+		return user, errUserNotFound
+	}
+	return user, err
+}
+
+func (s sqlUserStore) GetByReferralCode(code string) (User, error) {
+	user, err := scanUser(s.q.QueryRow(`
+		SELECT `+userColumns+`
+		FROM users WHERE referral_code = ?
+	`, code))
+	if err == sql.ErrNoRows {
+		return user, errUserNotFound
+	}
+	return user, err
+}
+
+func (s sqlUserStore) GetByMemberID(memberID string) (User, error) {
+	user, err := scanUser(s.q.QueryRow(`
+		SELECT `+userColumns+`
+		FROM users WHERE member_id = ?
+	`, memberID))
+	if err == sql.ErrNoRows {
+		return user, errUserNotFound
+	}
+	return user, err
+}
+
+func (s sqlUserStore) Create(user *User) error {
+	now := timestamp(time.Now())
+	id, err := s.q.insert(`
+		INSERT INTO users (member_id, first_name, last_name, mobile_number, email, register_date,
+		                   membership_level, point_balance, referral_code, referred_by, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?, ?, ?, ?)
+	`, user.MemberID, user.FirstName, user.LastName, user.MobileNumber, nullIfEmpty(user.Email),
+		user.RegisterDate, user.MembershipLevel, nullIfEmpty(user.ReferralCode), user.ReferredBy, now, now)
+	if err != nil {
+		if s.q.dialect.isUniqueViolation(err) {
+			return errDuplicateUser
+		}
+		return err
+	}
+
+	created, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	*user = created
+	return nil
+}
+
+func (s sqlUserStore) Update(id int, patch UserPatch) error {
+	var setClauses []string
+	var args []interface{}
+
+	set := func(column string, value *string, nullable bool) {
+		if value == nil {
+			return
+		}
+		setClauses = append(setClauses, column+" = ?")
+		if nullable {
+			args = append(args, nullIfEmpty(*value))
+		} else {
+			args = append(args, *value)
+		}
+	}
+	set("member_id", patch.MemberID, false)
+	set("first_name", patch.FirstName, false)
+	set("last_name", patch.LastName, false)
+	set("mobile_number", patch.MobileNumber, true)
+	set("email", patch.Email, true)
+	set("register_date", patch.RegisterDate, false)
+	set("membership_level", patch.MembershipLevel, false)
+
+	setClauses = append(setClauses, "updated_at = ?")
+	args = append(args, timestamp(time.Now()), id)
+
+	result, err := s.q.Exec("UPDATE users SET "+strings.Join(setClauses, ", ")+" WHERE id = ?", args...)
+	if err != nil {
+		if s.q.dialect.isUniqueViolation(err) {
+			return errDuplicateUser
+		}
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (s sqlUserStore) Delete(id int) error {
+	result, err := s.q.Exec("DELETE FROM users WHERE id = ?", id)
+	if err != nil {
+		if s.q.dialect.isForeignKeyViolation(err) {
+			return errUserHasHistory
+		}
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errUserNotFound
+	}
+
+	// Postgres cascades this; SQLite does not enforce foreign keys
+	_, err = s.q.Exec("DELETE FROM api_keys WHERE user_id = ?", id)
+	return err
+}
+
+func (s sqlUserStore) Balances(id int) (int, int, error) {
+	var balance, held int
+	err := s.q.QueryRow("SELECT point_balance, held_balance FROM users WHERE id = ?", id).Scan(&balance, &held)
+	if err == sql.ErrNoRows {
+		return 0, 0, errUserNotFound
+	}
+	return balance, held, err
+}
+
+func (s sqlUserStore) SetBalance(id, balance int) error {
+	_, err := s.q.Exec("UPDATE users SET point_balance = ?, updated_at = ? WHERE id = ?", balance, timestamp(time.Now()), id)
+	return err
+}
+
+func (s sqlUserStore) AddHeld(id, delta int) error {
+	_, err := s.q.Exec("UPDATE users SET held_balance = held_balance + ?, updated_at = ? WHERE id = ?", delta, timestamp(time.Now()), id)
+	return err
+}
+
+// Lock takes Postgres row locks with SELECT ... FOR UPDATE, in ascending id
+// order so that transfers in opposite directions cannot deadlock. SQLite
+// needs nothing here: openDatabase makes every transaction BEGIN IMMEDIATE,
+// which already serialises writers.
+func (s sqlUserStore) Lock(ids ...int) error {
+	if s.q.dialect != postgresDialect || len(ids) == 0 {
+		return nil
+	}
+
+	sorted := append([]int(nil), ids...)
+	sort.Ints(sorted)
+	placeholders := make([]string, len(sorted))
+	args := make([]interface{}, len(sorted))
+	for i, id := range sorted {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+
+	rows, err := s.q.Query("SELECT id FROM users WHERE id IN ("+strings.Join(placeholders, ", ")+") ORDER BY id FOR UPDATE", args...)
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+type sqlTransferStore struct {
+	q sqlConn
+}
+
+// transferColumns is the column list read by scanTransfer
+const transferColumns = `idempotency_key, id, from_user_id, to_user_id, amount, status, note,
+		       created_at, updated_at, completed_at, fail_reason, expires_at, reversed_at, reversal_reason, batch_id, schedule_id`
+
+// scanTransfer reads a row selected with transferColumns
+func scanTransfer(row rowScanner) (Transfer, error) {
+	var transfer Transfer
+	var note, completedAt, failReason, expiresAt, reversedAt, reversalReason, batchID sql.NullString
+	var scheduleID sql.NullInt64
+
+	err := row.Scan(&transfer.IdemKey, &transfer.TransferID, &transfer.FromUserID,
+		&transfer.ToUserID, &transfer.Amount, &transfer.Status, &note,
+		&transfer.CreatedAt, &transfer.UpdatedAt, &completedAt, &failReason,
+		&expiresAt, &reversedAt, &reversalReason, &batchID, &scheduleID)
+	if err != nil {
+		return transfer, err
+	}
+
+	// Handle nullable fields
+	if note.Valid {
+		transfer.Note = &note.String
+	}
+	if completedAt.Valid {
+		transfer.CompletedAt = &completedAt.String
+	}
+	if failReason.Valid {
+		transfer.FailReason = &failReason.String
+	}
+	if expiresAt.Valid {
+		transfer.ExpiresAt = &expiresAt.String
+	}
+	if reversedAt.Valid {
+		transfer.ReversedAt = &reversedAt.String
+	}
+	if reversalReason.Valid {
+		transfer.ReversalReason = &reversalReason.String
+	}
+	if batchID.Valid {
+		transfer.BatchID = &batchID.String
+	}
+	if scheduleID.Valid {
+		id := int(scheduleID.Int64)
+		transfer.ScheduleID = &id
+	}
+
+	return transfer, nil
+}
+
+func (s sqlTransferStore) Create(t *Transfer) error {
+	transferID, err := s.q.insert(`
+		INSERT INTO transfers (from_user_id, to_user_id, amount, status, note, idempotency_key, created_at, updated_at,
+		                       completed_at, expires_at, fail_reason, batch_id, schedule_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, t.FromUserID, t.ToUserID, t.Amount, t.Status, t.Note, t.IdemKey, t.CreatedAt, t.UpdatedAt,
+		t.CompletedAt, t.ExpiresAt, t.FailReason, t.BatchID, t.ScheduleID)
+	if err != nil {
+		if s.q.dialect.isUniqueViolation(err) {
+			return errIdemKeyConflict
+		}
+		return err
+	}
+
+	t.TransferID = transferID
+	return nil
+}
+
+func (s sqlTransferStore) GetByIdemKey(idemKey string) (Transfer, error) {
+	transfer, err := scanTransfer(s.q.QueryRow(`
+		SELECT `+transferColumns+`
+		FROM transfers
+		WHERE idempotency_key = ?
+	`, idemKey))
+	if err == sql.ErrNoRows {
+		return transfer, errTransferNotFound
+	}
+	return transfer, err
+}
+
+// transferFilterWhere builds the WHERE clause matching filter
+func transferFilterWhere(filter TransferFilter) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.UserID != 0 {
+		switch filter.Direction {
+		case "sent":
+			conditions = append(conditions, "from_user_id = ?")
+			args = append(args, filter.UserID)
+		case "received":
+			conditions = append(conditions, "to_user_id = ?")
+			args = append(args, filter.UserID)
+		default:
+			conditions = append(conditions, "(from_user_id = ? OR to_user_id = ?)")
+			args = append(args, filter.UserID, filter.UserID)
+		}
+	}
+	if filter.CounterpartyID != 0 {
+		conditions = append(conditions, "(from_user_id = ? OR to_user_id = ?)")
+		args = append(args, filter.CounterpartyID, filter.CounterpartyID)
+	}
+	if len(filter.Statuses) > 0 {
+		placeholders := make([]string, len(filter.Statuses))
+		for i, status := range filter.Statuses {
+			placeholders[i] = "?"
+			args = append(args, status)
+		}
+		conditions = append(conditions, "status IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if filter.MinAmount != nil {
+		conditions = append(conditions, "amount >= ?")
+		args = append(args, *filter.MinAmount)
+	}
+	if filter.MaxAmount != nil {
+		conditions = append(conditions, "amount <= ?")
+		args = append(args, *filter.MaxAmount)
+	}
+	if filter.CreatedFrom != "" {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.CreatedFrom)
+	}
+	if filter.CreatedTo != "" {
+		conditions = append(conditions, "created_at <= ?")
+		args = append(args, filter.CreatedTo)
+	}
+	if filter.CompletedFrom != "" {
+		conditions = append(conditions, "completed_at >= ?")
+		args = append(args, filter.CompletedFrom)
+	}
+	if filter.CompletedTo != "" {
+		conditions = append(conditions, "completed_at <= ?")
+		args = append(args, filter.CompletedTo)
+	}
+	if filter.Note != "" {
+		conditions = append(conditions, `LOWER(note) LIKE ? ESCAPE '\'`)
+		args = append(args, likePattern(filter.Note))
+	}
+	if filter.BatchID != "" {
+		conditions = append(conditions, "batch_id = ?")
+		args = append(args, filter.BatchID)
+	}
+	if filter.ScheduleID != 0 {
+		conditions = append(conditions, "schedule_id = ?")
+		args = append(args, filter.ScheduleID)
+	}
+
+	if len(conditions) == 0 {
+		return "1 = 1", args
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+func (s sqlTransferStore) List(filter TransferFilter, page ListPage) ([]Transfer, error) {
+	where, args := transferFilterWhere(filter)
+	column := "created_at"
+	if _, ok := transferSortFields[page.Sort]; ok {
+		column = page.Sort
+	}
+	query, args, reversed, err := keysetQuery(`
+		SELECT `+transferColumns+`
+		FROM transfers
+		WHERE `+where, args, page, column, transferSortFields[column])
+	if err != nil {
+		return nil, err
+	}
+
+	transfers, err := s.list(query, args...)
+	if reversed {
+		reverse(transfers)
+	}
+	return transfers, err
+}
+
+func (s sqlTransferStore) Count(filter TransferFilter) (int, error) {
+	where, args := transferFilterWhere(filter)
+	var total int
+	err := s.q.QueryRow("SELECT COUNT(*) FROM transfers WHERE "+where, args...).Scan(&total)
+	return total, err
+}
+
+func (s sqlTransferStore) Update(t Transfer, fromStatus string) error {
+	result, err := s.q.Exec(`
+		UPDATE transfers SET status = ?, updated_at = ?, completed_at = ?, fail_reason = ?,
+		       reversed_at = ?, reversal_reason = ?
+		WHERE id = ? AND status = ?
+	`, t.Status, t.UpdatedAt, t.CompletedAt, t.FailReason, t.ReversedAt, t.ReversalReason,
+		t.TransferID, fromStatus)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errTransferStatusChanged
+	}
+	return nil
+}
+
+func (s sqlTransferStore) ListExpiredPending(now string) ([]Transfer, error) {
+	return s.list(`
+		SELECT `+transferColumns+`
+		FROM transfers
+		WHERE status = 'pending' AND expires_at <= ?
+	`, now)
+}
+
+func (s sqlTransferStore) SumSent(userID int, since string) (int, error) {
+	var sent int
+	err := s.q.QueryRow(`
+		SELECT COALESCE(SUM(amount), 0)
+		FROM transfers
+		WHERE from_user_id = ? AND created_at >= ? AND status IN ('pending', 'processing', 'completed')
+	`, userID, since).Scan(&sent)
+	return sent, err
+}
+
+func (s sqlTransferStore) list(query string, args ...interface{}) ([]Transfer, error) {
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []Transfer{}
+	for rows.Next() {
+		transfer, err := scanTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, transfer)
+	}
+	return transfers, rows.Err()
+}
+
+type sqlLedgerStore struct {
+	q sqlConn
+}
+
+func (s sqlLedgerStore) Append(entry *PointLedgerEntry) error {
+	entryID, err := s.q.insert(`
+		INSERT INTO point_ledger (user_id, change, balance_after, event_type, transfer_id, reference, metadata, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, entry.UserID, entry.Change, entry.BalanceAfter, entry.EventType, entry.TransferID,
+		nullIfEmpty(entry.Reference), nullIfEmpty(entry.Metadata), entry.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	entry.ID = entryID
+	return nil
+}
+
+// ledgerFilterWhere builds the WHERE clause matching filter
+func ledgerFilterWhere(filter LedgerFilter) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.UserID != 0 {
+		conditions = append(conditions, "user_id = ?")
+		args = append(args, filter.UserID)
+	}
+	if filter.EventType != "" {
+		conditions = append(conditions, "event_type = ?")
+		args = append(args, filter.EventType)
+	}
+	if filter.TransferID != 0 {
+		conditions = append(conditions, "transfer_id = ?")
+		args = append(args, filter.TransferID)
+	}
+	if filter.From != "" {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.From)
+	}
+	if filter.To != "" {
+		conditions = append(conditions, "created_at <= ?")
+		args = append(args, filter.To)
+	}
+
+	if len(conditions) == 0 {
+		return "1 = 1", args
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+func (s sqlLedgerStore) List(filter LedgerFilter, page ListPage) ([]PointLedgerEntry, error) {
+	where, args := ledgerFilterWhere(filter)
+	query, args, reversed, err := keysetQuery(`
+		SELECT id, user_id, change, balance_after, event_type, transfer_id, reference, metadata, created_at
+		FROM point_ledger
+		WHERE `+where, args, page, "created_at", false)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []PointLedgerEntry{}
+	for rows.Next() {
+		var entry PointLedgerEntry
+		var transferID sql.NullInt64
+		var reference, metadata sql.NullString
+
+		err := rows.Scan(&entry.ID, &entry.UserID, &entry.Change, &entry.BalanceAfter,
+			&entry.EventType, &transferID, &reference, &metadata, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		// Handle nullable fields
+		if transferID.Valid {
+			id := int(transferID.Int64)
+			entry.TransferID = &id
+		}
+		entry.Reference = reference.String
+		entry.Metadata = metadata.String
+
+		entries = append(entries, entry)
+	}
+	if reversed {
+		reverse(entries)
+	}
+	return entries, rows.Err()
+}
+
+func (s sqlLedgerStore) Count(filter LedgerFilter) (int, error) {
+	where, args := ledgerFilterWhere(filter)
+	var total int
+	err := s.q.QueryRow("SELECT COUNT(*) FROM point_ledger WHERE "+where, args...).Scan(&total)
+	return total, err
+}
+
+func (s sqlLedgerStore) EarnedSince(since string, userID int) (map[int]int, error) {
+	query := "SELECT user_id, SUM(change) FROM point_ledger WHERE event_type = 'earn' AND created_at >= ?"
+	args := []interface{}{since}
+	if userID != 0 {
+		query += " AND user_id = ?"
+		args = append(args, userID)
+	}
+
+	rows, err := s.q.Query(query+" GROUP BY user_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	earned := map[int]int{}
+	for rows.Next() {
+		var id, sum int
+		if err := rows.Scan(&id, &sum); err != nil {
+			return nil, err
+		}
+		earned[id] = sum
+	}
+	return earned, rows.Err()
+}
+
+// keysetQuery completes a SELECT ending in its WHERE clause with the keyset
+// condition, ordering and limit of page, sorted by column and then id.
+// numeric binds the keyset value as an integer. A Before page is read in the
+// opposite order, so that LIMIT keeps the rows nearest the cursor; reversed
+// then tells the caller to flip the rows back into listing order.
+func keysetQuery(query string, args []interface{}, page ListPage, column string, numeric bool) (string, []interface{}, bool, error) {
+	backwards := page.Before != nil
+	at := page.After
+	if backwards {
+		at = page.Before
+	}
+
+	// Reading forwards in descending order, or backwards in ascending
+	// order, walks towards smaller values
+	descending := !page.Asc != backwards
+	direction, comparison := "ASC", ">"
+	if descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	offset := page.Offset
+	if at != nil {
+		var value interface{} = at.Value
+		if numeric {
+			n, err := strconv.Atoi(at.Value)
+			if err != nil {
+				return "", nil, false, err
+			}
+			value = n
+		}
+		query += " AND (" + column + " " + comparison + " ? OR (" + column + " = ? AND id " + comparison + " ?))"
+		args = append(args, value, value, at.ID)
+		offset = 0
+	}
+
+	query += " ORDER BY " + column + " " + direction + ", id " + direction + " LIMIT ? OFFSET ?"
+	return query, append(args, page.Limit, offset), backwards, nil
+}
+
+type sqlAPIKeyStore struct {
+	q sqlConn
+}
+
+// apiKeyColumns is the column list read by scanAPIKey
+const apiKeyColumns = `id, name, key_prefix, key_hash, role, user_id, partner_id, created_at, revoked_at`
+
+// scanAPIKey reads a row selected with apiKeyColumns
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	var userID, partnerID sql.NullInt64
+	var revokedAt sql.NullString
+
+	err := row.Scan(&key.ID, &key.Name, &key.Prefix, &key.KeyHash, &key.Role, &userID, &partnerID, &key.CreatedAt, &revokedAt)
+	if err != nil {
+		return key, err
+	}
+
+	// Handle nullable fields
+	if userID.Valid {
+		id := int(userID.Int64)
+		key.UserID = &id
+	}
+	if partnerID.Valid {
+		id := int(partnerID.Int64)
+		key.PartnerID = &id
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.String
+	}
+	return key, nil
+}
+
+func (s sqlAPIKeyStore) Create(key *APIKey) error {
+	id, err := s.q.insert(`
+		INSERT INTO api_keys (name, key_prefix, key_hash, role, user_id, partner_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, key.Name, key.Prefix, key.KeyHash, key.Role, key.UserID, key.PartnerID, key.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	key.ID = id
+	return nil
+}
+
+func (s sqlAPIKeyStore) GetByHash(hash string) (APIKey, error) {
+	key, err := scanAPIKey(s.q.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ?", hash))
+	if err == sql.ErrNoRows {
+		return key, errAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (s sqlAPIKeyStore) List() ([]APIKey, error) {
+	rows, err := s.q.Query("SELECT " + apiKeyColumns + " FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s sqlAPIKeyStore) Revoke(id int, now string) error {
+	result, err := s.q.Exec("UPDATE api_keys SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ?", now, id)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errAPIKeyNotFound
+	}
+	return nil
+}
+
+type sqlTierStore struct {
+	q sqlConn
+}
+
+func (s sqlTierStore) Record(change *TierChange) error {
+	id, err := s.q.insert(`
+		INSERT INTO tier_history (user_id, from_level, to_level, reason, points_earned, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, change.UserID, change.FromLevel, change.ToLevel, change.Reason, change.PointsEarned, change.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	change.ID = id
+	return nil
+}
+
+func (s sqlTierStore) ListByUser(userID int) ([]TierChange, error) {
+	rows, err := s.q.Query(`
+		SELECT id, user_id, from_level, to_level, reason, points_earned, created_at
+		FROM tier_history
+		WHERE user_id = ?
+		ORDER BY created_at DESC, id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []TierChange{}
+	for rows.Next() {
+		var change TierChange
+		err := rows.Scan(&change.ID, &change.UserID, &change.FromLevel, &change.ToLevel,
+			&change.Reason, &change.PointsEarned, &change.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+type sqlWebhookStore struct {
+	q sqlConn
+}
+
+func (s sqlWebhookStore) Enqueue(event *WebhookEvent) error {
+	id, err := s.q.insert(`
+		INSERT INTO webhook_events (event_type, payload, attempts, next_attempt_at, created_at)
+		VALUES (?, ?, 0, ?, ?)
+	`, event.EventType, event.Payload, event.NextAttemptAt, event.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	event.ID = id
+	return nil
+}
+
+func (s sqlWebhookStore) ListDue(now string, limit int) ([]WebhookEvent, error) {
+	rows, err := s.q.Query(`
+		SELECT id, event_type, payload, attempts, next_attempt_at, last_error, created_at
+		FROM webhook_events
+		WHERE delivered_at IS NULL AND next_attempt_at <= ?
+		ORDER BY id
+		LIMIT ?
+	`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []WebhookEvent{}
+	for rows.Next() {
+		var event WebhookEvent
+		var lastError sql.NullString
+		err := rows.Scan(&event.ID, &event.EventType, &event.Payload, &event.Attempts,
+			&event.NextAttemptAt, &lastError, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		event.LastError = lastError.String
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (s sqlWebhookStore) MarkDelivered(id int, now string) error {
+	_, err := s.q.Exec("UPDATE webhook_events SET delivered_at = ?, attempts = attempts + 1, last_error = NULL WHERE id = ?", now, id)
+	return err
+}
+
+func (s sqlWebhookStore) MarkFailed(id int, lastError, nextAttemptAt string) error {
+	_, err := s.q.Exec("UPDATE webhook_events SET attempts = attempts + 1, last_error = ?, next_attempt_at = ? WHERE id = ?",
+		lastError, nullIfEmpty(nextAttemptAt), id)
+	return err
+}
+
+type sqlTransferLimitStore struct {
+	q sqlConn
+}
+
+// scanTransferLimit reads a transfer_limits row
+func scanTransferLimit(row rowScanner) (TransferLimit, error) {
+	var limit TransferLimit
+	var perTransfer, daily, monthly sql.NullInt64
+
+	err := row.Scan(&limit.MembershipLevel, &perTransfer, &daily, &monthly, &limit.UpdatedAt)
+	if err != nil {
+		return limit, err
+	}
+
+	// Handle nullable fields; NULL is unlimited
+	for _, f := range []struct {
+		src sql.NullInt64
+		dst **int
+	}{
+		{perTransfer, &limit.PerTransferMax},
+		{daily, &limit.DailyMax},
+		{monthly, &limit.MonthlyMax},
+	} {
+		if f.src.Valid {
+			n := int(f.src.Int64)
+			*f.dst = &n
+		}
+	}
+	return limit, nil
+}
+
+func (s sqlTransferLimitStore) Get(level string) (TransferLimit, error) {
+	limit, err := scanTransferLimit(s.q.QueryRow(`
+		SELECT membership_level, per_transfer_max, daily_max, monthly_max, updated_at
+		FROM transfer_limits
+		WHERE membership_level = ?
+	`, level))
+	if err == sql.ErrNoRows {
+		return limit, errTransferLimitNotFound
+	}
+	return limit, err
+}
+
+func (s sqlTransferLimitStore) List() ([]TransferLimit, error) {
+	rows, err := s.q.Query(`
+		SELECT membership_level, per_transfer_max, daily_max, monthly_max, updated_at
+		FROM transfer_limits
+		ORDER BY membership_level
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	limits := []TransferLimit{}
+	for rows.Next() {
+		limit, err := scanTransferLimit(rows)
+		if err != nil {
+			return nil, err
+		}
+		limits = append(limits, limit)
+	}
+	return limits, rows.Err()
+}
+
+func (s sqlTransferLimitStore) Set(limit TransferLimit) error {
+	// ON CONFLICT ... DO UPDATE is understood by both SQLite and Postgres
+	_, err := s.q.Exec(`
+		INSERT INTO transfer_limits (membership_level, per_transfer_max, daily_max, monthly_max, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (membership_level) DO UPDATE SET
+			per_transfer_max = excluded.per_transfer_max,
+			daily_max = excluded.daily_max,
+			monthly_max = excluded.monthly_max,
+			updated_at = excluded.updated_at
+	`, limit.MembershipLevel, limit.PerTransferMax, limit.DailyMax, limit.MonthlyMax, limit.UpdatedAt)
+	return err
+}
+
+func (s sqlTransferLimitStore) Delete(level string) error {
+	result, err := s.q.Exec("DELETE FROM transfer_limits WHERE membership_level = ?", level)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errTransferLimitNotFound
+	}
+	return nil
+}
+
+type sqlPointLotStore struct {
+	q sqlConn
+}
+
+func (s sqlPointLotStore) Add(lot *PointLot) error {
+	id, err := s.q.insert(`
+		INSERT INTO point_lots (user_id, ledger_entry_id, amount, remaining, earned_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, lot.UserID, lot.EntryID, lot.Amount, lot.Remaining, lot.EarnedAt)
+	if err != nil {
+		return err
+	}
+
+	lot.ID = id
+	return nil
+}
+
+func (s sqlPointLotStore) ListOpen(userID int) ([]PointLot, error) {
+	return s.queryLots(`
+		SELECT id, user_id, ledger_entry_id, amount, remaining, earned_at
+		FROM point_lots
+		WHERE user_id = ? AND remaining > 0
+		ORDER BY earned_at, id
+	`, userID)
+}
+
+func (s sqlPointLotStore) ListByEntry(userID, entryID int) ([]PointLot, error) {
+	return s.queryLots(`
+		SELECT id, user_id, ledger_entry_id, amount, remaining, earned_at
+		FROM point_lots
+		WHERE user_id = ? AND ledger_entry_id = ?
+		ORDER BY earned_at, id
+	`, userID, entryID)
+}
+
+// queryLots runs a query selecting the point_lots columns
+func (s sqlPointLotStore) queryLots(query string, args ...interface{}) ([]PointLot, error) {
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lots := []PointLot{}
+	for rows.Next() {
+		var lot PointLot
+		var entryID sql.NullInt64
+		if err := rows.Scan(&lot.ID, &lot.UserID, &entryID, &lot.Amount, &lot.Remaining, &lot.EarnedAt); err != nil {
+			return nil, err
+		}
+		// Lots carried over from before lots existed have no ledger entry
+		lot.EntryID = int(entryID.Int64)
+		lots = append(lots, lot)
+	}
+	return lots, rows.Err()
+}
+
+func (s sqlPointLotStore) SetRemaining(id, remaining int) error {
+	_, err := s.q.Exec("UPDATE point_lots SET remaining = ? WHERE id = ?", remaining, id)
+	return err
+}
+
+func (s sqlPointLotStore) RecordUse(entryID, lotID, amount int) error {
+	_, err := s.q.Exec("INSERT INTO point_lot_uses (ledger_entry_id, lot_id, amount) VALUES (?, ?, ?)", entryID, lotID, amount)
+	return err
+}
+
+func (s sqlPointLotStore) ListUsedBy(userID, entryID int) ([]PointLot, error) {
+	return s.queryLots(`
+		SELECT l.id, l.user_id, l.ledger_entry_id, u.amount, 0, l.earned_at
+		FROM point_lot_uses u
+		JOIN point_lots l ON l.id = u.lot_id
+		WHERE l.user_id = ? AND u.ledger_entry_id = ?
+		ORDER BY l.earned_at, l.id
+	`, userID, entryID)
+}
+
+func (s sqlPointLotStore) ListUsersWithExpired(cutoff string) ([]int, error) {
+	rows, err := s.q.Query(`
+		SELECT DISTINCT user_id
+		FROM point_lots
+		WHERE remaining > 0 AND earned_at <= ?
+		ORDER BY user_id
+	`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIDs := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, id)
+	}
+	return userIDs, rows.Err()
+}
+
+type sqlRewardStore struct {
+	q sqlConn
+}
+
+// rewardColumns is the column list read by scanReward
+const rewardColumns = `id, name, description, point_cost, stock, valid_from, valid_until, eligible_tiers,
+		       active, created_at, updated_at`
+
+// scanReward reads a row selected with rewardColumns
+func scanReward(row rowScanner) (Reward, error) {
+	var reward Reward
+	var description, validFrom, validUntil, eligibleTiers sql.NullString
+	var stock sql.NullInt64
+
+	err := row.Scan(&reward.ID, &reward.Name, &description, &reward.PointCost, &stock,
+		&validFrom, &validUntil, &eligibleTiers, &reward.Active, &reward.CreatedAt, &reward.UpdatedAt)
+	if err != nil {
+		return reward, err
+	}
+
+	// Handle nullable fields; NULL stock is unlimited and NULL tiers are all tiers
+	reward.Description = description.String
+	reward.ValidFrom = validFrom.String
+	reward.ValidUntil = validUntil.String
+	if stock.Valid {
+		n := int(stock.Int64)
+		reward.Stock = &n
+	}
+	reward.EligibleTiers = []string{}
+	if eligibleTiers.String != "" {
+		reward.EligibleTiers = strings.Split(eligibleTiers.String, ",")
+	}
+	return reward, nil
+}
+
+func (s sqlRewardStore) Create(reward *Reward) error {
+	id, err := s.q.insert(`
+		INSERT INTO rewards (name, description, point_cost, stock, valid_from, valid_until, eligible_tiers, active, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, reward.Name, nullIfEmpty(reward.Description), reward.PointCost, reward.Stock,
+		nullIfEmpty(reward.ValidFrom), nullIfEmpty(reward.ValidUntil),
+		nullIfEmpty(strings.Join(reward.EligibleTiers, ",")), reward.Active, reward.CreatedAt, reward.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	reward.ID = id
+	return nil
+}
+
+func (s sqlRewardStore) Get(id int) (Reward, error) {
+	reward, err := scanReward(s.q.QueryRow(`
+		SELECT `+rewardColumns+`
+		FROM rewards
+		WHERE id = ?
+	`, id))
+	if err == sql.ErrNoRows {
+		return reward, errRewardNotFound
+	}
+	return reward, err
+}
+
+func (s sqlRewardStore) List(filter RewardFilter) ([]Reward, error) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.AvailableAt != "" {
+		conditions = append(conditions, "active = ?",
+			"(valid_from IS NULL OR valid_from <= ?)", "(valid_until IS NULL OR valid_until >= ?)")
+		args = append(args, true, filter.AvailableAt, filter.AvailableAt)
+	}
+	if filter.InStock {
+		conditions = append(conditions, "(stock IS NULL OR stock > 0)")
+	}
+	where := "1 = 1"
+	if len(conditions) > 0 {
+		where = strings.Join(conditions, " AND ")
+	}
+
+	rows, err := s.q.Query(`
+		SELECT `+rewardColumns+`
+		FROM rewards
+		WHERE `+where+`
+		ORDER BY id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rewards := []Reward{}
+	for rows.Next() {
+		reward, err := scanReward(rows)
+		if err != nil {
+			return nil, err
+		}
+		rewards = append(rewards, reward)
+	}
+	return rewards, rows.Err()
+}
+
+func (s sqlRewardStore) Update(reward Reward) error {
+	result, err := s.q.Exec(`
+		UPDATE rewards SET name = ?, description = ?, point_cost = ?, stock = ?, valid_from = ?,
+		       valid_until = ?, eligible_tiers = ?, active = ?, updated_at = ?
+		WHERE id = ?
+	`, reward.Name, nullIfEmpty(reward.Description), reward.PointCost, reward.Stock,
+		nullIfEmpty(reward.ValidFrom), nullIfEmpty(reward.ValidUntil),
+		nullIfEmpty(strings.Join(reward.EligibleTiers, ",")), reward.Active, reward.UpdatedAt, reward.ID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errRewardNotFound
+	}
+	return nil
+}
+
+func (s sqlRewardStore) AdjustStock(id, delta int) error {
+	// The condition makes the check and the change one atomic step
+	result, err := s.q.Exec(`
+		UPDATE rewards SET stock = stock + ?
+		WHERE id = ? AND stock IS NOT NULL AND stock + ? >= 0
+	`, delta, id, delta)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		return nil
+	}
+
+	// Nothing changed: the reward is missing, unlimited or short of stock
+	reward, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	if reward.Stock == nil {
+		return nil
+	}
+	return errOutOfStock
+}
+
+type sqlRedemptionStore struct {
+	q sqlConn
+}
+
+// redemptionColumns is the column list read by scanRedemption
+const redemptionColumns = `id, user_id, reward_id, quantity, points, status, ledger_entry_id, refund_entry_id,
+		       cancel_reason, created_at, updated_at, fulfilled_at, cancelled_at`
+
+// scanRedemption reads a row selected with redemptionColumns
+func scanRedemption(row rowScanner) (RedemptionOrder, error) {
+	var order RedemptionOrder
+	var ledgerEntryID, refundEntryID sql.NullInt64
+	var cancelReason, fulfilledAt, cancelledAt sql.NullString
+
+	err := row.Scan(&order.ID, &order.UserID, &order.RewardID, &order.Quantity, &order.Points,
+		&order.Status, &ledgerEntryID, &refundEntryID, &cancelReason,
+		&order.CreatedAt, &order.UpdatedAt, &fulfilledAt, &cancelledAt)
+	if err != nil {
+		return order, err
+	}
+
+	// Handle nullable fields
+	for _, f := range []struct {
+		src sql.NullInt64
+		dst **int
+	}{
+		{ledgerEntryID, &order.LedgerEntryID},
+		{refundEntryID, &order.RefundEntryID},
+	} {
+		if f.src.Valid {
+			n := int(f.src.Int64)
+			*f.dst = &n
+		}
+	}
+	if cancelReason.Valid {
+		order.CancelReason = &cancelReason.String
+	}
+	if fulfilledAt.Valid {
+		order.FulfilledAt = &fulfilledAt.String
+	}
+	if cancelledAt.Valid {
+		order.CancelledAt = &cancelledAt.String
+	}
+	return order, nil
+}
+
+func (s sqlRedemptionStore) Create(order *RedemptionOrder) error {
+	id, err := s.q.insert(`
+		INSERT INTO redemption_orders (user_id, reward_id, quantity, points, status, ledger_entry_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, order.UserID, order.RewardID, order.Quantity, order.Points, order.Status, order.LedgerEntryID,
+		order.CreatedAt, order.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	order.ID = id
+	return nil
+}
+
+func (s sqlRedemptionStore) Get(id int) (RedemptionOrder, error) {
+	order, err := scanRedemption(s.q.QueryRow(`
+		SELECT `+redemptionColumns+`
+		FROM redemption_orders
+		WHERE id = ?
+	`, id))
+	if err == sql.ErrNoRows {
+		return order, errRedemptionNotFound
+	}
+	return order, err
+}
+
+// redemptionFilterWhere builds the WHERE clause matching filter
+func redemptionFilterWhere(filter RedemptionFilter) (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+
+	if filter.UserID != 0 {
+		conditions = append(conditions, "user_id = ?")
+		args = append(args, filter.UserID)
+	}
+	if filter.RewardID != 0 {
+		conditions = append(conditions, "reward_id = ?")
+		args = append(args, filter.RewardID)
+	}
+	if filter.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, filter.Status)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+func (s sqlRedemptionStore) List(filter RedemptionFilter, page ListPage) ([]RedemptionOrder, error) {
+	where, args := redemptionFilterWhere(filter)
+	query, args, reversed, err := keysetQuery(`
+		SELECT `+redemptionColumns+`
+		FROM redemption_orders
+		WHERE `+where, args, page, "created_at", false)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []RedemptionOrder{}
+	for rows.Next() {
+		order, err := scanRedemption(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	if reversed {
+		reverse(orders)
+	}
+	return orders, rows.Err()
+}
+
+func (s sqlRedemptionStore) Count(filter RedemptionFilter) (int, error) {
+	where, args := redemptionFilterWhere(filter)
+	var total int
+	err := s.q.QueryRow("SELECT COUNT(*) FROM redemption_orders WHERE "+where, args...).Scan(&total)
+	return total, err
+}
+
+func (s sqlRedemptionStore) Update(order RedemptionOrder, fromStatus string) error {
+	result, err := s.q.Exec(`
+		UPDATE redemption_orders SET status = ?, ledger_entry_id = ?, refund_entry_id = ?, cancel_reason = ?,
+		       updated_at = ?, fulfilled_at = ?, cancelled_at = ?
+		WHERE id = ? AND status = ?
+	`, order.Status, order.LedgerEntryID, order.RefundEntryID, order.CancelReason,
+		order.UpdatedAt, order.FulfilledAt, order.CancelledAt, order.ID, fromStatus)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errRedemptionStatusChanged
+	}
+	return nil
+}
+
+type sqlCampaignStore struct {
+	q sqlConn
+}
+
+// campaignColumns is the column list read by scanCampaign
+const campaignColumns = `id, name, description, rule_type, trigger_type, multiplier, bonus_points, threshold, starts_at,
+		       ends_at, tiers, registered_from, registered_to, max_awards_per_member, budget, budget_used,
+		       active, created_at, updated_at`
+
+// scanCampaign reads a row selected with campaignColumns
+func scanCampaign(row rowScanner) (Campaign, error) {
+	var campaign Campaign
+	var description, tiers, registeredFrom, registeredTo sql.NullString
+	var maxAwards, budget sql.NullInt64
+
+	err := row.Scan(&campaign.ID, &campaign.Name, &description, &campaign.RuleType, &campaign.Trigger,
+		&campaign.Multiplier, &campaign.BonusPoints, &campaign.Threshold, &campaign.StartsAt, &campaign.EndsAt,
+		&tiers, &registeredFrom, &registeredTo, &maxAwards, &budget, &campaign.BudgetUsed,
+		&campaign.Active, &campaign.CreatedAt, &campaign.UpdatedAt)
+	if err != nil {
+		return campaign, err
+	}
+
+	// Handle nullable fields; NULL limits are unlimited and NULL tiers are all tiers
+	campaign.Description = description.String
+	campaign.RegisteredFrom = registeredFrom.String
+	campaign.RegisteredTo = registeredTo.String
+	if maxAwards.Valid {
+		n := int(maxAwards.Int64)
+		campaign.MaxAwardsPerMember = &n
+	}
+	if budget.Valid {
+		n := int(budget.Int64)
+		campaign.Budget = &n
+	}
+	campaign.Tiers = []string{}
+	if tiers.String != "" {
+		campaign.Tiers = strings.Split(tiers.String, ",")
+	}
+	return campaign, nil
+}
+
+func (s sqlCampaignStore) Create(campaign *Campaign) error {
+	id, err := s.q.insert(`
+		INSERT INTO campaigns (name, description, rule_type, trigger_type, multiplier, bonus_points, threshold,
+		                       starts_at, ends_at, tiers, registered_from, registered_to, max_awards_per_member,
+		                       budget, budget_used, active, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, campaign.Name, nullIfEmpty(campaign.Description), campaign.RuleType, campaign.Trigger,
+		campaign.Multiplier, campaign.BonusPoints, campaign.Threshold, campaign.StartsAt, campaign.EndsAt,
+		nullIfEmpty(strings.Join(campaign.Tiers, ",")), nullIfEmpty(campaign.RegisteredFrom),
+		nullIfEmpty(campaign.RegisteredTo), campaign.MaxAwardsPerMember, campaign.Budget, campaign.BudgetUsed,
+		campaign.Active, campaign.CreatedAt, campaign.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	campaign.ID = id
+	return nil
+}
+
+func (s sqlCampaignStore) Get(id int) (Campaign, error) {
+	campaign, err := scanCampaign(s.q.QueryRow(`
+		SELECT `+campaignColumns+`
+		FROM campaigns
+		WHERE id = ?
+	`, id))
+	if err == sql.ErrNoRows {
+		return campaign, errCampaignNotFound
+	}
+	return campaign, err
+}
+
+func (s sqlCampaignStore) List(filter CampaignFilter) ([]Campaign, error) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.RunningAt != "" {
+		conditions = append(conditions, "active = ?", "starts_at <= ?", "ends_at >= ?")
+		args = append(args, true, filter.RunningAt, filter.RunningAt)
+	}
+	if filter.Trigger != "" {
+		conditions = append(conditions, "trigger_type = ?")
+		args = append(args, filter.Trigger)
+	}
+	where := "1 = 1"
+	if len(conditions) > 0 {
+		where = strings.Join(conditions, " AND ")
+	}
+
+	rows, err := s.q.Query(`
+		SELECT `+campaignColumns+`
+		FROM campaigns
+		WHERE `+where+`
+		ORDER BY id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	campaigns := []Campaign{}
+	for rows.Next() {
+		campaign, err := scanCampaign(rows)
+		if err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, campaign)
+	}
+	return campaigns, rows.Err()
+}
+
+func (s sqlCampaignStore) Update(campaign Campaign) error {
+	result, err := s.q.Exec(`
+		UPDATE campaigns SET name = ?, description = ?, rule_type = ?, trigger_type = ?, multiplier = ?,
+		       bonus_points = ?, threshold = ?, starts_at = ?, ends_at = ?, tiers = ?, registered_from = ?,
+		       registered_to = ?, max_awards_per_member = ?, budget = ?, active = ?, updated_at = ?
+		WHERE id = ?
+	`, campaign.Name, nullIfEmpty(campaign.Description), campaign.RuleType, campaign.Trigger,
+		campaign.Multiplier, campaign.BonusPoints, campaign.Threshold, campaign.StartsAt, campaign.EndsAt,
+		nullIfEmpty(strings.Join(campaign.Tiers, ",")), nullIfEmpty(campaign.RegisteredFrom),
+		nullIfEmpty(campaign.RegisteredTo), campaign.MaxAwardsPerMember, campaign.Budget,
+		campaign.Active, campaign.UpdatedAt, campaign.ID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errCampaignNotFound
+	}
+	return nil
+}
+
+func (s sqlCampaignStore) AddBudgetUsed(id, points int) error {
+	// The condition makes the check and the change one atomic step
+	result, err := s.q.Exec(`
+		UPDATE campaigns SET budget_used = budget_used + ?
+		WHERE id = ? AND (budget IS NULL OR budget_used + ? <= budget)
+	`, points, id, points)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		return nil
+	}
+
+	// Nothing changed: the campaign is missing or its budget is spent
+	if _, err := s.Get(id); err != nil {
+		return err
+	}
+	return errCampaignBudgetExhausted
+}
+
+func (s sqlCampaignStore) RecordAward(award *CampaignAward) error {
+	id, err := s.q.insert(`
+		INSERT INTO campaign_awards (campaign_id, user_id, ledger_entry_id, points, transfer_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, award.CampaignID, award.UserID, award.LedgerEntryID, award.Points, award.TransferID, award.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	award.ID = id
+	return nil
+}
+
+func (s sqlCampaignStore) CountAwards(campaignID, userID int) (int, error) {
+	var total int
+	err := s.q.QueryRow(`
+		SELECT COUNT(*) FROM campaign_awards WHERE campaign_id = ? AND user_id = ? AND reversed_at IS NULL
+	`, campaignID, userID).Scan(&total)
+	return total, err
+}
+
+func (s sqlCampaignStore) ListAwardsByTransfer(transferID int) ([]CampaignAward, error) {
+	rows, err := s.q.Query(`
+		SELECT id, campaign_id, user_id, ledger_entry_id, points, transfer_id, created_at
+		FROM campaign_awards
+		WHERE transfer_id = ? AND reversed_at IS NULL
+		ORDER BY id
+	`, transferID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	awards := []CampaignAward{}
+	for rows.Next() {
+		var award CampaignAward
+		var transferID sql.NullInt64
+		err := rows.Scan(&award.ID, &award.CampaignID, &award.UserID, &award.LedgerEntryID,
+			&award.Points, &transferID, &award.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if transferID.Valid {
+			id := int(transferID.Int64)
+			award.TransferID = &id
+		}
+		awards = append(awards, award)
+	}
+	return awards, rows.Err()
+}
+
+func (s sqlCampaignStore) ReverseAward(id int, now string) error {
+	_, err := s.q.Exec("UPDATE campaign_awards SET reversed_at = ? WHERE id = ?", now, id)
+	return err
+}
+
+type sqlReferralStore struct {
+	q sqlConn
+}
+
+// referralColumns is the column list read by scanReferral
+const referralColumns = `id, referrer_id, referee_id, status, referrer_entry_id, referee_entry_id, reject_reason,
+		       created_at, resolved_at`
+
+// scanReferral reads a row selected with referralColumns
+func scanReferral(row rowScanner) (Referral, error) {
+	var referral Referral
+	var referrerEntryID, refereeEntryID sql.NullInt64
+	var rejectReason, resolvedAt sql.NullString
+
+	err := row.Scan(&referral.ID, &referral.ReferrerID, &referral.RefereeID, &referral.Status,
+		&referrerEntryID, &refereeEntryID, &rejectReason, &referral.CreatedAt, &resolvedAt)
+	if err != nil {
+		return referral, err
+	}
+
+	// Handle nullable fields
+	if referrerEntryID.Valid {
+		id := int(referrerEntryID.Int64)
+		referral.ReferrerEntryID = &id
+	}
+	if refereeEntryID.Valid {
+		id := int(refereeEntryID.Int64)
+		referral.RefereeEntryID = &id
+	}
+	referral.RejectReason = rejectReason.String
+	if resolvedAt.Valid {
+		referral.ResolvedAt = &resolvedAt.String
+	}
+	return referral, nil
+}
+
+func (s sqlReferralStore) Create(referral *Referral) error {
+	id, err := s.q.insert(`
+		INSERT INTO referrals (referrer_id, referee_id, status, created_at)
+		VALUES (?, ?, ?, ?)
+	`, referral.ReferrerID, referral.RefereeID, referral.Status, referral.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	referral.ID = id
+	return nil
+}
+
+func (s sqlReferralStore) GetByReferee(refereeID int) (Referral, error) {
+	referral, err := scanReferral(s.q.QueryRow(`
+		SELECT `+referralColumns+`
+		FROM referrals
+		WHERE referee_id = ?
+	`, refereeID))
+	if err == sql.ErrNoRows {
+		return referral, errReferralNotFound
+	}
+	return referral, err
+}
+
+// referralFilterWhere builds the WHERE clause for filter
+func referralFilterWhere(filter ReferralFilter) (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+
+	if filter.ReferrerID != 0 {
+		conditions = append(conditions, "referrer_id = ?")
+		args = append(args, filter.ReferrerID)
+	}
+	if len(filter.Statuses) > 0 {
+		conditions = append(conditions, "status IN (?"+strings.Repeat(", ?", len(filter.Statuses)-1)+")")
+		for _, status := range filter.Statuses {
+			args = append(args, status)
+		}
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+func (s sqlReferralStore) List(filter ReferralFilter) ([]Referral, error) {
+	where, args := referralFilterWhere(filter)
+	rows, err := s.q.Query(`
+		SELECT `+referralColumns+`
+		FROM referrals
+		WHERE `+where+`
+		ORDER BY id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	referrals := []Referral{}
+	for rows.Next() {
+		referral, err := scanReferral(rows)
+		if err != nil {
+			return nil, err
+		}
+		referrals = append(referrals, referral)
+	}
+	return referrals, rows.Err()
+}
+
+func (s sqlReferralStore) Count(filter ReferralFilter) (int, error) {
+	where, args := referralFilterWhere(filter)
+	var total int
+	err := s.q.QueryRow("SELECT COUNT(*) FROM referrals WHERE "+where, args...).Scan(&total)
+	return total, err
+}
+
+func (s sqlReferralStore) Update(referral Referral, fromStatus string) error {
+	result, err := s.q.Exec(`
+		UPDATE referrals SET status = ?, referrer_entry_id = ?, referee_entry_id = ?, reject_reason = ?,
+		       resolved_at = ?
+		WHERE id = ? AND status = ?
+	`, referral.Status, referral.ReferrerEntryID, referral.RefereeEntryID, nullIfEmpty(referral.RejectReason),
+		referral.ResolvedAt, referral.ID, fromStatus)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errReferralStatusChanged
+	}
+	return nil
+}
+
+type sqlPartnerStore struct {
+	q sqlConn
+}
+
+// partnerColumns is the column list read by scanPartner
+const partnerColumns = `id, name, currency, earn_rate, active, created_at, updated_at`
+
+// scanPartner reads a row selected with partnerColumns
+func scanPartner(row rowScanner) (Partner, error) {
+	var partner Partner
+	err := row.Scan(&partner.ID, &partner.Name, &partner.Currency, &partner.EarnRate, &partner.Active,
+		&partner.CreatedAt, &partner.UpdatedAt)
+	return partner, err
+}
+
+func (s sqlPartnerStore) Create(partner *Partner) error {
+	id, err := s.q.insert(`
+		INSERT INTO partners (name, currency, earn_rate, active, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, partner.Name, partner.Currency, partner.EarnRate, partner.Active, partner.CreatedAt, partner.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	partner.ID = id
+	return nil
+}
+
+func (s sqlPartnerStore) Get(id int) (Partner, error) {
+	partner, err := scanPartner(s.q.QueryRow(`
+		SELECT `+partnerColumns+`
+		FROM partners
+		WHERE id = ?
+	`, id))
+	if err == sql.ErrNoRows {
+		return partner, errPartnerNotFound
+	}
+	return partner, err
+}
+
+func (s sqlPartnerStore) List() ([]Partner, error) {
+	rows, err := s.q.Query(`
+		SELECT ` + partnerColumns + `
+		FROM partners
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	partners := []Partner{}
+	for rows.Next() {
+		partner, err := scanPartner(rows)
+		if err != nil {
+			return nil, err
+		}
+		partners = append(partners, partner)
+	}
+	return partners, rows.Err()
+}
+
+func (s sqlPartnerStore) Update(partner Partner) error {
+	result, err := s.q.Exec(`
+		UPDATE partners SET name = ?, currency = ?, earn_rate = ?, active = ?, updated_at = ?
+		WHERE id = ?
+	`, partner.Name, partner.Currency, partner.EarnRate, partner.Active, partner.UpdatedAt, partner.ID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errPartnerNotFound
+	}
+	return nil
+}
+
+type sqlPurchaseStore struct {
+	q sqlConn
+}
+
+// purchaseColumns is the column list read by scanPurchase
+const purchaseColumns = `id, partner_id, receipt_id, user_id, member_id, amount, currency, earn_rate, points,
+		       ledger_entry_id, purchased_at, created_at`
+
+// scanPurchase reads a row selected with purchaseColumns
+func scanPurchase(row rowScanner) (Purchase, error) {
+	var purchase Purchase
+	var ledgerEntryID sql.NullInt64
+
+	err := row.Scan(&purchase.ID, &purchase.PartnerID, &purchase.ReceiptID, &purchase.UserID, &purchase.MemberID,
+		&purchase.Amount, &purchase.Currency, &purchase.EarnRate, &purchase.Points, &ledgerEntryID,
+		&purchase.PurchasedAt, &purchase.CreatedAt)
+	if err != nil {
+		return purchase, err
+	}
+
+	// Purchases too small to earn a point have no ledger entry
+	if ledgerEntryID.Valid {
+		id := int(ledgerEntryID.Int64)
+		purchase.LedgerEntryID = &id
+	}
+	return purchase, nil
+}
+
+func (s sqlPurchaseStore) Create(purchase *Purchase) error {
+	id, err := s.q.insert(`
+		INSERT INTO partner_purchases (partner_id, receipt_id, user_id, member_id, amount, currency, earn_rate,
+		                               points, ledger_entry_id, purchased_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, purchase.PartnerID, purchase.ReceiptID, purchase.UserID, purchase.MemberID, purchase.Amount,
+		purchase.Currency, purchase.EarnRate, purchase.Points, purchase.LedgerEntryID, purchase.PurchasedAt,
+		purchase.CreatedAt)
+	if err != nil {
+		if s.q.dialect.isUniqueViolation(err) {
+			return errDuplicateReceipt
+		}
+		return err
+	}
+
+	purchase.ID = id
+	return nil
+}
+
+func (s sqlPurchaseStore) GetByReceipt(partnerID int, receiptID string) (Purchase, error) {
+	purchase, err := scanPurchase(s.q.QueryRow(`
+		SELECT `+purchaseColumns+`
+		FROM partner_purchases
+		WHERE partner_id = ? AND receipt_id = ?
+	`, partnerID, receiptID))
+	if err == sql.ErrNoRows {
+		return purchase, errPurchaseNotFound
+	}
+	return purchase, err
+}
+
+// purchaseFilterWhere builds the WHERE clause for filter
+func purchaseFilterWhere(filter PurchaseFilter) (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+
+	if filter.PartnerID != 0 {
+		conditions = append(conditions, "partner_id = ?")
+		args = append(args, filter.PartnerID)
+	}
+	if filter.UserID != 0 {
+		conditions = append(conditions, "user_id = ?")
+		args = append(args, filter.UserID)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+func (s sqlPurchaseStore) List(filter PurchaseFilter, page ListPage) ([]Purchase, error) {
+	where, args := purchaseFilterWhere(filter)
+	query, args, reversed, err := keysetQuery(`
+		SELECT `+purchaseColumns+`
+		FROM partner_purchases
+		WHERE `+where, args, page, "created_at", false)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	purchases := []Purchase{}
+	for rows.Next() {
+		purchase, err := scanPurchase(rows)
+		if err != nil {
+			return nil, err
+		}
+		purchases = append(purchases, purchase)
+	}
+	if reversed {
+		reverse(purchases)
+	}
+	return purchases, rows.Err()
+}
+
+func (s sqlPurchaseStore) Count(filter PurchaseFilter) (int, error) {
+	where, args := purchaseFilterWhere(filter)
+	var total int
+	err := s.q.QueryRow("SELECT COUNT(*) FROM partner_purchases WHERE "+where, args...).Scan(&total)
+	return total, err
+}
+
+type sqlScheduleStore struct {
+	q sqlConn
+}
+
+// scheduleColumns is the column list read by scanSchedule
+const scheduleColumns = `id, from_user_id, to_user_id, amount, note, starts_at, recurrence, status, next_run_at,
+		       run_count, last_run_at, fail_reason, created_at, updated_at`
+
+// scanSchedule reads a row selected with scheduleColumns
+func scanSchedule(row rowScanner) (ScheduledTransfer, error) {
+	var st ScheduledTransfer
+	var note, recurrence, nextRunAt, lastRunAt, failReason sql.NullString
+
+	err := row.Scan(&st.ID, &st.FromUserID, &st.ToUserID, &st.Amount, &note, &st.StartsAt, &recurrence,
+		&st.Status, &nextRunAt, &st.RunCount, &lastRunAt, &failReason, &st.CreatedAt, &st.UpdatedAt)
+	if err != nil {
+		return st, err
+	}
+
+	st.Recurrence = recurrence.String
+	for _, col := range []struct {
+		value sql.NullString
+		dst   **string
+	}{
+		{note, &st.Note},
+		{nextRunAt, &st.NextRunAt},
+		{lastRunAt, &st.LastRunAt},
+		{failReason, &st.FailReason},
+	} {
+		if col.value.Valid {
+			value := col.value.String
+			*col.dst = &value
+		}
+	}
+	return st, nil
+}
+
+func (s sqlScheduleStore) Create(schedule *ScheduledTransfer) error {
+	id, err := s.q.insert(`
+		INSERT INTO scheduled_transfers (from_user_id, to_user_id, amount, note, starts_at, recurrence, status,
+		                                 next_run_at, run_count, last_run_at, fail_reason, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, schedule.FromUserID, schedule.ToUserID, schedule.Amount, schedule.Note, schedule.StartsAt,
+		nullIfEmpty(schedule.Recurrence), schedule.Status, schedule.NextRunAt, schedule.RunCount, schedule.LastRunAt,
+		schedule.FailReason, schedule.CreatedAt, schedule.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	schedule.ID = id
+	return nil
+}
+
+func (s sqlScheduleStore) Get(id int) (ScheduledTransfer, error) {
+	st, err := scanSchedule(s.q.QueryRow(`
+		SELECT `+scheduleColumns+`
+		FROM scheduled_transfers
+		WHERE id = ?
+	`, id))
+	if err == sql.ErrNoRows {
+		return st, errScheduleNotFound
+	}
+	return st, err
+}
+
+// scheduleFilterWhere builds the WHERE clause for filter
+func scheduleFilterWhere(filter ScheduleFilter) (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+
+	if filter.UserID != 0 {
+		conditions = append(conditions, "from_user_id = ?")
+		args = append(args, filter.UserID)
+	}
+	if len(filter.Statuses) > 0 {
+		conditions = append(conditions, "status IN (?"+strings.Repeat(", ?", len(filter.Statuses)-1)+")")
+		for _, status := range filter.Statuses {
+			args = append(args, status)
+		}
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// querySchedules runs a query selecting scheduleColumns
+func (s sqlScheduleStore) querySchedules(query string, args ...interface{}) ([]ScheduledTransfer, error) {
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []ScheduledTransfer{}
+	for rows.Next() {
+		st, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, st)
+	}
+	return schedules, rows.Err()
+}
+
+func (s sqlScheduleStore) List(filter ScheduleFilter) ([]ScheduledTransfer, error) {
+	where, args := scheduleFilterWhere(filter)
+	return s.querySchedules(`
+		SELECT `+scheduleColumns+`
+		FROM scheduled_transfers
+		WHERE `+where+`
+		ORDER BY id
+	`, args...)
+}
+
+func (s sqlScheduleStore) ListDue(now string) ([]ScheduledTransfer, error) {
+	return s.querySchedules(`
+		SELECT `+scheduleColumns+`
+		FROM scheduled_transfers
+		WHERE status = 'active' AND next_run_at <= ?
+		ORDER BY next_run_at, id
+	`, now)
+}
+
+func (s sqlScheduleStore) Update(schedule ScheduledTransfer, fromStatus string) error {
+	result, err := s.q.Exec(`
+		UPDATE scheduled_transfers SET status = ?, next_run_at = ?, run_count = ?, last_run_at = ?,
+		       fail_reason = ?, updated_at = ?
+		WHERE id = ? AND status = ?
+	`, schedule.Status, schedule.NextRunAt, schedule.RunCount, schedule.LastRunAt, schedule.FailReason,
+		schedule.UpdatedAt, schedule.ID, fromStatus)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errScheduleStatusChanged
+	}
+	return nil
+}
@@ -5,16 +5,19 @@ echo ""
 
 BASE_URL="http://localhost:3000"
 
+# Requests authenticate with an admin key from: go run . apikey create <name> admin
+[ -z "$LBK_API_KEY" ] && echo "LBK_API_KEY is not set; requests will fail unless the server runs with LBK_AUTH_REQUIRED=false"
+
 echo "1. Testing Root Endpoint"
-curl -s "$BASE_URL/" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/" | python3 -m json.tool
 echo ""
 
 echo "2. GET /users - List all users (should be empty initially)"
-curl -s "$BASE_URL/users" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/users" | python3 -m json.tool
 echo ""
 
 echo "3. POST /users - Create the user from the Thai screenshot (Somchai Jaidee)"
-curl -s -X POST "$BASE_URL/users" \
+curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users" \
   -H "Content-Type: application/json" \
   -d '{
     "member_id": "LBK001234",
@@ -29,7 +32,7 @@ curl -s -X POST "$BASE_URL/users" \
 echo ""
 
 echo "4. POST /users - Create another test user"
-curl -s -X POST "$BASE_URL/users" \
+curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users" \
   -H "Content-Type: application/json" \
   -d '{
     "member_id": "LBK001235",
@@ -44,32 +47,37 @@ curl -s -X POST "$BASE_URL/users" \
 echo ""
 
 echo "5. GET /users - List all users (should now have 2 users)"
-curl -s "$BASE_URL/users" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/users" | python3 -m json.tool
 echo ""
 
 echo "6. GET /users/1 - Get user by ID"
-curl -s "$BASE_URL/users/1" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/users/1" | python3 -m json.tool
 echo ""
 
-echo "7. PUT /users/1 - Update user points"
-curl -s -X PUT "$BASE_URL/users/1" \
+echo "7. PATCH /users/1 - Update membership level and add points via the ledger"
+curl -s -H "X-API-Key: $LBK_API_KEY" -X PATCH "$BASE_URL/users/1" \
   -H "Content-Type: application/json" \
   -d '{
-    "point_balance": 20000,
     "membership_level": "Platinum"
   }' | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users/1/points/adjust" \
+  -H "Content-Type: application/json" \
+  -d '{
+    "amount": 4580,
+    "reference": "Balance correction"
+  }' | python3 -m json.tool
 echo ""
 
 echo "8. GET /users/1 - Verify the update"
-curl -s "$BASE_URL/users/1" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/users/1" | python3 -m json.tool
 echo ""
 
 echo "9. DELETE /users/2 - Delete second user"
-curl -s -X DELETE "$BASE_URL/users/2" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" -X DELETE "$BASE_URL/users/2" | python3 -m json.tool
 echo ""
 
 echo "10. GET /users - Final list (should have only 1 user)"
-curl -s "$BASE_URL/users" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/users" | python3 -m json.tool
 echo ""
 
 echo "=== API Testing Complete ==="
\ No newline at end of file
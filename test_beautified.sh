@@ -5,24 +5,27 @@ echo ""
 
 BASE_URL="http://localhost:3000"
 
+# Requests authenticate with an admin key from: go run . apikey create <name> admin
+[ -z "$LBK_API_KEY" ] && echo "LBK_API_KEY is not set; requests will fail unless the server runs with LBK_AUTH_REQUIRED=false"
+
 echo "1. Testing Root Endpoint (should show beautified JSON)"
 echo "curl $BASE_URL/"
 echo ""
-curl -s "$BASE_URL/"
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/"
 echo ""
 echo ""
 
 echo "2. Testing GET /users (empty list with beautified JSON)"
 echo "curl $BASE_URL/users"
 echo ""
-curl -s "$BASE_URL/users"
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/users"
 echo ""
 echo ""
 
 echo "3. Creating a user with beautified response"
 echo "curl -X POST $BASE_URL/users -H 'Content-Type: application/json' -d '{...}'"
 echo ""
-curl -s -X POST "$BASE_URL/users" \
+curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users" \
   -H "Content-Type: application/json" \
   -d '{
     "member_id": "LBK001234",
@@ -40,7 +43,7 @@ echo ""
 echo "4. Getting user by ID (beautified response)"
 echo "curl $BASE_URL/users/1"
 echo ""
-curl -s "$BASE_URL/users/1"
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/users/1"
 echo ""
 echo ""
 
@@ -5,6 +5,9 @@ echo ""
 
 BASE_URL="http://localhost:3000"
 
+# Requests authenticate with an admin key from: go run . apikey create <name> admin
+[ -z "$LBK_API_KEY" ] && echo "LBK_API_KEY is not set; requests will fail unless the server runs with LBK_AUTH_REQUIRED=false"
+
 # Colors for output
 RED='\033[0;31m'
 GREEN='\033[0;32m'
@@ -36,7 +39,7 @@ print_info() {
 print_test "Test 1: Setting up test users"
 
 print_info "Creating User 1 (Alice) with 10000 points"
-USER1_RESPONSE=$(curl -s -X POST "$BASE_URL/users" \
+USER1_RESPONSE=$(curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users" \
   -H "Content-Type: application/json" \
   -d '{
     "member_id": "LBK001001",
@@ -55,7 +58,7 @@ echo "$USER1_RESPONSE" | python3 -m json.tool
 echo ""
 
 print_info "Creating User 2 (Bob) with 5000 points"
-USER2_RESPONSE=$(curl -s -X POST "$BASE_URL/users" \
+USER2_RESPONSE=$(curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users" \
   -H "Content-Type: application/json" \
   -d '{
     "member_id": "LBK001002",
@@ -74,7 +77,7 @@ echo "$USER2_RESPONSE" | python3 -m json.tool
 echo ""
 
 print_info "Creating User 3 (Charlie) with 0 points"
-USER3_RESPONSE=$(curl -s -X POST "$BASE_URL/users" \
+USER3_RESPONSE=$(curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/users" \
   -H "Content-Type: application/json" \
   -d '{
     "member_id": "LBK001003",
@@ -96,7 +99,7 @@ echo ""
 print_test "Test 2: Valid Point Transfer (Alice → Bob: 1500 points)"
 
 print_info "Transferring 1500 points from Alice (ID: $USER1_ID) to Bob (ID: $USER2_ID)"
-TRANSFER1_RESPONSE=$(curl -s -X POST "$BASE_URL/transfers" \
+TRANSFER1_RESPONSE=$(curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/transfers" \
   -H "Content-Type: application/json" \
   -d "{
     \"fromUserId\": $USER1_ID,
@@ -115,18 +118,18 @@ echo ""
 
 # Verify balances after transfer
 print_info "Verifying Alice's balance (should be 8500)"
-curl -s "$BASE_URL/users/$USER1_ID" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/users/$USER1_ID" | python3 -m json.tool
 echo ""
 
 print_info "Verifying Bob's balance (should be 6500)"
-curl -s "$BASE_URL/users/$USER2_ID" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/users/$USER2_ID" | python3 -m json.tool
 echo ""
 
 # Test 3: Insufficient balance
 print_test "Test 3: Insufficient Balance Error"
 
 print_info "Attempting to transfer 20000 points from Bob (balance: 6500)"
-curl -s -X POST "$BASE_URL/transfers" \
+curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/transfers" \
   -H "Content-Type: application/json" \
   -d "{
     \"fromUserId\": $USER2_ID,
@@ -140,7 +143,7 @@ echo ""
 print_test "Test 4: Self-Transfer Validation"
 
 print_info "Attempting to transfer points to self (should fail)"
-curl -s -X POST "$BASE_URL/transfers" \
+curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/transfers" \
   -H "Content-Type: application/json" \
   -d "{
     \"fromUserId\": $USER1_ID,
@@ -154,7 +157,7 @@ echo ""
 print_test "Test 5: Non-existent User Error"
 
 print_info "Attempting transfer to non-existent user (ID: 99999)"
-curl -s -X POST "$BASE_URL/transfers" \
+curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/transfers" \
   -H "Content-Type: application/json" \
   -d "{
     \"fromUserId\": $USER1_ID,
@@ -168,7 +171,7 @@ echo ""
 print_test "Test 6: Input Validation Tests"
 
 print_info "Test 6a: Negative amount"
-curl -s -X POST "$BASE_URL/transfers" \
+curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/transfers" \
   -H "Content-Type: application/json" \
   -d "{
     \"fromUserId\": $USER1_ID,
@@ -179,7 +182,7 @@ curl -s -X POST "$BASE_URL/transfers" \
 echo ""
 
 print_info "Test 6b: Zero amount"
-curl -s -X POST "$BASE_URL/transfers" \
+curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/transfers" \
   -H "Content-Type: application/json" \
   -d "{
     \"fromUserId\": $USER1_ID,
@@ -190,7 +193,7 @@ curl -s -X POST "$BASE_URL/transfers" \
 echo ""
 
 print_info "Test 6c: Missing required fields"
-curl -s -X POST "$BASE_URL/transfers" \
+curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/transfers" \
   -H "Content-Type: application/json" \
   -d "{
     \"fromUserId\": $USER1_ID,
@@ -203,7 +206,7 @@ print_test "Test 7: Retrieve Transfer by ID"
 
 if [ ! -z "$TRANSFER1_ID" ]; then
     print_info "Getting transfer details for ID: $TRANSFER1_ID"
-    curl -s "$BASE_URL/transfers/$TRANSFER1_ID" | python3 -m json.tool
+    curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/transfers/$TRANSFER1_ID" | python3 -m json.tool
     echo ""
 else
     print_error "No valid transfer ID available for testing"
@@ -213,7 +216,7 @@ fi
 print_test "Test 8: Multiple Transfers and History"
 
 print_info "Creating second transfer: Bob → Charlie (2000 points)"
-TRANSFER2_RESPONSE=$(curl -s -X POST "$BASE_URL/transfers" \
+TRANSFER2_RESPONSE=$(curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/transfers" \
   -H "Content-Type: application/json" \
   -d "{
     \"fromUserId\": $USER2_ID,
@@ -226,7 +229,7 @@ echo "$TRANSFER2_RESPONSE" | python3 -m json.tool
 echo ""
 
 print_info "Creating third transfer: Alice → Charlie (500 points)"
-curl -s -X POST "$BASE_URL/transfers" \
+curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/transfers" \
   -H "Content-Type: application/json" \
   -d "{
     \"fromUserId\": $USER1_ID,
@@ -240,41 +243,41 @@ echo ""
 print_test "Test 9: Transfer History for Each User"
 
 print_info "Alice's transfer history (User ID: $USER1_ID)"
-curl -s "$BASE_URL/transfers?userId=$USER1_ID" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/transfers?userId=$USER1_ID" | python3 -m json.tool
 echo ""
 
 print_info "Bob's transfer history (User ID: $USER2_ID)"
-curl -s "$BASE_URL/transfers?userId=$USER2_ID" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/transfers?userId=$USER2_ID" | python3 -m json.tool
 echo ""
 
 print_info "Charlie's transfer history (User ID: $USER3_ID)"
-curl -s "$BASE_URL/transfers?userId=$USER3_ID" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/transfers?userId=$USER3_ID" | python3 -m json.tool
 echo ""
 
 # Test 10: Pagination testing
 print_test "Test 10: Pagination Testing"
 
 print_info "Testing pagination - page 1, pageSize 2"
-curl -s "$BASE_URL/transfers?userId=$USER1_ID&page=1&pageSize=2" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/transfers?userId=$USER1_ID&page=1&pageSize=2" | python3 -m json.tool
 echo ""
 
 print_info "Testing pagination - page 2, pageSize 1"
-curl -s "$BASE_URL/transfers?userId=$USER2_ID&page=2&pageSize=1" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/transfers?userId=$USER2_ID&page=2&pageSize=1" | python3 -m json.tool
 echo ""
 
 # Test 11: Final balance verification
 print_test "Test 11: Final Balance Verification"
 
 print_info "Alice's final balance (started: 10000, sent: 1500 + 500 = 2000, should be: 8000)"
-curl -s "$BASE_URL/users/$USER1_ID" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/users/$USER1_ID" | python3 -m json.tool
 echo ""
 
 print_info "Bob's final balance (started: 5000, received: 1500, sent: 2000, should be: 4500)"
-curl -s "$BASE_URL/users/$USER2_ID" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/users/$USER2_ID" | python3 -m json.tool
 echo ""
 
 print_info "Charlie's final balance (started: 0, received: 2000 + 500 = 2500, should be: 2500)"
-curl -s "$BASE_URL/users/$USER3_ID" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/users/$USER3_ID" | python3 -m json.tool
 echo ""
 
 # Test 12: Edge cases
@@ -282,10 +285,10 @@ print_test "Test 12: Edge Cases"
 
 print_info "Test 12a: Transfer all remaining points (Bob → Alice)"
 # First get Bob's current balance
-BOB_BALANCE=$(curl -s "$BASE_URL/users/$USER2_ID" | python3 -c "import sys, json; print(json.load(sys.stdin)['data']['point_balance'])" 2>/dev/null)
+BOB_BALANCE=$(curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/users/$USER2_ID" | python3 -c "import sys, json; print(json.load(sys.stdin)['data']['point_balance'])" 2>/dev/null)
 echo "Bob's current balance: $BOB_BALANCE"
 
-curl -s -X POST "$BASE_URL/transfers" \
+curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/transfers" \
   -H "Content-Type: application/json" \
   -d "{
     \"fromUserId\": $USER2_ID,
@@ -296,11 +299,11 @@ curl -s -X POST "$BASE_URL/transfers" \
 echo ""
 
 print_info "Verify Bob's balance is now 0"
-curl -s "$BASE_URL/users/$USER2_ID" | python3 -m json.tool
+curl -s -H "X-API-Key: $LBK_API_KEY" "$BASE_URL/users/$USER2_ID" | python3 -m json.tool
 echo ""
 
 print_info "Test 12b: Try to transfer from user with 0 balance"
-curl -s -X POST "$BASE_URL/transfers" \
+curl -s -H "X-API-Key: $LBK_API_KEY" -X POST "$BASE_URL/transfers" \
   -H "Content-Type: application/json" \
   -d "{
     \"fromUserId\": $USER2_ID,
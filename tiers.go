@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TierChange records a member moving from one membership tier to another.
+// Reason is "evaluation" for changes made by the tier engine and "manual"
+// for changes made through PUT/PATCH /users/:id. A "baseline" entry records
+// the level a member already held when there was no ledger to justify it:
+// members from before the tier engine, and members created or imported
+// above the lowest tier.
+type TierChange struct {
+	ID           int    `json:"id"`
+	UserID       int    `json:"user_id"`
+	FromLevel    string `json:"from_level"`
+	ToLevel      string `json:"to_level"`
+	Reason       string `json:"reason"`
+	PointsEarned int    `json:"points_earned"`
+	CreatedAt    string `json:"created_at"`
+}
+
+// TierStatusResponse describes a member's tier and their progress within the
+// qualification window. NextTier is empty at the top tier.
+type TierStatusResponse struct {
+	UserID          int          `json:"user_id"`
+	MembershipLevel string       `json:"membership_level"`
+	QualifyingTier  string       `json:"qualifying_tier"`
+	PointsEarned    int          `json:"points_earned"`
+	WindowStart     string       `json:"window_start"`
+	NextTier        string       `json:"next_tier,omitempty"`
+	PointsToNext    int          `json:"points_to_next,omitempty"`
+	History         []TierChange `json:"history"`
+}
+
+// TierEvaluationResult summarises a run of the tier engine
+type TierEvaluationResult struct {
+	Evaluated int `json:"evaluated"`
+	Changed   int `json:"changed"`
+}
+
+// errUnknownTier is returned when a membership level is not a configured tier
+var errUnknownTier = errors.New("unknown membership tier")
+
+// tierEvaluationBatch is how many users the tier engine reads at a time
+const tierEvaluationBatch = 500
+
+// lowestTier is the tier new members start in
+func lowestTier() string {
+	return cfg.Tiers[0].Name
+}
+
+// isTier reports whether name is a configured tier
+func isTier(name string) bool {
+	for _, tier := range cfg.Tiers {
+		if tier.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// tierNames lists the configured tiers from lowest to highest
+func tierNames() []string {
+	names := make([]string, len(cfg.Tiers))
+	for i, tier := range cfg.Tiers {
+		names[i] = tier.Name
+	}
+	return names
+}
+
+// tierRank is the position of name among the configured tiers, lowest
+// first, or -1 when it is not one of them
+func tierRank(name string) int {
+	for i, tier := range cfg.Tiers {
+		if tier.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// qualifyingTier returns the highest tier that earned points qualify for
+func qualifyingTier(earned int) string {
+	name := lowestTier()
+	for _, tier := range cfg.Tiers {
+		if earned >= tier.MinPoints {
+			name = tier.Name
+		}
+	}
+	return name
+}
+
+// nextTier returns the tier above the one earned points qualify for and how
+// many more points it needs, or "" at the top tier
+func nextTier(earned int) (string, int) {
+	for _, tier := range cfg.Tiers {
+		if earned < tier.MinPoints {
+			return tier.Name, tier.MinPoints - earned
+		}
+	}
+	return "", 0
+}
+
+// tierWindowStart is the start of the qualification window ending at now
+func tierWindowStart(now time.Time) string {
+	return timestamp(now.Add(-cfg.TierWindow))
+}
+
+// setMemberTier moves user to toLevel, recording the change in the tier
+// history, as a zero-point tier_change ledger entry and as a
+// member.tier_changed webhook event. It must run inside a transaction.
+func setMemberTier(tx Store, user User, toLevel, reason string, earned int, now string) (TierChange, error) {
+	if !isTier(toLevel) {
+		return TierChange{}, errUnknownTier
+	}
+
+	if err := tx.Users().Update(user.ID, UserPatch{MembershipLevel: &toLevel}); err != nil {
+		return TierChange{}, err
+	}
+
+	change := TierChange{
+		UserID:       user.ID,
+		FromLevel:    user.MembershipLevel,
+		ToLevel:      toLevel,
+		Reason:       reason,
+		PointsEarned: earned,
+		CreatedAt:    now,
+	}
+	if err := tx.Tiers().Record(&change); err != nil {
+		return TierChange{}, err
+	}
+
+	metadata, _ := json.Marshal(map[string]interface{}{
+		"from_level": change.FromLevel,
+		"to_level":   change.ToLevel,
+		"reason":     change.Reason,
+	})
+	_, err := applyPointChange(tx, pointChange{
+		UserID:    user.ID,
+		EventType: "tier_change",
+		Reference: fmt.Sprintf("Tier changed from %s to %s", change.FromLevel, change.ToLevel),
+		Metadata:  string(metadata),
+	}, now)
+	if err != nil {
+		return TierChange{}, err
+	}
+
+	return change, enqueueWebhook(tx, "member.tier_changed", change, now)
+}
+
+// recordTierBaseline records the level user holds as a baseline, so the
+// tier engine does not downgrade them before a full window of earning
+func recordTierBaseline(tx Store, user User, now string) error {
+	return tx.Tiers().Record(&TierChange{
+		UserID:    user.ID,
+		FromLevel: user.MembershipLevel,
+		ToLevel:   user.MembershipLevel,
+		Reason:    "baseline",
+		CreatedAt: now,
+	})
+}
+
+// keepsBaselineTier reports whether user still holds a baseline level
+// recorded within the current window, which the tier engine must not
+// downgrade: the ledger does not yet cover a full window of their earning.
+func keepsBaselineTier(tx Store, user User, now time.Time) (bool, error) {
+	history, err := tx.Tiers().ListByUser(user.ID)
+	if err != nil || len(history) == 0 {
+		return false, err
+	}
+	latest := history[0]
+	return latest.Reason == "baseline" && latest.CreatedAt > tierWindowStart(now), nil
+}
+
+// evaluateMemberTier moves the user to the tier qualified for by earned, the
+// points they earned within the window. A member holding a baseline level is
+// only upgraded until a full window has passed since it was recorded. It
+// reports whether the tier changed.
+func evaluateMemberTier(s Store, userID, earned int, now time.Time) (bool, error) {
+	target := qualifyingTier(earned)
+	changed := false
+	err := s.RunInTx(func(tx Store) error {
+		if err := tx.Users().Lock(userID); err != nil {
+			return err
+		}
+		user, err := tx.Users().Get(userID)
+		if err != nil || user.MembershipLevel == target {
+			return err
+		}
+		if tierRank(target) < tierRank(user.MembershipLevel) {
+			keep, err := keepsBaselineTier(tx, user, now)
+			if err != nil || keep {
+				return err
+			}
+		}
+		changed = true
+		_, err = setMemberTier(tx, user, target, "evaluation", earned, timestamp(now))
+		return err
+	})
+	return changed && err == nil, err
+}
+
+// evaluateTiers runs the tier engine over every member, upgrading and
+// downgrading each to the tier their points earned within the window
+// qualify for. Members are not downgraded from a baseline level until it
+// is a full window old. Each change commits on its own, so a failure part-way
+// through keeps the changes made before it.
+func evaluateTiers(s Store, now time.Time) (TierEvaluationResult, error) {
+	var result TierEvaluationResult
+
+	earned, err := s.Ledger().EarnedSince(tierWindowStart(now), 0)
+	if err != nil {
+		return result, err
+	}
+
+	query := UserQuery{Sort: "id", Limit: tierEvaluationBatch, SkipCount: true}
+	for {
+		users, _, err := s.Users().List(query)
+		if err != nil {
+			return result, err
+		}
+
+		for _, user := range users {
+			result.Evaluated++
+			// Skip the transaction for the common case of no change
+			if user.MembershipLevel == qualifyingTier(earned[user.ID]) {
+				continue
+			}
+
+			changed, err := evaluateMemberTier(s, user.ID, earned[user.ID], now)
+			if err == errUserNotFound {
+				continue
+			}
+			if err != nil {
+				return result, err
+			}
+			if changed {
+				result.Changed++
+			}
+		}
+
+		if len(users) < tierEvaluationBatch {
+			return result, nil
+		}
+		last := users[len(users)-1]
+		query.After = &Keyset{Value: strconv.Itoa(last.ID), ID: last.ID}
+	}
+}
+
+// nextTierEvaluation returns the first configured evaluation time after now
+func nextTierEvaluation(now time.Time) time.Time {
+	at, _ := time.Parse("15:04", cfg.TierEvaluationTime)
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, time.UTC)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// runTierWorker evaluates every member's tier once a day at the configured
+// time until the process exits
+func runTierWorker(store Store) {
+	for {
+		time.Sleep(time.Until(nextTierEvaluation(time.Now())))
+
+		result, err := evaluateTiers(store, time.Now())
+		if err != nil {
+			log.Println("Failed to evaluate membership tiers:", err)
+			continue
+		}
+		log.Printf("Evaluated %d member tier(s), %d changed", result.Evaluated, result.Changed)
+	}
+}
+
+// GET /tiers - List the membership tiers and the qualification window
+func (a *API) getTiers(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"data":       cfg.Tiers,
+		"windowDays": int(cfg.TierWindow.Hours() / 24),
+	})
+}
+
+// GET /users/:id/tier - Show a member's tier, progress towards the next one and tier history
+func (a *API) getUserTier(c *fiber.Ctx) error {
+	userID, err := strconv.Atoi(c.Params("id"))
+	if err != nil || userID <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "User ID must be a positive integer",
+		})
+	}
+
+	user, err := a.store.Users().Get(userID)
+	if err != nil {
+		return transferErrorResponse(c, err, "fetch user")
+	}
+
+	now := time.Now()
+	earned, err := a.store.Ledger().EarnedSince(tierWindowStart(now), userID)
+	if err != nil {
+		return transferErrorResponse(c, err, "sum earned points")
+	}
+	history, err := a.store.Tiers().ListByUser(userID)
+	if err != nil {
+		return transferErrorResponse(c, err, "fetch tier history")
+	}
+
+	response := TierStatusResponse{
+		UserID:          userID,
+		MembershipLevel: user.MembershipLevel,
+		QualifyingTier:  qualifyingTier(earned[userID]),
+		PointsEarned:    earned[userID],
+		WindowStart:     tierWindowStart(now),
+		History:         history,
+	}
+	response.NextTier, response.PointsToNext = nextTier(earned[userID])
+
+	return c.JSON(fiber.Map{
+		"data": response,
+	})
+}
+
+// POST /tiers/evaluate - Run the tier engine now instead of waiting for the nightly run
+func (a *API) evaluateTiersNow(c *fiber.Ctx) error {
+	result, err := evaluateTiers(a.store, time.Now())
+	if err != nil {
+		return transferErrorResponse(c, err, "evaluate tiers")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": result,
+	})
+}
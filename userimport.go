@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// userFileColumns lists the User fields of an import or export file, by
+// their JSON name. Exports carry them all; imports may carry any of them and
+// ignore the ones set by the system.
+var userFileColumns = []string{
+	"id", "member_id", "first_name", "last_name", "mobile_number", "email", "register_date",
+	"membership_level", "point_balance", "held_balance", "referral_code", "referred_by",
+	"created_at", "updated_at",
+}
+
+// userReadOnlyColumns are exported but never imported
+var userReadOnlyColumns = []string{"id", "held_balance", "referral_code", "referred_by", "created_at", "updated_at"}
+
+const (
+	// maxImportUsers bounds the rows of one import
+	maxImportUsers = 10000
+	// exportBatchSize is the number of users read from the store at a time
+	exportBatchSize = 500
+)
+
+// errImportDryRun rolls back the transaction of a dry-run import row
+var errImportDryRun = errors.New("dry run")
+
+// userImportRow is one record of an import file: the fields it carries,
+// keyed by their JSON name, or the message explaining why it cannot be read
+type userImportRow struct {
+	line    int
+	fields  map[string]string
+	message string
+}
+
+// UserImportResult reports what an import did with one row
+type UserImportResult struct {
+	Row      int    `json:"row"`
+	MemberID string `json:"memberId"`
+	// Status is created, updated or failed; a dry run reports what it would do
+	Status  string `json:"status"`
+	UserID  int    `json:"userId,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// importFormat returns the format, csv or ndjson, of an import: the format
+// query parameter, or else the one the content type or the uploaded file's
+// extension suggests
+func importFormat(c *fiber.Ctx, filename string) string {
+	if format := c.Query("format"); format != "" {
+		return strings.ToLower(format)
+	}
+	contentType := strings.ToLower(c.Get(fiber.HeaderContentType))
+	filename = strings.ToLower(filename)
+	if strings.Contains(contentType, "ndjson") || strings.HasSuffix(filename, ".ndjson") || strings.HasSuffix(filename, ".jsonl") {
+		return "ndjson"
+	}
+	return "csv"
+}
+
+// parseUserCSV reads the rows of a CSV import, whose header row names the
+// columns, or returns the message explaining why the file cannot be read
+func parseUserCSV(data []byte) ([]userImportRow, string) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, "the file must start with a header row"
+	}
+	for i, name := range header {
+		// Spreadsheet exports may start with a byte order mark
+		header[i] = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if !containsString(userFileColumns, header[i]) {
+			return nil, "unknown column " + strconv.Quote(header[i]) + "; columns are " + strings.Join(userFileColumns, ", ")
+		}
+	}
+	if !containsString(header, "member_id") {
+		return nil, "the header must include member_id"
+	}
+
+	var rows []userImportRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "the file is not valid CSV: " + err.Error()
+		}
+		if len(rows) == maxImportUsers {
+			return nil, fmt.Sprintf("a file can hold at most %d users", maxImportUsers)
+		}
+
+		// Row 1 is the header
+		row := userImportRow{line: len(rows) + 2, fields: map[string]string{}}
+		for i, name := range header {
+			if i < len(record) {
+				row.fields[name] = strings.TrimSpace(record[i])
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, ""
+}
+
+// parseUserNDJSON reads the rows of an NDJSON import, one JSON object per
+// line. A line that is not a valid user fails on its own.
+func parseUserNDJSON(data []byte) ([]userImportRow, string) {
+	var rows []userImportRow
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if len(rows) == maxImportUsers {
+			return nil, fmt.Sprintf("a file can hold at most %d users", maxImportUsers)
+		}
+
+		row := userImportRow{line: i + 1, fields: map[string]string{}}
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(line, &raw); err != nil {
+			row.message = "the line is not a JSON object"
+			rows = append(rows, row)
+			continue
+		}
+		for name, value := range raw {
+			if !containsString(userFileColumns, name) {
+				row.message = "unknown field " + strconv.Quote(name)
+				break
+			}
+			var s string
+			switch {
+			case string(value) == "null":
+			case json.Unmarshal(value, &s) == nil:
+			case name == "point_balance" || containsString(userReadOnlyColumns, name):
+				// Numbers are kept as written
+				s = string(value)
+			default:
+				row.message = name + " must be a string"
+			}
+			row.fields[name] = strings.TrimSpace(s)
+		}
+		rows = append(rows, row)
+	}
+	return rows, ""
+}
+
+// importUserRow creates the member a row describes or, with upsert, updates
+// the member with its member_id. Only the fields the row carries are
+// changed, and an empty mobile_number or email clears it. A dry run does
+// the same inside a transaction that is rolled back.
+func importUserRow(s Store, row userImportRow, upsert, dryRun bool) UserImportResult {
+	result := UserImportResult{Row: row.line, MemberID: row.fields["member_id"]}
+	fail := func(code, message string) UserImportResult {
+		result.Status, result.Error, result.Message = "failed", code, message
+		return result
+	}
+	if row.message != "" {
+		return fail("VALIDATION_ERROR", row.message)
+	}
+	if result.MemberID == "" {
+		return fail("VALIDATION_ERROR", "member_id is required")
+	}
+	if date, ok := row.fields["register_date"]; ok && date != "" {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return fail("VALIDATION_ERROR", "register_date must be a date (YYYY-MM-DD)")
+		}
+	}
+	balance, hasBalance := 0, false
+	if value := row.fields["point_balance"]; value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fail("VALIDATION_ERROR", "point_balance must be an integer")
+		}
+		balance, hasBalance = n, true
+	}
+
+	current, err := s.Users().GetByMemberID(result.MemberID)
+	if err != nil && err != errUserNotFound {
+		return fail("INTERNAL_ERROR", "Failed to look up member")
+	}
+	exists := err == nil
+	if exists && !upsert {
+		return fail("DUPLICATE_USER", "A user with this member ID already exists")
+	}
+
+	var write func(tx Store) error
+	if exists {
+		if hasBalance && balance != current.PointBalance {
+			return fail("VALIDATION_ERROR", "point_balance cannot be updated directly; use the /users/:id/points endpoints")
+		}
+		var patch UserPatch
+		for _, f := range userPatchFields {
+			value, ok := row.fields[f.field]
+			if !ok {
+				continue
+			}
+			if value == "" && !f.nullable {
+				return fail("VALIDATION_ERROR", f.field+" cannot be empty")
+			}
+			*f.target(&patch) = &value
+		}
+		if level := patch.MembershipLevel; level != nil && !isTier(*level) {
+			return fail("VALIDATION_ERROR", "membership_level must be one of: "+strings.Join(tierNames(), ", "))
+		}
+
+		result.Status, result.UserID = "updated", current.ID
+		write = func(tx Store) error {
+			return updateMember(tx, current, patch)
+		}
+	} else {
+		user := User{
+			MemberID:        result.MemberID,
+			FirstName:       row.fields["first_name"],
+			LastName:        row.fields["last_name"],
+			MobileNumber:    row.fields["mobile_number"],
+			Email:           row.fields["email"],
+			RegisterDate:    row.fields["register_date"],
+			MembershipLevel: row.fields["membership_level"],
+			PointBalance:    balance,
+		}
+		if message := validateNewUser(&user); message != "" {
+			return fail("VALIDATION_ERROR", message)
+		}
+
+		result.Status = "created"
+		write = func(tx Store) error {
+			if err := createMember(tx, &user); err != nil {
+				return err
+			}
+			result.UserID = user.ID
+			return nil
+		}
+	}
+
+	err = s.RunInTx(func(tx Store) error {
+		if err := write(tx); err != nil {
+			return err
+		}
+		if dryRun {
+			return errImportDryRun
+		}
+		return nil
+	})
+	if dryRun && err == errImportDryRun {
+		// The id a dry run was given is rolled back with the user
+		if !exists {
+			result.UserID = 0
+		}
+		return result
+	}
+	if err == errDuplicateUser {
+		return fail("DUPLICATE_USER", "A user with this member ID or email already exists")
+	}
+	if err != nil {
+		return fail("INTERNAL_ERROR", "Failed to import user")
+	}
+	return result
+}
+
+// POST /admin/users/import - Create users from a CSV or NDJSON file, sent
+// as the request body or as the "file" field of a multipart form. Each row
+// is imported on its own, so one bad row does not hold back the rest.
+// upsert=true updates members whose member_id already exists, and
+// dryRun=true reports what would happen without changing anything.
+func (a *API) importUsers(c *fiber.Ctx) error {
+	validationError := func(message string) error {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": message,
+		})
+	}
+
+	data, filename, message := uploadedFile(c)
+	if message != "" {
+		return validationError(message)
+	}
+	format := importFormat(c, filename)
+	if format != "csv" && format != "ndjson" {
+		return validationError("format must be csv or ndjson")
+	}
+	upsert := c.Query("upsert") == "true"
+	dryRun := c.Query("dryRun") == "true"
+
+	var rows []userImportRow
+	if format == "csv" {
+		rows, message = parseUserCSV(data)
+	} else {
+		rows, message = parseUserNDJSON(data)
+	}
+	if message != "" {
+		return validationError(message)
+	}
+
+	results := make([]UserImportResult, 0, len(rows))
+	counts := map[string]int{"created": 0, "updated": 0, "failed": 0}
+	// A dry run would not catch a member_id or email repeated in the file,
+	// so repeats fail up front
+	seen := map[string]map[string]int{"member_id": {}, "email": {}}
+	for _, row := range rows {
+		repeated := ""
+		for _, field := range []string{"member_id", "email"} {
+			value := row.fields[field]
+			if first, ok := seen[field][value]; ok && repeated == "" {
+				repeated = fmt.Sprintf("%s already appears on row %d", field, first)
+			} else if !ok && value != "" {
+				seen[field][value] = row.line
+			}
+		}
+
+		result := UserImportResult{
+			Row:      row.line,
+			MemberID: row.fields["member_id"],
+			Status:   "failed",
+			Error:    "VALIDATION_ERROR",
+			Message:  repeated,
+		}
+		if repeated == "" {
+			result = importUserRow(a.store, row, upsert, dryRun)
+		}
+		counts[result.Status]++
+		results = append(results, result)
+	}
+
+	return c.JSON(fiber.Map{
+		"dryRun":  dryRun,
+		"created": counts["created"],
+		"updated": counts["updated"],
+		"failed":  counts["failed"],
+		"results": results,
+	})
+}
+
+// userCSVRecord returns u's fields in userFileColumns order
+func userCSVRecord(u User) []string {
+	referredBy := ""
+	if u.ReferredBy != nil {
+		referredBy = strconv.Itoa(*u.ReferredBy)
+	}
+	return []string{
+		strconv.Itoa(u.ID), u.MemberID, u.FirstName, u.LastName, u.MobileNumber, u.Email, u.RegisterDate,
+		u.MembershipLevel, strconv.Itoa(u.PointBalance), strconv.Itoa(u.HeldBalance), u.ReferralCode, referredBy,
+		u.CreatedAt, u.UpdatedAt,
+	}
+}
+
+// GET /admin/users/export - Stream every user, by id, as CSV or NDJSON.
+// membershipLevel, registeredFrom and registeredTo narrow it like GET /users.
+func (a *API) exportUsers(c *fiber.Ctx) error {
+	format := strings.ToLower(c.Query("format", "csv"))
+	if format != "csv" && format != "ndjson" {
+		return c.Status(400).JSON(fiber.Map{
+			"error":   "VALIDATION_ERROR",
+			"message": "format must be csv or ndjson",
+		})
+	}
+
+	query := UserQuery{
+		MembershipLevel: c.Query("membershipLevel"),
+		Sort:            "id",
+		Limit:           exportBatchSize,
+		SkipCount:       true,
+	}
+	for _, bound := range []struct {
+		param string
+		dst   *string
+	}{
+		{"registeredFrom", &query.RegisteredFrom},
+		{"registeredTo", &query.RegisteredTo},
+	} {
+		if value := c.Query(bound.param); value != "" {
+			if _, err := time.Parse("2006-01-02", value); err != nil {
+				return c.Status(400).JSON(fiber.Map{
+					"error":   "VALIDATION_ERROR",
+					"message": bound.param + " must be a date (YYYY-MM-DD)",
+				})
+			}
+			*bound.dst = value
+		}
+	}
+
+	// Read the first batch now, so a failing store is still reported as an error
+	users, _, err := a.store.Users().List(query)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error":   "INTERNAL_ERROR",
+			"message": "Failed to export users",
+		})
+	}
+
+	if format == "csv" {
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	} else {
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	}
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="users.`+format+`"`)
+
+	store := a.store
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		csvWriter := csv.NewWriter(w)
+		if format == "csv" {
+			csvWriter.Write(userFileColumns)
+		}
+		for len(users) > 0 {
+			for _, u := range users {
+				if format == "csv" {
+					csvWriter.Write(userCSVRecord(u))
+					continue
+				}
+				line, _ := json.Marshal(u)
+				w.Write(line)
+				w.WriteByte('\n')
+			}
+			csvWriter.Flush()
+			if err := w.Flush(); err != nil {
+				// The client went away
+				return
+			}
+			if len(users) < exportBatchSize {
+				return
+			}
+
+			after := Keyset{Value: userSortValue(users[len(users)-1], "id"), ID: users[len(users)-1].ID}
+			query.After = &after
+			if users, _, err = store.Users().List(query); err != nil {
+				// The status line has been sent; all that is left is to cut the file short
+				log.Printf("Export users: %v", err)
+				return
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// WebhookEvent is a notification waiting in the outbox or already sent to
+// the configured webhook URL. Payload is the JSON-encoded event data.
+type WebhookEvent struct {
+	ID            int
+	EventType     string
+	Payload       string
+	Attempts      int
+	NextAttemptAt string
+	DeliveredAt   *string
+	LastError     string
+	CreatedAt     string
+}
+
+// webhookBody is the JSON document POSTed for each event
+type webhookBody struct {
+	ID        int             `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt string          `json:"createdAt"`
+	Data      json.RawMessage `json:"data"`
+}
+
+const (
+	// webhookBatch is how many due events one delivery run sends
+	webhookBatch = 100
+	// maxWebhookAttempts is how often an event is tried before giving up
+	maxWebhookAttempts = 10
+	// maxWebhookBackoff caps the wait between attempts
+	maxWebhookBackoff = 6 * time.Hour
+)
+
+// enqueueWebhook adds an event to the outbox in the caller's transaction, so
+// it is only sent if the change it describes commits. Nothing is queued
+// when no webhook URL is configured.
+func enqueueWebhook(tx Store, eventType string, data interface{}, now string) error {
+	if cfg.WebhookURL == "" {
+		return nil
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return tx.Webhooks().Enqueue(&WebhookEvent{
+		EventType:     eventType,
+		Payload:       string(payload),
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+}
+
+// signWebhook returns the X-LBK-Signature header value for body: the
+// hex-encoded HMAC-SHA256 of the body keyed with the webhook secret
+func signWebhook(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(cfg.WebhookSecret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is how long to wait after an event's nth failed attempt
+func webhookBackoff(attempts int) time.Duration {
+	wait := cfg.WebhookInterval
+	for i := 1; i < attempts && wait < maxWebhookBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxWebhookBackoff {
+		wait = maxWebhookBackoff
+	}
+	return wait
+}
+
+// postWebhook sends one event, treating any non-2xx response as a failure
+func postWebhook(client *http.Client, event WebhookEvent) error {
+	body, err := json.Marshal(webhookBody{
+		ID:        event.ID,
+		Type:      event.EventType,
+		CreatedAt: event.CreatedAt,
+		Data:      json.RawMessage(event.Payload),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-LBK-Event", event.EventType)
+	req.Header.Set("X-LBK-Signature", signWebhook(body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// deliverWebhooks sends the events that are due, rescheduling failed ones
+// with exponential backoff. It returns the number delivered.
+func deliverWebhooks(s Store, client *http.Client, now time.Time) (int, error) {
+	events, err := s.Webhooks().ListDue(timestamp(now), webhookBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, event := range events {
+		if err := postWebhook(client, event); err != nil {
+			next := ""
+			if event.Attempts+1 < maxWebhookAttempts {
+				next = timestamp(now.Add(webhookBackoff(event.Attempts + 1)))
+			} else {
+				log.Printf("Giving up on webhook event %d (%s): %v", event.ID, event.EventType, err)
+			}
+			if err := s.Webhooks().MarkFailed(event.ID, err.Error(), next); err != nil {
+				return delivered, err
+			}
+			continue
+		}
+
+		if err := s.Webhooks().MarkDelivered(event.ID, timestamp(now)); err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+	return delivered, nil
+}
+
+// runWebhookWorker periodically delivers queued webhook events until the process exits
+func runWebhookWorker(store Store, interval time.Duration) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := deliverWebhooks(store, client, time.Now()); err != nil {
+			log.Println("Failed to deliver webhooks:", err)
+		}
+	}
+}